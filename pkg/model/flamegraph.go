@@ -73,7 +73,7 @@ func NewFlameGraph(t *Tree, maxNodes int64) *querierv1.FlameGraph {
 
 		otherTotal := int64(0)
 		for _, child := range current.node.children {
-			if child.total >= minVal && child.name != "other" {
+			if abs(child.total) >= minVal && child.name != "other" {
 				stack.Push(stackNode{xOffset: current.xOffset, level: current.level + 1, node: child})
 				current.xOffset += int(child.total)
 			} else {
@@ -199,7 +199,7 @@ func (m *FlameGraphMerger) MergeFlameGraph(src *querierv1.FlameGraph) {
 		}
 		for j := 0; j < len(l.Values); j += 4 {
 			self := l.Values[j+2]
-			if self > 0 {
+			if self != 0 {
 				dst = buildStack(dst, src, i, j)
 				m.t.InsertStack(self, dst...)
 			}
@@ -2,6 +2,8 @@ package model
 
 import (
 	"container/heap"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"sort"
@@ -57,8 +59,11 @@ func (t *Tree) Total() (v int64) {
 	return v
 }
 
+// InsertStack adds the value to the stack, given from the root to the
+// leaf. Values may be negative, e.g. in diff profiles; zero values are
+// ignored.
 func (t *Tree) InsertStack(v int64, stack ...string) {
-	if v <= 0 {
+	if v == 0 {
 		return
 	}
 	r := &node{children: t.root}
@@ -88,7 +93,7 @@ func (t *Tree) IterateStacks(cb func(name string, self int64, stack []string)) {
 		n := nodes[0]
 		self := n.self
 		label := n.name
-		if self > 0 {
+		if self != 0 {
 			current := n
 			stack = stack[:0]
 			for current != nil && current.parent != nil {
@@ -102,6 +107,114 @@ func (t *Tree) IterateStacks(cb func(name string, self int64, stack []string)) {
 	}
 }
 
+// IterateNodes calls fn for each node of the tree in the depth-first
+// pre-order: a node is visited before its children, and siblings are
+// visited in the order of their names. Nodes are identified by their
+// position in the traversal, starting from 1; the parent of the root
+// nodes is 0. The iteration stops if fn returns false.
+func (t *Tree) IterateNodes(fn func(id, parent int64, name string, self, total int64) bool) {
+	type entry struct {
+		node   *node
+		parent int64
+	}
+	nodes := make([]entry, 0, defaultDFSSize)
+	for i := len(t.root) - 1; i >= 0; i-- {
+		nodes = append(nodes, entry{node: t.root[i]})
+	}
+	var id int64
+	for len(nodes) > 0 {
+		e := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+		id++
+		if !fn(id, e.parent, e.node.name, e.node.self, e.node.total) {
+			return
+		}
+		for i := len(e.node.children) - 1; i >= 0; i-- {
+			nodes = append(nodes, entry{node: e.node.children[i], parent: id})
+		}
+	}
+}
+
+// TreeWalkNode is a tree node visited by Walk.
+type TreeWalkNode struct {
+	Name  string
+	Self  int64
+	Total int64
+	// Depth of the node: zero for the root nodes.
+	Depth int
+}
+
+// Walk calls fn for each node of the tree in the depth-first pre-order,
+// the way IterateNodes does, with the depth of the node instead of its
+// identifier. The walk stops if fn returns false. The tree is not
+// modified, therefore Walk can be called multiple times.
+func (t *Tree) Walk(fn func(TreeWalkNode) bool) {
+	// Identifiers of the ancestors of the node visited:
+	// the path length is the depth of the node.
+	path := make([]int64, 0, defaultDFSSize)
+	t.IterateNodes(func(id, parent int64, name string, self, total int64) bool {
+		for len(path) > 0 && path[len(path)-1] != parent {
+			path = path[:len(path)-1]
+		}
+		n := TreeWalkNode{Name: name, Self: self, Total: total, Depth: len(path)}
+		path = append(path, id)
+		return fn(n)
+	})
+}
+
+// LimitChildren keeps at most n children of each node, including the
+// root nodes: children with the largest absolute total values are kept,
+// and the rest are folded into a single node named "other (k)", where
+// k is the number of children folded. The total value of each level is
+// preserved. Does nothing, if n is not positive.
+func (t *Tree) LimitChildren(n int) {
+	if n <= 0 || len(t.root) == 0 {
+		return
+	}
+	// The root nodes share the virtual root parent.
+	t.root = limitChildren(t.root[0].parent, t.root, n)
+	nodes := append(make([]*node, 0, defaultDFSSize), t.root...)
+	for len(nodes) > 0 {
+		x := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+		x.children = limitChildren(x, x.children, n)
+		nodes = append(nodes, x.children...)
+	}
+}
+
+func limitChildren(parent *node, children []*node, n int) []*node {
+	if len(children) <= n {
+		return children
+	}
+	sort.Slice(children, func(i, j int) bool {
+		a, b := abs(children[i].total), abs(children[j].total)
+		if a != b {
+			return a > b
+		}
+		return children[i].name < children[j].name
+	})
+	var other int64
+	for _, c := range children[n:] {
+		other += c.total
+	}
+	name := fmt.Sprintf("%s (%d)", truncatedNodeName, len(children)-n)
+	kept := children[:n]
+	sort.Slice(kept, func(i, j int) bool { return kept[i].name < kept[j].name })
+	// Children must remain ordered by name. The folded
+	// children are overwritten, as the capacity is shared.
+	tmp := &node{children: kept}
+	x := tmp.insert(name)
+	if x.parent == tmp {
+		x.parent = parent
+	}
+	x.self += other
+	x.total += other
+	for i := len(tmp.children); i < len(children); i++ {
+		children[i] = nil
+	}
+	return tmp.children
+}
+
 // Default Depth First Search slice capacity. The value should be equal
 // to the number of all the siblings of the tree leaf ascendants.
 //
@@ -157,6 +270,62 @@ func (t *Tree) FormatNodeNames(fn func(string) string) {
 	t.Fix()
 }
 
+// TransformValues replaces self and total values of each of the nodes
+// with the values returned by fn. The function is applied to self and
+// total independently: it's the caller's responsibility to ensure it
+// preserves the relationship between the values, if needed.
+func (t *Tree) TransformValues(fn func(int64) int64) {
+	nodes := make([]*node, 0, defaultDFSSize)
+	nodes = append(nodes, t.root...)
+	var n *node
+	for len(nodes) > 0 {
+		n, nodes = nodes[len(nodes)-1], nodes[:len(nodes)-1]
+		n.self = fn(n.self)
+		n.total = fn(n.total)
+		nodes = append(nodes, n.children...)
+	}
+}
+
+// TransformSelfValues replaces self values of each of the nodes with
+// the values returned by fn, and recomputes the total values bottom-up:
+// in contrast to TransformValues, the total of a node is always equal
+// to the sum of its self value and the totals of its children.
+func (t *Tree) TransformSelfValues(fn func(int64) int64) {
+	// Parents precede their children in the DFS order.
+	order := make([]*node, 0, defaultDFSSize)
+	nodes := make([]*node, 0, defaultDFSSize)
+	nodes = append(nodes, t.root...)
+	var n *node
+	for len(nodes) > 0 {
+		n, nodes = nodes[len(nodes)-1], nodes[:len(nodes)-1]
+		n.self = fn(n.self)
+		order = append(order, n)
+		nodes = append(nodes, n.children...)
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		n = order[i]
+		n.total = n.self
+		for _, c := range n.children {
+			n.total += c.total
+		}
+	}
+}
+
+// MakeCumulative replaces the self value of each of the nodes with its
+// total value: every node carries the cumulative value of its subtree,
+// and the self values no longer sum up to the total. Merging such trees
+// is valid, as long as all of them are cumulative.
+func (t *Tree) MakeCumulative() {
+	nodes := make([]*node, 0, defaultDFSSize)
+	nodes = append(nodes, t.root...)
+	var n *node
+	for len(nodes) > 0 {
+		n, nodes = nodes[len(nodes)-1], nodes[:len(nodes)-1]
+		n.self = n.total
+		nodes = append(nodes, n.children...)
+	}
+}
+
 // Fix re-establishes order of nodes and merges duplicates.
 func (t *Tree) Fix() {
 	if len(t.root) == 0 {
@@ -202,6 +371,46 @@ func (t *Tree) Fix() {
 	t.root = r.children
 }
 
+type treeNodeJSON struct {
+	Name     string          `json:"name"`
+	Self     int64           `json:"self"`
+	Total    int64           `json:"total"`
+	Children []*treeNodeJSON `json:"children,omitempty"`
+}
+
+// MarshalJSON encodes the tree as an array of the root nodes. Nodes
+// are ordered by the total value, descending, then by name, so that
+// equal trees produce identical output, regardless of the order the
+// stacks were inserted in. The order of the nodes in the tree is not
+// affected: internally, nodes are ordered by name.
+func (t *Tree) MarshalJSON() ([]byte, error) {
+	return json.Marshal(treeNodesJSON(t.root))
+}
+
+func treeNodesJSON(nodes []*node) []*treeNodeJSON {
+	if len(nodes) == 0 {
+		return nil
+	}
+	sorted := make([]*node, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].total != sorted[j].total {
+			return sorted[i].total > sorted[j].total
+		}
+		return sorted[i].name < sorted[j].name
+	})
+	n := make([]*treeNodeJSON, len(sorted))
+	for i, x := range sorted {
+		n[i] = &treeNodeJSON{
+			Name:     x.name,
+			Self:     x.self,
+			Total:    x.total,
+			Children: treeNodesJSON(x.children),
+		}
+	}
+	return n
+}
+
 func (n *node) String() string {
 	return fmt.Sprintf("{%s: self %d total %d}", n.name, n.self, n.total)
 }
@@ -223,7 +432,7 @@ func (n *node) insert(name string) *node {
 }
 
 // minValue returns the minimum "total" value a node in a tree has to have to show up in
-// the resulting flamegraph
+// the resulting flamegraph. Negative values are compared by the absolute value.
 func (t *Tree) minValue(maxNodes int64) int64 {
 	if maxNodes < 1 {
 		return 0
@@ -243,13 +452,13 @@ func (t *Tree) minValue(maxNodes int64) int64 {
 		last := len(nodes) - 1
 		n, nodes = nodes[last], nodes[:last]
 		if h.Len() >= int(maxNodes) {
-			if n.total > (*h)[0] {
+			if abs(n.total) > (*h)[0] {
 				heap.Pop(h)
 			} else {
 				continue
 			}
 		}
-		heap.Push(h, n.total)
+		heap.Push(h, abs(n.total))
 		nodes = append(nodes, n.children...)
 	}
 
@@ -307,6 +516,13 @@ func (h *minHeap) Pop() interface{} {
 
 const truncatedNodeName = "other"
 
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
 // MarshalTruncate writes tree byte representation to the writer provider,
 // the number of nodes is limited to maxNodes. The function modifies
 // the tree: truncated nodes are removed from the tree.
@@ -337,7 +553,7 @@ func (t *Tree) MarshalTruncate(w io.Writer, maxNodes int64) (err error) {
 		var other int64
 		var j int
 		for _, cn := range n.children {
-			if cn.total >= minVal || cn.name == truncatedNodeName {
+			if abs(cn.total) >= minVal || cn.name == truncatedNodeName {
 				n.children[j] = cn
 				j++
 			} else {
@@ -346,7 +562,7 @@ func (t *Tree) MarshalTruncate(w io.Writer, maxNodes int64) (err error) {
 		}
 
 		n.children = n.children[:j]
-		if other > 0 {
+		if other != 0 {
 			o := n.insert(truncatedNodeName)
 			o.total += other
 			o.self += other
@@ -425,6 +641,161 @@ func UnmarshalTree(b []byte) (*Tree, error) {
 	return t, nil
 }
 
+// treeBinaryMagic identifies the binary encoding of the tree
+// produced by MarshalBinary; the last byte is the version.
+var treeBinaryMagic = [4]byte{'t', 'r', 'e', '1'}
+
+// MarshalBinary encodes the tree in a compact binary format: the magic
+// number and version are followed by the string table of distinct node
+// names, and by the nodes in the depth-first pre-order. Each node is
+// encoded as the name index, self and total values, and the number of
+// children, all the numbers are varint-encoded. Unlike MarshalTruncate,
+// the tree is encoded as is, without truncation, and names occurring
+// multiple times are only stored once.
+func (t *Tree) MarshalBinary() ([]byte, error) {
+	names := make(map[string]uint64)
+	var table []string
+	var nodes int
+	stack := make([]*node, 0, defaultDFSSize)
+	stack = append(stack, t.root...)
+	var n *node
+	for len(stack) > 0 {
+		n, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		if _, ok := names[n.name]; !ok {
+			names[n.name] = uint64(len(table))
+			table = append(table, n.name)
+		}
+		nodes++
+		stack = append(stack, n.children...)
+	}
+	b := make([]byte, 0, len(treeBinaryMagic)+nodes*estimateBytesPerNode)
+	b = append(b, treeBinaryMagic[:]...)
+	b = binary.AppendUvarint(b, uint64(len(table)))
+	for _, name := range table {
+		b = binary.AppendUvarint(b, uint64(len(name)))
+		b = append(b, name...)
+	}
+	b = binary.AppendUvarint(b, uint64(len(t.root)))
+	stack = append(stack, t.root...)
+	slices.Reverse(stack)
+	for len(stack) > 0 {
+		n, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		b = binary.AppendUvarint(b, names[n.name])
+		b = binary.AppendVarint(b, n.self)
+		b = binary.AppendVarint(b, n.total)
+		b = binary.AppendUvarint(b, uint64(len(n.children)))
+		for i := len(n.children) - 1; i >= 0; i-- {
+			stack = append(stack, n.children[i])
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes the tree encoded with MarshalBinary,
+// replacing the tree contents.
+func (t *Tree) UnmarshalBinary(b []byte) error {
+	if len(b) < len(treeBinaryMagic) || string(b[:len(treeBinaryMagic)]) != string(treeBinaryMagic[:]) {
+		return errMalformedTreeBytes
+	}
+	d := treeDecoder{b: b[len(treeBinaryMagic):]}
+	table := make([]string, d.length())
+	for i := range table {
+		table[i] = d.string()
+	}
+	// Virtual root node.
+	root := &node{children: make([]*node, 0, d.length())}
+	parents := []*node{root}
+	// Number of children of the parents to be decoded.
+	remaining := []int{cap(root.children)}
+	for len(parents) > 0 && d.err == nil {
+		last := len(parents) - 1
+		if remaining[last] == 0 {
+			parents, remaining = parents[:last], remaining[:last]
+			continue
+		}
+		remaining[last]--
+		parent := parents[last]
+		i := d.uvarint()
+		if d.err == nil && i >= uint64(len(table)) {
+			d.err = errMalformedTreeBytes
+		}
+		if d.err != nil {
+			break
+		}
+		n := &node{
+			parent: parent,
+			name:   table[i],
+			self:   d.varint(),
+			total:  d.varint(),
+		}
+		children := d.length()
+		n.children = make([]*node, 0, children)
+		parent.children = append(parent.children, n)
+		parents = append(parents, n)
+		remaining = append(remaining, children)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.b) > 0 {
+		return errMalformedTreeBytes
+	}
+	t.root = root.children
+	return nil
+}
+
+type treeDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *treeDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errMalformedTreeBytes
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// length decodes the length of a string, or the number of elements:
+// as each of the elements takes at least one byte, the value can't
+// exceed the size of the remaining input.
+func (d *treeDecoder) length() int {
+	v := d.uvarint()
+	if d.err == nil && v > uint64(len(d.b)) {
+		d.err = errMalformedTreeBytes
+	}
+	if d.err != nil {
+		return 0
+	}
+	return int(v)
+}
+
+func (d *treeDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errMalformedTreeBytes
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *treeDecoder) string() string {
+	n := d.length()
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
 type TreeMerger struct {
 	mu sync.Mutex
 	t  *Tree
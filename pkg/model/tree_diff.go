@@ -0,0 +1,113 @@
+package model
+
+// TreeDiff is a tree that combines two trees: each node holds the
+// values of both sides. Nodes are matched by the function name path
+// from the root; nodes present only in one of the trees have zero
+// values on the other side.
+type TreeDiff struct {
+	Root []*TreeDiffNode
+	Mode TreeDiffMode
+	// LeftTotal and RightTotal are the total values of the trees.
+	LeftTotal  int64
+	RightTotal int64
+}
+
+type TreeDiffMode int
+
+const (
+	// TreeDiffAbsolute diff only holds the values of the trees.
+	TreeDiffAbsolute TreeDiffMode = iota
+	// TreeDiffNormalized diff, in addition, holds the difference
+	// between the shares of the node in the right and left trees,
+	// which allows to compare trees of different total values.
+	TreeDiffNormalized
+)
+
+type TreeDiffNode struct {
+	Name     string
+	Left     TreeDiffValue
+	Right    TreeDiffValue
+	Children []*TreeDiffNode
+	// NormalizedDelta is the difference between the shares of the
+	// node total value in the right and left trees: in the range
+	// from -1 to 1. Only set in the TreeDiffNormalized mode.
+	NormalizedDelta float64
+}
+
+type TreeDiffValue struct {
+	Self  int64
+	Total int64
+}
+
+// Delta returns the difference between the right and left total values.
+func (n *TreeDiffNode) Delta() int64 { return n.Right.Total - n.Left.Total }
+
+// Diff combines the tree (left) with the right tree. Neither of the
+// trees is modified, and the resulting diff tree does not reference
+// them (besides node names).
+func (t *Tree) Diff(right *Tree) *TreeDiff {
+	return t.DiffWithMode(right, TreeDiffAbsolute)
+}
+
+// DiffWithMode is like Diff, but the values of the diff tree nodes
+// are computed according to the mode specified.
+func (t *Tree) DiffWithMode(right *Tree, mode TreeDiffMode) *TreeDiff {
+	d := &TreeDiff{
+		Mode:       mode,
+		LeftTotal:  t.Total(),
+		RightTotal: right.Total(),
+	}
+	type frame struct {
+		dst         *TreeDiffNode
+		left, right []*node
+	}
+	root := new(TreeDiffNode)
+	stack := make([]frame, 1, defaultDFSSize)
+	stack[0] = frame{dst: root, left: t.root, right: right.root}
+	var f frame
+	for len(stack) > 0 {
+		f, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		// Children are ordered by name, therefore we can
+		// combine them in a single pass.
+		l, r := f.left, f.right
+		f.dst.Children = make([]*TreeDiffNode, 0, maxInt(len(l), len(r)))
+		for len(l) > 0 || len(r) > 0 {
+			var ln, rn *node
+			switch {
+			case len(r) == 0 || (len(l) > 0 && l[0].name < r[0].name):
+				ln, l = l[0], l[1:]
+			case len(l) == 0 || r[0].name < l[0].name:
+				rn, r = r[0], r[1:]
+			default:
+				ln, l = l[0], l[1:]
+				rn, r = r[0], r[1:]
+			}
+			n := new(TreeDiffNode)
+			next := frame{dst: n}
+			if ln != nil {
+				n.Name = ln.name
+				n.Left = TreeDiffValue{Self: ln.self, Total: ln.total}
+				next.left = ln.children
+			}
+			if rn != nil {
+				n.Name = rn.name
+				n.Right = TreeDiffValue{Self: rn.self, Total: rn.total}
+				next.right = rn.children
+			}
+			if mode == TreeDiffNormalized {
+				n.NormalizedDelta = share(n.Right.Total, d.RightTotal) - share(n.Left.Total, d.LeftTotal)
+			}
+			f.dst.Children = append(f.dst.Children, n)
+			stack = append(stack, next)
+		}
+	}
+	d.Root = root.Children
+	return d
+}
+
+func share(v, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(v) / float64(total)
+}
@@ -0,0 +1,105 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Tree_Diff(t *testing.T) {
+	left := newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 3},
+		{locations: []string{"d", "b", "a"}, value: 2},
+		{locations: []string{"e", "a"}, value: 1},
+	})
+	right := newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 5},
+		{locations: []string{"f", "a"}, value: 4},
+	})
+
+	d := left.Diff(right)
+	require.Len(t, d.Root, 1)
+	a := d.Root[0]
+	require.Equal(t, "a", a.Name)
+	require.Equal(t, TreeDiffValue{Total: 6}, a.Left)
+	require.Equal(t, TreeDiffValue{Total: 9}, a.Right)
+	require.Equal(t, int64(3), a.Delta())
+
+	actual := make(map[string][2]int64)
+	for _, n := range a.Children {
+		actual[n.Name] = [2]int64{n.Left.Total, n.Right.Total}
+	}
+	require.Equal(t, map[string][2]int64{
+		"b": {5, 5},
+		"e": {1, 0},
+		"f": {0, 4},
+	}, actual)
+}
+
+func Test_Tree_Diff_Self(t *testing.T) {
+	tree := newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 3},
+		{locations: []string{"d", "b", "a"}, value: 2},
+		{locations: []string{"e", "a"}, value: 1},
+		{locations: []string{"a"}, value: 1},
+		{locations: []string{"x"}, value: 7},
+	})
+	nodes := tree.Diff(tree).Root
+	var n int
+	for len(nodes) > 0 {
+		x := nodes[len(nodes)-1]
+		nodes = append(nodes[:len(nodes)-1], x.Children...)
+		require.Equal(t, x.Left, x.Right)
+		require.Zero(t, x.Delta())
+		n++
+	}
+	require.Equal(t, 6, n)
+}
+
+func Test_Tree_DiffWithMode_Normalized(t *testing.T) {
+	stacks := []stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 3},
+		{locations: []string{"d", "b", "a"}, value: 2},
+		{locations: []string{"e", "a"}, value: 1},
+		{locations: []string{"x"}, value: 4},
+	}
+	left := newTree(stacks)
+	scaled := make([]stacktraces, len(stacks))
+	for i, s := range stacks {
+		scaled[i] = stacktraces{locations: s.locations, value: s.value * 7}
+	}
+	right := newTree(scaled)
+
+	d := left.DiffWithMode(right, TreeDiffNormalized)
+	require.Equal(t, TreeDiffNormalized, d.Mode)
+	require.Equal(t, int64(10), d.LeftTotal)
+	require.Equal(t, int64(70), d.RightTotal)
+	nodes := d.Root
+	var n int
+	for len(nodes) > 0 {
+		x := nodes[len(nodes)-1]
+		nodes = append(nodes[:len(nodes)-1], x.Children...)
+		require.NotZero(t, x.Delta())
+		require.InDelta(t, 0, x.NormalizedDelta, 1e-9, x.Name)
+		n++
+	}
+	require.Equal(t, 6, n)
+
+	// The share of "x" grows from 40% to 80%.
+	right = newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 1},
+		{locations: []string{"x"}, value: 4},
+	})
+	d = left.DiffWithMode(right, TreeDiffNormalized)
+	actual := make(map[string]float64)
+	for _, x := range d.Root {
+		actual[x.Name] = x.NormalizedDelta
+	}
+	require.InDelta(t, 0.4, actual["x"], 1e-9)
+	require.InDelta(t, -0.4, actual["a"], 1e-9)
+
+	// In the absolute mode, normalized deltas are not set.
+	for _, x := range left.Diff(right).Root {
+		require.Zero(t, x.NormalizedDelta)
+	}
+}
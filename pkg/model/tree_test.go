@@ -2,6 +2,8 @@ package model
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"math"
 	"testing"
 
@@ -277,6 +279,29 @@ func Test_Tree_MarshalUnmarshal(t *testing.T) {
 
 		require.Equal(t, expected.String(), actual.String())
 	})
+
+	t.Run("negative values", func(t *testing.T) {
+		fullTree := newTree([]stacktraces{
+			{locations: []string{"b", "a"}, value: -5},
+			{locations: []string{"c", "a"}, value: 1},
+			{locations: []string{"d", "a"}, value: 6},
+		})
+
+		var buf bytes.Buffer
+		require.NoError(t, fullTree.MarshalTruncate(&buf, 3))
+
+		actual, err := UnmarshalTree(buf.Bytes())
+		require.NoError(t, err)
+
+		expected := newTree([]stacktraces{
+			{locations: []string{"b", "a"}, value: -5},
+			{locations: []string{"d", "a"}, value: 6},
+			{locations: []string{"other", "a"}, value: 1},
+		})
+
+		require.Equal(t, expected.String(), actual.String())
+		require.Equal(t, int64(2), actual.Total())
+	})
 }
 
 func Test_FormatNames(t *testing.T) {
@@ -390,3 +415,233 @@ func stackToTree(stack stacktraces) *Tree {
 	t.root = []*node{current}
 	return t
 }
+
+func Test_Tree_MarshalJSON(t *testing.T) {
+	x := newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 1},
+		{locations: []string{"d", "b", "a"}, value: 2},
+		{locations: []string{"e", "a"}, value: 3},
+		{locations: []string{"f"}, value: 1},
+		{locations: []string{"g"}, value: 1},
+	})
+	expected := `[{"name":"a","self":0,"total":6,"children":[` +
+		`{"name":"b","self":0,"total":3,"children":[{"name":"d","self":2,"total":2},{"name":"c","self":1,"total":1}]},` +
+		`{"name":"e","self":3,"total":3}]},` +
+		`{"name":"f","self":1,"total":1},{"name":"g","self":1,"total":1}]`
+	b, err := json.Marshal(x)
+	require.NoError(t, err)
+	require.JSONEq(t, expected, string(b))
+	require.Equal(t, expected, string(b))
+
+	b, err = json.Marshal(new(Tree))
+	require.NoError(t, err)
+	require.Equal(t, "null", string(b))
+}
+
+func Test_Tree_IterateNodes(t *testing.T) {
+	x := newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 1},
+		{locations: []string{"d", "b", "a"}, value: 2},
+		{locations: []string{"e", "a"}, value: 3},
+		{locations: []string{"f"}, value: 4},
+	})
+	var actual []string
+	x.IterateNodes(func(id, parent int64, name string, self, total int64) bool {
+		actual = append(actual, fmt.Sprintf("%d %d %s %d %d", id, parent, name, self, total))
+		return true
+	})
+	expected := []string{
+		"1 0 a 0 6",
+		"2 1 b 0 3",
+		"3 2 c 1 1",
+		"4 2 d 2 2",
+		"5 1 e 3 3",
+		"6 0 f 4 4",
+	}
+	require.Equal(t, expected, actual)
+
+	var n int
+	x.IterateNodes(func(int64, int64, string, int64, int64) bool {
+		n++
+		return n < 3
+	})
+	require.Equal(t, 3, n)
+}
+
+func Test_Tree_Walk(t *testing.T) {
+	x := newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 1},
+		{locations: []string{"d", "b", "a"}, value: 2},
+		{locations: []string{"e", "a"}, value: 3},
+		{locations: []string{"f"}, value: 4},
+	})
+	walk := func() []string {
+		var actual []string
+		x.Walk(func(n TreeWalkNode) bool {
+			actual = append(actual, fmt.Sprintf("%d %s %d %d", n.Depth, n.Name, n.Self, n.Total))
+			return true
+		})
+		return actual
+	}
+	expected := []string{
+		"0 a 0 6",
+		"1 b 0 3",
+		"2 c 1 1",
+		"2 d 2 2",
+		"1 e 3 3",
+		"0 f 4 4",
+	}
+	require.Equal(t, expected, walk())
+	require.Equal(t, expected, walk())
+
+	// Depth-weighted self value.
+	var cost int64
+	x.Walk(func(n TreeWalkNode) bool {
+		cost += n.Self * int64(n.Depth+1)
+		return true
+	})
+	require.Equal(t, int64(1*3+2*3+3*2+4*1), cost)
+
+	var n int
+	x.Walk(func(TreeWalkNode) bool {
+		n++
+		return n < 3
+	})
+	require.Equal(t, 3, n)
+}
+
+func Test_Tree_TransformValues(t *testing.T) {
+	x := newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 1},
+		{locations: []string{"d", "b", "a"}, value: 2},
+		{locations: []string{"e", "a"}, value: 3},
+	})
+	x.TransformValues(func(v int64) int64 { return 10 * v })
+	expected := newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 10},
+		{locations: []string{"d", "b", "a"}, value: 20},
+		{locations: []string{"e", "a"}, value: 30},
+	})
+	require.Equal(t, expected.String(), x.String())
+}
+
+func Test_Tree_TransformSelfValues(t *testing.T) {
+	x := newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 1},
+		{locations: []string{"d", "b", "a"}, value: 2},
+		{locations: []string{"b", "a"}, value: 2},
+		{locations: []string{"e", "a"}, value: 3},
+	})
+	// Rounding values separately would break the totals.
+	x.TransformSelfValues(func(v int64) int64 { return (v + 1) / 2 })
+	expected := `.
+└── a: self 0 total 5
+    ├── b: self 1 total 3
+    │   ├── c: self 1 total 1
+    │   └── d: self 1 total 1
+    └── e: self 2 total 2
+`
+	require.Equal(t, expected, x.String())
+	require.Equal(t, int64(5), x.Total())
+}
+
+func Test_Tree_MakeCumulative(t *testing.T) {
+	x := newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 1},
+		{locations: []string{"d", "b", "a"}, value: 2},
+		{locations: []string{"e", "a"}, value: 3},
+		{locations: []string{"a"}, value: 4},
+	})
+	x.MakeCumulative()
+	expected := `.
+└── a: self 10 total 10
+    ├── b: self 3 total 3
+    │   ├── c: self 1 total 1
+    │   └── d: self 2 total 2
+    └── e: self 3 total 3
+`
+	require.Equal(t, expected, x.String())
+}
+
+func Test_Tree_MarshalBinary(t *testing.T) {
+	for _, x := range []*Tree{
+		new(Tree),
+		newTree([]stacktraces{
+			{locations: []string{"c", "b", "a"}, value: 1},
+			{locations: []string{"c", "b", "a"}, value: 1},
+			{locations: []string{"c1", "b", "a"}, value: 1},
+			{locations: []string{"c", "b1", "a"}, value: 1},
+			{locations: []string{"a", "a"}, value: 3},
+			{locations: []string{"b"}, value: 4},
+		}),
+	} {
+		b, err := x.MarshalBinary()
+		require.NoError(t, err)
+		actual := new(Tree)
+		require.NoError(t, actual.UnmarshalBinary(b))
+		require.Equal(t, x.String(), actual.String())
+		var expectedStacks, actualStacks []string
+		x.IterateStacks(func(name string, self int64, stack []string) {
+			expectedStacks = append(expectedStacks, fmt.Sprint(self, stack))
+		})
+		actual.IterateStacks(func(name string, self int64, stack []string) {
+			actualStacks = append(actualStacks, fmt.Sprint(self, stack))
+		})
+		require.Equal(t, expectedStacks, actualStacks)
+
+		// Any truncation of the input is detected.
+		for i := 0; i < len(b); i++ {
+			require.Error(t, new(Tree).UnmarshalBinary(b[:i]))
+		}
+	}
+}
+
+func Test_Tree_MarshalBinary_size(t *testing.T) {
+	// Names repeat across the subtrees.
+	var stacks []stacktraces
+	for i := 0; i < 100; i++ {
+		stacks = append(stacks, stacktraces{
+			locations: []string{
+				fmt.Sprintf("github.com/grafana/pyroscope/pkg/model.function_%d", i%10),
+				fmt.Sprintf("github.com/grafana/pyroscope/pkg/model.caller_%d", i/10),
+				"main",
+			},
+			value: int64(i + 1),
+		})
+	}
+	x := newTree(stacks)
+	b, err := x.MarshalBinary()
+	require.NoError(t, err)
+	j, err := json.Marshal(x)
+	require.NoError(t, err)
+	require.Less(t, 4*len(b), len(j))
+}
+
+func Test_Tree_LimitChildren(t *testing.T) {
+	x := newTree([]stacktraces{
+		{locations: []string{"c", "b", "a"}, value: 1},
+		{locations: []string{"d", "b", "a"}, value: 2},
+		{locations: []string{"e", "b", "a"}, value: 3},
+		{locations: []string{"f", "b", "a"}, value: 4},
+		{locations: []string{"g", "a"}, value: 5},
+		{locations: []string{"h"}, value: 1},
+		{locations: []string{"i"}, value: 2},
+	})
+	total := x.Total()
+	x.LimitChildren(2)
+	expected := newTree([]stacktraces{
+		{locations: []string{"e", "b", "a"}, value: 3},
+		{locations: []string{"f", "b", "a"}, value: 4},
+		{locations: []string{"other (2)", "b", "a"}, value: 3},
+		{locations: []string{"g", "a"}, value: 5},
+		{locations: []string{"i"}, value: 2},
+		{locations: []string{"other (1)"}, value: 1},
+	})
+	require.Equal(t, expected.String(), x.String())
+	require.Equal(t, total, x.Total())
+
+	// The stacks remain iterable, as the parents are set.
+	var n int
+	x.IterateStacks(func(string, int64, []string) { n++ })
+	require.Equal(t, 6, n)
+}
@@ -65,6 +65,11 @@ func (r *symbolsResolverV1) Close() error {
 		Err()
 }
 
+func (r *symbolsResolverV1) PartitionKeys(_ context.Context) ([]uint64, error) {
+	// The whole block is a single partition.
+	return []uint64{0}, nil
+}
+
 func (r *symbolsResolverV1) Partition(_ context.Context, _ uint64) (symdb.PartitionReader, error) {
 	p := symbolsPartition{
 		stats: symdb.PartitionStats{
@@ -145,6 +150,10 @@ func (r *symbolsResolverV2) Close() error {
 	return err.Err()
 }
 
+func (r *symbolsResolverV2) PartitionKeys(ctx context.Context) ([]uint64, error) {
+	return r.symbols.PartitionKeys(ctx)
+}
+
 func (r *symbolsResolverV2) Partition(ctx context.Context, partition uint64) (symdb.PartitionReader, error) {
 	sr, err := r.symbols.Partition(ctx, partition)
 	if err != nil {
@@ -169,21 +178,46 @@ func (r *symbolsResolverV2) Partition(ctx context.Context, partition uint64) (sy
 			Functions:   r.functions.cache,
 			Strings:     r.strings.cache,
 		},
-		release: sr.Release,
+		// The symdb partition only holds the stack traces.
+		stacktracesSize: sr.EstimateSize,
+		release:         sr.Release,
 	}
 	return &p, nil
 }
 
 type symbolsPartition struct {
-	stats   symdb.PartitionStats
-	symbols *symdb.Symbols
-	release func()
+	stats           symdb.PartitionStats
+	symbols         *symdb.Symbols
+	stacktracesSize func() int64
+	release         func()
 }
 
 func (p *symbolsPartition) Symbols() *symdb.Symbols { return p.symbols }
 
+func (p *symbolsPartition) ResolveFrames(ctx context.Context, stacktraces []uint32, fn func(uint32, []symdb.Frame)) error {
+	return p.symbols.ResolveFrames(ctx, stacktraces, fn)
+}
+
+func (p *symbolsPartition) SymbolRecords(ctx context.Context) iter.Iterator[symdb.SymbolRecord] {
+	return p.symbols.Iterator(ctx)
+}
+
 func (p *symbolsPartition) WriteStats(stats *symdb.PartitionStats) { *stats = p.stats }
 
+// EstimateSize returns the estimated size of the partition symbols.
+// The tables are shared by all the partitions of the block.
+func (p *symbolsPartition) EstimateSize() int64 {
+	n := p.symbols.EstimateSize()
+	if p.stacktracesSize != nil {
+		n += p.stacktracesSize()
+	}
+	return n
+}
+
+// Preload has no effect: the symbols are loaded by the time
+// the partition is returned.
+func (p *symbolsPartition) Preload(context.Context) error { return nil }
+
 func (p *symbolsPartition) Release() {
 	if p.release != nil {
 		p.release()
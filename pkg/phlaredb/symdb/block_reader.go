@@ -9,14 +9,17 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 
+	"github.com/grafana/dskit/backoff"
 	"github.com/grafana/dskit/multierror"
 	"github.com/opentracing/opentracing-go"
 	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/parquet-go/parquet-go"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/grafana/pyroscope/pkg/iter"
 	"github.com/grafana/pyroscope/pkg/objstore"
 	parquetobj "github.com/grafana/pyroscope/pkg/objstore/parquet"
 	"github.com/grafana/pyroscope/pkg/phlaredb/block"
@@ -30,6 +33,7 @@ type Reader struct {
 	meta   *block.Meta
 
 	chunkFetchBufferSize int
+	retry                *backoff.Config
 
 	index         IndexFile
 	partitions    []*partition
@@ -43,7 +47,7 @@ type Reader struct {
 
 const defaultChunkFetchBufferSize = 4096
 
-func Open(ctx context.Context, b objstore.BucketReader, m *block.Meta) (*Reader, error) {
+func Open(ctx context.Context, b objstore.BucketReader, m *block.Meta, opts ...OpenOption) (*Reader, error) {
 	r := Reader{
 		bucket: b,
 		meta:   m,
@@ -51,6 +55,9 @@ func Open(ctx context.Context, b objstore.BucketReader, m *block.Meta) (*Reader,
 
 		chunkFetchBufferSize: defaultChunkFetchBufferSize,
 	}
+	for _, opt := range opts {
+		opt(&r)
+	}
 	if err := r.open(ctx); err != nil {
 		return nil, err
 	}
@@ -183,10 +190,19 @@ func (r *Reader) Partition(ctx context.Context, partition uint64) (PartitionRead
 	return r.partition(ctx, partition)
 }
 
+func (r *Reader) PartitionKeys(_ context.Context) ([]uint64, error) {
+	keys := make([]uint64, len(r.index.PartitionHeaders))
+	for i, h := range r.index.PartitionHeaders {
+		keys[i] = h.Partition
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, nil
+}
+
 func (r *Reader) partition(ctx context.Context, partition uint64) (*partition, error) {
 	p, ok := r.partitionsMap[partition]
 	if !ok {
-		return nil, ErrPartitionNotFound
+		return nil, &PartitionError{Partition: partition, Err: ErrPartitionNotFound}
 	}
 	if err := p.init(ctx); err != nil {
 		return nil, err
@@ -194,6 +210,30 @@ func (r *Reader) partition(ctx context.Context, partition uint64) (*partition, e
 	return p, nil
 }
 
+func (r *Reader) PartitionLocations(ctx context.Context, partition uint64) (PartitionReader, error) {
+	p, ok := r.partitionsMap[partition]
+	if !ok {
+		return nil, &PartitionError{Partition: partition, Err: ErrPartitionNotFound}
+	}
+	x := &partitionLocations{partition: p}
+	if err := x.tx().fetch(ctx, r); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (r *Reader) PartitionFunctions(ctx context.Context, partition uint64) (PartitionReader, error) {
+	p, ok := r.partitionsMap[partition]
+	if !ok {
+		return nil, &PartitionError{Partition: partition, Err: ErrPartitionNotFound}
+	}
+	x := &partitionFunctions{partition: p}
+	if err := x.tx().fetch(ctx, r); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
 type partition struct {
 	reader *Reader
 
@@ -204,7 +244,7 @@ type partition struct {
 	strings          parquetTableRange[string, *schemav1.StringPersister]
 }
 
-func (p *partition) init(ctx context.Context) (err error) { return p.tx().fetch(ctx) }
+func (p *partition) init(ctx context.Context) (err error) { return p.tx().fetch(ctx, p.reader) }
 
 func (p *partition) Release() { p.tx().release() }
 
@@ -232,6 +272,30 @@ func (p *partition) Symbols() *Symbols {
 	}
 }
 
+func (p *partition) ResolveFrames(ctx context.Context, stacktraces []uint32, fn func(uint32, []Frame)) error {
+	return p.Symbols().ResolveFrames(ctx, stacktraces, fn)
+}
+
+func (p *partition) SymbolRecords(ctx context.Context) iter.Iterator[SymbolRecord] {
+	return p.Symbols().Iterator(ctx)
+}
+
+// bytesRead returns the estimated amount of data
+// fetched from the storage to load the partition.
+func (p *partition) bytesRead() int64 {
+	var n int64
+	for _, c := range p.stacktraceChunks {
+		n += c.header.Size
+	}
+	if p.reader.index.Header.Version > FormatV1 {
+		n += p.locations.bytesRead()
+		n += p.mappings.bytesRead()
+		n += p.functions.bytesRead()
+		n += p.strings.bytesRead()
+	}
+	return n
+}
+
 func (p *partition) WriteStats(s *PartitionStats) {
 	var nodes uint32
 	for _, c := range p.stacktraceChunks {
@@ -245,6 +309,114 @@ func (p *partition) WriteStats(s *PartitionStats) {
 	s.StringsTotal = len(p.strings.s)
 }
 
+// partitionLocations only fetches stack traces
+// and locations of the partition.
+type partitionLocations struct {
+	*partition
+}
+
+func (p *partitionLocations) Release() { p.tx().release() }
+
+func (p *partitionLocations) tx() *fetchTx {
+	tx := make(fetchTx, 0, len(p.stacktraceChunks)+1)
+	for _, c := range p.stacktraceChunks {
+		tx.append(c)
+	}
+	if p.reader.index.Header.Version > FormatV1 {
+		tx.append(&p.locations)
+	}
+	return &tx
+}
+
+func (p *partitionLocations) Symbols() *Symbols {
+	return &Symbols{
+		Stacktraces: p.partition,
+		Locations:   p.locations.s,
+	}
+}
+
+func (p *partitionLocations) ResolveFrames(ctx context.Context, stacktraces []uint32, fn func(uint32, []Frame)) error {
+	return p.Symbols().ResolveFrames(ctx, stacktraces, fn)
+}
+
+func (p *partitionLocations) SymbolRecords(ctx context.Context) iter.Iterator[SymbolRecord] {
+	return p.Symbols().Iterator(ctx)
+}
+
+func (p *partitionLocations) bytesRead() int64 {
+	var n int64
+	for _, c := range p.stacktraceChunks {
+		n += c.header.Size
+	}
+	if p.reader.index.Header.Version > FormatV1 {
+		n += p.locations.bytesRead()
+	}
+	return n
+}
+
+func (p *partitionLocations) WriteStats(s *PartitionStats) {
+	p.partition.WriteStats(s)
+	s.MappingsTotal = 0
+	s.FunctionsTotal = 0
+	s.StringsTotal = 0
+}
+
+// partitionFunctions fetches the partition
+// symbols, except for mappings.
+type partitionFunctions struct {
+	*partition
+}
+
+func (p *partitionFunctions) Release() { p.tx().release() }
+
+func (p *partitionFunctions) tx() *fetchTx {
+	tx := make(fetchTx, 0, len(p.stacktraceChunks)+3)
+	for _, c := range p.stacktraceChunks {
+		tx.append(c)
+	}
+	if p.reader.index.Header.Version > FormatV1 {
+		tx.append(&p.locations)
+		tx.append(&p.functions)
+		tx.append(&p.strings)
+	}
+	return &tx
+}
+
+func (p *partitionFunctions) Symbols() *Symbols {
+	return &Symbols{
+		Stacktraces: p.partition,
+		Locations:   p.locations.s,
+		Functions:   p.functions.s,
+		Strings:     p.strings.s,
+	}
+}
+
+func (p *partitionFunctions) ResolveFrames(ctx context.Context, stacktraces []uint32, fn func(uint32, []Frame)) error {
+	return p.Symbols().ResolveFrames(ctx, stacktraces, fn)
+}
+
+func (p *partitionFunctions) SymbolRecords(ctx context.Context) iter.Iterator[SymbolRecord] {
+	return p.Symbols().Iterator(ctx)
+}
+
+func (p *partitionFunctions) bytesRead() int64 {
+	var n int64
+	for _, c := range p.stacktraceChunks {
+		n += c.header.Size
+	}
+	if p.reader.index.Header.Version > FormatV1 {
+		n += p.locations.bytesRead()
+		n += p.functions.bytesRead()
+		n += p.strings.bytesRead()
+	}
+	return n
+}
+
+func (p *partitionFunctions) WriteStats(s *PartitionStats) {
+	p.partition.WriteStats(s)
+	s.MappingsTotal = 0
+}
+
 var ErrInvalidStacktraceRange = fmt.Errorf("invalid range: stack traces can't be resolved")
 
 func (p *partition) ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, s []uint32) (err error) {
@@ -305,13 +477,18 @@ func (r *stacktracesLookup) do() error {
 		return ErrInvalidStacktraceRange
 	}
 	s := stacktraceLocations.get()
+	defer func() { stacktraceLocations.put(s) }()
 	// Restore the original stacktrace ID.
 	off := r.c.offset()
-	for _, sid := range r.c.ids {
+	for i, sid := range r.c.ids {
+		if i%contextCheckInterval == 0 {
+			if err := r.ctx.Err(); err != nil {
+				return err
+			}
+		}
 		s = cr.t.resolve(s, sid)
 		r.dst.InsertStacktrace(off+sid, s)
 	}
-	stacktraceLocations.put(s)
 	return nil
 }
 
@@ -362,10 +539,10 @@ func (c *stacktraceChunkReader) readFrom(r io.Reader) error {
 	crc := crc32.New(castagnoli)
 	tee := io.TeeReader(r, crc)
 	if _, err := t.ReadFrom(tee); err != nil {
-		return fmt.Errorf("failed to unmarshal stack traces: %w", err)
+		return &SectionError{Section: sectionStacktraces, Err: fmt.Errorf("failed to unmarshal stack traces: %w", err)}
 	}
 	if c.header.CRC != crc.Sum32() {
-		return ErrInvalidCRC
+		return &SectionError{Section: sectionStacktraces, Err: ErrInvalidCRC}
 	}
 	c.t = t
 	return nil
@@ -429,6 +606,25 @@ func (t *parquetTableRange[M, P]) fetch(ctx context.Context) (err error) {
 	})
 }
 
+// bytesRead returns the estimated size of the table range: the row
+// group size is proportionally divided between the rows of it.
+func (t *parquetTableRange[M, P]) bytesRead() int64 {
+	var n int64
+	rgs := t.file.Metadata().RowGroups
+	for _, h := range t.headers {
+		rg := rgs[h.RowGroup]
+		if rg.NumRows == 0 {
+			continue
+		}
+		size := rg.TotalCompressedSize
+		if size == 0 {
+			size = rg.TotalByteSize
+		}
+		n += size * int64(h.Rows) / rg.NumRows
+	}
+	return n
+}
+
 func (t *parquetTableRange[M, P]) readRows(dst []M, buf []parquet.Row, rows parquet.Rows) (err error) {
 	defer func() {
 		err = multierror.New(err, rows.Close()).Err()
@@ -442,7 +638,7 @@ func (t *parquetTableRange[M, P]) readRows(dst []M, buf []parquet.Row, rows parq
 				}
 				_, v, err := t.persister.Reconstruct(row)
 				if err != nil {
-					return err
+					return &SectionError{Section: t.persister.Name(), Err: err}
 				}
 				dst[i] = v
 				i++
@@ -475,7 +671,7 @@ type fetch interface {
 
 func (tx *fetchTx) append(x fetch) { *tx = append(*tx, x) }
 
-func (tx *fetchTx) fetch(ctx context.Context) (err error) {
+func (tx *fetchTx) fetch(ctx context.Context, r *Reader) (err error) {
 	defer func() {
 		if err != nil {
 			tx.release()
@@ -486,7 +682,7 @@ func (tx *fetchTx) fetch(ctx context.Context) (err error) {
 		i := i
 		x := x
 		g.Go(func() error {
-			fErr := x.fetch(ctx)
+			fErr := r.fetch(ctx, x)
 			if fErr != nil {
 				(*tx)[i] = nil
 			}
@@ -0,0 +1,125 @@
+package symdb
+
+import (
+	"context"
+	"sync"
+)
+
+// PartitionLazy returns the reader of the partition without loading
+// its symbols: EstimateSize can be used to decide whether the partition
+// should be loaded at all, e.g., for admission control. The symbols are
+// loaded with Preload, which must succeed before the symbols are
+// accessed. Release releases the symbols, if they have been loaded.
+func (r *Reader) PartitionLazy(partition uint64) (PartitionReader, error) {
+	p, ok := r.partitionsMap[partition]
+	if !ok {
+		return nil, &PartitionError{Partition: partition, Err: ErrPartitionNotFound}
+	}
+	return &deferredPartition{partition: p}, nil
+}
+
+type deferredPartition struct {
+	*partition
+	m      sync.Mutex
+	loaded bool
+}
+
+func (p *deferredPartition) Preload(ctx context.Context) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.loaded {
+		return nil
+	}
+	if err := p.init(ctx); err != nil {
+		return err
+	}
+	p.loaded = true
+	return nil
+}
+
+func (p *deferredPartition) Release() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.loaded {
+		p.partition.Release()
+		p.loaded = false
+	}
+}
+
+// Preload has no effect: partitions returned by Partition,
+// PartitionLocations, and PartitionFunctions are loaded by
+// the time they are returned.
+func (p *partition) Preload(context.Context) error { return nil }
+
+// EstimateSize estimates the in-memory size based on the index: the
+// number of the stack trace nodes and table rows of the partition.
+// Each of the locations is assumed to have a single line, and the
+// size of the strings is estimated based on the uncompressed size
+// of the table.
+func (p *partition) EstimateSize() int64 {
+	n := p.stacktracesSize()
+	if p.reader.index.Header.Version > FormatV1 {
+		n += p.locationsSize()
+		n += p.mappings.rows() * int64(mappingSize)
+		n += p.functions.rows() * int64(functionSize)
+		n += p.stringsSize()
+	}
+	return n
+}
+
+func (p *partitionLocations) EstimateSize() int64 {
+	n := p.stacktracesSize()
+	if p.reader.index.Header.Version > FormatV1 {
+		n += p.locationsSize()
+	}
+	return n
+}
+
+func (p *partitionFunctions) EstimateSize() int64 {
+	n := p.stacktracesSize()
+	if p.reader.index.Header.Version > FormatV1 {
+		n += p.locationsSize()
+		n += p.functions.rows() * int64(functionSize)
+		n += p.stringsSize()
+	}
+	return n
+}
+
+func (p *partition) stacktracesSize() int64 {
+	var n int64
+	for _, c := range p.stacktraceChunks {
+		n += int64(c.header.StacktraceNodes) * pptNodeSize
+	}
+	return n
+}
+
+func (p *partition) locationsSize() int64 {
+	return p.locations.rows() * int64(locationSize+lineSize)
+}
+
+func (p *partition) stringsSize() int64 {
+	return p.strings.rows()*estimatedStringSize + p.strings.uncompressedSize()
+}
+
+func (t *parquetTableRange[M, P]) rows() int64 {
+	var n int64
+	for _, h := range t.headers {
+		n += int64(h.Rows)
+	}
+	return n
+}
+
+// uncompressedSize returns the estimated uncompressed size of the
+// table range, similarly to bytesRead.
+func (t *parquetTableRange[M, P]) uncompressedSize() int64 {
+	var n int64
+	rgs := t.file.Metadata().RowGroups
+	for _, h := range t.headers {
+		rg := rgs[h.RowGroup]
+		if rg.NumRows == 0 {
+			continue
+		}
+		n += rg.TotalByteSize * int64(h.Rows) / rg.NumRows
+	}
+	return n
+}
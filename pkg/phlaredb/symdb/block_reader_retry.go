@@ -0,0 +1,56 @@
+package symdb
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/grafana/dskit/backoff"
+)
+
+type OpenOption func(*Reader)
+
+// WithFetchRetry makes the reader retry fetching the partition sections
+// (stack trace chunks and symbol tables) that have failed with transient
+// errors, such as object store request failures. MaxRetries specifies
+// the number of retries after the first attempt; zero means no limit,
+// retries stop only when the context is done.
+//
+// Errors that retrying is not going to help with are returned
+// immediately: corrupt sections (ErrSectionCorrupt), missing objects,
+// and context errors. By default, fetches are not retried.
+func WithFetchRetry(c backoff.Config) OpenOption {
+	return func(r *Reader) {
+		r.retry = &c
+	}
+}
+
+// fetch fetches x, retrying on transient errors, if configured.
+func (r *Reader) fetch(ctx context.Context, x fetch) (err error) {
+	if r.retry == nil {
+		return x.fetch(ctx)
+	}
+	b := backoff.New(ctx, *r.retry)
+	for {
+		if err = x.fetch(ctx); err == nil || !r.retryable(ctx, err) {
+			return err
+		}
+		if !b.Ongoing() {
+			return err
+		}
+		b.Wait()
+	}
+}
+
+func (r *Reader) retryable(ctx context.Context, err error) bool {
+	switch {
+	case ctx.Err() != nil,
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, ErrSectionCorrupt),
+		errors.Is(err, os.ErrNotExist),
+		r.bucket.IsObjNotFoundErr(err):
+		return false
+	}
+	return true
+}
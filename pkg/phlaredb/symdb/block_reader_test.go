@@ -2,11 +2,19 @@ package symdb
 
 import (
 	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/grafana/dskit/backoff"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
+	"github.com/grafana/pyroscope/pkg/objstore"
 	"github.com/grafana/pyroscope/pkg/objstore/providers/filesystem"
 	"github.com/grafana/pyroscope/pkg/phlaredb/block"
 	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
@@ -79,3 +87,195 @@ type mockStacktraceInserter struct{ mock.Mock }
 func (m *mockStacktraceInserter) InsertStacktrace(stacktraceID uint32, locations []int32) {
 	m.Called(stacktraceID, locations)
 }
+
+func Test_Reader_Verify(t *testing.T) {
+	b, err := filesystem.NewBucket("testdata/symbols/v2")
+	require.NoError(t, err)
+	x, err := Open(context.Background(), b, testBlockMeta)
+	require.NoError(t, err)
+
+	report, err := x.Verify(context.Background())
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Issues)
+	require.Equal(t, 2, report.Partitions)
+
+	// Corrupt the stack traces of the first partition,
+	// and the functions of the second one.
+	x.partitions[0].stacktraceChunks[0].header.CRC++
+	x.partitions[1].functions.headers[0].Rows += 1 << 20
+	report, err = x.Verify(context.Background())
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	require.Len(t, report.Issues, 2)
+	require.Equal(t, VerifyIssue{
+		Partition: 0,
+		Section:   sectionStacktraces,
+		Message:   "chunk 0: " + ErrInvalidCRC.Error(),
+	}, report.Issues[0])
+	require.Equal(t, uint64(1), report.Issues[1].Partition)
+	require.Equal(t, sectionFunctions, report.Issues[1].Section)
+}
+
+var errTransient = errors.New("transient error")
+
+// flakyBucket fails the first stack trace range requests.
+type flakyBucket struct {
+	objstore.Bucket
+	failures int32
+	calls    int32
+}
+
+func (b *flakyBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if name == StacktracesFileName {
+		atomic.AddInt32(&b.calls, 1)
+		if atomic.AddInt32(&b.failures, -1) >= 0 {
+			return nil, errTransient
+		}
+	}
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+func Test_Reader_FetchRetry(t *testing.T) {
+	fs, err := filesystem.NewBucket("testdata/symbols/v2")
+	require.NoError(t, err)
+	retry := WithFetchRetry(backoff.Config{
+		MinBackoff: time.Millisecond,
+		MaxBackoff: time.Millisecond,
+		MaxRetries: 3,
+	})
+	samples := schemav1.Samples{
+		StacktraceIDs: []uint32{1, 2, 3, 4, 5},
+		Values:        []uint64{1, 1, 1, 1, 1},
+	}
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		b := &flakyBucket{Bucket: fs, failures: 2}
+		x, err := Open(context.Background(), b, testBlockMeta, retry)
+		require.NoError(t, err)
+		r := NewResolver(context.Background(), x)
+		defer r.Release()
+		r.AddSamples(0, samples)
+		resolved, err := r.Tree()
+		require.NoError(t, err)
+		require.Equal(t, int64(5), resolved.Total())
+		require.Equal(t, int32(3), atomic.LoadInt32(&b.calls))
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		b := &flakyBucket{Bucket: fs, failures: 10}
+		x, err := Open(context.Background(), b, testBlockMeta, retry)
+		require.NoError(t, err)
+		r := NewResolver(context.Background(), x)
+		defer r.Release()
+		r.AddSamples(0, samples)
+		_, err = r.Tree()
+		require.ErrorIs(t, err, errTransient)
+		require.Equal(t, int32(4), atomic.LoadInt32(&b.calls))
+	})
+
+	t.Run("no retries by default", func(t *testing.T) {
+		b := &flakyBucket{Bucket: fs, failures: 1}
+		x, err := Open(context.Background(), b, testBlockMeta)
+		require.NoError(t, err)
+		r := NewResolver(context.Background(), x)
+		defer r.Release()
+		r.AddSamples(0, samples)
+		_, err = r.Tree()
+		require.ErrorIs(t, err, errTransient)
+		require.Equal(t, int32(1), atomic.LoadInt32(&b.calls))
+	})
+
+	t.Run("permanent errors are not retried", func(t *testing.T) {
+		b := &flakyBucket{Bucket: fs}
+		x, err := Open(context.Background(), b, testBlockMeta, retry)
+		require.NoError(t, err)
+		x.partitions[0].stacktraceChunks[0].header.CRC++
+		r := NewResolver(context.Background(), x)
+		defer r.Release()
+		r.AddSamples(0, samples)
+		_, err = r.Tree()
+		require.ErrorIs(t, err, ErrSectionCorrupt)
+		require.Equal(t, int32(1), atomic.LoadInt32(&b.calls))
+	})
+}
+
+func Test_Partition_ResolveFrames(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	values := make(map[uint32]uint64, len(samples.StacktraceIDs))
+	for i, sid := range samples.StacktraceIDs {
+		values[sid] += samples.Values[i]
+	}
+	ids := make([]uint32, 0, len(values))
+	for sid := range values {
+		ids = append(ids, sid)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	expected := pprofFingerprint(s.profiles[0].Profile, 0)
+
+	block, err := s.reader.Partition(context.Background(), 0)
+	require.NoError(t, err)
+	defer block.Release()
+	memory, err := s.db.Partition(context.Background(), 0)
+	require.NoError(t, err)
+
+	for _, p := range []PartitionReader{memory, block} {
+		m := make(map[uint64]uint64)
+		mappings := make(map[string]struct{})
+		h := xxhash.New()
+		stacktraces := make([]uint32, len(ids))
+		copy(stacktraces, ids)
+		err = p.ResolveFrames(context.Background(), stacktraces, func(sid uint32, frames []Frame) {
+			v := values[sid]
+			if v == 0 {
+				return
+			}
+			h.Reset()
+			for _, f := range frames {
+				_, _ = h.WriteString(f.Function)
+				mappings[f.Mapping] = struct{}{}
+				require.NotZero(t, f.Address)
+			}
+			m[h.Sum64()] += v
+		})
+		require.NoError(t, err)
+		actual := make([][2]uint64, 0, len(m))
+		for k, v := range m {
+			actual = append(actual, [2]uint64{k, v})
+		}
+		sort.Slice(actual, func(i, j int) bool { return actual[i][0] < actual[j][0] })
+		require.Equal(t, expected, actual)
+		require.Contains(t, mappings, "/usr/bin/pyroscope")
+	}
+}
+
+func Test_Reader_PartitionLazy(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	ctx := context.Background()
+
+	p, err := s.reader.PartitionLazy(0)
+	require.NoError(t, err)
+	estimate := p.EstimateSize()
+	require.Greater(t, estimate, int64(0))
+	// The estimate is available before the symbols are loaded.
+	require.Nil(t, s.reader.partitionsMap[0].locations.s)
+
+	require.NoError(t, p.Preload(ctx))
+	require.NoError(t, p.Preload(ctx))
+	symbols := p.Symbols()
+	require.NotEmpty(t, symbols.Locations)
+	loaded := symbols.EstimateSize() + s.reader.partitionsMap[0].stacktracesSize()
+	require.InEpsilon(t, loaded, estimate, 0.5)
+	// The estimate does not depend on whether the symbols are loaded.
+	require.Equal(t, estimate, p.EstimateSize())
+
+	// The symbols are released, once the partition is released.
+	p.Release()
+	p.Release()
+	require.Nil(t, s.reader.partitionsMap[0].locations.s)
+
+	_, err = s.reader.PartitionLazy(1)
+	require.ErrorIs(t, err, ErrPartitionNotFound)
+}
@@ -0,0 +1,266 @@
+package symdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// VerifyReport describes inconsistencies of the block symbols.
+type VerifyReport struct {
+	// Number of partitions verified.
+	Partitions int
+	Issues     []VerifyIssue
+}
+
+func (r *VerifyReport) OK() bool { return len(r.Issues) == 0 }
+
+type VerifyIssue struct {
+	Partition uint64
+	// Section is one of: stacktraces, locations,
+	// mappings, functions, strings.
+	Section string
+	Message string
+}
+
+func (i VerifyIssue) String() string {
+	return fmt.Sprintf("partition %d: %s: %s", i.Partition, i.Section, i.Message)
+}
+
+const (
+	sectionStacktraces = "stacktraces"
+	sectionLocations   = "locations"
+	sectionMappings    = "mappings"
+	sectionFunctions   = "functions"
+	sectionStrings     = "strings"
+)
+
+// Verify checks the block symbols for consistency, without resolving
+// any profile: partitions are fetched one by one, checksums of stack
+// trace chunks are validated, and all the references between stack
+// traces, locations, mappings, functions, and strings are checked to
+// be in bounds. Inconsistencies are returned in the report; an error
+// is only returned if the verification can't be performed, e.g., if
+// the context is canceled.
+func (r *Reader) Verify(ctx context.Context) (*VerifyReport, error) {
+	stacktracesSize, err := r.fileSize(ctx, StacktracesFileName)
+	if err != nil {
+		return nil, err
+	}
+	var report VerifyReport
+	for i, p := range r.partitions {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		v := partitionVerifier{
+			partition:       p,
+			id:              r.index.PartitionHeaders[i].Partition,
+			report:          &report,
+			stacktracesSize: stacktracesSize,
+		}
+		v.verify(ctx)
+		report.Partitions++
+	}
+	return &report, nil
+}
+
+func (r *Reader) fileSize(ctx context.Context, name string) (int64, error) {
+	f, err := r.file(name)
+	if err != nil {
+		return 0, err
+	}
+	if f.SizeBytes > 0 {
+		return int64(f.SizeBytes), nil
+	}
+	attrs, err := r.bucket.Attributes(ctx, f.RelPath)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Size, nil
+}
+
+type partitionVerifier struct {
+	*partition
+	report          *VerifyReport
+	stacktracesSize int64
+	id              uint64
+	tx              fetchTx
+}
+
+func (v *partitionVerifier) issue(section string, format string, args ...any) {
+	v.report.Issues = append(v.report.Issues, VerifyIssue{
+		Partition: v.id,
+		Section:   section,
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *partitionVerifier) verify(ctx context.Context) {
+	defer v.tx.release()
+	chunks := v.fetchStacktraces(ctx)
+	if v.reader.index.Header.Version <= FormatV1 {
+		// Symbols of the partition are
+		// stored out of the symdb block.
+		return
+	}
+	locations := fetchTable(ctx, v, sectionLocations, &v.locations)
+	mappings := fetchTable(ctx, v, sectionMappings, &v.mappings)
+	functions := fetchTable(ctx, v, sectionFunctions, &v.functions)
+	strings := fetchTable(ctx, v, sectionStrings, &v.strings)
+	if chunks && locations {
+		v.verifyStacktraceLocations()
+	}
+	if locations && mappings && functions {
+		v.verifyLocations()
+	}
+	if mappings && strings {
+		v.verifyMappings()
+	}
+	if functions && strings {
+		v.verifyFunctions()
+	}
+}
+
+func (v *partitionVerifier) fetchStacktraces(ctx context.Context) bool {
+	ok := true
+	for _, c := range v.stacktraceChunks {
+		h := c.header
+		if h.Partition != v.id {
+			v.issue(sectionStacktraces, "chunk %d belongs to partition %d", h.ChunkIndex, h.Partition)
+			ok = false
+			continue
+		}
+		if h.Offset < 0 || h.Size <= 0 || h.Offset+h.Size > v.stacktracesSize {
+			v.issue(sectionStacktraces, "chunk %d range [%d:%d) is out of the file bounds [0:%d)",
+				h.ChunkIndex, h.Offset, h.Offset+h.Size, v.stacktracesSize)
+			ok = false
+			continue
+		}
+		if err := c.fetch(ctx); err != nil {
+			v.issue(sectionStacktraces, "chunk %d: %v", h.ChunkIndex, sectionErrorCause(err))
+			ok = false
+			continue
+		}
+		v.tx.append(c)
+		for i, n := range c.t.nodes {
+			if i > 0 && (n.p < 0 || int(n.p) >= i) {
+				v.issue(sectionStacktraces, "chunk %d: node %d has invalid parent %d", h.ChunkIndex, i, n.p)
+				ok = false
+				break
+			}
+		}
+	}
+	return ok
+}
+
+func fetchTable[M schemav1.Models, P schemav1.Persister[M]](
+	ctx context.Context,
+	v *partitionVerifier,
+	section string,
+	t *parquetTableRange[M, P],
+) bool {
+	rgs := t.file.RowGroups()
+	for _, h := range t.headers {
+		if int(h.RowGroup) >= len(rgs) {
+			v.issue(section, "row group %d does not exist: the table has %d row groups", h.RowGroup, len(rgs))
+			return false
+		}
+		if n := rgs[h.RowGroup].NumRows(); int64(h.Index)+int64(h.Rows) > n {
+			v.issue(section, "row range [%d:%d) is out of the row group %d bounds [0:%d)",
+				h.Index, h.Index+h.Rows, h.RowGroup, n)
+			return false
+		}
+	}
+	if err := t.fetch(ctx); err != nil {
+		v.issue(section, "%v", sectionErrorCause(err))
+		return false
+	}
+	v.tx.append(t)
+	return true
+}
+
+// sectionErrorCause returns the cause of the SectionError, as the
+// section is already specified in the issue, or err otherwise.
+func sectionErrorCause(err error) error {
+	var s *SectionError
+	if errors.As(err, &s) {
+		return s.Err
+	}
+	return err
+}
+
+// outOfBounds reports the number of references out of bounds, and the
+// first of them.
+type outOfBounds struct {
+	section string
+	target  string
+	count   int
+	total   int
+	first   int
+	ref     int64
+}
+
+func (b *outOfBounds) check(i int, ref int64, n int) {
+	b.total++
+	if ref >= 0 && ref < int64(n) {
+		return
+	}
+	if b.count == 0 {
+		b.first, b.ref = i, ref
+	}
+	b.count++
+}
+
+func (b *outOfBounds) report(v *partitionVerifier) {
+	if b.count > 0 {
+		v.issue(b.section, "%d of %d references to %s are out of bounds (first: %d -> %d)",
+			b.count, b.total, b.target, b.first, b.ref)
+	}
+}
+
+func (v *partitionVerifier) verifyStacktraceLocations() {
+	n := len(v.locations.s)
+	b := outOfBounds{section: sectionStacktraces, target: sectionLocations}
+	for _, c := range v.stacktraceChunks {
+		for i, node := range c.t.nodes {
+			if i > 0 {
+				b.check(i, int64(node.r), n)
+			}
+		}
+	}
+	b.report(v)
+}
+
+func (v *partitionVerifier) verifyLocations() {
+	m := outOfBounds{section: sectionLocations, target: sectionMappings}
+	f := outOfBounds{section: sectionLocations, target: sectionFunctions}
+	for i, loc := range v.locations.s {
+		m.check(i, int64(loc.MappingId), len(v.mappings.s))
+		for _, line := range loc.Line {
+			f.check(i, int64(line.FunctionId), len(v.functions.s))
+		}
+	}
+	m.report(v)
+	f.report(v)
+}
+
+func (v *partitionVerifier) verifyMappings() {
+	b := outOfBounds{section: sectionMappings, target: sectionStrings}
+	for i, m := range v.mappings.s {
+		b.check(i, int64(m.Filename), len(v.strings.s))
+		b.check(i, int64(m.BuildId), len(v.strings.s))
+	}
+	b.report(v)
+}
+
+func (v *partitionVerifier) verifyFunctions() {
+	b := outOfBounds{section: sectionFunctions, target: sectionStrings}
+	for i, f := range v.functions.s {
+		b.check(i, int64(f.Name), len(v.strings.s))
+		b.check(i, int64(f.SystemName), len(v.strings.s))
+		b.check(i, int64(f.Filename), len(v.strings.s))
+	}
+	b.report(v)
+}
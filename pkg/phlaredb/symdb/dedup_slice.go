@@ -10,6 +10,7 @@ import (
 	"unsafe"
 
 	"github.com/colega/zeropool"
+	googleprofile "github.com/google/pprof/profile"
 	"go.uber.org/atomic"
 
 	profilev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
@@ -104,6 +105,18 @@ func (p *PartitionWriter) WriteProfileSymbols(profile *profilev1.Profile) []sche
 	return profiles
 }
 
+// ImportProfile writes symbols of the profile in the format of the
+// github.com/google/pprof/profile package to the partition, and returns
+// the samples that refer to the partition stack traces, a collection
+// per each sample type, as WriteProfileSymbols does.
+func (p *PartitionWriter) ImportProfile(profile *googleprofile.Profile) ([]schemav1.InMemoryProfile, error) {
+	x, err := pprof.FromProfile(profile)
+	if err != nil {
+		return nil, fmt.Errorf("converting profile: %w", err)
+	}
+	return p.WriteProfileSymbols(x), nil
+}
+
 func (p *PartitionWriter) convertSamples(r *rewriter, in []*profilev1.Sample, spans []uint64) []schemav1.Samples {
 	if len(in) == 0 {
 		return nil
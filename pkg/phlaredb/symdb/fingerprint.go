@@ -0,0 +1,99 @@
+package symdb
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+
+	profilev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
+)
+
+// ProfileFingerprint returns a content hash of the profile samples,
+// suitable as a cache key of a resolved profile. The fingerprint only
+// depends on the sample types, and on the stack traces (function names
+// of the location lines) and the values of the samples: the order of the
+// samples, locations, functions, and strings of the profile does not
+// affect it, and samples of the same stack trace are summed up. Labels
+// and samples with zero values are ignored.
+func ProfileFingerprint(p *profilev1.Profile) uint64 {
+	locations := make(map[uint64]*profilev1.Location, len(p.Location))
+	for _, loc := range p.Location {
+		locations[loc.Id] = loc
+	}
+	functions := make(map[uint64]*profilev1.Function, len(p.Function))
+	for _, fn := range p.Function {
+		functions[fn.Id] = fn
+	}
+	str := func(i int64) string {
+		if i >= 0 && int(i) < len(p.StringTable) {
+			return p.StringTable[i]
+		}
+		return ""
+	}
+
+	h := xxhash.New()
+	stacks := make(map[uint64][]int64, len(p.Sample))
+	for _, s := range p.Sample {
+		if isZero(s.Value) {
+			continue
+		}
+		h.Reset()
+		for _, id := range s.LocationId {
+			loc, ok := locations[id]
+			if !ok {
+				continue
+			}
+			for _, line := range loc.Line {
+				if fn, ok := functions[line.FunctionId]; ok {
+					_, _ = h.WriteString(str(fn.Name))
+				}
+				_, _ = h.Write([]byte{0})
+			}
+		}
+		k := h.Sum64()
+		values := stacks[k]
+		if len(values) < len(s.Value) {
+			values = append(values, make([]int64, len(s.Value)-len(values))...)
+		}
+		for i, v := range s.Value {
+			values[i] += v
+		}
+		stacks[k] = values
+	}
+
+	keys := make([]uint64, 0, len(stacks))
+	for k, v := range stacks {
+		if !isZero(v) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	h.Reset()
+	for _, t := range p.SampleType {
+		_, _ = h.WriteString(str(t.Type))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.WriteString(str(t.Unit))
+		_, _ = h.Write([]byte{0})
+	}
+	var b [8]byte
+	for _, k := range keys {
+		binary.LittleEndian.PutUint64(b[:], k)
+		_, _ = h.Write(b[:])
+		for _, v := range stacks[k] {
+			binary.LittleEndian.PutUint64(b[:], uint64(v))
+			_, _ = h.Write(b[:])
+		}
+	}
+	return h.Sum64()
+}
+
+func isZero(values []int64) bool {
+	for _, v := range values {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
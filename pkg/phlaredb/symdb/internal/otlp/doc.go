@@ -0,0 +1,20 @@
+// Package otlp contains the generated Go types of the OpenTelemetry
+// profiles signal (opentelemetry/proto/profiles/v1development), copied
+// from go.opentelemetry.io/proto/otlp v1.7.0 with the import paths
+// rewritten. The types are only used by the tests of the package to
+// verify the output of symdb.ProfileToOTLP and Resolver.ProfileOTLP:
+// the module itself can't be required, as it depends on newer versions
+// of Go and google.golang.org/protobuf.
+//
+// The generated files must not be edited. If the version ProfileToOTLP
+// targets changes, the files are to be copied from the upstream module
+// again, and the import paths rewritten:
+//
+//	src=$(go mod download -json go.opentelemetry.io/proto/otlp@v1.7.0 | jq -r .Dir)
+//	for p in common/v1 resource/v1 profiles/v1development; do
+//		install -m 644 "$src/$p"/*.pb.go "$p/"
+//	done
+//	sed -i 's#go.opentelemetry.io/proto/otlp/#github.com/grafana/pyroscope/pkg/phlaredb/symdb/internal/otlp/#' */*/*.pb.go
+//
+// The commands are run from the directory of the package.
+package otlp
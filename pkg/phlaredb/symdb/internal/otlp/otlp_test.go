@@ -0,0 +1,232 @@
+package otlp_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/grafana/pyroscope/pkg/model"
+	"github.com/grafana/pyroscope/pkg/phlaredb/symdb"
+	otlpprofiles "github.com/grafana/pyroscope/pkg/phlaredb/symdb/internal/otlp/profiles/v1development"
+	"github.com/grafana/pyroscope/pkg/pprof"
+)
+
+func unmarshalProfilesData(t *testing.T, b []byte) *otlpprofiles.ProfilesData {
+	var data otlpprofiles.ProfilesData
+	require.NoError(t, proto.Unmarshal(b, &data))
+	require.NotNil(t, data.Dictionary)
+	return &data
+}
+
+func Test_ProfileToOTLP_Schema(t *testing.T) {
+	f, err := os.Open("../../testdata/profile.pb.gz")
+	require.NoError(t, err)
+	defer f.Close()
+	p, err := profile.Parse(f)
+	require.NoError(t, err)
+	opts := symdb.OTLPOptions{
+		AggregationTemporality: symdb.OTLPAggregationTemporalityCumulative,
+		SampleTypes: map[symdb.OTLPValueType]symdb.OTLPValueType{
+			{Type: "alloc_objects", Unit: "count"}: {Type: "allocations", Unit: "count"},
+		},
+		ResourceAttributes: []symdb.OTLPAttribute{{Key: "service.name", Value: "test"}},
+		Attributes:         []symdb.OTLPAttribute{{Key: "profile.kind", Value: "memory"}},
+		ScopeName:          "pyroscope",
+		ScopeVersion:       "1.0.0",
+	}
+	b, err := symdb.ProfileToOTLP(p, opts)
+	require.NoError(t, err)
+
+	data := unmarshalProfilesData(t, b)
+	dict := data.Dictionary
+	strs := dict.StringTable
+	require.Equal(t, "", strs[0])
+	attr := func(i int32) (string, string) {
+		kv := dict.AttributeTable[i]
+		return kv.Key, kv.Value.GetStringValue()
+	}
+
+	require.Len(t, data.ResourceProfiles, 1)
+	resource := data.ResourceProfiles[0].Resource
+	require.Len(t, resource.Attributes, 1)
+	require.Equal(t, "service.name", resource.Attributes[0].Key)
+	require.Equal(t, "test", resource.Attributes[0].Value.GetStringValue())
+	require.Len(t, data.ResourceProfiles[0].ScopeProfiles, 1)
+	scopeProfiles := data.ResourceProfiles[0].ScopeProfiles[0]
+	require.Equal(t, "pyroscope", scopeProfiles.Scope.Name)
+	require.Equal(t, "1.0.0", scopeProfiles.Scope.Version)
+	require.Len(t, scopeProfiles.Profiles, 1)
+	x := scopeProfiles.Profiles[0]
+	require.Len(t, x.ProfileId, 16)
+	require.Equal(t, p.TimeNanos, x.TimeNanos)
+	require.Equal(t, p.DurationNanos, x.DurationNanos)
+	require.Equal(t, p.Period, x.Period)
+	require.Len(t, x.AttributeIndices, 1)
+	k, v := attr(x.AttributeIndices[0])
+	require.Equal(t, "profile.kind", k)
+	require.Equal(t, "memory", v)
+
+	// The sample types not present in the mapping are exported as is.
+	require.Len(t, x.SampleType, len(p.SampleType))
+	for i, typ := range p.SampleType {
+		expected := symdb.OTLPValueType{Type: typ.Type, Unit: typ.Unit}
+		if m, ok := opts.SampleTypes[expected]; ok {
+			expected = m
+		}
+		actual := x.SampleType[i]
+		require.Equal(t, expected.Type, strs[actual.TypeStrindex])
+		require.Equal(t, expected.Unit, strs[actual.UnitStrindex])
+		require.Equal(t, otlpprofiles.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			actual.AggregationTemporality)
+	}
+	require.Equal(t, "allocations", strs[x.SampleType[0].TypeStrindex])
+
+	// The first entries of the tables are zero values,
+	// and the profile entities follow in the same order.
+	require.Len(t, dict.MappingTable, len(p.Mapping)+1)
+	require.Len(t, dict.LocationTable, len(p.Location)+1)
+	require.Len(t, dict.FunctionTable, len(p.Function)+1)
+	require.True(t, proto.Equal(new(otlpprofiles.Mapping), dict.MappingTable[0]))
+	require.True(t, proto.Equal(new(otlpprofiles.Location), dict.LocationTable[0]))
+	require.True(t, proto.Equal(new(otlpprofiles.Function), dict.FunctionTable[0]))
+	for i, m := range p.Mapping {
+		actual := dict.MappingTable[i+1]
+		require.Equal(t, m.Start, actual.MemoryStart)
+		require.Equal(t, m.Limit, actual.MemoryLimit)
+		require.Equal(t, m.File, strs[actual.FilenameStrindex])
+		if m.BuildID != "" {
+			require.Len(t, actual.AttributeIndices, 1)
+			k, v := attr(actual.AttributeIndices[0])
+			require.Equal(t, symdb.DefaultOTLPBuildIDAttribute, k)
+			require.Equal(t, m.BuildID, v)
+		}
+	}
+	for i, fn := range p.Function {
+		require.Equal(t, fn.Name, strs[dict.FunctionTable[i+1].NameStrindex])
+	}
+	for i, loc := range p.Location {
+		actual := dict.LocationTable[i+1]
+		require.Equal(t, loc.Address, actual.Address)
+		if loc.Mapping != nil {
+			require.NotNil(t, actual.MappingIndex)
+			require.Equal(t, loc.Mapping.File, strs[dict.MappingTable[*actual.MappingIndex].FilenameStrindex])
+		}
+		require.Len(t, actual.Line, len(loc.Line))
+		for j, line := range loc.Line {
+			fn := dict.FunctionTable[actual.Line[j].FunctionIndex]
+			require.Equal(t, line.Function.Name, strs[fn.NameStrindex])
+			require.Equal(t, line.Line, actual.Line[j].Line)
+		}
+	}
+
+	// Samples refer to the locations of the profile.
+	require.Len(t, x.Sample, len(p.Sample))
+	for i, s := range p.Sample {
+		actual := x.Sample[i]
+		require.Equal(t, s.Value, actual.Value)
+		start := actual.LocationsStartIndex
+		indices := x.LocationIndices[start : start+actual.LocationsLength]
+		require.Len(t, indices, len(s.Location))
+		for j, loc := range s.Location {
+			require.Equal(t, loc.Address, dict.LocationTable[indices[j]].Address)
+		}
+	}
+}
+
+func Test_Resolver_ProfileOTLP(t *testing.T) {
+	x, err := pprof.OpenFile("../../testdata/profile.pb.gz")
+	require.NoError(t, err)
+	db := symdb.NewSymDB(symdb.DefaultConfig().WithDirectory(t.TempDir()))
+	samples := db.PartitionWriter(0).WriteProfileSymbols(x.Profile)[0].Samples
+	resolver := func() *symdb.Resolver {
+		r := symdb.NewResolver(context.Background(), db)
+		r.AddSamples(0, samples)
+		return r
+	}
+	r := resolver()
+	expected, err := r.Tree()
+	require.NoError(t, err)
+	r.Release()
+
+	r = resolver()
+	defer r.Release()
+	b, err := r.ProfileOTLP(symdb.OTLPOptions{
+		Meta: symdb.ProfileMeta{
+			SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		},
+		AggregationTemporality: symdb.OTLPAggregationTemporalityDelta,
+		SampleTypes: map[symdb.OTLPValueType]symdb.OTLPValueType{
+			{Type: "cpu", Unit: "nanoseconds"}: {Type: "cpu", Unit: "ns"},
+		},
+		ResourceAttributes: []symdb.OTLPAttribute{{Key: "service.name", Value: "test"}},
+		ScopeName:          "pyroscope",
+	})
+	require.NoError(t, err)
+
+	data := unmarshalProfilesData(t, b)
+	dict := data.Dictionary
+	strs := dict.StringTable
+	require.Len(t, data.ResourceProfiles, 1)
+	require.Equal(t, "service.name", data.ResourceProfiles[0].Resource.Attributes[0].Key)
+	require.Len(t, data.ResourceProfiles[0].ScopeProfiles, 1)
+	scopeProfiles := data.ResourceProfiles[0].ScopeProfiles[0]
+	require.Equal(t, "pyroscope", scopeProfiles.Scope.Name)
+	require.Len(t, scopeProfiles.Profiles, 1)
+	prof := scopeProfiles.Profiles[0]
+	require.Len(t, prof.ProfileId, 16)
+	require.Len(t, prof.SampleType, 1)
+	require.Equal(t, "cpu", strs[prof.SampleType[0].TypeStrindex])
+	require.Equal(t, "ns", strs[prof.SampleType[0].UnitStrindex])
+	require.Equal(t, otlpprofiles.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+		prof.SampleType[0].AggregationTemporality)
+
+	// The stack traces resolved through the dictionary
+	// tables make up the tree of the samples.
+	tree := new(model.Tree)
+	var stack []string
+	for _, s := range prof.Sample {
+		stack = stack[:0]
+		indices := prof.LocationIndices[s.LocationsStartIndex : s.LocationsStartIndex+s.LocationsLength]
+		for i := len(indices) - 1; i >= 0; i-- {
+			require.NotZero(t, indices[i])
+			lines := dict.LocationTable[indices[i]].Line
+			for j := len(lines) - 1; j >= 0; j-- {
+				stack = append(stack, strs[dict.FunctionTable[lines[j].FunctionIndex].NameStrindex])
+			}
+		}
+		tree.InsertStack(s.Value[0], stack...)
+	}
+	require.Equal(t, expected.String(), tree.String())
+}
+
+func Test_ProfileToOTLP_LabelAttributes(t *testing.T) {
+	fn := &profile.Function{ID: 1, Name: "main"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	p := &profile.Profile{
+		Function: []*profile.Function{fn},
+		Location: []*profile.Location{loc},
+		Sample: []*profile.Sample{{
+			Location: []*profile.Location{loc},
+			Value:    []int64{1},
+			Label:    map[string][]string{"span_id": {"a"}, "thread": {"b"}, "other": {"c"}},
+		}},
+	}
+	attributes := func(opts symdb.OTLPOptions) []string {
+		b, err := symdb.ProfileToOTLP(p, opts)
+		require.NoError(t, err)
+		var keys []string
+		for _, kv := range unmarshalProfilesData(t, b).Dictionary.AttributeTable {
+			keys = append(keys, kv.Key)
+		}
+		return keys
+	}
+	labels := map[string]string{"span_id": "span.id"}
+	require.Equal(t, []string{"other", "span.id", "thread"},
+		attributes(symdb.OTLPOptions{LabelAttributes: labels}))
+	require.Equal(t, []string{"span.id"},
+		attributes(symdb.OTLPOptions{LabelAttributes: labels, DropUnmappedLabels: true}))
+}
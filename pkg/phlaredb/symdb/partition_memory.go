@@ -5,6 +5,7 @@ import (
 	"io"
 	"sync"
 
+	"github.com/grafana/pyroscope/pkg/iter"
 	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
 )
 
@@ -22,13 +23,13 @@ func (p *PartitionWriter) AppendStacktraces(dst []uint32, s []*schemav1.Stacktra
 	p.stacktraces.append(dst, s)
 }
 
-func (p *PartitionWriter) ResolveStacktraceLocations(_ context.Context, dst StacktraceInserter, stacktraces []uint32) error {
+func (p *PartitionWriter) ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) error {
 	// TODO(kolesnikovae): Add option to do resolve concurrently.
 	//   Depends on StacktraceInserter implementation.
 	if len(stacktraces) == 0 {
 		return nil
 	}
-	return p.stacktraces.resolve(dst, stacktraces)
+	return p.stacktraces.resolve(ctx, dst, stacktraces)
 }
 
 func (p *PartitionWriter) ResolveChunk(dst StacktraceInserter, sr StacktracesRange) error {
@@ -182,9 +183,9 @@ func (p *stacktraceLocationsPool) put(x []int32) {
 	stacktraceLocations.Put(x)
 }
 
-func (p *stacktracesPartition) resolve(dst StacktraceInserter, stacktraces []uint32) (err error) {
+func (p *stacktracesPartition) resolve(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) (err error) {
 	for _, sr := range SplitStacktraces(stacktraces, p.maxNodesPerChunk) {
-		if err = p.ResolveChunk(dst, sr); err != nil {
+		if err = p.resolveChunk(ctx, dst, sr); err != nil {
 			return err
 		}
 	}
@@ -199,6 +200,10 @@ func (p *stacktracesPartition) resolve(dst StacktraceInserter, stacktraces []uin
 //  the options, the package provides.
 
 func (p *stacktracesPartition) ResolveChunk(dst StacktraceInserter, sr StacktracesRange) error {
+	return p.resolveChunk(context.Background(), dst, sr)
+}
+
+func (p *stacktracesPartition) resolveChunk(ctx context.Context, dst StacktraceInserter, sr StacktracesRange) error {
 	p.m.RLock()
 	c, found := p.stacktraceChunkForRead(int(sr.chunk))
 	if !found {
@@ -216,13 +221,18 @@ func (p *stacktracesPartition) ResolveChunk(dst StacktraceInserter, sr Stacktrac
 	// the call.
 	p.m.RUnlock()
 	s := stacktraceLocations.get()
+	defer func() { stacktraceLocations.put(s) }()
 	// Restore the original stacktrace ID.
 	off := sr.offset()
-	for _, sid := range sr.ids {
+	for i, sid := range sr.ids {
+		if i%contextCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
 		s = t.resolve(s, sid)
 		dst.InsertStacktrace(off+sid, s)
 	}
-	stacktraceLocations.put(s)
 	return nil
 }
 
@@ -324,6 +334,14 @@ func (p *PartitionWriter) Symbols() *Symbols {
 	}
 }
 
+func (p *PartitionWriter) ResolveFrames(ctx context.Context, stacktraces []uint32, fn func(uint32, []Frame)) error {
+	return p.Symbols().ResolveFrames(ctx, stacktraces, fn)
+}
+
+func (p *PartitionWriter) SymbolRecords(ctx context.Context) iter.Iterator[SymbolRecord] {
+	return p.Symbols().Iterator(ctx)
+}
+
 func (p *PartitionWriter) WriteStats(s *PartitionStats) {
 	p.stacktraces.m.RLock()
 	c := p.stacktraces.currentStacktraceChunk()
@@ -348,6 +366,15 @@ func (p *PartitionWriter) WriteStats(s *PartitionStats) {
 	p.strings.lock.RUnlock()
 }
 
+// EstimateSize returns the in-memory size of the partition symbols:
+// unlike block partitions, the size is not estimated but measured.
+func (p *PartitionWriter) EstimateSize() int64 {
+	return int64(p.stacktraces.size()) + p.Symbols().EstimateSize()
+}
+
+// Preload has no effect: the symbols are already in memory.
+func (p *PartitionWriter) Preload(context.Context) error { return nil }
+
 func (p *PartitionWriter) Release() {
 	// Noop. Satisfies PartitionReader interface.
 }
@@ -476,3 +476,18 @@ func pprofSampleToStacktrace(samples []*googlev1.Sample) []*schemav1.Stacktrace
 	}
 	return s
 }
+
+func Test_PartitionWriter_EstimateSize(t *testing.T) {
+	s := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	p, err := s.db.Partition(context.Background(), 0)
+	require.NoError(t, err)
+	defer p.Release()
+	require.NoError(t, p.Preload(context.Background()))
+	// In-memory partitions are measured exactly.
+	w := p.(*PartitionWriter)
+	var expected int64
+	expected += int64(w.stacktraces.size())
+	expected += int64(w.locations.Size() + w.mappings.Size() + w.functions.Size() + w.strings.Size())
+	expected += int64(len(w.strings.slice)) * estimatedStringSize
+	require.Equal(t, expected, p.EstimateSize())
+}
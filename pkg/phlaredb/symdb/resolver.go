@@ -2,14 +2,22 @@ package symdb
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"path"
 	"runtime"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/pprof/profile"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
 	"golang.org/x/sync/errgroup"
 
+	querierv1 "github.com/grafana/pyroscope/api/gen/proto/go/querier/v1"
 	"github.com/grafana/pyroscope/pkg/model"
 	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
 )
@@ -25,100 +33,615 @@ type Resolver struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 	span   opentracing.Span
+	// The context r.ctx is derived from: unlike r.ctx,
+	// it's not canceled on failures to load partitions.
+	parent context.Context
 
 	s SymbolsReader
 	g *errgroup.Group
 	c int
 	m sync.Mutex
 	p map[uint64]*lazyPartition
+	// Sample maps of the partitions released
+	// at Reset, ready for reuse.
+	free []map[uint32]int64
+
+	minValue         int64
+	valueTransform   func(int64) int64
+	countMode        bool
+	upscale          int64
+	skipZeroValues   bool
+	rate             int64
+	maxStacktraces   int64
+	stacktraces      atomic.Int64
+	memoryLimit      int64
+	memory           atomic.Int64
+	released         atomic.Bool
+	progress         *progressReporter
+	metrics          *ResolverMetrics
+	cache            *StacktraceCache
+	memo             *StacktraceCache
+	interner         *StringInterner
+	mappingFilter    *mappingFilter
+	functionFilter   *functionFilter
+	locationsOnly    bool
+	demangle         DemangleMode
+	nameNormalizer   func(string) string
+	maxNameLength    int
+	maxChildren      int
+	cumulative       bool
+	treeValueIdx     int
+	contention       bool
+	inlining         InliningMode
+	symbolDetail     SymbolDetail
+	lineGranularity  bool
+	recursionFolding bool
+	sampleLabels     bool
+	sampleTimestamps bool
+	rootLabel        string
+	comments         []string
+	locationDedup    bool
+	canonicalize     bool
+	bestEffort       bool
+	softDeadline     time.Duration
+	timeBudget       time.Duration
+	fallbackRate     float64
+
+	// Depths of the stack traces observed
+	// by the last Tree call, if any.
+	depths *DepthHistogram
+	// Tree of the profiles merged with MergeTreeProfiles.
+	external *model.Tree
+	// String table of the last profile produced.
+	stringTable *StringTable
+	// Whether the last tree is approximate, see WithTimeBudget.
+	approximate bool
 }
 
 type ResolverOption func(*Resolver)
 
 // WithMaxConcurrent specifies how many partitions
-// can be resolved concurrently.
+// can be resolved concurrently. By default, the limit
+// is GOMAXPROCS. Values less than one are ignored.
 func WithMaxConcurrent(n int) ResolverOption {
 	return func(r *Resolver) {
-		r.c = n
+		if n > 0 {
+			r.c = n
+		}
+	}
+}
+
+// WithMinValue specifies the minimum total value a tree node must
+// have: subtrees with a lower total value are folded into "other"
+// nodes, therefore the total value of the tree is preserved.
+// The threshold is applied to every partition individually, as
+// the partition stack traces are resolved: a subtree is kept if
+// its total value within the partition is not less than minValue.
+// Negative values, e.g. of diff profiles, are compared by the
+// absolute value.
+func WithMinValue(minValue int64) ResolverOption {
+	return func(r *Resolver) {
+		r.minValue = minValue
+	}
+}
+
+// WithMaxChildren limits the number of children of each node of the
+// tree returned by Tree: the n children with the largest total values
+// are kept, and the rest are folded into the "other (k)" node, where
+// k is the number of children folded, see model.Tree.LimitChildren.
+// The limit applies to the root nodes as well. In contrast to the
+// limit of Flamegraph nodes, the limit applies to every level.
+func WithMaxChildren(n int) ResolverOption {
+	return func(r *Resolver) {
+		r.maxChildren = n
+	}
+}
+
+// WithCumulativeValues changes the semantics of the self values of the
+// nodes of the tree returned by Tree: the self value of each node is the
+// cumulative value of the node, equal to its total value, therefore the
+// serialized tree needs no post-processing to obtain cumulative values.
+// The self values of such a tree no longer sum up to the total; the
+// tree must not be merged with trees produced without the option, and
+// methods built on Tree, such as Flamegraph, report the cumulative
+// values as self. The values are made cumulative last, after WithRate
+// and WithMaxChildren are applied.
+func WithCumulativeValues() ResolverOption {
+	return func(r *Resolver) {
+		r.cumulative = true
+	}
+}
+
+// WithSkipZeroValues specifies that stack traces with the zero value
+// are not resolved: the samples are aggregated by stack trace, and the
+// stack traces whose total value is zero are removed before the symbols
+// are accessed. In contrast to WithMinValue, this does not affect the
+// result, but saves the symbol lookups: stack traces with the zero
+// value do not contribute to the tree, for example. If the samples are
+// added with multiple value types, a stack trace is only skipped if all
+// its values are zero. Partitions with no stack traces remaining are
+// not resolved.
+func WithSkipZeroValues() ResolverOption {
+	return func(r *Resolver) {
+		r.skipZeroValues = true
+	}
+}
+
+// WithValueTransform specifies the function applied to every sample
+// value as the samples are added to the resolver, e.g., to convert the
+// value units. The transform is applied to the values of individual
+// samples, before they are aggregated by stack trace, therefore all
+// the resolution methods observe the transformed values. Options that
+// operate on the aggregated values, such as WithMinValue and sampling
+// of TreeSampled, are applied to the transformed values.
+func WithValueTransform(fn func(int64) int64) ResolverOption {
+	return func(r *Resolver) {
+		r.valueTransform = fn
+	}
+}
+
+// WithCountMode specifies that each of the samples added contributes
+// one to the stack trace value, regardless of the sample value: the
+// resolved trees are weighted by the number of stack trace occurrences,
+// and the total value equals the number of samples added. Samples with
+// the zero value are counted as well. WithValueTransform is not applied.
+func WithCountMode() ResolverOption {
+	return func(r *Resolver) {
+		r.countMode = true
+	}
+}
+
+// WithUpscale specifies that the sample values are multiplied by the
+// sampling period as the samples are added, the way pprof scales Go CPU
+// profiles: e.g., with the period of 10ms in nanoseconds, each of the
+// samples counted with WithCountMode contributes 10ms to the resolved
+// values. Upscaling is applied after WithValueTransform. The option is
+// ignored, if the period is not positive.
+func WithUpscale(period int64) ResolverOption {
+	return func(r *Resolver) {
+		r.upscale = period
+	}
+}
+
+func (r *Resolver) value(v uint64) int64 {
+	x := int64(v)
+	switch {
+	case r.countMode:
+		x = 1
+	case r.valueTransform != nil:
+		x = r.valueTransform(x)
+	}
+	if r.upscale > 0 {
+		x *= r.upscale
+	}
+	return x
+}
+
+// WithStacktraceCache specifies the cache of resolved stack traces
+// the resolver consults before accessing the partition stack traces.
+// The cache must only be shared by resolvers of the same SymbolsReader.
+func WithStacktraceCache(c *StacktraceCache) ResolverOption {
+	return func(r *Resolver) {
+		r.cache = c
+	}
+}
+
+// WithStringInterner specifies the table of strings shared by
+// resolvers. Unlike the stack trace cache, the interner can be shared
+// by resolvers of any symbols readers. Interning the strings adds
+// some overhead to the resolution of each partition, but reduces the
+// memory consumption when the resolved data is kept for long, e.g.,
+// when many resolvers run concurrently, or the results are cached.
+func WithStringInterner(t *StringInterner) ResolverOption {
+	return func(r *Resolver) {
+		r.interner = t
 	}
 }
 
 type lazyPartition struct {
-	id      uint64
-	reader  chan PartitionReader
+	id     uint64
+	reader chan PartitionReader
+	// m protects samples and values
+	// while samples are being added.
+	m       sync.Mutex
 	samples map[uint32]int64
+	// Samples of the additional value types, if any:
+	// values[0] refers to the samples map.
+	values []map[uint32]int64
+	// Samples added with labels, by the labels hash.
+	labeled map[uint64]*labeledSamples
 	err     chan error
 	done    chan struct{}
+	// loaded is closed once the partition is loaded;
+	// loadErr is set before, if loading has failed.
+	loaded  chan struct{}
+	loadErr error
+	// acquired is set once the partition loading starts.
+	acquired atomic.Bool
+	// canceled is closed at CancelPartition.
+	canceled   chan struct{}
+	cancelOnce sync.Once
+
+	// loadDuration is set before the reader is sent.
+	loadDuration time.Duration
+	stats        *ResolverPartitionStats
+
+	// Samples added with timestamps, by Unix nanoseconds.
+	timed map[int64]map[uint32]int64
+}
+
+// WithMaxStacktraces limits the number of distinct stack traces the
+// resolver may resolve across all the partitions. If the limit is
+// exceeded, resolution fails with StacktracesLimitError before the
+// symbols of the offending partition are accessed.
+func WithMaxStacktraces(n int) ResolverOption {
+	return func(r *Resolver) {
+		r.maxStacktraces = int64(n)
+	}
+}
+
+var ErrStacktracesLimitExceeded = fmt.Errorf("stack traces limit exceeded")
+
+type StacktracesLimitError struct {
+	Partition   uint64
+	Stacktraces int64
+	Limit       int64
+}
+
+func (e *StacktracesLimitError) Error() string {
+	return fmt.Sprintf("%v: partition %d: %d distinct stack traces observed, the limit is %d",
+		ErrStacktracesLimitExceeded, e.Partition, e.Stacktraces, e.Limit)
 }
 
-func NewResolver(ctx context.Context, s SymbolsReader) *Resolver {
+func (e *StacktracesLimitError) Unwrap() error { return ErrStacktracesLimitExceeded }
+
+// NewResolver creates a new Resolver for the symbols reader given.
+//
+// Partitions are resolved concurrently, and the results are merged:
+// if resolution of any of the partitions fails, the whole operation
+// is canceled, and the first error is returned.
+func NewResolver(ctx context.Context, s SymbolsReader, opts ...ResolverOption) *Resolver {
 	r := Resolver{
 		s: s,
 		c: runtime.GOMAXPROCS(-1),
 		p: make(map[uint64]*lazyPartition),
 	}
+	for _, opt := range opts {
+		opt(&r)
+	}
+	r.init(ctx)
+	return &r
+}
+
+func (r *Resolver) init(ctx context.Context) {
 	r.span, r.ctx = opentracing.StartSpanFromContext(ctx, "NewResolver")
 	r.ctx, r.cancel = context.WithCancel(r.ctx)
+	r.parent = r.ctx
 	r.g, r.ctx = errgroup.WithContext(r.ctx)
-	return &r
+	r.stacktraces.Store(0)
+	r.memory.Store(0)
+	r.depths = nil
+	r.external = nil
+	r.stringTable = nil
+	r.approximate = false
+	r.released.Store(false)
+	if r.progress != nil {
+		r.progress.init()
+	}
 }
 
+// Release releases the resolver resources and cancels the resolution
+// in progress, if any. Release is idempotent and safe for concurrent
+// use: only the first call takes effect, subsequent calls return
+// immediately.
 func (r *Resolver) Release() {
+	if !r.released.CompareAndSwap(false, true) {
+		return
+	}
 	r.cancel()
 	// The error is already sent to the caller.
 	_ = r.g.Wait()
+	if r.progress != nil {
+		r.progress.release()
+	}
+	if r.memo != nil {
+		r.memo.Purge()
+	}
 	r.span.Finish()
 }
 
+// Close implements io.Closer: it calls Release and always returns nil.
+func (r *Resolver) Close() error {
+	r.Release()
+	return nil
+}
+
+// Reset releases the resolver and prepares it for reuse with the
+// new context and symbols reader: all the samples added are discarded,
+// but the allocated buffers are retained. The resolver options are
+// preserved. Release must be called when the resolver is not needed
+// anymore, regardless of whether it has been reset.
+//
+// Reset is not thread-safe: it must not be called concurrently with
+// any other Resolver call, including in-flight resolution.
+func (r *Resolver) Reset(ctx context.Context, s SymbolsReader) {
+	r.Release()
+	for k, p := range r.p {
+		for _, m := range p.values {
+			for sid := range m {
+				delete(m, sid)
+			}
+			r.free = append(r.free, m)
+		}
+		delete(r.p, k)
+	}
+	r.s = s
+	r.init(ctx)
+}
+
 // AddSamples adds a collection of stack trace samples to the resolver.
-// Samples can be added to different partitions concurrently, but modification
-// of the same partition is not thread-safe.
+// Samples added to the same partition are merged before resolution:
+// values of identical stack traces are summed, so that each distinct
+// stack trace is only resolved once, regardless of how many calls it
+// has been added with.
+//
+// AddSamples and other AddSamples* methods are safe for concurrent use,
+// including calls that add samples to the same partition. Samples must
+// be added before the resolution starts: Tree, Profile, and the other
+// methods that resolve samples only observe the samples added before
+// the call.
 func (r *Resolver) AddSamples(partition uint64, s schemav1.Samples) {
-	p := r.Partition(partition)
+	r.AddSamplesWithValueIndex(partition, s, 0)
+}
+
+// AddSamplesRange adds the samples [start, end) of the collection to
+// the resolver; the range is clamped to the collection bounds. Adding
+// consecutive ranges covering the collection is equivalent to AddSamples
+// with the whole collection, which allows to resolve huge sample sets
+// in pages: with a new resolver per page, the trees can be merged as
+// they are resolved.
+func (r *Resolver) AddSamplesRange(partition uint64, s schemav1.Samples, start, end int) {
+	if n := len(s.StacktraceIDs); end > n {
+		end = n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start >= end {
+		return
+	}
+	r.AddSamples(partition, schemav1.Samples{
+		StacktraceIDs: s.StacktraceIDs[start:end],
+		Values:        s.Values[start:end],
+	})
+}
+
+func (r *Resolver) AddSamplesWithSpanSelector(partition uint64, s schemav1.Samples, spanSelector model.SpanSelector) {
+	p := r.partition(partition)
+	p.m.Lock()
+	defer p.m.Unlock()
+	for i, sid := range s.StacktraceIDs {
+		if _, ok := spanSelector[s.Spans[i]]; ok {
+			p.samples[sid] += r.value(s.Values[i])
+		}
+	}
+	if len(p.samples) > 0 {
+		r.acquire(p)
+	}
+}
+
+// AddSamplesWithFilter adds a collection of stack trace samples to the
+// resolver, skipping samples for which the filter returns false. The
+// filter is applied before symbols are resolved, so that the skipped
+// stack traces are never looked up.
+func (r *Resolver) AddSamplesWithFilter(partition uint64, s schemav1.Samples, filter func(stacktraceID uint32) bool) {
+	p := r.partition(partition)
+	p.m.Lock()
+	defer p.m.Unlock()
 	for i, sid := range s.StacktraceIDs {
+		if sid > 0 && filter(sid) {
+			p.samples[sid] += r.value(s.Values[i])
+		}
+	}
+	if len(p.samples) > 0 {
+		r.acquire(p)
+	}
+}
+
+// AddStacktraceIDs adds the values of the stack traces to the resolver:
+// values[i] is the value of ids[i]. The call is equivalent to AddSamples
+// with the samples of the stack traces, but does not require the caller
+// to construct schemav1.Samples; the sets can be added incrementally.
+// The slices must be of the same length, and are not retained.
+func (r *Resolver) AddStacktraceIDs(partition uint64, ids []uint32, values []int64) {
+	p := r.partition(partition)
+	p.m.Lock()
+	defer p.m.Unlock()
+	for i, sid := range ids {
 		if sid > 0 {
-			p[sid] += int64(s.Values[i])
+			p.samples[sid] += r.value(uint64(values[i]))
 		}
 	}
+	if len(p.samples) > 0 {
+		r.acquire(p)
+	}
 }
 
-func (r *Resolver) AddSamplesWithSpanSelector(partition uint64, s schemav1.Samples, spanSelector model.SpanSelector) {
-	p := r.Partition(partition)
+// AddSamplesWithValueIndex adds a collection of stack trace samples of
+// the value type valueIdx to the resolver. This allows to resolve samples
+// of multiple value types (e.g., alloc_objects, alloc_space, inuse_objects,
+// and inuse_space of a heap profile) in a single pass: Profile returns a
+// profile with a value per each type. AddSamples is equivalent to the call
+// with valueIdx 0.
+func (r *Resolver) AddSamplesWithValueIndex(partition uint64, s schemav1.Samples, valueIdx int) {
+	p := r.partition(partition)
+	p.m.Lock()
+	defer p.m.Unlock()
+	values := p.valuesOf(valueIdx)
 	for i, sid := range s.StacktraceIDs {
-		if _, ok := spanSelector[s.Spans[i]]; ok {
-			p[sid] += int64(s.Values[i])
+		if sid > 0 {
+			values[sid] += r.value(s.Values[i])
 		}
 	}
+	if len(values) > 0 {
+		r.acquire(p)
+	}
 }
 
 // Partition returns map of samples corresponding to the partition.
 // The function initializes symbols of the partition on the first occurrence.
-// The call is thread-safe, but access to the returned map is not.
+// The call is thread-safe, but access to the returned map is not:
+// it must not be modified concurrently with AddSamples calls.
 func (r *Resolver) Partition(partition uint64) map[uint32]int64 {
+	p := r.partition(partition)
+	r.acquire(p)
+	return p.samples
+}
+
+func (r *Resolver) partition(partition uint64) *lazyPartition {
 	r.m.Lock()
 	p, ok := r.p[partition]
 	if ok {
 		r.m.Unlock()
-		return p.samples
+		return p
 	}
 	p = &lazyPartition{
 		id:      partition,
-		samples: make(map[uint32]int64),
+		samples: r.samplesMap(),
 		err:     make(chan error),
 		done:    make(chan struct{}),
+		loaded:  make(chan struct{}),
 		reader:  make(chan PartitionReader, 1),
+
+		canceled: make(chan struct{}),
 	}
+	p.values = []map[uint32]int64{p.samples}
 	r.p[partition] = p
 	r.m.Unlock()
+	return p
+}
+
+// acquire starts loading the partition, unless it has been started
+// already. Partitions are only loaded once samples are added to them:
+// the symbols reader is not accessed for partitions with no samples.
+func (r *Resolver) acquire(p *lazyPartition) {
+	if !p.acquired.CompareAndSwap(false, true) {
+		return
+	}
 	r.g.Go(func() error {
 		return r.acquirePartition(p)
 	})
 	// r.g.Wait() is only called at Resolver.Release.
-	return p.samples
+}
+
+// samplesMap returns an empty samples map. Must be
+// called with the resolver mutex held.
+func (r *Resolver) samplesMap() map[uint32]int64 {
+	if n := len(r.free); n > 0 {
+		m := r.free[n-1]
+		r.free = r.free[:n-1]
+		return m
+	}
+	return make(map[uint32]int64)
+}
+
+func (p *lazyPartition) valuesOf(valueIdx int) map[uint32]int64 {
+	for len(p.values) <= valueIdx {
+		p.values = append(p.values, make(map[uint32]int64))
+	}
+	return p.values[valueIdx]
+}
+
+// removeZeroValues removes stack traces with zero
+// values of all the value types from the partition.
+func (p *lazyPartition) removeZeroValues() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for _, m := range p.values {
+		for sid, v := range m {
+			if v != 0 || !p.zeroValues(sid) {
+				continue
+			}
+			for _, x := range p.values {
+				delete(x, sid)
+			}
+		}
+	}
+}
+
+func (p *lazyPartition) zeroValues(sid uint32) bool {
+	for _, m := range p.values {
+		if m[sid] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// stacktraces returns the number of distinct stack traces.
+func (p *lazyPartition) stacktraces() int {
+	if len(p.values) == 1 {
+		return len(p.samples)
+	}
+	ids := make(map[uint32]struct{}, len(p.samples))
+	for _, m := range p.values {
+		for sid := range m {
+			ids[sid] = struct{}{}
+		}
+	}
+	return len(ids)
+}
+
+// multiValueSamples returns samples of all the value types
+// of the partition. Values of the resulting samples are
+// ordered by the value type index.
+func (p *lazyPartition) multiValueSamples() multiValueSamples {
+	if len(p.values) == 1 {
+		s := schemav1.NewSamplesFromMap(p.samples)
+		return multiValueSamples{
+			StacktraceIDs: s.StacktraceIDs,
+			Values:        [][]uint64{s.Values},
+		}
+	}
+	ids := make(map[uint32]struct{}, len(p.samples))
+	for _, m := range p.values {
+		for sid := range m {
+			ids[sid] = struct{}{}
+		}
+	}
+	s := multiValueSamples{
+		StacktraceIDs: make([]uint32, 0, len(ids)),
+		Values:        make([][]uint64, len(p.values)),
+	}
+	for sid := range ids {
+		s.StacktraceIDs = append(s.StacktraceIDs, sid)
+	}
+	sort.Slice(s.StacktraceIDs, func(i, j int) bool {
+		return s.StacktraceIDs[i] < s.StacktraceIDs[j]
+	})
+	for i, m := range p.values {
+		values := make([]uint64, len(s.StacktraceIDs))
+		for j, sid := range s.StacktraceIDs {
+			values[j] = uint64(m[sid])
+		}
+		s.Values[i] = values
+	}
+	return s
+}
+
+// multiValueSamples is similar to schemav1.Samples, but
+// carries values of multiple types: Values[t][i] is the
+// value of the type t of the stack trace StacktraceIDs[i].
+type multiValueSamples struct {
+	StacktraceIDs []uint32
+	Values        [][]uint64
 }
 
 func (r *Resolver) acquirePartition(p *lazyPartition) error {
-	pr, err := r.s.Partition(r.ctx, p.id)
+	start := time.Now()
+	pr, err := r.loadPartition(p.id)
+	p.loadErr = err
+	close(p.loaded)
 	if err != nil {
 		r.span.LogFields(log.String("err", err.Error()))
 		select {
@@ -128,17 +651,34 @@ func (r *Resolver) acquirePartition(p *lazyPartition) error {
 			// Signal the partition receiver
 			// about the failure, so it won't
 			// block and return early.
+			if r.bestEffort {
+				// Other partitions must not be canceled.
+				return nil
+			}
 			return err
 		}
 	}
+	p.loadDuration = time.Since(start)
 	// We've acquired the partition and must release it
 	// once resolution finished or canceled.
 	select {
 	case p.reader <- pr:
 		// We transferred ownership to the recipient,
 		// which is now responsible for releasing the
-		// partition.
-		<-p.done
+		// partition. If the resolver is released before
+		// the partition is received, we still own it.
+		select {
+		case <-p.done:
+		case <-r.ctx.Done():
+		}
+		select {
+		case pr = <-p.reader:
+			// The recipient has not received the partition,
+			// e.g., resolution has been aborted: we still
+			// own the partition.
+			pr.Release()
+		default:
+		}
 	case <-r.ctx.Done():
 		// We still own the partition and must release
 		// it on our own. It's guaranteed that p.c receiver
@@ -152,10 +692,41 @@ func (r *Resolver) acquirePartition(p *lazyPartition) error {
 func (r *Resolver) Tree() (*model.Tree, error) {
 	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.Tree")
 	defer span.Finish()
+	if r.rootLabel != "" {
+		return r.rootLabelTree(ctx, 1)
+	}
+	var lock sync.Mutex
+	depths := new(DepthHistogram)
+	budget := r.newTimeBudget()
+	tree, err := r.buildTree(ctx, func(symbols *Symbols, _ *lazyPartition, samples schemav1.Samples) (*model.Tree, error) {
+		resolved, h, err := budget.tree(ctx, symbols, samples)
+		if err != nil {
+			return nil, err
+		}
+		lock.Lock()
+		depths.merge(h)
+		lock.Unlock()
+		return resolved, nil
+	})
+	r.m.Lock()
+	r.depths = depths
+	r.approximate = budget.exceeded.Load()
+	r.m.Unlock()
+	return tree, err
+}
+
+// partitionTreeFunc resolves the tree of the partition samples
+// of the value type selected with WithTreeValueIndex.
+type partitionTreeFunc func(symbols *Symbols, p *lazyPartition, samples schemav1.Samples) (*model.Tree, error)
+
+// buildTree merges the trees of the partitions resolved with fn, and
+// the tree given to MergeTreeProfiles. Then, the rate, the limit of
+// the children, and the cumulative values are applied, in that order.
+func (r *Resolver) buildTree(ctx context.Context, fn partitionTreeFunc) (*model.Tree, error) {
 	var lock sync.Mutex
 	tree := new(model.Tree)
-	err := r.withSymbols(ctx, func(symbols *Symbols, samples schemav1.Samples) error {
-		resolved, err := symbols.Tree(ctx, samples)
+	err := r.withPartitionSymbols(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		resolved, err := fn(symbols, p, p.valueSamples(r.treeValueIdx))
 		if err != nil {
 			return err
 		}
@@ -164,65 +735,276 @@ func (r *Resolver) Tree() (*model.Tree, error) {
 		lock.Unlock()
 		return nil
 	})
+	r.m.Lock()
+	if r.external != nil {
+		tree.Merge(r.external)
+	}
+	r.m.Unlock()
+	if r.rate > 0 {
+		tree.TransformSelfValues(r.perSecond)
+	}
+	tree.LimitChildren(r.maxChildren)
+	if r.cumulative {
+		tree.MakeCumulative()
+	}
 	return tree, err
 }
 
+// Flamegraph resolves the samples and builds a flame graph,
+// limited to maxNodes nodes: the nodes that do not fit are
+// truncated into "other" nodes. Flamegraph shares the symbol
+// resolution with Tree, therefore the stack traces are
+// identical to those of the tree.
+func (r *Resolver) Flamegraph(maxNodes int64) (*querierv1.FlameGraph, error) {
+	span, _ := opentracing.StartSpanFromContext(r.ctx, "Resolver.Flamegraph")
+	defer span.Finish()
+	tree, err := r.Tree()
+	if err != nil && !IsPartialResult(err) {
+		return nil, err
+	}
+	return model.NewFlameGraph(tree, maxNodes), err
+}
+
 func (r *Resolver) Profile() (*profile.Profile, error) {
 	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.Profile")
 	defer span.Finish()
+	if r.contention {
+		r.withContentionValues()
+	}
 	var lock sync.Mutex
 	profiles := make([]*profile.Profile, 0, len(r.p))
-	err := r.withSymbols(ctx, func(symbols *Symbols, samples schemav1.Samples) error {
-		resolved, err := symbols.Profile(ctx, samples)
+	err := r.withPartitionSymbols(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		samples := p.multiValueSamples()
+		resolved, err := symbols.profile(ctx, samples)
 		if err != nil {
 			return err
 		}
+		var groups []sampleGroup
+		if r.sampleLabels {
+			groups = append(groups, p.labelGroups()...)
+		}
+		if r.sampleTimestamps {
+			groups = append(groups, p.timestampGroups()...)
+		}
+		splitSamples(resolved, samples.StacktraceIDs, groups)
 		lock.Lock()
 		profiles = append(profiles, resolved)
 		lock.Unlock()
 		return nil
 	})
-	if err != nil {
+	if err != nil && !IsPartialResult(err) {
 		return nil, err
 	}
-	return profile.Merge(profiles)
+	merged, mergeErr := MergeProfiles(profiles...)
+	if mergeErr != nil {
+		return nil, mergeErr
+	}
+	if r.locationDedup {
+		merged = dedupLocations(merged)
+	}
+	merged.Comments = append(merged.Comments, r.comments...)
+	if r.contention {
+		meta := ContentionProfileMeta()
+		if err := meta.apply(merged); err != nil {
+			return nil, err
+		}
+	}
+	if r.rate > 0 {
+		for _, s := range merged.Sample {
+			for i, v := range s.Value {
+				s.Value[i] = r.perSecond(v)
+			}
+		}
+	}
+	return merged, err
 }
 
 func (r *Resolver) withSymbols(ctx context.Context, fn func(*Symbols, schemav1.Samples) error) error {
+	return r.withPartitionSymbols(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		return fn(symbols, schemav1.NewSamplesFromMap(p.samples))
+	})
+}
+
+func (r *Resolver) withPartitionSymbols(ctx context.Context, fn func(*Symbols, *lazyPartition) error) error {
+	if r.locationsOnly {
+		// Partition symbols might lack mappings,
+		// functions, and strings.
+		return ErrLocationsOnly
+	}
+	return r.withPartitions(ctx, fn)
+}
+
+// withPartitions calls fn for each of the partitions, regardless of
+// the symbols loaded, see withPartitionSymbols.
+func (r *Resolver) withPartitions(ctx context.Context, fn func(*Symbols, *lazyPartition) error) error {
+	parent := ctx
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(r.c)
+	if r.skipZeroValues {
+		for _, p := range r.p {
+			p.removeZeroValues()
+		}
+	}
+	if r.progress != nil {
+		var total int
+		for _, p := range r.p {
+			total += p.stacktraces()
+		}
+		r.progress.reset(uint64(total))
+	}
+	// Partitions are resolved with the soft deadline, if any:
+	// the group context is only canceled on the first error.
+	pctx := ctx
+	if r.softDeadline > 0 {
+		var cancel context.CancelFunc
+		pctx, cancel = context.WithTimeout(ctx, r.softDeadline)
+		defer cancel()
+	}
+	var errs partitionErrors
 	for _, p := range r.p {
 		p := p
+		if p.stacktraces() == 0 {
+			// The partition is never accessed.
+			continue
+		}
+		r.acquire(p)
 		g.Go(func() error {
-			defer close(p.done)
-			select {
-			case err := <-p.err:
+			cctx, cancel := p.withCancel(pctx)
+			defer cancel()
+			err := r.resolvePartition(cctx, p, fn)
+			if err != nil && pctx != ctx && pctx.Err() != nil && ctx.Err() == nil {
+				errs.add(p.id, ErrSoftDeadlineExceeded)
+				return nil
+			}
+			if err != nil && p.isCanceled() && pctx.Err() == nil {
+				if !r.bestEffort {
+					return &PartitionError{Partition: p.id, Err: ErrPartitionCanceled}
+				}
+				errs.add(p.id, ErrPartitionCanceled)
+				return nil
+			}
+			if err == nil || !r.bestEffort || ctx.Err() != nil || isLimitError(err) {
 				return err
-			case <-ctx.Done():
-				return ctx.Err()
-			case pr := <-p.reader:
-				defer pr.Release()
-				return fn(pr.Symbols(), schemav1.NewSamplesFromMap(p.samples))
 			}
+			errs.add(p.id, err)
+			return nil
 		})
 	}
-	return g.Wait()
+	if err := g.Wait(); err != nil {
+		return r.canceled(parent, err)
+	}
+	return errs.err()
+}
+
+// isLimitError reports whether the error is caused by
+// one of the resolver limits, which apply regardless of
+// the best-effort mode.
+func isLimitError(err error) bool {
+	return errors.Is(err, ErrStacktracesLimitExceeded) || errors.Is(err, ErrMemoryLimitExceeded)
+}
+
+func (r *Resolver) resolvePartition(ctx context.Context, p *lazyPartition, fn func(*Symbols, *lazyPartition) error) error {
+	defer close(p.done)
+	if err := r.checkStacktracesLimit(p); err != nil {
+		return err
+	}
+	if p.isCanceled() {
+		return ErrPartitionCanceled
+	}
+	select {
+	case err := <-p.err:
+		return err
+	case <-p.canceled:
+		return ErrPartitionCanceled
+	case <-ctx.Done():
+		return ctx.Err()
+	case pr := <-p.reader:
+		defer pr.Release()
+		symbols := pr.Symbols()
+		defer r.observePartition(p, pr, symbols, time.Now())
+		symbols = withDemangledNames(symbols, r.demangle)
+		symbols = withNormalizedNames(symbols, r.nameNormalizer)
+		symbols = withTruncatedNames(symbols, r.maxNameLength)
+		symbols = withCollapsedInlining(symbols, r.inlining)
+		symbols = withSymbolDetail(symbols, r.symbolDetail)
+		if r.lineGranularity {
+			symbols = withLineGranularity(symbols)
+		}
+		if r.interner != nil {
+			symbols = r.interner.withInternedStrings(symbols)
+		}
+		if r.cache != nil {
+			symbols = r.cache.withCache(p.id, symbols)
+		}
+		if r.memo != nil {
+			symbols = r.memo.withCache(p.id, symbols)
+		}
+		if r.mappingFilter != nil {
+			// The filter must not affect the cached stack traces.
+			symbols = r.mappingFilter.withMappingFilter(symbols)
+		}
+		if r.functionFilter != nil {
+			symbols = r.functionFilter.withFunctionFilter(symbols)
+		}
+		if r.canonicalize {
+			symbols = withCanonicalLocations(symbols)
+		}
+		if r.recursionFolding {
+			symbols = withRecursionFolding(symbols)
+		}
+		if r.memoryLimit > 0 {
+			var err error
+			if symbols, err = r.withMemoryLimit(p.id, symbols); err != nil {
+				return err
+			}
+		}
+		if r.progress != nil {
+			symbols = r.progress.withProgress(symbols)
+		}
+		return fn(symbols, p)
+	}
+}
+
+func (r *Resolver) checkStacktracesLimit(p *lazyPartition) error {
+	if r.maxStacktraces <= 0 {
+		return nil
+	}
+	n := r.stacktraces.Add(int64(p.stacktraces()))
+	if n > r.maxStacktraces {
+		return &StacktracesLimitError{
+			Partition:   p.id,
+			Stacktraces: n,
+			Limit:       r.maxStacktraces,
+		}
+	}
+	return nil
 }
 
 func (r *Symbols) Tree(ctx context.Context, samples schemav1.Samples) (*model.Tree, error) {
+	return r.tree(ctx, samples, 0, nil)
+}
+
+// tree builds a tree of the samples. If depths is not nil,
+// depths of the stack traces are observed in the same pass.
+func (r *Symbols) tree(ctx context.Context, samples schemav1.Samples, minValue int64, depths *DepthHistogram) (*model.Tree, error) {
+	if minValue > 0 {
+		return r.truncatedTree(ctx, samples, minValue, depths)
+	}
 	t := treeSymbolsFromPool()
 	defer t.reset()
 	t.init(r, samples)
+	t.depths = depths
 	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, t, samples.StacktraceIDs); err != nil {
 		return nil, err
 	}
-	return t.tree, nil
+	return t.tree.Build(), nil
 }
 
 type treeSymbols struct {
 	symbols *Symbols
 	samples *schemav1.Samples
-	tree    *model.Tree
+	tree    TreeBuilder
+	depths  *DepthHistogram
 	lines   []string
 	cur     int
 }
@@ -238,7 +1020,8 @@ func treeSymbolsFromPool() *treeSymbols {
 func (r *treeSymbols) reset() {
 	r.symbols = nil
 	r.samples = nil
-	r.tree = nil
+	r.tree = TreeBuilder{}
+	r.depths = nil
 	r.lines = r.lines[:0]
 	r.cur = 0
 	treeSymbolsPool.Put(r)
@@ -247,23 +1030,80 @@ func (r *treeSymbols) reset() {
 func (r *treeSymbols) init(symbols *Symbols, samples schemav1.Samples) {
 	r.symbols = symbols
 	r.samples = &samples
-	r.tree = new(model.Tree)
 }
 
 func (r *treeSymbols) InsertStacktrace(_ uint32, locations []int32) {
-	r.lines = r.lines[:0]
+	r.lines = r.symbols.appendFunctionNames(r.lines[:0], locations)
+	v := int64(r.samples.Values[r.cur])
+	r.tree.Insert(r.lines, v)
+	if r.depths != nil {
+		r.depths.observe(r.lines, v)
+	}
+	r.cur++
+}
+
+// appendFunctionNames appends names of the functions of the
+// stack trace locations to dst, from the root to the leaf.
+// Inlined functions are included.
+func (r *Symbols) appendFunctionNames(dst []string, locations []int32) []string {
 	for i := len(locations) - 1; i >= 0; i-- {
-		lines := r.symbols.Locations[locations[i]].Line
-		for j := len(lines) - 1; j >= 0; j-- {
-			f := r.symbols.Functions[lines[j].FunctionId]
-			r.lines = append(r.lines, r.symbols.Strings[f.Name])
+		loc := r.Locations[locations[i]]
+		if len(loc.Line) == 0 {
+			dst = append(dst, r.unsymbolizedName(loc))
+			continue
+		}
+		for j := len(loc.Line) - 1; j >= 0; j-- {
+			name := r.functionName(loc.Line[j].FunctionId)
+			if name == "" {
+				name = r.unsymbolizedName(loc)
+			}
+			dst = append(dst, name)
 		}
 	}
-	r.tree.InsertStack(int64(r.samples.Values[r.cur]), r.lines...)
-	r.cur++
+	return dst
+}
+
+func (r *Symbols) functionName(id uint32) string {
+	if int(id) < len(r.Functions) {
+		return r.Strings[r.Functions[id].Name]
+	}
+	return ""
+}
+
+// unsymbolizedName returns the name of the location that has no
+// function info, see formatUnsymbolized.
+func (r *Symbols) unsymbolizedName(loc *schemav1.InMemoryLocation) string {
+	if int(loc.MappingId) < len(r.Mappings) {
+		m := r.Mappings[loc.MappingId]
+		return formatUnsymbolized(r.Strings[m.Filename], m.MemoryStart, m.MemoryLimit, m.FileOffset, loc.Address)
+	}
+	return formatUnsymbolized("", 0, 0, 0, loc.Address)
+}
+
+// formatUnsymbolized returns the name of the location that has no
+// function info, in the form of "mapping+0x1234": the base name of
+// the mapping file, and the offset of the address in the file. If
+// the mapping is not known, i.e., has no limit, the address is used
+// as the offset.
+func formatUnsymbolized(file string, start, limit, offset, addr uint64) string {
+	name := unknownMappingName
+	if file != "" {
+		name = path.Base(file)
+	}
+	if limit > 0 && addr >= start {
+		addr = addr - start + offset
+	}
+	return name + "+0x" + strconv.FormatUint(addr, 16)
 }
 
 func (r *Symbols) Profile(ctx context.Context, samples schemav1.Samples) (*profile.Profile, error) {
+	return r.profile(ctx, multiValueSamples{
+		StacktraceIDs: samples.StacktraceIDs,
+		Values:        [][]uint64{samples.Values},
+	})
+}
+
+func (r *Symbols) profile(ctx context.Context, samples multiValueSamples) (*profile.Profile, error) {
 	t := pprofResolveFromPool()
 	defer t.reset()
 	t.init(r, samples)
@@ -277,7 +1117,7 @@ func (r *Symbols) Profile(ctx context.Context, samples schemav1.Samples) (*profi
 type pprofSymbols struct {
 	profile *profile.Profile
 	symbols *Symbols
-	samples *schemav1.Samples
+	samples *multiValueSamples
 	cur     int
 
 	locations []*profile.Location
@@ -304,7 +1144,7 @@ func (r *pprofSymbols) reset() {
 	pprofSymbolsPool.Put(r)
 }
 
-func (r *pprofSymbols) init(symbols *Symbols, samples schemav1.Samples) {
+func (r *pprofSymbols) init(symbols *Symbols, samples multiValueSamples) {
 	r.symbols = symbols
 	r.samples = &samples
 	r.profile = &profile.Profile{
@@ -334,7 +1174,10 @@ func clear[T any](s []T) {
 func (r *pprofSymbols) InsertStacktrace(_ uint32, locations []int32) {
 	sample := &profile.Sample{
 		Location: make([]*profile.Location, len(locations)),
-		Value:    []int64{int64(r.samples.Values[r.cur])},
+		Value:    make([]int64, len(r.samples.Values)),
+	}
+	for i, values := range r.samples.Values {
+		sample.Value[i] = int64(values[r.cur])
 	}
 	for j, loc := range locations {
 		sample.Location[j] = r.location(loc)
@@ -0,0 +1,44 @@
+package symdb
+
+import (
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// AggregateBy resolves the samples and returns the total value of the
+// stack traces by the key: keyFn is called once for each of the
+// distinct stack traces of a partition with the resolved frames,
+// ordered from the leaf to the root, see Symbols.ResolveFrames. The
+// sum of the values equals the total value of the samples.
+//
+// The frames slice is reused between the calls, and keyFn may be
+// called concurrently for stack traces of different partitions.
+func (r *Resolver) AggregateBy(keyFn func(frames []Frame) string) (map[string]int64, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.AggregateBy")
+	defer span.Finish()
+	var lock sync.Mutex
+	result := make(map[string]int64)
+	err := r.withPartitionSymbols(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		samples := schemav1.NewSamplesFromMap(p.samples)
+		keys := make(map[string]int64)
+		err := symbols.ResolveFrames(ctx, samples.StacktraceIDs, func(sid uint32, frames []Frame) {
+			keys[keyFn(frames)] += p.samples[sid]
+		})
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for k, v := range keys {
+			result[k] += v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
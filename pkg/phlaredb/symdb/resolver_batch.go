@@ -0,0 +1,84 @@
+package symdb
+
+import (
+	"context"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/grafana/pyroscope/pkg/model"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// LabeledSamples is a sample set of a batch. Sample sets of the
+// same label are resolved into the same tree.
+type LabeledSamples struct {
+	Label     string
+	Partition uint64
+	Samples   schemav1.Samples
+}
+
+// BatchResolver resolves multiple independent sample sets at once:
+// each partition is loaded once for the whole batch, and stack traces
+// shared by the sample sets are only resolved once. Similarly to
+// Resolver, a BatchResolver can only be used once.
+type BatchResolver struct {
+	r *Resolver
+}
+
+// NewBatchResolver creates a new batch resolver. The options are
+// applied to the underlying Resolver; WithMinValue is not applied
+// to the trees.
+func NewBatchResolver(ctx context.Context, s SymbolsReader, opts ...ResolverOption) *BatchResolver {
+	return &BatchResolver{r: NewResolver(ctx, s, opts...)}
+}
+
+func (b *BatchResolver) Release() { b.r.Release() }
+
+// Trees resolves the sample sets and returns a tree per each of the
+// labels. A sample set may only refer to a single partition, but
+// several sets of the same label may refer to different partitions.
+func (b *BatchResolver) Trees(sets []LabeledSamples) (map[string]*model.Tree, error) {
+	span, ctx := opentracing.StartSpanFromContext(b.r.ctx, "BatchResolver.Trees")
+	defer span.Finish()
+	// Each label is represented by a distinct value type.
+	var labels []string
+	columns := make(map[string]int)
+	for _, s := range sets {
+		c, ok := columns[s.Label]
+		if !ok {
+			c = len(labels)
+			columns[s.Label] = c
+			labels = append(labels, s.Label)
+		}
+		b.r.AddSamplesWithValueIndex(s.Partition, s.Samples, c)
+	}
+	var lock sync.Mutex
+	trees := make(map[string]*model.Tree, len(labels))
+	err := b.r.withPartitionSymbols(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		resolved, err := symbols.trees(ctx, p.multiValueSamples())
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for i, tree := range resolved {
+			if t, ok := trees[labels[i]]; ok {
+				t.Merge(tree)
+				continue
+			}
+			trees[labels[i]] = tree
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Labels with no samples resolved get an empty tree.
+	for _, l := range labels {
+		if _, ok := trees[l]; !ok {
+			trees[l] = new(model.Tree)
+		}
+	}
+	return trees, nil
+}
@@ -0,0 +1,92 @@
+package symdb
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/pyroscope/pkg/model"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// WithTimeBudget specifies the time budget of Tree: the partitions
+// that are not resolved exactly within the duration are resolved
+// approximately instead, as TreeSampled does with the fallback rate.
+// In contrast to WithSoftDeadline, no partition is skipped, and the
+// tree is valid and complete, but the values of the partitions resolved
+// with sampling are estimates: Approximate reports whether the budget
+// has been exceeded.
+//
+// The budget is measured from the start of the Tree call and only
+// covers the exact resolution: the sampled resolution is not limited,
+// and it may only start once the partition is loaded. Therefore, Tree
+// may take longer than the budget, by the time needed to load the
+// partitions and to resolve the sampled stack traces. The budget does
+// not apply to the trees built with WithRootLabel.
+//
+// The fallback rate must be in the range (0, 1]; otherwise, the
+// option is ignored.
+func WithTimeBudget(d time.Duration, fallbackRate float64) ResolverOption {
+	return func(r *Resolver) {
+		if fallbackRate > 0 && fallbackRate <= 1 {
+			r.timeBudget = d
+			r.fallbackRate = fallbackRate
+		}
+	}
+}
+
+// Approximate reports whether the last tree is approximate: the time
+// budget has been exceeded, and some of the partitions have been
+// resolved with sampling. Approximate returns false, if Tree has
+// not been called.
+func (r *Resolver) Approximate() bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.approximate
+}
+
+type timeBudget struct {
+	resolver *Resolver
+	deadline time.Time
+	exceeded atomic.Bool
+}
+
+func (r *Resolver) newTimeBudget() *timeBudget {
+	b := &timeBudget{resolver: r}
+	if r.timeBudget > 0 {
+		b.deadline = time.Now().Add(r.timeBudget)
+	}
+	return b
+}
+
+// tree resolves the samples exactly within the budget,
+// and falls back to sampling once the budget is exceeded.
+func (b *timeBudget) tree(ctx context.Context, symbols *Symbols, samples schemav1.Samples) (*model.Tree, *DepthHistogram, error) {
+	r := b.resolver
+	h := new(DepthHistogram)
+	if b.deadline.IsZero() {
+		resolved, err := symbols.tree(ctx, samples, r.minValue, h)
+		return resolved, h, err
+	}
+	if time.Now().Before(b.deadline) {
+		// The samples are retained for the fallback: the
+		// stack trace resolver may modify the identifiers.
+		exact := schemav1.Samples{
+			StacktraceIDs: append([]uint32(nil), samples.StacktraceIDs...),
+			Values:        samples.Values,
+		}
+		bctx, cancel := context.WithDeadline(ctx, b.deadline)
+		resolved, err := symbols.tree(bctx, exact, r.minValue, h)
+		cancel()
+		if err == nil || ctx.Err() != nil || bctx.Err() == nil {
+			return resolved, h, err
+		}
+		h = new(DepthHistogram)
+	}
+	b.exceeded.Store(true)
+	rnd := rand.New(rand.NewSource(rand.Int63()))
+	samples = sampleStacktraces(samples, r.fallbackRate, rnd)
+	resolved, err := symbols.tree(ctx, samples, r.minValue, h)
+	return resolved, h, err
+}
@@ -0,0 +1,84 @@
+package symdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opentracing/opentracing-go"
+)
+
+// Compression of the serialized profile, see Resolver.Bytes.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+type compressor interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+var (
+	profileBufferPool = sync.Pool{
+		New: func() any { return new(bytes.Buffer) },
+	}
+	gzipCompressorPool = sync.Pool{
+		New: func() any { return gzip.NewWriter(nil) },
+	}
+	zstdCompressorPool = sync.Pool{
+		New: func() any {
+			// The options are valid, therefore the error is always nil.
+			e, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+			return e
+		},
+	}
+)
+
+// Bytes resolves the samples and returns the profile in the pprof
+// format, compressed as specified: the profile is written the same
+// way as WriteProfile writes it, with the metadata populated. Buffers
+// and compressors are reused across calls, and the returned slice is
+// owned by the caller.
+func (r *Resolver) Bytes(ctx context.Context, meta ProfileMeta, c Compression) ([]byte, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Resolver.Bytes")
+	defer span.Finish()
+	var pool *sync.Pool
+	switch c {
+	case CompressionNone:
+	case CompressionGzip:
+		pool = &gzipCompressorPool
+	case CompressionZstd:
+		pool = &zstdCompressorPool
+	default:
+		return nil, fmt.Errorf("unknown compression: %d", c)
+	}
+	buf := profileBufferPool.Get().(*bytes.Buffer)
+	defer profileBufferPool.Put(buf)
+	buf.Reset()
+	if pool == nil {
+		if err := r.writeProfile(ctx, buf, meta); err != nil {
+			return nil, err
+		}
+	} else {
+		w := pool.Get().(compressor)
+		defer pool.Put(w)
+		w.Reset(buf)
+		if err := r.writeProfile(ctx, w, meta); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	}
+	b := make([]byte, buf.Len())
+	copy(b, buf.Bytes())
+	return b, nil
+}
@@ -0,0 +1,227 @@
+package symdb
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+type CallGraphOptions struct {
+	// NodeThreshold specifies the minimum total value of a node.
+	// Nodes with a lower total value are omitted along with their
+	// edges.
+	NodeThreshold int64
+	// EdgeThreshold specifies the minimum value of an edge.
+	EdgeThreshold int64
+}
+
+// CallGraph writes the call graph of the resolved stack traces to w
+// in the Graphviz DOT format, similarly to `pprof -dot`. Nodes of the
+// graph are functions, aggregated by name, and edges connect callers
+// with callees. The value of an edge is the total value of the samples
+// where the caller calls the callee directly. A sample is accounted
+// once per node and per edge, therefore, in the absence of recursion,
+// the node total value equals the sum of its self value and outgoing
+// edges; for functions that never appear at the root of a stack trace,
+// it also equals the sum of incoming edges.
+func (r *Resolver) CallGraph(w io.Writer, opts CallGraphOptions) error {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.CallGraph")
+	defer span.Finish()
+	g := newCallGraph()
+	err := r.withSymbols(ctx, func(symbols *Symbols, samples schemav1.Samples) error {
+		x, err := symbols.callGraph(ctx, samples)
+		if err != nil {
+			return err
+		}
+		g.merge(x)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return g.writeDOT(w, opts)
+}
+
+type callGraphNode struct {
+	self  int64
+	total int64
+	// Index of the last sample the node
+	// was accounted in, plus one.
+	sample int
+}
+
+type callGraphEdge struct {
+	value  int64
+	sample int
+}
+
+type callGraphEdgeKey struct {
+	caller string
+	callee string
+}
+
+type callGraph struct {
+	m     sync.Mutex
+	nodes map[string]*callGraphNode
+	edges map[callGraphEdgeKey]*callGraphEdge
+	total int64
+}
+
+func newCallGraph() *callGraph {
+	return &callGraph{
+		nodes: make(map[string]*callGraphNode),
+		edges: make(map[callGraphEdgeKey]*callGraphEdge),
+	}
+}
+
+func (g *callGraph) merge(x *callGraph) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.total += x.total
+	for name, n := range x.nodes {
+		if e, ok := g.nodes[name]; ok {
+			e.self += n.self
+			e.total += n.total
+			continue
+		}
+		g.nodes[name] = n
+	}
+	for k, v := range x.edges {
+		if e, ok := g.edges[k]; ok {
+			e.value += v.value
+			continue
+		}
+		g.edges[k] = v
+	}
+}
+
+func (g *callGraph) writeDOT(w io.Writer, opts CallGraphOptions) error {
+	names := make([]string, 0, len(g.nodes))
+	for name, n := range g.nodes {
+		if n.total >= opts.NodeThreshold {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := g.nodes[names[i]], g.nodes[names[j]]
+		if a.total != b.total {
+			return a.total > b.total
+		}
+		return names[i] < names[j]
+	})
+	ids := make(map[string]int, len(names))
+	for i, name := range names {
+		ids[name] = i + 1
+	}
+	edges := make([]callGraphEdgeKey, 0, len(g.edges))
+	for k, e := range g.edges {
+		_, caller := ids[k.caller]
+		_, callee := ids[k.callee]
+		if caller && callee && e.value >= opts.EdgeThreshold {
+			edges = append(edges, k)
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		a, b := g.edges[edges[i]], g.edges[edges[j]]
+		if a.value != b.value {
+			return a.value > b.value
+		}
+		if x, y := ids[edges[i].caller], ids[edges[j].caller]; x != y {
+			return x < y
+		}
+		return ids[edges[i].callee] < ids[edges[j].callee]
+	})
+
+	bw := bufio.NewWriter(w)
+	_, _ = fmt.Fprintln(bw, `digraph "callgraph" {`)
+	_, _ = fmt.Fprintln(bw, `node [shape=box style=filled fillcolor="#f8f8f8"]`)
+	for i, name := range names {
+		n := g.nodes[name]
+		_, _ = fmt.Fprintf(bw, "N%d [label=\"%s\\n%d (%s)\\nof %d (%s)\"]\n",
+			i+1, dotEscape(name), n.self, g.percent(n.self), n.total, g.percent(n.total))
+	}
+	for _, k := range edges {
+		e := g.edges[k]
+		_, _ = fmt.Fprintf(bw, "N%d -> N%d [label=\" %d\" weight=%d]\n",
+			ids[k.caller], ids[k.callee], e.value, e.value)
+	}
+	_, _ = fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+func (g *callGraph) percent(v int64) string {
+	if g.total == 0 {
+		return "0.00%"
+	}
+	return fmt.Sprintf("%.2f%%", float64(v)/float64(g.total)*100)
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func dotEscape(s string) string { return dotEscaper.Replace(s) }
+
+func (r *Symbols) callGraph(ctx context.Context, samples schemav1.Samples) (*callGraph, error) {
+	c := &callGraphSymbols{
+		symbols: r,
+		samples: &samples,
+		graph:   newCallGraph(),
+	}
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, c, samples.StacktraceIDs); err != nil {
+		return nil, err
+	}
+	return c.graph, nil
+}
+
+type callGraphSymbols struct {
+	symbols *Symbols
+	samples *schemav1.Samples
+	graph   *callGraph
+	names   []string
+	cur     int
+}
+
+func (r *callGraphSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	v := int64(r.samples.Values[r.cur])
+	r.cur++
+	if v == 0 {
+		return
+	}
+	g := r.graph
+	g.total += v
+	r.names = r.symbols.appendFunctionNames(r.names[:0], locations)
+	for i, name := range r.names {
+		n, ok := g.nodes[name]
+		if !ok {
+			n = new(callGraphNode)
+			g.nodes[name] = n
+		}
+		if i == len(r.names)-1 {
+			n.self += v
+		}
+		if n.sample != r.cur {
+			n.sample = r.cur
+			n.total += v
+		}
+		if i == 0 {
+			continue
+		}
+		k := callGraphEdgeKey{caller: r.names[i-1], callee: name}
+		e, ok := g.edges[k]
+		if !ok {
+			e = new(callGraphEdge)
+			g.edges[k] = e
+		}
+		if e.sample != r.cur {
+			e.sample = r.cur
+			e.value += v
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package symdb
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// WithCanonicalLocations specifies that locations referring to the same
+// functions and lines are resolved as a single location, regardless of
+// their addresses: stack traces refer to the location of the partition
+// that comes first, therefore the result is deterministic. Trees merge
+// such frames regardless, as nodes are identified by function names,
+// but profiles returned by Profile, and the other location-based
+// results, contain fewer locations. Locations without lines are not
+// affected. In contrast to WithLocationDedup, the canonicalization
+// takes place before the symbols are resolved.
+func WithCanonicalLocations() ResolverOption {
+	return func(r *Resolver) {
+		r.canonicalize = true
+	}
+}
+
+// withCanonicalLocations returns symbols that resolve stack traces
+// with the locations replaced by their canonical counterparts.
+func withCanonicalLocations(s *Symbols) *Symbols {
+	if len(s.Locations) == 0 {
+		return s
+	}
+	var b strings.Builder
+	seen := make(map[string]int32, len(s.Locations))
+	canonical := make([]int32, len(s.Locations))
+	var remapped bool
+	for i, loc := range s.Locations {
+		canonical[i] = int32(i)
+		if len(loc.Line) == 0 {
+			continue
+		}
+		b.Reset()
+		for _, line := range loc.Line {
+			b.WriteString(strconv.FormatUint(uint64(line.FunctionId), 16))
+			b.WriteByte(':')
+			b.WriteString(strconv.FormatInt(int64(line.Line), 16))
+			b.WriteByte(';')
+		}
+		k := b.String()
+		if x, ok := seen[k]; ok {
+			canonical[i] = x
+			remapped = true
+			continue
+		}
+		seen[k] = int32(i)
+	}
+	if !remapped {
+		return s
+	}
+	x := *s
+	x.Stacktraces = &canonicalStacktraceResolver{
+		StacktraceResolver: s.Stacktraces,
+		canonical:          canonical,
+	}
+	return &x
+}
+
+type canonicalStacktraceResolver struct {
+	StacktraceResolver
+	canonical []int32
+}
+
+func (r *canonicalStacktraceResolver) ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) error {
+	return r.StacktraceResolver.ResolveStacktraceLocations(ctx, &canonicalInserter{
+		StacktraceInserter: dst,
+		canonical:          r.canonical,
+	}, stacktraces)
+}
+
+type canonicalInserter struct {
+	StacktraceInserter
+	canonical []int32
+	locations []int32
+}
+
+func (i *canonicalInserter) InsertStacktrace(stacktraceID uint32, locations []int32) {
+	i.locations = i.locations[:0]
+	for _, loc := range locations {
+		i.locations = append(i.locations, i.canonical[loc])
+	}
+	i.StacktraceInserter.InsertStacktrace(stacktraceID, i.locations)
+}
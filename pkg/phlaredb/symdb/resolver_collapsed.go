@@ -0,0 +1,98 @@
+package symdb
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// Collapsed writes resolved stack traces to w in the collapsed
+// (folded) format: function names are joined with semicolons,
+// from the root to the leaf, followed by the sample value:
+//
+//	main;foo;bar 42
+//
+// Each distinct stack trace is resolved once and written as soon
+// as it is resolved, therefore the output is not sorted, and the
+// same stack may appear more than once, if it is present in
+// multiple partitions, or its locations differ only by address.
+// Consumers of the format are expected to sum up such lines.
+func (r *Resolver) Collapsed(w io.Writer) error {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.Collapsed")
+	defer span.Finish()
+	cw := &collapsedWriter{w: w}
+	return r.withSymbols(ctx, func(symbols *Symbols, samples schemav1.Samples) error {
+		return symbols.Collapsed(ctx, samples, cw)
+	})
+}
+
+// collapsedWriter serializes writes of multiple partitions.
+type collapsedWriter struct {
+	m   sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func (w *collapsedWriter) write(b []byte) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+	return w.err
+}
+
+func (r *Symbols) Collapsed(ctx context.Context, samples schemav1.Samples, w *collapsedWriter) error {
+	c := &collapsedSymbols{
+		ctx:     ctx,
+		symbols: r,
+		samples: &samples,
+		w:       w,
+	}
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, c, samples.StacktraceIDs); err != nil {
+		return err
+	}
+	return c.err
+}
+
+type collapsedSymbols struct {
+	ctx     context.Context
+	symbols *Symbols
+	samples *schemav1.Samples
+	w       *collapsedWriter
+	lines   []string
+	buf     []byte
+	cur     int
+	err     error
+}
+
+func (r *collapsedSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	v := int64(r.samples.Values[r.cur])
+	r.cur++
+	if r.err != nil || v == 0 {
+		return
+	}
+	if r.err = r.ctx.Err(); r.err != nil {
+		return
+	}
+	r.lines = r.symbols.appendFunctionNames(r.lines[:0], locations)
+	if len(r.lines) == 0 {
+		return
+	}
+	r.buf = r.buf[:0]
+	for i, name := range r.lines {
+		if i > 0 {
+			r.buf = append(r.buf, ';')
+		}
+		r.buf = append(r.buf, name...)
+	}
+	r.buf = append(r.buf, ' ')
+	r.buf = strconv.AppendInt(r.buf, v, 10)
+	r.buf = append(r.buf, '\n')
+	r.err = r.w.write(r.buf)
+}
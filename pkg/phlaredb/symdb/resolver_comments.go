@@ -0,0 +1,38 @@
+package symdb
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// WithComments specifies the comments of the resolved profile, such
+// as the provenance of the data: the profiles returned by Profile,
+// ProfileProto, ProfileInto, and written by WriteProfile carry the
+// comments in the order given. Empty comments are ignored.
+func WithComments(comments []string) ResolverOption {
+	return func(r *Resolver) {
+		r.comments = r.comments[:0]
+		for _, c := range comments {
+			if c != "" {
+				r.comments = append(r.comments, c)
+			}
+		}
+	}
+}
+
+// writeComments references the comments in the string table. The
+// call must precede writeStrings, if the profile is streamed.
+func (w *pprofWriter) writeComments(comments []string) error {
+	for _, c := range comments {
+		x := w.string(c)
+		if w.dst != nil {
+			w.dst.Comment = append(w.dst.Comment, x)
+			continue
+		}
+		w.buf = protowire.AppendTag(w.buf[:0], 13, protowire.VarintType)
+		w.buf = protowire.AppendVarint(w.buf, uint64(x))
+		if _, err := w.w.Write(w.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
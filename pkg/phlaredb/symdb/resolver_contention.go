@@ -0,0 +1,88 @@
+package symdb
+
+import (
+	"github.com/google/pprof/profile"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// Value types of the Go block and mutex profiles, in the order they
+// are written by runtime/pprof: the number of contention events, and
+// the time spent waiting, in nanoseconds.
+const (
+	ContentionsValueIndex = 0
+	DelayValueIndex       = 1
+)
+
+// ContentionProfileMeta returns the metadata of the Go block and mutex
+// profiles, as written by runtime/pprof and expected by go tool pprof.
+func ContentionProfileMeta() ProfileMeta {
+	return ProfileMeta{
+		SampleType: []*profile.ValueType{
+			{Type: "contentions", Unit: "count"},
+			{Type: "delay", Unit: "nanoseconds"},
+		},
+		PeriodType: &profile.ValueType{Type: "contentions", Unit: "count"},
+		Period:     1,
+	}
+}
+
+// WithContentionProfile specifies that the samples are of a Go block
+// or mutex profile: the number of contentions is added with the value
+// index ContentionsValueIndex, and the delay is added with the value
+// index DelayValueIndex, see AddSamplesWithValueIndex. Profile returns
+// a profile with both of the values, and the sample types and period
+// of ContentionProfileMeta, and so does ProfileInto. ProfileProto,
+// WriteProfile, and Bytes use the metadata, unless the sample types
+// are specified explicitly. Use WithTreeValueIndex to build the tree
+// of the delay.
+func WithContentionProfile() ResolverOption {
+	return func(r *Resolver) {
+		r.contention = true
+	}
+}
+
+// WithTreeValueIndex specifies the value type Tree and TreeSampled
+// resolve: by default, the tree is built of the samples of the value
+// index 0, see AddSamplesWithValueIndex. Stack traces that only have
+// values of the other types do not contribute to the tree.
+func WithTreeValueIndex(valueIdx int) ResolverOption {
+	return func(r *Resolver) {
+		if valueIdx >= 0 {
+			r.treeValueIdx = valueIdx
+		}
+	}
+}
+
+// valueSamples returns the partition samples of the value type.
+func (p *lazyPartition) valueSamples(valueIdx int) schemav1.Samples {
+	if valueIdx < len(p.values) {
+		return schemav1.NewSamplesFromMap(p.values[valueIdx])
+	}
+	return schemav1.Samples{}
+}
+
+// withContentionValues makes sure the partitions have both values
+// of contention profiles, even if one of them is not added at all.
+func (r *Resolver) withContentionValues() {
+	for _, p := range r.p {
+		p.m.Lock()
+		p.valuesOf(DelayValueIndex)
+		p.m.Unlock()
+	}
+}
+
+// contentionMeta fills the sample types and period of the
+// metadata, if the sample types are not specified.
+func (r *Resolver) contentionMeta(m ProfileMeta) ProfileMeta {
+	if !r.contention || len(m.SampleType) > 0 {
+		return m
+	}
+	c := ContentionProfileMeta()
+	m.SampleType = c.SampleType
+	if m.PeriodType == nil {
+		m.PeriodType = c.PeriodType
+		m.Period = c.Period
+	}
+	return m
+}
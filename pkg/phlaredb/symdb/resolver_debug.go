@@ -0,0 +1,22 @@
+package symdb
+
+// DumpSamples returns a copy of the aggregated stack trace values of
+// the partition, as they are after AddSamples calls and before the
+// symbols are resolved. The method is meant for debugging: unlike
+// Partition, it does not add the partition to the resolver. Nil is
+// returned, if the resolver has no samples of the partition.
+func (r *Resolver) DumpSamples(partition uint64) map[uint32]int64 {
+	r.m.Lock()
+	p, ok := r.p[partition]
+	r.m.Unlock()
+	if !ok {
+		return nil
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	m := make(map[uint32]int64, len(p.samples))
+	for sid, v := range p.samples {
+		m[sid] = v
+	}
+	return m
+}
@@ -0,0 +1,108 @@
+package symdb
+
+import (
+	"strings"
+
+	"github.com/ianlancetaylor/demangle"
+)
+
+type DemangleMode int
+
+const (
+	// DemangleNone leaves function names as is.
+	DemangleNone DemangleMode = iota
+	// DemangleSimplified demangles C++ and Rust function names, omitting
+	// parameters and template arguments. Type parameters of Go generic
+	// functions are replaced with "...".
+	DemangleSimplified
+	// DemangleFull demangles C++ and Rust function names, preserving
+	// parameters and template arguments. Go function names are not
+	// modified.
+	DemangleFull
+)
+
+// WithDemangle specifies how the resolver demangles function names.
+// By default, function names are not demangled.
+func WithDemangle(mode DemangleMode) ResolverOption {
+	return func(r *Resolver) {
+		r.demangle = mode
+	}
+}
+
+// withDemangledNames returns symbols with the function names
+// demangled. The string table of the partition is shared and
+// therefore is not modified in place: a copy is made instead.
+func withDemangledNames(s *Symbols, mode DemangleMode) *Symbols {
+	if mode == DemangleNone || len(s.Functions) == 0 {
+		return s
+	}
+	x := *s
+	x.Strings = make([]string, len(s.Strings))
+	copy(x.Strings, s.Strings)
+	seen := make(map[uint32]struct{}, len(s.Functions))
+	for _, f := range s.Functions {
+		if _, ok := seen[f.Name]; ok {
+			continue
+		}
+		seen[f.Name] = struct{}{}
+		x.Strings[f.Name] = demangleName(s.Strings[f.Name], mode)
+	}
+	return &x
+}
+
+func demangleName(name string, mode DemangleMode) string {
+	var options []demangle.Option
+	switch mode {
+	case DemangleSimplified:
+		options = []demangle.Option{demangle.NoParams, demangle.NoEnclosingParams, demangle.NoTemplateParams}
+	case DemangleFull:
+		options = []demangle.Option{demangle.NoClones}
+	default:
+		return name
+	}
+	if demangled, err := demangle.ToString(name, options...); err == nil {
+		return demangled
+	}
+	if mode == DemangleSimplified {
+		return simplifyTypeParams(name)
+	}
+	return name
+}
+
+// simplifyTypeParams replaces type parameters of Go generic
+// functions with "...", e.g. "main.Map[go.shape.int_0]" is
+// simplified to "main.Map[...]". Empty brackets, such as in
+// "operator[]", are preserved.
+func simplifyTypeParams(name string) string {
+	if !strings.Contains(name, "[") {
+		return name
+	}
+	var b strings.Builder
+	b.Grow(len(name))
+	var depth int
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '[':
+			depth++
+			if depth == 1 {
+				b.WriteByte(c)
+				if i+1 < len(name) && name[i+1] != ']' {
+					b.WriteString("...")
+				}
+			}
+		case c == ']' && depth > 0:
+			depth--
+			if depth == 0 {
+				b.WriteByte(c)
+			}
+		case depth == 0:
+			b.WriteByte(c)
+		}
+	}
+	if depth > 0 {
+		// Unbalanced brackets: not a generic function.
+		return name
+	}
+	return b.String()
+}
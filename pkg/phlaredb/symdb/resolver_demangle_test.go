@@ -0,0 +1,80 @@
+package symdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+func Test_demangleName(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		simplified string
+		full       string
+	}{
+		{
+			// C++ Itanium.
+			name:       "_ZNSt6vectorIiSaIiEE9push_backERKi",
+			simplified: "std::vector::push_back",
+			full:       "std::vector<int, std::allocator<int> >::push_back(int const&)",
+		},
+		{
+			// Rust legacy.
+			name:       "_ZN4core3fmt5write17h2f0b8e1a3c5d7e9fE",
+			simplified: "core::fmt::write",
+			full:       "core::fmt::write",
+		},
+		{
+			// Rust v0.
+			name:       "_RNvCs15kBYyAo9fc_7mycrate7example",
+			simplified: "mycrate::example",
+			full:       "mycrate::example",
+		},
+		{
+			// Go generic function.
+			name:       "main.Map[go.shape.int_0,go.shape.string_1]",
+			simplified: "main.Map[...]",
+			full:       "main.Map[go.shape.int_0,go.shape.string_1]",
+		},
+		{
+			// Go generic type method.
+			name:       "main.(*T[go.shape.int_0]).method",
+			simplified: "main.(*T[...]).method",
+			full:       "main.(*T[go.shape.int_0]).method",
+		},
+		{
+			name:       "main.main",
+			simplified: "main.main",
+			full:       "main.main",
+		},
+		{
+			name:       "main.f[",
+			simplified: "main.f[",
+			full:       "main.f[",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.name, demangleName(tc.name, DemangleNone))
+			require.Equal(t, tc.simplified, demangleName(tc.name, DemangleSimplified))
+			require.Equal(t, tc.full, demangleName(tc.name, DemangleFull))
+		})
+	}
+}
+
+func Test_withDemangledNames(t *testing.T) {
+	s := &Symbols{
+		Functions: []*schemav1.InMemoryFunction{
+			{Name: 1, Filename: 2},
+			{Name: 3, Filename: 2},
+		},
+		Strings: []string{"", "_ZN4core3fmt5write17h2f0b8e1a3c5d7e9fE", "_ZN.go", "main.Map[go.shape.int_0]"},
+	}
+	x := withDemangledNames(s, DemangleSimplified)
+	require.Equal(t, []string{"", "core::fmt::write", "_ZN.go", "main.Map[...]"}, x.Strings)
+	// The source string table is not modified.
+	require.Equal(t, "_ZN4core3fmt5write17h2f0b8e1a3c5d7e9fE", s.Strings[1])
+	require.Same(t, s, withDemangledNames(s, DemangleNone))
+}
@@ -0,0 +1,57 @@
+package symdb
+
+// DepthHistogram describes depths of the resolved stack traces. The
+// depth of a stack trace is the number of its frames, including the
+// inlined functions; it matches the depth of the stack in the tree.
+type DepthHistogram struct {
+	// Stacktraces[d] is the number of distinct stack
+	// traces of depth d resolved, across all partitions.
+	Stacktraces []int64
+	// Values[d] is the total value of the stack traces of depth d.
+	Values []int64
+	// MaxDepth is the depth of the deepest stack trace, and
+	// MaxDepthStack is an example of such a stack trace, with
+	// function names ordered from the root to the leaf.
+	MaxDepth      int
+	MaxDepthStack []string
+}
+
+// DepthHistogram returns the histogram of the stack trace depths
+// observed by the last Tree call. The histogram is computed in the
+// same pass that builds the tree, with the stack traces not truncated
+// by WithMinValue. DepthHistogram returns nil, if Tree has not been
+// called.
+func (r *Resolver) DepthHistogram() *DepthHistogram {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.depths
+}
+
+func (h *DepthHistogram) observe(stack []string, v int64) {
+	d := len(stack)
+	for len(h.Stacktraces) <= d {
+		h.Stacktraces = append(h.Stacktraces, 0)
+		h.Values = append(h.Values, 0)
+	}
+	h.Stacktraces[d]++
+	h.Values[d] += v
+	if d > h.MaxDepth || h.MaxDepthStack == nil {
+		h.MaxDepth = d
+		h.MaxDepthStack = append(make([]string, 0, d), stack...)
+	}
+}
+
+func (h *DepthHistogram) merge(x *DepthHistogram) {
+	for len(h.Stacktraces) < len(x.Stacktraces) {
+		h.Stacktraces = append(h.Stacktraces, 0)
+		h.Values = append(h.Values, 0)
+	}
+	for d := range x.Stacktraces {
+		h.Stacktraces[d] += x.Stacktraces[d]
+		h.Values[d] += x.Values[d]
+	}
+	if x.MaxDepth > h.MaxDepth || h.MaxDepthStack == nil {
+		h.MaxDepth = x.MaxDepth
+		h.MaxDepthStack = x.MaxDepthStack
+	}
+}
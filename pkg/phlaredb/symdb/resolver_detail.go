@@ -0,0 +1,54 @@
+package symdb
+
+import (
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+type SymbolDetail int
+
+const (
+	// SymbolDetailFull resolves the symbols with all the details
+	// available: line numbers, and inlined functions.
+	SymbolDetailFull SymbolDetail = iota
+	// SymbolDetailFunctions only resolves the top-level functions of
+	// the locations, without line numbers. If the symbols reader
+	// implements PartitionFunctionsReader, mappings of the partitions
+	// are not loaded, and unsymbolized locations are attributed to the
+	// unknown mapping. Otherwise, the partition is loaded in full, and
+	// the details are discarded.
+	SymbolDetailFunctions
+)
+
+// WithSymbolDetail specifies the level of detail of the resolved
+// symbols. By default, the symbols are resolved in full.
+func WithSymbolDetail(level SymbolDetail) ResolverOption {
+	return func(r *Resolver) {
+		r.symbolDetail = level
+	}
+}
+
+// withSymbolDetail returns symbols with locations that only refer to
+// the top-level function, and have no line numbers. If the mappings
+// are not loaded, locations refer to an empty mapping. As the location
+// table is shared, a copy is made.
+func withSymbolDetail(s *Symbols, level SymbolDetail) *Symbols {
+	if level != SymbolDetailFunctions || len(s.Locations) == 0 {
+		return s
+	}
+	x := *s
+	if len(s.Mappings) == 0 {
+		x.Mappings = []*schemav1.InMemoryMapping{{}}
+	}
+	x.Locations = make([]*schemav1.InMemoryLocation, len(s.Locations))
+	for i, loc := range s.Locations {
+		c := *loc
+		if len(s.Mappings) == 0 {
+			c.MappingId = 0
+		}
+		if n := len(loc.Line); n > 0 {
+			c.Line = []schemav1.InMemoryLine{{FunctionId: loc.Line[n-1].FunctionId}}
+		}
+		x.Locations[i] = &c
+	}
+	return &x
+}
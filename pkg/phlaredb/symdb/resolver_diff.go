@@ -0,0 +1,22 @@
+package symdb
+
+import (
+	"github.com/grafana/pyroscope/pkg/model"
+)
+
+// DiffTrees resolves the trees of the left and right resolvers, and
+// combines them according to the mode, see model.Tree.DiffWithMode.
+// In the model.TreeDiffNormalized mode, profiles of different total
+// values can be compared: for example, profiles collected over time
+// ranges of different duration.
+func DiffTrees(left, right *Resolver, mode model.TreeDiffMode) (*model.TreeDiff, error) {
+	l, err := left.Tree()
+	if err != nil {
+		return nil, err
+	}
+	r, err := right.Tree()
+	if err != nil {
+		return nil, err
+	}
+	return l.DiffWithMode(r, mode), nil
+}
@@ -0,0 +1,66 @@
+package symdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidEncodedStacktraceIDs = errors.New("invalid encoded stack trace IDs")
+
+// EncodeStacktraceIDs appends the stack trace IDs to dst in the packed
+// representation AddSamplesEncoded accepts: each ID is encoded as the
+// zig-zag varint of the difference to the previous one, so that sorted
+// IDs take one or two bytes each. The IDs do not have to be sorted.
+func EncodeStacktraceIDs(dst []byte, ids []uint32) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	var prev int64
+	for _, id := range ids {
+		n := binary.PutVarint(buf[:], int64(id)-prev)
+		dst = append(dst, buf[:n]...)
+		prev = int64(id)
+	}
+	return dst
+}
+
+// AddSamplesEncoded is equivalent to AddSamples with the stack trace
+// IDs encoded with EncodeStacktraceIDs: values[i] is the value of the
+// i-th ID. The IDs are decoded as the values are added, without being
+// materialized. If the encoding is malformed, or the number of IDs does
+// not match the number of values, ErrInvalidEncodedStacktraceIDs is
+// returned, and the samples decoded before the error remain added.
+func (r *Resolver) AddSamplesEncoded(partition uint64, ids []byte, values []uint64) error {
+	p := r.partition(partition)
+	p.m.Lock()
+	defer p.m.Unlock()
+	var err error
+	var prev int64
+	var i int
+	for off := 0; off < len(ids); i++ {
+		d, n := binary.Varint(ids[off:])
+		if n <= 0 {
+			err = fmt.Errorf("%w: malformed varint at offset %d", ErrInvalidEncodedStacktraceIDs, off)
+			break
+		}
+		off += n
+		prev += d
+		if prev < 0 || prev > int64(^uint32(0)) {
+			err = fmt.Errorf("%w: ID %d is out of range", ErrInvalidEncodedStacktraceIDs, prev)
+			break
+		}
+		if i >= len(values) {
+			err = fmt.Errorf("%w: more IDs than values (%d)", ErrInvalidEncodedStacktraceIDs, len(values))
+			break
+		}
+		if sid := uint32(prev); sid > 0 {
+			p.samples[sid] += r.value(values[i])
+		}
+	}
+	if err == nil && i != len(values) {
+		err = fmt.Errorf("%w: %d IDs, %d values", ErrInvalidEncodedStacktraceIDs, i, len(values))
+	}
+	if len(p.samples) > 0 {
+		r.acquire(p)
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package symdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the symbols readers and the resolver fall into one
+// of the categories below, distinguishable with errors.Is and errors.As:
+//
+//   - The partition is not present in the reader: ErrPartitionNotFound,
+//     wrapped with *PartitionError.
+//   - The data of a section of the block can't be decoded, or does not
+//     match the checksum: ErrSectionCorrupt, a *SectionError. Retrying
+//     is not going to help.
+//   - The resolution is canceled: a *CanceledError that matches the
+//     context error, e.g., context.Canceled.
+//
+// Other errors, e.g., failures to fetch the data from the object store,
+// are returned as is; Reader retries them, if opened with
+// WithFetchRetry. In all the cases, the underlying error is wrapped,
+// and can be examined with errors.Is and errors.As.
+
+var ErrSectionCorrupt = errors.New("section corrupt")
+
+// SectionError is returned if the data of a section of the block, such
+// as a stack trace chunk or a table of the partition symbols, is corrupt.
+// errors.Is(err, ErrSectionCorrupt) is true for any SectionError.
+type SectionError struct {
+	// Section is one of: stacktraces, locations,
+	// mappings, functions, strings.
+	Section string
+	Err     error
+}
+
+func (e *SectionError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Section, e.Err)
+}
+
+func (e *SectionError) Unwrap() error { return e.Err }
+
+func (e *SectionError) Is(target error) bool { return target == ErrSectionCorrupt }
+
+// CanceledError is returned if the resolution has been canceled: either
+// the context is done, or the resolver has been released. The error
+// matches the context error (Cause), and wraps the error the resolution
+// has failed with, which is not necessarily the context error.
+type CanceledError struct {
+	Cause error
+	Err   error
+}
+
+func (e *CanceledError) Error() string {
+	if e.Err == e.Cause {
+		return fmt.Sprintf("resolution canceled: %v", e.Cause)
+	}
+	return fmt.Sprintf("resolution canceled: %v: %v", e.Cause, e.Err)
+}
+
+func (e *CanceledError) Unwrap() error { return e.Err }
+
+func (e *CanceledError) Is(target error) bool { return errors.Is(e.Cause, target) }
+
+// canceled wraps err with CanceledError, if the resolution
+// in the context given has been canceled.
+func (r *Resolver) canceled(ctx context.Context, err error) error {
+	var c *CanceledError
+	if err == nil || errors.As(err, &c) {
+		return err
+	}
+	if cause := r.canceledCause(ctx); cause != nil {
+		return &CanceledError{Cause: cause, Err: err}
+	}
+	return err
+}
+
+// canceledCause returns the error of the context the resolution has
+// been canceled with, if any. The resolver context is also canceled
+// if a partition fails to load: this is not a cancellation.
+func (r *Resolver) canceledCause(ctx context.Context) error {
+	if err := r.parent.Err(); err != nil {
+		// Canceled by the caller, or released.
+		return err
+	}
+	if r.ctx.Err() == nil {
+		return ctx.Err()
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package symdb
+
+import (
+	"fmt"
+
+	profilev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
+)
+
+// MergeTreeProfiles folds profiles resolved elsewhere, e.g., received
+// from an agent, into the tree returned by Tree, TreeSampled, and
+// Flamegraph: the stack traces of the profile samples are resolved with
+// the profile string table, and the first value of the samples is added
+// to the tree. Each profile has its own string table, therefore the stack
+// traces are merged by the function names. Only the tree is affected:
+// other methods, such as Profile, TreeInverted, or WriteProfile, do
+// not include the merged samples.
+//
+// The function names are taken as is: the name transformations and
+// filters of the resolver, such as WithDemangle, WithMaxNameLength,
+// WithFunctionAllowList, or WithMappingFilter, are not applied to
+// them, nor is WithMinValue. The value options, such as WithCountMode,
+// WithUpscale, and WithRate, do apply. With WithRootLabel, the stack
+// traces are grouped by the sample labels of the profile.
+// The profiles are not retained, and the merged stack traces are
+// discarded at Reset.
+func (r *Resolver) MergeTreeProfiles(profiles ...*profilev1.Profile) error {
+	var b TreeBuilder
+	for _, p := range profiles {
+		if p == nil {
+			continue
+		}
+		if err := r.insertProfile(&b, p); err != nil {
+			return err
+		}
+	}
+	tree := b.Build()
+	r.m.Lock()
+	if r.external == nil {
+		r.external = tree
+	} else {
+		r.external.Merge(tree)
+	}
+	r.m.Unlock()
+	return nil
+}
+
+func (r *Resolver) insertProfile(tree *TreeBuilder, p *profilev1.Profile) error {
+	str := func(i int64) (string, error) {
+		if i < 0 || int(i) >= len(p.StringTable) {
+			return "", fmt.Errorf("invalid string index %d", i)
+		}
+		return p.StringTable[i], nil
+	}
+	functions := make(map[uint64]string, len(p.Function))
+	for _, fn := range p.Function {
+		name, err := str(fn.Name)
+		if err != nil {
+			return fmt.Errorf("function %d: %w", fn.Id, err)
+		}
+		functions[fn.Id] = name
+	}
+	mappings := make(map[uint64]*profilev1.Mapping, len(p.Mapping))
+	for _, m := range p.Mapping {
+		mappings[m.Id] = m
+	}
+	// Names of the location lines, from the caller to the callee.
+	locations := make(map[uint64][]string, len(p.Location))
+	for _, loc := range p.Location {
+		if len(loc.Line) == 0 {
+			name, err := unsymbolizedProfileName(p, mappings[loc.MappingId], loc.Address)
+			if err != nil {
+				return fmt.Errorf("location %d: %w", loc.Id, err)
+			}
+			locations[loc.Id] = []string{name}
+			continue
+		}
+		names := make([]string, len(loc.Line))
+		for i, line := range loc.Line {
+			name, ok := functions[line.FunctionId]
+			if !ok {
+				return fmt.Errorf("location %d: function %d not found", loc.Id, line.FunctionId)
+			}
+			names[len(names)-1-i] = name
+		}
+		locations[loc.Id] = names
+	}
+	var stack []string
+	for _, s := range p.Sample {
+		if len(s.Value) == 0 {
+			continue
+		}
+		v := r.value(uint64(s.Value[0]))
+		if v == 0 {
+			continue
+		}
+		stack = stack[:0]
+		if r.rootLabel != "" {
+			root, err := profileRootLabel(p, s, r.rootLabel)
+			if err != nil {
+				return err
+			}
+			stack = append(stack, root)
+		}
+		for i := len(s.LocationId) - 1; i >= 0; i-- {
+			names, ok := locations[s.LocationId[i]]
+			if !ok {
+				return fmt.Errorf("location %d not found", s.LocationId[i])
+			}
+			stack = append(stack, names...)
+		}
+		tree.Insert(stack, v)
+	}
+	return nil
+}
+
+// profileRootLabel returns the root frame of the
+// sample with WithRootLabel: the label value.
+func profileRootLabel(p *profilev1.Profile, s *profilev1.Sample, key string) (string, error) {
+	for _, l := range s.Label {
+		if l.Key < 0 || int(l.Key) >= len(p.StringTable) {
+			return "", fmt.Errorf("invalid string index %d", l.Key)
+		}
+		if p.StringTable[l.Key] != key || l.Str == 0 {
+			continue
+		}
+		if l.Str < 0 || int(l.Str) >= len(p.StringTable) {
+			return "", fmt.Errorf("invalid string index %d", l.Str)
+		}
+		return p.StringTable[l.Str], nil
+	}
+	return UnknownRootLabelValue, nil
+}
+
+// unsymbolizedProfileName is the profile counterpart
+// of Symbols.unsymbolizedName.
+func unsymbolizedProfileName(p *profilev1.Profile, m *profilev1.Mapping, address uint64) (string, error) {
+	if m == nil {
+		return formatUnsymbolized("", 0, 0, 0, address), nil
+	}
+	if m.Filename < 0 || int(m.Filename) >= len(p.StringTable) {
+		return "", fmt.Errorf("invalid string index %d", m.Filename)
+	}
+	return formatUnsymbolized(p.StringTable[m.Filename], m.MemoryStart, m.MemoryLimit, m.FileOffset, address), nil
+}
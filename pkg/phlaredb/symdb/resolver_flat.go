@@ -0,0 +1,78 @@
+package symdb
+
+import (
+	"context"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// FlatSelf returns the self value of the functions of the resolved
+// stack traces, by function name: the value of a sample is attributed
+// to the leaf function, which is the innermost inlined function of the
+// leaf location, if any. Only the leaf locations are resolved, therefore
+// FlatSelf is cheaper than Tree and Top. The values sum up to the total
+// value of the samples.
+func (r *Resolver) FlatSelf() (map[string]int64, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.FlatSelf")
+	defer span.Finish()
+	var lock sync.Mutex
+	functions := make(map[string]int64)
+	err := r.withSymbols(ctx, func(symbols *Symbols, samples schemav1.Samples) error {
+		x, err := symbols.flatSelf(ctx, samples)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for name, v := range x {
+			functions[name] += v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return functions, nil
+}
+
+func (r *Symbols) flatSelf(ctx context.Context, samples schemav1.Samples) (map[string]int64, error) {
+	t := &flatSelfSymbols{
+		symbols:   r,
+		samples:   &samples,
+		functions: make(map[string]int64),
+	}
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, t, samples.StacktraceIDs); err != nil {
+		return nil, err
+	}
+	return t.functions, nil
+}
+
+type flatSelfSymbols struct {
+	symbols   *Symbols
+	samples   *schemav1.Samples
+	functions map[string]int64
+	cur       int
+}
+
+func (r *flatSelfSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	v := int64(r.samples.Values[r.cur])
+	r.cur++
+	if v == 0 || len(locations) == 0 {
+		return
+	}
+	r.functions[r.symbols.leafName(locations[0])] += v
+}
+
+// leafName returns the name of the innermost function of the location.
+func (r *Symbols) leafName(location int32) string {
+	loc := r.Locations[location]
+	if len(loc.Line) > 0 {
+		if name := r.functionName(loc.Line[0].FunctionId); name != "" {
+			return name
+		}
+	}
+	return r.unsymbolizedName(loc)
+}
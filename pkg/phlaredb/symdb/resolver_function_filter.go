@@ -0,0 +1,115 @@
+package symdb
+
+import (
+	"context"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// WithFunctionAllowList specifies the names of the functions whose
+// frames are kept in the stack traces: other frames are removed, and
+// their values are attributed to the nearest kept caller. If none of
+// the frames of a stack trace is kept, the value is attributed to the
+// "other" node at the root, so that the total value is preserved. In
+// contrast to WithMappingFilter, the names are looked up in the set,
+// which makes the option suitable for large lists. Names are matched
+// exactly, after the name transformations, such as WithDemangle, are
+// applied; inlined functions are matched individually, and frames of
+// unsymbolized locations are removed. The set must not be modified
+// while the resolver is in use. An empty set is ignored.
+func WithFunctionAllowList(names map[string]struct{}) ResolverOption {
+	return func(r *Resolver) {
+		if len(names) > 0 {
+			r.functionFilter = &functionFilter{names: names}
+		}
+	}
+}
+
+type functionFilter struct {
+	names map[string]struct{}
+}
+
+// withFunctionFilter returns symbols that resolve stack traces with
+// the frames of the functions not in the set removed. Locations that
+// have both the kept and removed lines are replaced with extra ones,
+// that only have the kept lines. An extra location of the "other"
+// function is added for stack traces with no frames left.
+func (f *functionFilter) withFunctionFilter(s *Symbols) *Symbols {
+	if len(s.Locations) == 0 {
+		return s
+	}
+	kept := make([]bool, len(s.Functions))
+	for i, fn := range s.Functions {
+		_, kept[i] = f.names[s.Strings[fn.Name]]
+	}
+	x := *s
+	x.Strings = append(s.Strings[:len(s.Strings):len(s.Strings)], truncatedNodeName)
+	x.Functions = append(s.Functions[:len(s.Functions):len(s.Functions)], &schemav1.InMemoryFunction{
+		Name: uint32(len(x.Strings) - 1),
+	})
+	x.Locations = s.Locations[:len(s.Locations):len(s.Locations)]
+	// Location the i-th location is replaced with, or -1, if removed.
+	replaced := make([]int32, len(s.Locations))
+	for i, loc := range s.Locations {
+		replaced[i] = -1
+		lines := make([]schemav1.InMemoryLine, 0, len(loc.Line))
+		for _, line := range loc.Line {
+			if int(line.FunctionId) < len(kept) && kept[line.FunctionId] {
+				lines = append(lines, line)
+			}
+		}
+		switch len(lines) {
+		case 0:
+		case len(loc.Line):
+			replaced[i] = int32(i)
+		default:
+			c := *loc
+			c.Line = lines
+			replaced[i] = int32(len(x.Locations))
+			x.Locations = append(x.Locations, &c)
+		}
+	}
+	x.Mappings = append(s.Mappings[:len(s.Mappings):len(s.Mappings)], new(schemav1.InMemoryMapping))
+	x.Locations = append(x.Locations, &schemav1.InMemoryLocation{
+		MappingId: uint32(len(x.Mappings) - 1),
+		Line:      []schemav1.InMemoryLine{{FunctionId: uint32(len(x.Functions) - 1)}},
+	})
+	x.Stacktraces = &functionFilterStacktraceResolver{
+		StacktraceResolver: s.Stacktraces,
+		replaced:           replaced,
+		other:              int32(len(x.Locations) - 1),
+	}
+	return &x
+}
+
+type functionFilterStacktraceResolver struct {
+	StacktraceResolver
+	replaced []int32
+	other    int32
+}
+
+func (r *functionFilterStacktraceResolver) ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) error {
+	return r.StacktraceResolver.ResolveStacktraceLocations(ctx, &functionFilterInserter{
+		StacktraceInserter: dst,
+		resolver:           r,
+	}, stacktraces)
+}
+
+type functionFilterInserter struct {
+	StacktraceInserter
+	resolver  *functionFilterStacktraceResolver
+	locations []int32
+}
+
+func (i *functionFilterInserter) InsertStacktrace(stacktraceID uint32, locations []int32) {
+	i.locations = i.locations[:0]
+	for _, loc := range locations {
+		if x := i.resolver.replaced[loc]; x >= 0 {
+			i.locations = append(i.locations, x)
+		}
+	}
+	if len(i.locations) == 0 && len(locations) > 0 {
+		i.locations = append(i.locations, i.resolver.other)
+	}
+	i.StacktraceInserter.InsertStacktrace(stacktraceID, i.locations)
+}
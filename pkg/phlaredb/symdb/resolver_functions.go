@@ -0,0 +1,98 @@
+package symdb
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// FunctionName identifies a function by name and source file name.
+type FunctionName struct {
+	Name     string
+	Filename string
+}
+
+// Functions returns the distinct functions present in the resolved
+// stack traces, including inlined ones, ordered by name and file name.
+// Neither tree nor profile is built: functions are deduplicated by ID
+// within a partition, and by name and file name across partitions.
+func (r *Resolver) Functions() ([]FunctionName, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.Functions")
+	defer span.Finish()
+	var lock sync.Mutex
+	functions := make(map[FunctionName]struct{})
+	err := r.withSymbols(ctx, func(symbols *Symbols, samples schemav1.Samples) error {
+		resolved, err := symbols.functions(ctx, samples)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for _, f := range resolved {
+			functions[f] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]FunctionName, 0, len(functions))
+	for f := range functions {
+		names = append(names, f)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].Name != names[j].Name {
+			return names[i].Name < names[j].Name
+		}
+		return names[i].Filename < names[j].Filename
+	})
+	return names, nil
+}
+
+func (r *Symbols) functions(ctx context.Context, samples schemav1.Samples) ([]FunctionName, error) {
+	f := &functionsSymbols{
+		symbols: r,
+		samples: &samples,
+		seen:    make([]bool, len(r.Functions)),
+	}
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, f, samples.StacktraceIDs); err != nil {
+		return nil, err
+	}
+	functions := make([]FunctionName, 0, len(f.ids))
+	for _, id := range f.ids {
+		fn := r.Functions[id]
+		functions = append(functions, FunctionName{
+			Name:     r.Strings[fn.Name],
+			Filename: r.Strings[fn.Filename],
+		})
+	}
+	return functions, nil
+}
+
+type functionsSymbols struct {
+	symbols *Symbols
+	samples *schemav1.Samples
+	seen    []bool
+	ids     []uint32
+	cur     int
+}
+
+func (r *functionsSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	v := r.samples.Values[r.cur]
+	r.cur++
+	if v == 0 {
+		return
+	}
+	for _, loc := range locations {
+		for _, line := range r.symbols.Locations[loc].Line {
+			if !r.seen[line.FunctionId] {
+				r.seen[line.FunctionId] = true
+				r.ids = append(r.ids, line.FunctionId)
+			}
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package symdb
+
+import (
+	"github.com/google/pprof/profile"
+	"github.com/opentracing/opentracing-go"
+
+	profilev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
+)
+
+// GenericProfile is a representation of the resolved profile that
+// does not depend on the pprof or protobuf models: stack traces are
+// represented with the function names. Sample labels, addresses and
+// source lines are not retained. Use Proto to convert the profile to
+// the protobuf representation.
+type GenericProfile struct {
+	SampleTypes []GenericValueType
+	Samples     []GenericSample
+	Mappings    []GenericMapping
+}
+
+type GenericValueType struct {
+	Type string
+	Unit string
+}
+
+type GenericSample struct {
+	// Stack holds the function names, from the leaf to the root,
+	// in the order of the pprof sample locations. Names of inlined
+	// functions precede the names of their callers.
+	Stack []string
+	// Values has an entry per each of the sample types.
+	Values []int64
+}
+
+type GenericMapping struct {
+	Start   uint64
+	Limit   uint64
+	Offset  uint64
+	File    string
+	BuildID string
+}
+
+// ProfileGeneric resolves the samples and returns the profile in the
+// generic representation, with the sample types of the metadata, see
+// ProfileProto.
+func (r *Resolver) ProfileGeneric(meta ProfileMeta) (*GenericProfile, error) {
+	span, _ := opentracing.StartSpanFromContext(r.ctx, "Resolver.ProfileGeneric")
+	defer span.Finish()
+	p, err := r.profileWithMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+	return ProfileToGeneric(p), nil
+}
+
+// ProfileToGeneric converts the profile to the generic representation.
+// Unsymbolized locations are named after the mapping file and offset,
+// the way Resolver names them.
+func ProfileToGeneric(p *profile.Profile) *GenericProfile {
+	g := &GenericProfile{
+		SampleTypes: make([]GenericValueType, len(p.SampleType)),
+		Samples:     make([]GenericSample, len(p.Sample)),
+		Mappings:    make([]GenericMapping, len(p.Mapping)),
+	}
+	for i, t := range p.SampleType {
+		g.SampleTypes[i] = GenericValueType{Type: t.Type, Unit: t.Unit}
+	}
+	for i, m := range p.Mapping {
+		g.Mappings[i] = GenericMapping{
+			Start:   m.Start,
+			Limit:   m.Limit,
+			Offset:  m.Offset,
+			File:    m.File,
+			BuildID: m.BuildID,
+		}
+	}
+	// Names of the location lines, from the callee to the caller.
+	locations := make(map[*profile.Location][]string, len(p.Location))
+	for _, loc := range p.Location {
+		if len(loc.Line) == 0 {
+			locations[loc] = []string{unsymbolizedGenericName(loc)}
+			continue
+		}
+		names := make([]string, 0, len(loc.Line))
+		for _, line := range loc.Line {
+			if line.Function != nil {
+				names = append(names, line.Function.Name)
+			}
+		}
+		locations[loc] = names
+	}
+	for i, s := range p.Sample {
+		var n int
+		for _, loc := range s.Location {
+			n += len(locations[loc])
+		}
+		stack := make([]string, 0, n)
+		for _, loc := range s.Location {
+			stack = append(stack, locations[loc]...)
+		}
+		values := make([]int64, len(s.Value))
+		copy(values, s.Value)
+		g.Samples[i] = GenericSample{Stack: stack, Values: values}
+	}
+	return g
+}
+
+// unsymbolizedGenericName is the pprof model counterpart
+// of Symbols.unsymbolizedName.
+func unsymbolizedGenericName(loc *profile.Location) string {
+	if m := loc.Mapping; m != nil {
+		return formatUnsymbolized(m.File, m.Start, m.Limit, m.Offset, loc.Address)
+	}
+	return formatUnsymbolized("", 0, 0, 0, loc.Address)
+}
+
+// Proto converts the profile to the protobuf representation: each
+// of the distinct function names is represented with a function and
+// a location of a single line. The locations do not refer to any of
+// the mappings, as the generic profile does not retain addresses.
+func (g *GenericProfile) Proto() *profilev1.Profile {
+	x := &profilev1.Profile{
+		SampleType:  make([]*profilev1.ValueType, len(g.SampleTypes)),
+		Sample:      make([]*profilev1.Sample, len(g.Samples)),
+		Mapping:     make([]*profilev1.Mapping, len(g.Mappings)),
+		StringTable: []string{""},
+	}
+	table := map[string]int64{"": 0}
+	str := func(s string) int64 {
+		i, ok := table[s]
+		if !ok {
+			i = int64(len(x.StringTable))
+			table[s] = i
+			x.StringTable = append(x.StringTable, s)
+		}
+		return i
+	}
+	for i, t := range g.SampleTypes {
+		x.SampleType[i] = &profilev1.ValueType{Type: str(t.Type), Unit: str(t.Unit)}
+	}
+	for i, m := range g.Mappings {
+		x.Mapping[i] = &profilev1.Mapping{
+			Id:           uint64(i + 1),
+			MemoryStart:  m.Start,
+			MemoryLimit:  m.Limit,
+			FileOffset:   m.Offset,
+			Filename:     str(m.File),
+			BuildId:      str(m.BuildID),
+			HasFunctions: true,
+		}
+	}
+	// Location and function IDs are identical.
+	locations := make(map[string]uint64)
+	for i, s := range g.Samples {
+		ids := make([]uint64, len(s.Stack))
+		for j, name := range s.Stack {
+			id, ok := locations[name]
+			if !ok {
+				id = uint64(len(x.Location) + 1)
+				locations[name] = id
+				x.Function = append(x.Function, &profilev1.Function{Id: id, Name: str(name)})
+				x.Location = append(x.Location, &profilev1.Location{
+					Id:   id,
+					Line: []*profilev1.Line{{FunctionId: id}},
+				})
+			}
+			ids[j] = id
+		}
+		values := make([]int64, len(s.Values))
+		copy(values, s.Values)
+		x.Sample[i] = &profilev1.Sample{LocationId: ids, Value: values}
+	}
+	return x
+}
@@ -0,0 +1,58 @@
+package symdb
+
+import (
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+type InliningMode int
+
+const (
+	// InliningExpand resolves each of the lines of a location as a
+	// distinct frame: inlined functions appear as callees of the
+	// function they are inlined into.
+	InliningExpand InliningMode = iota
+	// InliningCollapse only keeps the top-level function of a
+	// location: inlined functions are collapsed into the caller,
+	// which receives the full value.
+	InliningCollapse
+)
+
+// WithInlining specifies how the resolver handles inlined functions.
+// By default, inlined functions are expanded.
+func WithInlining(mode InliningMode) ResolverOption {
+	return func(r *Resolver) {
+		r.inlining = mode
+	}
+}
+
+// withCollapsedInlining returns symbols with locations that only refer
+// to the top-level function: the last line of the location. As the
+// location table is shared, a copy is made, if any of the locations
+// has inlined lines.
+func withCollapsedInlining(s *Symbols, mode InliningMode) *Symbols {
+	if mode != InliningCollapse {
+		return s
+	}
+	var inlined bool
+	for _, loc := range s.Locations {
+		if len(loc.Line) > 1 {
+			inlined = true
+			break
+		}
+	}
+	if !inlined {
+		return s
+	}
+	x := *s
+	x.Locations = make([]*schemav1.InMemoryLocation, len(s.Locations))
+	for i, loc := range s.Locations {
+		if len(loc.Line) < 2 {
+			x.Locations[i] = loc
+			continue
+		}
+		c := *loc
+		c.Line = loc.Line[len(loc.Line)-1:]
+		x.Locations[i] = &c
+	}
+	return &x
+}
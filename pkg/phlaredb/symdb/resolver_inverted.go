@@ -0,0 +1,61 @@
+package symdb
+
+import (
+	"context"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/grafana/pyroscope/pkg/model"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/pyroscope/pkg/slices"
+)
+
+// TreeInverted builds an inverted tree of the stack traces: the leaf
+// frames are at the root, and the children are the callers. Thus, the
+// total value of a root node is the self value of the function in the
+// tree returned by Tree. WithMinValue option is not applied.
+func (r *Resolver) TreeInverted() (*model.Tree, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.TreeInverted")
+	defer span.Finish()
+	var lock sync.Mutex
+	tree := new(model.Tree)
+	err := r.withSymbols(ctx, func(symbols *Symbols, samples schemav1.Samples) error {
+		resolved, err := symbols.treeInverted(ctx, samples)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		tree.Merge(resolved)
+		lock.Unlock()
+		return nil
+	})
+	return tree, err
+}
+
+func (r *Symbols) treeInverted(ctx context.Context, samples schemav1.Samples) (*model.Tree, error) {
+	t := &invertedTreeSymbols{
+		symbols: r,
+		samples: &samples,
+	}
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, t, samples.StacktraceIDs); err != nil {
+		return nil, err
+	}
+	return t.tree.Build(), nil
+}
+
+type invertedTreeSymbols struct {
+	symbols *Symbols
+	samples *schemav1.Samples
+	tree    TreeBuilder
+	lines   []string
+	cur     int
+}
+
+func (r *invertedTreeSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	v := int64(r.samples.Values[r.cur])
+	r.cur++
+	r.lines = r.symbols.appendFunctionNames(r.lines[:0], locations)
+	slices.Reverse(r.lines)
+	r.tree.Insert(r.lines, v)
+}
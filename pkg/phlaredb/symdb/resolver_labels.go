@@ -0,0 +1,272 @@
+package symdb
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/google/pprof/profile"
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/grafana/pyroscope/pkg/model"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+type labeledSamples struct {
+	labels  model.Labels
+	samples map[uint32]int64
+}
+
+// AddSamplesWithLabels adds a collection of stack trace samples with
+// the labels attached to the resolver. The samples are resolved as if
+// they were added with AddSamples; in addition, TreeByLabel can split
+// them by the label values.
+func (r *Resolver) AddSamplesWithLabels(partition uint64, s schemav1.Samples, labels model.Labels) {
+	p := r.partition(partition)
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.labeled == nil {
+		p.labeled = make(map[uint64]*labeledSamples)
+	}
+	h := labels.Hash()
+	ls, ok := p.labeled[h]
+	if !ok {
+		ls = &labeledSamples{labels: labels, samples: make(map[uint32]int64)}
+		p.labeled[h] = ls
+	}
+	for i, sid := range s.StacktraceIDs {
+		if sid > 0 {
+			v := r.value(s.Values[i])
+			p.samples[sid] += v
+			ls.samples[sid] += v
+		}
+	}
+	if len(p.samples) > 0 {
+		r.acquire(p)
+	}
+}
+
+// WithSampleLabels specifies that Profile carries the labels of the
+// samples added with AddSamplesWithLabels to the resolved profile: a
+// distinct sample is created for each of the label sets of the stack
+// trace, and samples without labels remain unlabeled. Labels only
+// apply to the values added with AddSamplesWithLabels; values of the
+// other types, if any, are attributed to the unlabeled sample.
+func WithSampleLabels() ResolverOption {
+	return func(r *Resolver) {
+		r.sampleLabels = true
+	}
+}
+
+// labelGroups returns the samples of the label sets of the partition,
+// ordered by the label set hash, see splitSamples.
+func (p *lazyPartition) labelGroups() []sampleGroup {
+	hashes := make([]uint64, 0, len(p.labeled))
+	for h := range p.labeled {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	groups := make([]sampleGroup, len(hashes))
+	for i, h := range hashes {
+		ls := p.labeled[h]
+		m := make(map[string][]string, len(ls.labels))
+		for _, l := range ls.labels {
+			m[l.Name] = append(m[l.Name], l.Value)
+		}
+		groups[i] = sampleGroup{
+			samples: ls.samples,
+			set:     func(s *profile.Sample) { s.Label = m },
+		}
+	}
+	return groups
+}
+
+// sampleGroup is a subset of the partition samples, represented
+// in the resolved profile with distinct samples, see splitSamples.
+type sampleGroup struct {
+	samples map[uint32]int64
+	// set attaches the group attributes to the sample.
+	set func(*profile.Sample)
+}
+
+// splitSamples splits the samples of the resolved profile by the
+// groups: a distinct sample is created for each of the groups the
+// stack trace belongs to, and the value that remains is attributed
+// to the original sample. The i-th sample of the profile must refer
+// to the i-th element of stacktraces.
+func splitSamples(resolved *profile.Profile, stacktraces []uint32, groups []sampleGroup) {
+	if len(groups) == 0 {
+		return
+	}
+	samples := make([]*profile.Sample, 0, len(resolved.Sample))
+	for i, s := range resolved.Sample {
+		sid := stacktraces[i]
+		for _, g := range groups {
+			v := g.samples[sid]
+			if v == 0 {
+				continue
+			}
+			split := &profile.Sample{
+				Location: s.Location,
+				Value:    make([]int64, len(s.Value)),
+			}
+			g.set(split)
+			split.Value[0] = v
+			s.Value[0] -= v
+			samples = append(samples, split)
+		}
+		for _, v := range s.Value {
+			if v != 0 {
+				samples = append(samples, s)
+				break
+			}
+		}
+	}
+	resolved.Sample = samples
+}
+
+// TreeByLabel resolves the samples and builds a tree for each value
+// of the label: samples added with AddSamplesWithLabels are grouped
+// by the value of the label key, and samples without the label are
+// grouped under the empty string. Samples of the value type selected
+// with WithTreeValueIndex are resolved, and so the trees sum up to the
+// tree returned by Tree; stack traces are resolved once for all the
+// groups.
+// WithMinValue option is not applied to the trees.
+func (r *Resolver) TreeByLabel(key string) (map[string]*model.Tree, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.TreeByLabel")
+	defer span.Finish()
+	var lock sync.Mutex
+	trees := make(map[string]*model.Tree)
+	err := r.withPartitionSymbols(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		values, samples := p.samplesByLabel(key, r.treeValueIdx)
+		resolved, err := symbols.trees(ctx, samples)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for i, tree := range resolved {
+			if t, ok := trees[values[i]]; ok {
+				t.Merge(tree)
+				continue
+			}
+			trees[values[i]] = tree
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return trees, nil
+}
+
+// samplesByLabel returns the partition samples of the value type
+// grouped by the value of the label key: values of the i-th group
+// are at the i-th column. Labels are only attached to the samples
+// of the value index 0, see AddSamplesWithLabels: samples of other
+// value types are not grouped.
+func (p *lazyPartition) samplesByLabel(key string, valueIdx int) ([]string, multiValueSamples) {
+	var base map[uint32]int64
+	if valueIdx < len(p.values) {
+		base = p.values[valueIdx]
+	}
+	var labeled map[uint64]*labeledSamples
+	if valueIdx == 0 {
+		labeled = p.labeled
+	}
+	// Samples without the label are those that
+	// remain after the labeled ones are subtracted.
+	unlabeled := make(map[uint32]int64, len(base))
+	for sid, v := range base {
+		unlabeled[sid] = v
+	}
+	groups := map[string]map[uint32]int64{"": unlabeled}
+	for _, ls := range labeled {
+		value := ls.labels.Get(key)
+		if value == "" {
+			continue
+		}
+		g, ok := groups[value]
+		if !ok {
+			g = make(map[uint32]int64, len(ls.samples))
+			groups[value] = g
+		}
+		for sid, v := range ls.samples {
+			g[sid] += v
+			unlabeled[sid] -= v
+		}
+	}
+	if isEmpty(unlabeled) {
+		delete(groups, "")
+	}
+	values := make([]string, 0, len(groups))
+	for value := range groups {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	s := schemav1.NewSamplesFromMap(base)
+	samples := multiValueSamples{
+		StacktraceIDs: s.StacktraceIDs,
+		Values:        make([][]uint64, len(values)),
+	}
+	for i, value := range values {
+		g := groups[value]
+		column := make([]uint64, len(s.StacktraceIDs))
+		for j, sid := range s.StacktraceIDs {
+			column[j] = uint64(g[sid])
+		}
+		samples.Values[i] = column
+	}
+	return values, samples
+}
+
+func isEmpty(samples map[uint32]int64) bool {
+	for _, v := range samples {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// trees builds a tree for each of the sample value columns.
+func (r *Symbols) trees(ctx context.Context, samples multiValueSamples) ([]*model.Tree, error) {
+	t := &multiTreeSymbols{
+		symbols: r,
+		samples: &samples,
+		trees:   make([]TreeBuilder, len(samples.Values)),
+	}
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, t, samples.StacktraceIDs); err != nil {
+		return nil, err
+	}
+	trees := make([]*model.Tree, len(t.trees))
+	for i := range t.trees {
+		trees[i] = t.trees[i].Build()
+	}
+	return trees, nil
+}
+
+type multiTreeSymbols struct {
+	symbols *Symbols
+	samples *multiValueSamples
+	trees   []TreeBuilder
+	lines   []string
+	cur     int
+}
+
+func (r *multiTreeSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	i := r.cur
+	r.cur++
+	r.lines = r.lines[:0]
+	for j, values := range r.samples.Values {
+		v := int64(values[i])
+		if v == 0 {
+			continue
+		}
+		if len(r.lines) == 0 {
+			r.lines = r.symbols.appendFunctionNames(r.lines, locations)
+		}
+		r.trees[j].Insert(r.lines, v)
+	}
+}
@@ -0,0 +1,63 @@
+package symdb
+
+import (
+	"strconv"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// WithLineGranularity specifies that distinct source lines of a function
+// are resolved as distinct functions named "func:line", therefore the
+// nodes of the resolved trees refer to lines rather than functions. The
+// total value of a function is the sum of the values of its lines.
+// Inlined functions are resolved individually. Lines of unknown number
+// keep the function name as is.
+func WithLineGranularity() ResolverOption {
+	return func(r *Resolver) {
+		r.lineGranularity = true
+	}
+}
+
+type functionLine struct {
+	function uint32
+	line     int32
+}
+
+// withLineGranularity returns symbols with a function per each of the
+// distinct function lines referenced by the locations. The function
+// and string tables are shared, therefore new functions and strings
+// are appended to copies of the tables.
+func withLineGranularity(s *Symbols) *Symbols {
+	if len(s.Functions) == 0 || len(s.Locations) == 0 {
+		return s
+	}
+	x := *s
+	x.Strings = s.Strings[:len(s.Strings):len(s.Strings)]
+	x.Functions = s.Functions[:len(s.Functions):len(s.Functions)]
+	x.Locations = make([]*schemav1.InMemoryLocation, len(s.Locations))
+	functions := make(map[functionLine]uint32)
+	for i, loc := range s.Locations {
+		c := *loc
+		c.Line = make([]schemav1.InMemoryLine, len(loc.Line))
+		for j, line := range loc.Line {
+			c.Line[j] = line
+			if line.Line == 0 {
+				continue
+			}
+			k := functionLine{function: line.FunctionId, line: line.Line}
+			id, ok := functions[k]
+			if !ok {
+				f := *s.Functions[line.FunctionId]
+				name := s.Strings[f.Name] + ":" + strconv.FormatInt(int64(line.Line), 10)
+				x.Strings = append(x.Strings, name)
+				f.Name = uint32(len(x.Strings) - 1)
+				x.Functions = append(x.Functions, &f)
+				id = uint32(len(x.Functions) - 1)
+				functions[k] = id
+			}
+			c.Line[j].FunctionId = id
+		}
+		x.Locations[i] = &c
+	}
+	return &x
+}
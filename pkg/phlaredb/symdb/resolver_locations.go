@@ -0,0 +1,118 @@
+package symdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// WithLocationsOnly specifies that the resolver only needs stack traces
+// and locations of the partitions: if the symbols reader implements
+// PartitionLocationsReader, mappings, functions, and strings are not
+// loaded. Only Locations can be used to resolve samples then: the other
+// methods return ErrLocationsOnly.
+func WithLocationsOnly() ResolverOption {
+	return func(r *Resolver) {
+		r.locationsOnly = true
+	}
+}
+
+var ErrLocationsOnly = fmt.Errorf("resolver only resolves locations")
+
+func (r *Resolver) loadPartition(partition uint64) (PartitionReader, error) {
+	if r.locationsOnly {
+		if lr, ok := r.s.(PartitionLocationsReader); ok {
+			return lr.PartitionLocations(r.ctx, partition)
+		}
+	}
+	if r.symbolDetail == SymbolDetailFunctions {
+		if fr, ok := r.s.(PartitionFunctionsReader); ok {
+			return fr.PartitionFunctions(r.ctx, partition)
+		}
+	}
+	return r.s.Partition(r.ctx, partition)
+}
+
+// PartitionLocations contains stack traces of the partition represented
+// as location paths.
+type PartitionLocations struct {
+	Partition   uint64
+	Stacktraces []StacktraceLocations
+	// Locations of the partition: stack trace locations
+	// refer to the elements of the slice by index.
+	Locations []*schemav1.InMemoryLocation
+}
+
+type StacktraceLocations struct {
+	StacktraceID uint32
+	Value        int64
+	// Locations of the stack trace, from the leaf to the root.
+	Locations []int32
+}
+
+// Locations resolves stack traces into locations, without function
+// names. Partitions are ordered by the identifier, and stack traces
+// are ordered by the stack trace identifier.
+func (r *Resolver) Locations() ([]PartitionLocations, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.Locations")
+	defer span.Finish()
+	var lock sync.Mutex
+	partitions := make([]PartitionLocations, 0, len(r.p))
+	err := r.withPartitions(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		stacktraces, err := symbols.locations(ctx, schemav1.NewSamplesFromMap(p.samples))
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		partitions = append(partitions, PartitionLocations{
+			Partition:   p.id,
+			Stacktraces: stacktraces,
+			Locations:   symbols.Locations,
+		})
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].Partition < partitions[j].Partition
+	})
+	return partitions, nil
+}
+
+func (r *Symbols) locations(ctx context.Context, samples schemav1.Samples) ([]StacktraceLocations, error) {
+	x := &locationsInserter{
+		samples:     &samples,
+		stacktraces: make([]StacktraceLocations, 0, len(samples.StacktraceIDs)),
+	}
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, x, samples.StacktraceIDs); err != nil {
+		return nil, err
+	}
+	return x.stacktraces, nil
+}
+
+type locationsInserter struct {
+	samples     *schemav1.Samples
+	stacktraces []StacktraceLocations
+	// Locations of all the stack traces.
+	buf []int32
+	cur int
+}
+
+func (r *locationsInserter) InsertStacktrace(id uint32, locations []int32) {
+	v := int64(r.samples.Values[r.cur])
+	r.cur++
+	n := len(r.buf)
+	r.buf = append(r.buf, locations...)
+	r.stacktraces = append(r.stacktraces, StacktraceLocations{
+		StacktraceID: id,
+		Value:        v,
+		Locations:    r.buf[n:len(r.buf):len(r.buf)],
+	})
+}
@@ -0,0 +1,104 @@
+package symdb
+
+import (
+	"context"
+	"regexp"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// WithMappingFilter specifies which frames of the stack traces are
+// kept, based on the file name of the mapping (binary or library) the
+// frame belongs to: a frame is kept, if the mapping file name matches
+// the include expression, and does not match the exclude one. A nil
+// expression is ignored. Excluded frames are removed from the stack
+// traces: their values are attributed to the nearest included caller.
+// If all the frames of a stack trace are excluded, the value is
+// attributed to the "other" node at the root, so that the total value
+// is always preserved. The filter has no effect, if the mappings are
+// not available (see WithLocationsOnly).
+func WithMappingFilter(include, exclude *regexp.Regexp) ResolverOption {
+	return func(r *Resolver) {
+		if include != nil || exclude != nil {
+			r.mappingFilter = &mappingFilter{include: include, exclude: exclude}
+		}
+	}
+}
+
+type mappingFilter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+func (f *mappingFilter) keep(filename string) bool {
+	return (f.include == nil || f.include.MatchString(filename)) &&
+		(f.exclude == nil || !f.exclude.MatchString(filename))
+}
+
+// withMappingFilter returns symbols that resolve stack traces with
+// the frames of the excluded mappings removed. An extra location of
+// the "other" function is added for stack traces with no frames left.
+func (f *mappingFilter) withMappingFilter(s *Symbols) *Symbols {
+	if len(s.Mappings) == 0 || len(s.Locations) == 0 {
+		return s
+	}
+	excluded := make([]bool, len(s.Mappings))
+	var filtered bool
+	for i, m := range s.Mappings {
+		excluded[i] = !f.keep(s.Strings[m.Filename])
+		filtered = filtered || excluded[i]
+	}
+	if !filtered {
+		return s
+	}
+	x := *s
+	x.Strings = append(s.Strings[:len(s.Strings):len(s.Strings)], truncatedNodeName)
+	x.Functions = append(s.Functions[:len(s.Functions):len(s.Functions)], &schemav1.InMemoryFunction{
+		Name: uint32(len(x.Strings) - 1),
+	})
+	x.Mappings = append(s.Mappings[:len(s.Mappings):len(s.Mappings)], new(schemav1.InMemoryMapping))
+	x.Locations = append(s.Locations[:len(s.Locations):len(s.Locations)], &schemav1.InMemoryLocation{
+		MappingId: uint32(len(x.Mappings) - 1),
+		Line:      []schemav1.InMemoryLine{{FunctionId: uint32(len(x.Functions) - 1)}},
+	})
+	x.Stacktraces = &mappingFilterStacktraceResolver{
+		StacktraceResolver: s.Stacktraces,
+		locations:          s.Locations,
+		excluded:           excluded,
+		other:              int32(len(x.Locations) - 1),
+	}
+	return &x
+}
+
+type mappingFilterStacktraceResolver struct {
+	StacktraceResolver
+	locations []*schemav1.InMemoryLocation
+	excluded  []bool
+	other     int32
+}
+
+func (r *mappingFilterStacktraceResolver) ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) error {
+	return r.StacktraceResolver.ResolveStacktraceLocations(ctx, &mappingFilterInserter{
+		StacktraceInserter: dst,
+		resolver:           r,
+	}, stacktraces)
+}
+
+type mappingFilterInserter struct {
+	StacktraceInserter
+	resolver  *mappingFilterStacktraceResolver
+	locations []int32
+}
+
+func (i *mappingFilterInserter) InsertStacktrace(stacktraceID uint32, locations []int32) {
+	i.locations = i.locations[:0]
+	for _, loc := range locations {
+		if !i.resolver.excluded[i.resolver.locations[loc].MappingId] {
+			i.locations = append(i.locations, loc)
+		}
+	}
+	if len(i.locations) == 0 && len(locations) > 0 {
+		i.locations = append(i.locations, i.resolver.other)
+	}
+	i.StacktraceInserter.InsertStacktrace(stacktraceID, i.locations)
+}
@@ -0,0 +1,150 @@
+package symdb
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// unknownMappingName is the name of the mapping of the
+// frames that don't refer to a mapping with a file name.
+const unknownMappingName = "[unknown]"
+
+// MappingValue contains aggregated values of the mapping (binary or
+// shared library): Self is the value of the samples where the leaf
+// frame belongs to the mapping, and Total is the value of the samples
+// where any of the frames belongs to the mapping.
+type MappingValue struct {
+	Name  string
+	Self  int64
+	Total int64
+}
+
+// ByMapping returns the values of the resolved stack traces aggregated
+// by the file name of the mapping, ordered by the self value, descending.
+// Frames without a mapping, or of a mapping with no file name, are
+// accounted under "[unknown]". The self values of the mappings sum up
+// to the total value of the samples.
+func (r *Resolver) ByMapping() ([]MappingValue, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.ByMapping")
+	defer span.Finish()
+	var lock sync.Mutex
+	mappings := make(map[string]*MappingValue)
+	err := r.withSymbols(ctx, func(symbols *Symbols, samples schemav1.Samples) error {
+		x, err := symbols.byMapping(ctx, samples)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for i, m := range x.values {
+			if m.Self == 0 && m.Total == 0 {
+				continue
+			}
+			name := x.names[i]
+			e, ok := mappings[name]
+			if !ok {
+				e = &MappingValue{Name: name}
+				mappings[name] = e
+			}
+			e.Self += m.Self
+			e.Total += m.Total
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	values := make([]MappingValue, 0, len(mappings))
+	for _, m := range mappings {
+		values = append(values, *m)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Self != values[j].Self {
+			return values[i].Self > values[j].Self
+		}
+		if values[i].Total != values[j].Total {
+			return values[i].Total > values[j].Total
+		}
+		return values[i].Name < values[j].Name
+	})
+	return values, nil
+}
+
+func (r *Symbols) byMapping(ctx context.Context, samples schemav1.Samples) (*mappingSymbols, error) {
+	// Mappings may share the file name: values are
+	// aggregated by the index of the distinct name.
+	// The last element refers to the unknown mapping.
+	m := &mappingSymbols{
+		symbols:  r,
+		samples:  &samples,
+		mappings: make([]int, len(r.Mappings)+1),
+	}
+	index := make(map[string]int)
+	for i := range m.mappings {
+		name := unknownMappingName
+		if i < len(r.Mappings) && r.Strings[r.Mappings[i].Filename] != "" {
+			name = r.Strings[r.Mappings[i].Filename]
+		}
+		j, ok := index[name]
+		if !ok {
+			j = len(m.names)
+			index[name] = j
+			m.names = append(m.names, name)
+		}
+		m.mappings[i] = j
+	}
+	m.values = make([]mappingSymbolsValue, len(m.names))
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, m, samples.StacktraceIDs); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type mappingSymbols struct {
+	symbols *Symbols
+	samples *schemav1.Samples
+	// Index of the mapping name, by the mapping index.
+	mappings []int
+	// Distinct mapping names and their values.
+	names  []string
+	values []mappingSymbolsValue
+	cur    int
+}
+
+type mappingSymbolsValue struct {
+	Self  int64
+	Total int64
+	// Index of the last sample the mapping
+	// was accounted in, plus one.
+	sample int
+}
+
+func (r *mappingSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	v := int64(r.samples.Values[r.cur])
+	r.cur++
+	if v == 0 || len(locations) == 0 {
+		return
+	}
+	for i, loc := range locations {
+		m := &r.values[r.mapping(loc)]
+		if i == 0 {
+			m.Self += v
+		}
+		if m.sample != r.cur {
+			m.sample = r.cur
+			m.Total += v
+		}
+	}
+}
+
+func (r *mappingSymbols) mapping(loc int32) int {
+	if m := int(r.symbols.Locations[loc].MappingId); m < len(r.symbols.Mappings) {
+		return r.mappings[m]
+	}
+	return r.mappings[len(r.symbols.Mappings)]
+}
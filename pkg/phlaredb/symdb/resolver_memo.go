@@ -0,0 +1,18 @@
+package symdb
+
+// WithStacktraceMemo specifies that the resolver memoizes up to size
+// resolved stack traces, so that the stack traces resolved more than
+// once in the course of the resolution, e.g., by both passes of Tree
+// with WithMinValue, are only looked up in the partition once.
+//
+// In contrast to WithStacktraceCache, the memo is owned by the
+// resolver and is not shared: it is purged on Release and Reset.
+// The option is ignored, if size is not positive.
+func WithStacktraceMemo(size int) ResolverOption {
+	return func(r *Resolver) {
+		if size > 0 {
+			// The error is only returned for non-positive sizes.
+			r.memo, _ = NewStacktraceCache(size, nil)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package symdb
+
+import (
+	"context"
+	"fmt"
+)
+
+// WithMemoryLimit specifies the approximate number of bytes the
+// resolver may allocate for the partition string tables and the
+// resolved stack traces. If the limit is exceeded, the resolution
+// fails with MemoryLimitError.
+//
+// The accounting is approximate: the string table of a partition is
+// charged once its symbols are accessed, and every resolved stack
+// trace is charged as if each of its frames created a new tree node.
+// The estimate never decreases during the resolution, and therefore
+// overestimates the actual memory usage if nodes are shared.
+func WithMemoryLimit(bytes int64) ResolverOption {
+	return func(r *Resolver) {
+		r.memoryLimit = bytes
+	}
+}
+
+const (
+	// Estimated size of a string header, in bytes.
+	estimatedStringSize = 16
+	// Estimated size of a tree node, including the
+	// reference in the children slice of the parent.
+	estimatedTreeNodeSize = 72
+	// memoryLimitCheckInterval defines how often, in stack
+	// traces, the resolved stack traces are accounted.
+	memoryLimitCheckInterval = 1 << 8
+)
+
+var ErrMemoryLimitExceeded = fmt.Errorf("memory limit exceeded")
+
+type MemoryLimitError struct {
+	Partition uint64
+	Bytes     int64
+	Limit     int64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("%v: partition %d: approximately %d bytes allocated, the limit is %d",
+		ErrMemoryLimitExceeded, e.Partition, e.Bytes, e.Limit)
+}
+
+func (e *MemoryLimitError) Unwrap() error { return ErrMemoryLimitExceeded }
+
+// allocate accounts n bytes allocated for the partition
+// and checks whether the memory limit is exceeded.
+func (r *Resolver) allocate(partition uint64, n int64) error {
+	b := r.memory.Add(n)
+	if b > r.memoryLimit {
+		return &MemoryLimitError{
+			Partition: partition,
+			Bytes:     b,
+			Limit:     r.memoryLimit,
+		}
+	}
+	return nil
+}
+
+// withMemoryLimit accounts the string table of the partition,
+// and returns symbols that account the resolved stack traces.
+func (r *Resolver) withMemoryLimit(partition uint64, s *Symbols) (*Symbols, error) {
+	n := int64(len(s.Strings)) * estimatedStringSize
+	for _, x := range s.Strings {
+		n += int64(len(x))
+	}
+	if err := r.allocate(partition, n); err != nil {
+		return nil, err
+	}
+	c := *s
+	c.Stacktraces = &memoryLimitStacktraceResolver{
+		StacktraceResolver: s.Stacktraces,
+		resolver:           r,
+		partition:          partition,
+	}
+	return &c, nil
+}
+
+type memoryLimitStacktraceResolver struct {
+	StacktraceResolver
+	resolver  *Resolver
+	partition uint64
+}
+
+func (r *memoryLimitStacktraceResolver) ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c := &memoryLimitInserter{
+		StacktraceInserter: dst,
+		resolver:           r,
+		cancel:             cancel,
+	}
+	err := r.StacktraceResolver.ResolveStacktraceLocations(ctx, c, stacktraces)
+	if c.err == nil {
+		c.flush()
+	}
+	if c.err != nil {
+		// The context is canceled by the inserter.
+		return c.err
+	}
+	return err
+}
+
+type memoryLimitInserter struct {
+	StacktraceInserter
+	resolver *memoryLimitStacktraceResolver
+	cancel   context.CancelFunc
+	err      error
+	bytes    int64
+	n        int
+}
+
+func (i *memoryLimitInserter) InsertStacktrace(stacktraceID uint32, locations []int32) {
+	if i.err != nil {
+		// Resolution is being canceled.
+		return
+	}
+	i.StacktraceInserter.InsertStacktrace(stacktraceID, locations)
+	i.bytes += int64(len(locations)) * estimatedTreeNodeSize
+	if i.n++; i.n == memoryLimitCheckInterval {
+		i.flush()
+	}
+}
+
+func (i *memoryLimitInserter) flush() {
+	i.err = i.resolver.resolver.allocate(i.resolver.partition, i.bytes)
+	i.bytes = 0
+	i.n = 0
+	if i.err != nil {
+		i.cancel()
+	}
+}
@@ -0,0 +1,100 @@
+package symdb
+
+import (
+	"github.com/google/pprof/profile"
+
+	profilev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
+	"github.com/grafana/pyroscope/pkg/model"
+	"github.com/grafana/pyroscope/pkg/pprof"
+)
+
+// MergeProfiles merges profiles produced by multiple resolvers into one.
+// Functions, locations, and mappings are deduplicated, and values of
+// samples with identical stack traces are summed. Nil profiles are
+// ignored. The profiles must have compatible sample and period types.
+func MergeProfiles(profiles ...*profile.Profile) (*profile.Profile, error) {
+	src := make([]*profile.Profile, 0, len(profiles))
+	for _, p := range profiles {
+		if p != nil {
+			src = append(src, p)
+		}
+	}
+	if len(src) == 0 {
+		return &profile.Profile{PeriodType: new(profile.ValueType)}, nil
+	}
+	return profile.Merge(src)
+}
+
+// MergeProfilesIgnoringLabels merges profiles similarly to MergeProfiles,
+// but the sample labels are not preserved: values of samples with
+// identical stack traces are summed regardless of their labels, e.g.,
+// of different series. The profiles are not modified.
+func MergeProfilesIgnoringLabels(profiles ...*profile.Profile) (*profile.Profile, error) {
+	merged, err := MergeProfiles(profiles...)
+	if err != nil {
+		return nil, err
+	}
+	// The merged profile is independent of the sources.
+	for _, s := range merged.Sample {
+		s.Label = nil
+		s.NumLabel = nil
+		s.NumUnit = nil
+	}
+	return merged.Compact(), nil
+}
+
+// MergeProfilesProto merges profiles in the pprof format produced by
+// multiple resolvers into one. In contrast to MergeProfiles, each of
+// the profiles has its own string table: functions, locations, and
+// mappings are deduplicated by their resolved string values. Nil
+// profiles are ignored. The profiles are modified in place.
+func MergeProfilesProto(profiles ...*profilev1.Profile) (*profilev1.Profile, error) {
+	var m pprof.ProfileMerge
+	for _, p := range profiles {
+		if p == nil {
+			continue
+		}
+		if err := m.Merge(p); err != nil {
+			return nil, err
+		}
+	}
+	if p := m.Profile(); p != nil {
+		return p, nil
+	}
+	return &profilev1.Profile{StringTable: []string{""}}, nil
+}
+
+// MergeProfilesProtoIgnoringLabels merges profiles in the pprof format
+// similarly to MergeProfilesProto, but the sample labels are removed:
+// values of samples with identical stack traces are summed regardless
+// of their labels. The profiles are modified in place.
+func MergeProfilesProtoIgnoringLabels(profiles ...*profilev1.Profile) (*profilev1.Profile, error) {
+	for _, p := range profiles {
+		if p == nil {
+			continue
+		}
+		for _, s := range p.Sample {
+			s.Label = nil
+		}
+	}
+	return MergeProfilesProto(profiles...)
+}
+
+// MergeTrees merges trees produced by multiple resolvers into one.
+// The first non-nil tree is modified in place and returned.
+func MergeTrees(trees ...*model.Tree) *model.Tree {
+	var dst *model.Tree
+	for _, t := range trees {
+		switch {
+		case t == nil:
+		case dst == nil:
+			dst = t
+		default:
+			dst.Merge(t)
+		}
+	}
+	if dst == nil {
+		dst = new(model.Tree)
+	}
+	return dst
+}
@@ -0,0 +1,92 @@
+package symdb
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/pyroscope/pkg/util"
+)
+
+// ResolverMetrics records the resolution of partitions by resolvers
+// created with WithMetrics. The metrics are meant to be shared by the
+// resolvers of the process:
+//
+//   - pyroscope_symdb_resolver_partitions_resolved_total
+//   - pyroscope_symdb_resolver_stacktraces_resolved_total
+//   - pyroscope_symdb_resolver_symbols_loaded_total, by type: locations,
+//     mappings, functions, strings
+//   - pyroscope_symdb_resolver_bytes_read_total
+//   - pyroscope_symdb_resolver_partition_load_duration_seconds
+//   - pyroscope_symdb_resolver_partition_resolve_duration_seconds
+//
+// The values are those of ResolverPartitionStats, observed once a
+// partition has been resolved.
+type ResolverMetrics struct {
+	partitions      prometheus.Counter
+	stacktraces     prometheus.Counter
+	symbols         *prometheus.CounterVec
+	bytesRead       prometheus.Counter
+	loadDuration    prometheus.Histogram
+	resolveDuration prometheus.Histogram
+}
+
+func NewResolverMetrics(reg prometheus.Registerer) *ResolverMetrics {
+	m := &ResolverMetrics{
+		partitions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pyroscope_symdb_resolver_partitions_resolved_total",
+			Help: "Total number of partitions resolved.",
+		}),
+		stacktraces: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pyroscope_symdb_resolver_stacktraces_resolved_total",
+			Help: "Total number of distinct stack traces resolved.",
+		}),
+		symbols: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pyroscope_symdb_resolver_symbols_loaded_total",
+			Help: "Total number of symbols of the partitions resolved.",
+		}, []string{"type"}),
+		bytesRead: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pyroscope_symdb_resolver_bytes_read_total",
+			Help: "Estimated amount of data fetched from the storage to load the partitions.",
+		}),
+		loadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "pyroscope_symdb_resolver_partition_load_duration_seconds",
+			Help: "Time spent on loading a partition.",
+			// [1ms, 2.5ms, 6.25ms, ..., 9.54s]
+			Buckets: prometheus.ExponentialBuckets(0.001, 2.5, 11),
+		}),
+		resolveDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "pyroscope_symdb_resolver_partition_resolve_duration_seconds",
+			Help: "Time spent on resolving stack traces of a partition, once it has been loaded.",
+			// [1ms, 2.5ms, 6.25ms, ..., 9.54s]
+			Buckets: prometheus.ExponentialBuckets(0.001, 2.5, 11),
+		}),
+	}
+	if reg != nil {
+		m.partitions = util.RegisterOrGet(reg, m.partitions)
+		m.stacktraces = util.RegisterOrGet(reg, m.stacktraces)
+		m.symbols = util.RegisterOrGet(reg, m.symbols)
+		m.bytesRead = util.RegisterOrGet(reg, m.bytesRead)
+		m.loadDuration = util.RegisterOrGet(reg, m.loadDuration)
+		m.resolveDuration = util.RegisterOrGet(reg, m.resolveDuration)
+	}
+	return m
+}
+
+// WithMetrics specifies the metrics the resolver records
+// the resolution to. By default, no metrics are recorded.
+func WithMetrics(m *ResolverMetrics) ResolverOption {
+	return func(r *Resolver) {
+		r.metrics = m
+	}
+}
+
+func (m *ResolverMetrics) observe(s *ResolverPartitionStats) {
+	m.partitions.Inc()
+	m.stacktraces.Add(float64(s.Stacktraces))
+	m.symbols.WithLabelValues("locations").Add(float64(s.Locations))
+	m.symbols.WithLabelValues("mappings").Add(float64(s.Mappings))
+	m.symbols.WithLabelValues("functions").Add(float64(s.Functions))
+	m.symbols.WithLabelValues("strings").Add(float64(s.Strings))
+	m.bytesRead.Add(float64(s.BytesRead))
+	m.loadDuration.Observe(s.LoadDuration.Seconds())
+	m.resolveDuration.Observe(s.ResolveDuration.Seconds())
+}
@@ -0,0 +1,142 @@
+package symdb
+
+import "strings"
+
+const truncatedNameSuffix = "…"
+
+// WithNameNormalizer specifies the function that rewrites function
+// names before the stack traces are resolved, e.g., to remove noisy
+// suffixes that fragment the aggregation: functions with identical
+// normalized names refer to the same node. The normalizer is applied
+// after demangling and before truncation, once per distinct name of a
+// partition, and must be safe for concurrent use. See
+// NormalizeGoClosureName.
+func WithNameNormalizer(fn func(string) string) ResolverOption {
+	return func(r *Resolver) {
+		r.nameNormalizer = fn
+	}
+}
+
+// NormalizeGoClosureName removes suffixes of Go closures and function
+// wrappers: the closures, e.g., "main.run.func1" and "main.run.func1.2",
+// and the go and defer statement wrappers, e.g., "main.run.gowrap1",
+// are attributed to the enclosing function "main.run".
+func NormalizeGoClosureName(name string) string {
+	for {
+		i := strings.LastIndexByte(name, '.')
+		if i <= 0 || !isGoClosureSuffix(name[i+1:]) {
+			return name
+		}
+		name = name[:i]
+	}
+}
+
+func isGoClosureSuffix(s string) bool {
+	for _, prefix := range []string{"func", "gowrap", "deferwrap"} {
+		if strings.HasPrefix(s, prefix) {
+			s = s[len(prefix):]
+			break
+		}
+	}
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// withNormalizedNames returns symbols with the function names rewritten
+// with fn. Similarly to withDemangledNames, the string table of the
+// partition is copied, if any of the names is changed.
+func withNormalizedNames(s *Symbols, fn func(string) string) *Symbols {
+	if fn == nil || len(s.Functions) == 0 {
+		return s
+	}
+	var table []string
+	seen := make(map[uint32]struct{}, len(s.Functions))
+	for _, f := range s.Functions {
+		if _, ok := seen[f.Name]; ok {
+			continue
+		}
+		seen[f.Name] = struct{}{}
+		name := s.Strings[f.Name]
+		normalized := fn(name)
+		if normalized == name {
+			continue
+		}
+		if table == nil {
+			table = make([]string, len(s.Strings))
+			copy(table, s.Strings)
+		}
+		table[f.Name] = normalized
+	}
+	if table == nil {
+		return s
+	}
+	x := *s
+	x.Strings = table
+	return &x
+}
+
+// WithMaxNameLength specifies the maximum length of function names, in
+// runes: longer names are truncated to n runes, followed by an ellipsis.
+// Names are truncated after demangling. Functions with the same name
+// are truncated identically, and therefore still refer to the same
+// node; note that distinct names with a common prefix of n runes are
+// not distinguishable after truncation. By default, or if n is not
+// positive, names are not truncated.
+func WithMaxNameLength(n int) ResolverOption {
+	return func(r *Resolver) {
+		r.maxNameLength = n
+	}
+}
+
+// withTruncatedNames returns symbols with the function names truncated
+// to n runes. Similarly to withDemangledNames, the string table of the
+// partition is copied, if any of the names is truncated.
+func withTruncatedNames(s *Symbols, n int) *Symbols {
+	if n <= 0 || len(s.Functions) == 0 {
+		return s
+	}
+	var table []string
+	for _, f := range s.Functions {
+		name := s.Strings[f.Name]
+		if len(name) <= n {
+			// The name is not longer than n bytes,
+			// let alone runes.
+			continue
+		}
+		truncated, ok := truncateName(name, n)
+		if !ok {
+			continue
+		}
+		if table == nil {
+			table = make([]string, len(s.Strings))
+			copy(table, s.Strings)
+		}
+		table[f.Name] = truncated
+	}
+	if table == nil {
+		return s
+	}
+	x := *s
+	x.Strings = table
+	return &x
+}
+
+// truncateName returns the name truncated to n runes with the
+// ellipsis appended, and false, if the name is not longer than n.
+func truncateName(name string, n int) (string, bool) {
+	var runes int
+	for i := range name {
+		if runes == n {
+			return name[:i] + truncatedNameSuffix, true
+		}
+		runes++
+	}
+	return name, false
+}
@@ -0,0 +1,59 @@
+package symdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// TreeNode is a tree node written by WriteTreeNDJSON.
+type TreeNode struct {
+	ID int64 `json:"id"`
+	// Parent is the identifier of the parent
+	// node, or zero for the root nodes.
+	Parent int64  `json:"parent"`
+	Name   string `json:"name"`
+	Self   int64  `json:"self"`
+	Total  int64  `json:"total"`
+}
+
+// WriteTreeNDJSON resolves the samples and writes the tree to w in the
+// newline-delimited JSON format: one TreeNode object per line. Nodes
+// are written in the depth-first pre-order, siblings ordered by name,
+// therefore a node is always preceded by its parent, and the output is
+// deterministic. The nodes are encoded one by one, as the tree is
+// traversed, without building the whole document in memory. If the
+// resolver is created with WithBestEffort, the nodes of the partitions
+// resolved are written, and the partial result error is returned.
+func (r *Resolver) WriteTreeNDJSON(ctx context.Context, w io.Writer) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Resolver.WriteTreeNDJSON")
+	defer span.Finish()
+	tree, resolveErr := r.Tree()
+	if resolveErr != nil && !IsPartialResult(resolveErr) {
+		return resolveErr
+	}
+	var err error
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var n TreeNode
+	tree.IterateNodes(func(id, parent int64, name string, self, total int64) bool {
+		if id%contextCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
+		}
+		n = TreeNode{ID: id, Parent: parent, Name: name, Self: self, Total: total}
+		err = enc.Encode(&n)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	return resolveErr
+}
@@ -0,0 +1,431 @@
+package symdb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DefaultOTLPBuildIDAttribute is the attribute key the mapping
+// build ID is exported with, unless specified otherwise.
+const DefaultOTLPBuildIDAttribute = "process.executable.build_id.gnu"
+
+type OTLPAggregationTemporality int32
+
+const (
+	OTLPAggregationTemporalityUnspecified OTLPAggregationTemporality = iota
+	OTLPAggregationTemporalityDelta
+	OTLPAggregationTemporalityCumulative
+)
+
+// OTLPAttribute is a string attribute of the OTLP resource or profile.
+type OTLPAttribute struct {
+	Key   string
+	Value string
+}
+
+// OTLPValueType is the type and unit of the OTLP sample values.
+type OTLPValueType struct {
+	Type string
+	Unit string
+}
+
+// OTLPOptions configure the representation of the profile in
+// the OpenTelemetry profiles signal.
+type OTLPOptions struct {
+	// Meta describes the sample types and other profile metadata,
+	// see Resolver.ProfileProto. Meta is only used by Resolver.
+	Meta ProfileMeta
+	// AggregationTemporality of the sample types.
+	AggregationTemporality OTLPAggregationTemporality
+	// SampleTypes maps the sample types of the profile to the ones
+	// exported, e.g., "samples"/"count" to "cpu"/"count", if the
+	// consumer expects the semantic conventions names. The period
+	// type is mapped the same way. Types not present in the map are
+	// exported as is.
+	SampleTypes map[OTLPValueType]OTLPValueType
+
+	// ResourceAttributes are attached to the resource,
+	// and Attributes are attached to the profile.
+	ResourceAttributes []OTLPAttribute
+	Attributes         []OTLPAttribute
+	// LabelAttributes maps the keys of the sample labels to the
+	// sample attribute keys. Labels not present in the map are
+	// exported with the original key, unless DropUnmappedLabels
+	// is set. Labels with multiple values are exported as arrays.
+	LabelAttributes    map[string]string
+	DropUnmappedLabels bool
+	// BuildIDAttribute is the key of the mapping attribute the
+	// build ID is exported with. DefaultOTLPBuildIDAttribute
+	// is used, if empty.
+	BuildIDAttribute string
+
+	ScopeName    string
+	ScopeVersion string
+	// ProfileID is generated randomly, if not specified.
+	ProfileID [16]byte
+}
+
+// ProfileOTLP resolves the samples and returns the profile in the
+// OpenTelemetry profiles signal representation: the result is the
+// serialized ProfilesData message, that can be sent to an OTLP
+// collector. See ProfileToOTLP for details.
+func (r *Resolver) ProfileOTLP(opts OTLPOptions) ([]byte, error) {
+	span, _ := opentracing.StartSpanFromContext(r.ctx, "Resolver.ProfileOTLP")
+	defer span.Finish()
+	p, err := r.Profile()
+	if err != nil && !IsPartialResult(err) {
+		return nil, err
+	}
+	if metaErr := opts.Meta.apply(p); metaErr != nil {
+		return nil, metaErr
+	}
+	b, encErr := ProfileToOTLP(p, opts)
+	if encErr != nil {
+		return nil, encErr
+	}
+	return b, err
+}
+
+// ProfileToOTLP encodes the profile as the OTLP ProfilesData message
+// (opentelemetry/proto/profiles/v1development, as of the OTLP v1.7.0
+// release), that includes a single resource with a single profile.
+// Mappings, locations and functions of the profile are stored in the
+// ProfilesDictionary tables in the order of the profile. The first
+// entry of each of the tables is reserved: similarly to the empty
+// string at the index 0 of the string table, it is the zero value,
+// and the entities of the profile start at the index 1.
+func ProfileToOTLP(p *profile.Profile, opts OTLPOptions) ([]byte, error) {
+	if opts.BuildIDAttribute == "" {
+		opts.BuildIDAttribute = DefaultOTLPBuildIDAttribute
+	}
+	if opts.ProfileID == [16]byte{} {
+		opts.ProfileID = uuid.New()
+	}
+	e := &otlpEncoder{
+		opts:       &opts,
+		strings:    map[string]int32{"": 0},
+		table:      []string{""},
+		attributes: make(map[string]int32),
+		mappings:   make(map[*profile.Mapping]int32, len(p.Mapping)),
+		functions:  make(map[*profile.Function]int32, len(p.Function)),
+		locations:  make(map[*profile.Location]int32, len(p.Location)),
+	}
+	// Index 0 of the tables refers to the zero entry.
+	for i, m := range p.Mapping {
+		e.mappings[m] = int32(i + 1)
+	}
+	for i, f := range p.Function {
+		e.functions[f] = int32(i + 1)
+	}
+	for i, loc := range p.Location {
+		e.locations[loc] = int32(i + 1)
+	}
+	dict := appendMessage(nil, 1, nil)
+	for _, m := range p.Mapping {
+		dict = appendMessage(dict, 1, e.mapping(m))
+	}
+	dict = appendMessage(dict, 2, nil)
+	for _, loc := range p.Location {
+		b, err := e.location(loc)
+		if err != nil {
+			return nil, err
+		}
+		dict = appendMessage(dict, 2, b)
+	}
+	dict = appendMessage(dict, 3, nil)
+	for _, f := range p.Function {
+		dict = appendMessage(dict, 3, e.function(f))
+	}
+	prof, err := e.profile(p)
+	if err != nil {
+		return nil, err
+	}
+	var resource []byte
+	for _, a := range opts.ResourceAttributes {
+		resource = appendMessage(resource, 1, appendStringAttribute(nil, a.Key, a.Value))
+	}
+	var scope []byte
+	scope = appendString(scope, 1, opts.ScopeName)
+	scope = appendString(scope, 2, opts.ScopeVersion)
+	scopeProfiles := appendMessage(nil, 1, scope)
+	scopeProfiles = appendMessage(scopeProfiles, 2, prof)
+	resourceProfiles := appendMessage(nil, 1, resource)
+	resourceProfiles = appendMessage(resourceProfiles, 2, scopeProfiles)
+	// Strings and attributes are collected while
+	// encoding, therefore they are written last.
+	for _, s := range e.table {
+		dict = protowire.AppendTag(dict, 5, protowire.BytesType)
+		dict = protowire.AppendString(dict, s)
+	}
+	for _, a := range e.attributeTable {
+		dict = appendMessage(dict, 6, a)
+	}
+	data := appendMessage(nil, 1, resourceProfiles)
+	return appendMessage(data, 2, dict), nil
+}
+
+type otlpEncoder struct {
+	opts *OTLPOptions
+
+	strings map[string]int32
+	table   []string
+	// Encoded KeyValue messages.
+	attributes     map[string]int32
+	attributeTable [][]byte
+
+	mappings  map[*profile.Mapping]int32
+	functions map[*profile.Function]int32
+	locations map[*profile.Location]int32
+}
+
+func (e *otlpEncoder) string(s string) int32 {
+	x, ok := e.strings[s]
+	if !ok {
+		x = int32(len(e.table))
+		e.strings[s] = x
+		e.table = append(e.table, s)
+	}
+	return x
+}
+
+func (e *otlpEncoder) attribute(kv []byte) int32 {
+	x, ok := e.attributes[string(kv)]
+	if !ok {
+		x = int32(len(e.attributeTable))
+		e.attributes[string(kv)] = x
+		e.attributeTable = append(e.attributeTable, kv)
+	}
+	return x
+}
+
+func (e *otlpEncoder) labelKey(key string) (string, bool) {
+	if k, ok := e.opts.LabelAttributes[key]; ok {
+		return k, true
+	}
+	return key, !e.opts.DropUnmappedLabels
+}
+
+func (e *otlpEncoder) valueType(t *profile.ValueType) []byte {
+	x := OTLPValueType{Type: t.Type, Unit: t.Unit}
+	if m, ok := e.opts.SampleTypes[x]; ok {
+		x = m
+	}
+	var b []byte
+	b = appendVarint(b, 1, uint64(e.string(x.Type)))
+	b = appendVarint(b, 2, uint64(e.string(x.Unit)))
+	return appendVarint(b, 3, uint64(e.opts.AggregationTemporality))
+}
+
+func (e *otlpEncoder) profile(p *profile.Profile) ([]byte, error) {
+	var b []byte
+	for _, t := range p.SampleType {
+		b = appendMessage(b, 1, e.valueType(t))
+	}
+	var locations []int32
+	var attrs []int32
+	for _, s := range p.Sample {
+		if len(p.SampleType) > 0 && len(s.Value) != len(p.SampleType) {
+			return nil, fmt.Errorf("sample has %d values, but %d sample types specified",
+				len(s.Value), len(p.SampleType))
+		}
+		var sample []byte
+		sample = appendVarint(sample, 1, uint64(len(locations)))
+		sample = appendVarint(sample, 2, uint64(len(s.Location)))
+		for _, loc := range s.Location {
+			x, ok := e.locations[loc]
+			if !ok {
+				return nil, fmt.Errorf("sample references unknown location %d", loc.ID)
+			}
+			locations = append(locations, x)
+		}
+		sample = appendPacked(sample, 3, s.Value)
+		attrs = attrs[:0]
+		for _, k := range sortedKeys(s.Label) {
+			if key, ok := e.labelKey(k); ok && len(s.Label[k]) > 0 {
+				attrs = append(attrs, e.attribute(appendStringAttribute(nil, key, s.Label[k]...)))
+			}
+		}
+		for _, k := range sortedKeys(s.NumLabel) {
+			if key, ok := e.labelKey(k); ok && len(s.NumLabel[k]) > 0 {
+				attrs = append(attrs, e.attribute(appendIntAttribute(nil, key, s.NumLabel[k]...)))
+			}
+		}
+		sample = appendPacked(sample, 4, attrs)
+		b = appendMessage(b, 2, sample)
+	}
+	b = appendPacked(b, 3, locations)
+	b = appendVarint(b, 4, uint64(p.TimeNanos))
+	b = appendVarint(b, 5, uint64(p.DurationNanos))
+	if p.PeriodType != nil {
+		b = appendMessage(b, 6, e.valueType(p.PeriodType))
+	}
+	b = appendVarint(b, 7, uint64(p.Period))
+	comments := make([]int32, len(p.Comments))
+	for i, c := range p.Comments {
+		comments[i] = e.string(c)
+	}
+	b = appendPacked(b, 8, comments)
+	for i, t := range p.SampleType {
+		if t.Type == p.DefaultSampleType {
+			b = appendVarint(b, 9, uint64(i))
+			break
+		}
+	}
+	b = appendBytes(b, 10, e.opts.ProfileID[:])
+	attrs = attrs[:0]
+	for _, a := range e.opts.Attributes {
+		attrs = append(attrs, e.attribute(appendStringAttribute(nil, a.Key, a.Value)))
+	}
+	return appendPacked(b, 14, attrs), nil
+}
+
+func (e *otlpEncoder) mapping(m *profile.Mapping) []byte {
+	var b []byte
+	b = appendVarint(b, 1, m.Start)
+	b = appendVarint(b, 2, m.Limit)
+	b = appendVarint(b, 3, m.Offset)
+	b = appendVarint(b, 4, uint64(e.string(m.File)))
+	if m.BuildID != "" {
+		attr := e.attribute(appendStringAttribute(nil, e.opts.BuildIDAttribute, m.BuildID))
+		b = appendPacked(b, 5, []int32{attr})
+	}
+	b = appendBool(b, 6, m.HasFunctions)
+	b = appendBool(b, 7, m.HasFilenames)
+	b = appendBool(b, 8, m.HasLineNumbers)
+	return appendBool(b, 9, m.HasInlineFrames)
+}
+
+func (e *otlpEncoder) location(loc *profile.Location) ([]byte, error) {
+	var b []byte
+	if loc.Mapping != nil {
+		x, ok := e.mappings[loc.Mapping]
+		if !ok {
+			return nil, fmt.Errorf("location %d references unknown mapping %d", loc.ID, loc.Mapping.ID)
+		}
+		// The field has explicit presence.
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(x))
+	}
+	b = appendVarint(b, 2, loc.Address)
+	for _, line := range loc.Line {
+		x, ok := e.functions[line.Function]
+		if !ok {
+			return nil, fmt.Errorf("location %d references unknown function", loc.ID)
+		}
+		var l []byte
+		l = appendVarint(l, 1, uint64(x))
+		l = appendVarint(l, 2, uint64(line.Line))
+		b = appendMessage(b, 3, l)
+	}
+	return appendBool(b, 4, loc.IsFolded), nil
+}
+
+func (e *otlpEncoder) function(f *profile.Function) []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(e.string(f.Name)))
+	b = appendVarint(b, 2, uint64(e.string(f.SystemName)))
+	b = appendVarint(b, 3, uint64(e.string(f.Filename)))
+	return appendVarint(b, 4, uint64(f.StartLine))
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// appendStringAttribute appends KeyValue message with the string
+// value, or with the array value, if multiple values are given.
+func appendStringAttribute(b []byte, key string, values ...string) []byte {
+	b = appendString(b, 1, key)
+	value := func(v string) []byte {
+		x := protowire.AppendTag(nil, 1, protowire.BytesType)
+		return protowire.AppendString(x, v)
+	}
+	if len(values) == 1 {
+		return appendMessage(b, 2, value(values[0]))
+	}
+	var array []byte
+	for _, v := range values {
+		array = appendMessage(array, 1, value(v))
+	}
+	return appendMessage(b, 2, appendMessage(nil, 5, array))
+}
+
+func appendIntAttribute(b []byte, key string, values ...int64) []byte {
+	b = appendString(b, 1, key)
+	value := func(v int64) []byte {
+		x := protowire.AppendTag(nil, 3, protowire.VarintType)
+		return protowire.AppendVarint(x, uint64(v))
+	}
+	if len(values) == 1 {
+		return appendMessage(b, 2, value(values[0]))
+	}
+	var array []byte
+	for _, v := range values {
+		array = appendMessage(array, 1, value(v))
+	}
+	return appendMessage(b, 2, appendMessage(nil, 5, array))
+}
+
+// The helpers below omit fields with zero values,
+// as the proto3 serialization does.
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	return appendMessage(b, num, v)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarint(b, num, 1)
+}
+
+func appendPacked[T int32 | int64](b []byte, num protowire.Number, values []T) []byte {
+	if len(values) == 0 {
+		return b
+	}
+	var size int
+	for _, v := range values {
+		size += protowire.SizeVarint(uint64(v))
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	b = protowire.AppendVarint(b, uint64(size))
+	for _, v := range values {
+		b = protowire.AppendVarint(b, uint64(v))
+	}
+	return b
+}
@@ -0,0 +1,153 @@
+package symdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithBestEffort enables the best-effort mode: partitions that fail to
+// load or to resolve are skipped, and the result only includes the
+// partitions resolved successfully. In this mode, Tree, Flamegraph,
+// and Profile return the partial result along with a non-nil error
+// of type *PartialResultError that lists the partition errors. Other
+// methods return no result in case of an error, as usual.
+//
+// Cancellation of the resolution and exceeding the stack traces limit
+// are not partition errors: they fail the whole resolution.
+func WithBestEffort() ResolverOption {
+	return func(r *Resolver) {
+		r.bestEffort = true
+	}
+}
+
+// WithSoftDeadline specifies the time budget of the resolution: the
+// partitions that are not resolved within the duration are skipped,
+// and the result only includes the partitions resolved completely.
+// In contrast to a context deadline, exceeding the soft deadline is
+// not a failure: Tree, Flamegraph, and Profile return the partial
+// result along with a *PartialResultError, for which IsTruncated
+// returns true. Other methods return no result, as usual.
+//
+// The duration is measured from the start of the resolution call,
+// e.g., Tree; loading of the partitions starts when the samples are
+// added. The soft deadline applies regardless of the best-effort mode.
+func WithSoftDeadline(d time.Duration) ResolverOption {
+	return func(r *Resolver) {
+		r.softDeadline = d
+	}
+}
+
+var ErrSoftDeadlineExceeded = fmt.Errorf("soft deadline exceeded")
+
+var ErrPartitionCanceled = fmt.Errorf("partition canceled")
+
+// CancelPartition abandons resolution of the partition: if the partition
+// is being resolved, the resolution is canceled, and the partition will
+// not be resolved by subsequent calls. In the best-effort mode, the other
+// partitions are resolved as usual, and the canceled partition does not
+// contribute to the result: the partial result error lists it with
+// ErrPartitionCanceled. Otherwise, the resolution fails with the error.
+// The call has no effect on a partition that has already been resolved.
+// CancelPartition is safe to call concurrently with resolution.
+func (r *Resolver) CancelPartition(partition uint64) {
+	p := r.partition(partition)
+	p.cancelOnce.Do(func() { close(p.canceled) })
+}
+
+func (p *lazyPartition) isCanceled() bool {
+	select {
+	case <-p.canceled:
+		return true
+	default:
+		return false
+	}
+}
+
+// withCancel returns a context that is canceled
+// once the partition is canceled.
+func (p *lazyPartition) withCancel(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-p.canceled:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// IsTruncated reports whether err is a PartialResultError, and some
+// of the partitions have been skipped due to the soft deadline.
+func IsTruncated(err error) bool {
+	var partial *PartialResultError
+	if !errors.As(err, &partial) {
+		return false
+	}
+	for _, e := range partial.Errors {
+		if errors.Is(e, ErrSoftDeadlineExceeded) {
+			return true
+		}
+	}
+	return false
+}
+
+// PartitionError describes a failure to resolve a partition.
+type PartitionError struct {
+	Partition uint64
+	Err       error
+}
+
+func (e *PartitionError) Error() string {
+	return fmt.Sprintf("partition %d: %v", e.Partition, e.Err)
+}
+
+func (e *PartitionError) Unwrap() error { return e.Err }
+
+// PartialResultError is returned in the best-effort mode,
+// if some of the partitions have not been resolved.
+type PartialResultError struct {
+	// Errors are ordered by the partition identifier.
+	Errors []*PartitionError
+}
+
+func (e *PartialResultError) Error() string {
+	s := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		s[i] = err.Error()
+	}
+	return fmt.Sprintf("partial result: %d partitions failed: %s", len(e.Errors), strings.Join(s, "; "))
+}
+
+// IsPartialResult reports whether err is a PartialResultError:
+// the result of the call is partial, but valid.
+func IsPartialResult(err error) bool {
+	var partial *PartialResultError
+	return errors.As(err, &partial)
+}
+
+type partitionErrors struct {
+	m      sync.Mutex
+	errors []*PartitionError
+}
+
+func (e *partitionErrors) add(partition uint64, err error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.errors = append(e.errors, &PartitionError{Partition: partition, Err: err})
+}
+
+func (e *partitionErrors) err() error {
+	if len(e.errors) == 0 {
+		return nil
+	}
+	sort.Slice(e.errors, func(i, j int) bool {
+		return e.errors[i].Partition < e.errors[j].Partition
+	})
+	return &PartialResultError{Errors: e.errors}
+}
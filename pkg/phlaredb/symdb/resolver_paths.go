@@ -0,0 +1,90 @@
+package symdb
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// Paths returns the distinct function name paths of the stack traces,
+// from the root to the leaf, regardless of the sample values: stack
+// traces that resolve to the same names, e.g., of different partitions,
+// make up a single path. Paths are ordered lexicographically, by the
+// names from the root.
+func (r *Resolver) Paths() ([][]string, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.Paths")
+	defer span.Finish()
+	var lock sync.Mutex
+	paths := make(map[string][]string)
+	err := r.withSymbols(ctx, func(symbols *Symbols, samples schemav1.Samples) error {
+		x, err := symbols.paths(ctx, samples)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for k, p := range x {
+			paths[k] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := make([][]string, 0, len(paths))
+	for _, p := range paths {
+		s = append(s, p)
+	}
+	sort.Slice(s, func(i, j int) bool { return lessPath(s[i], s[j]) })
+	return s, nil
+}
+
+func lessPath(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func (r *Symbols) paths(ctx context.Context, samples schemav1.Samples) (map[string][]string, error) {
+	t := &pathSymbols{
+		symbols: r,
+		paths:   make(map[string][]string),
+	}
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, t, samples.StacktraceIDs); err != nil {
+		return nil, err
+	}
+	return t.paths, nil
+}
+
+type pathSymbols struct {
+	symbols *Symbols
+	paths   map[string][]string
+	lines   []string
+	key     strings.Builder
+}
+
+func (r *pathSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	r.lines = r.symbols.appendFunctionNames(r.lines[:0], locations)
+	r.key.Reset()
+	for _, name := range r.lines {
+		// Names are separated with a byte
+		// that is not valid in UTF-8.
+		r.key.WriteString(name)
+		r.key.WriteByte(0xff)
+	}
+	k := r.key.String()
+	if _, ok := r.paths[k]; ok {
+		return
+	}
+	p := make([]string, len(r.lines))
+	copy(p, r.lines)
+	r.paths[k] = p
+}
@@ -0,0 +1,76 @@
+package symdb
+
+import (
+	"fmt"
+
+	"github.com/google/pprof/profile"
+	"github.com/opentracing/opentracing-go"
+
+	profilev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
+	"github.com/grafana/pyroscope/pkg/pprof"
+)
+
+// ProfileMeta describes the profile metadata that is not stored
+// in symdb, but is required by the pprof tools to interpret the
+// resolved profile correctly.
+type ProfileMeta struct {
+	// SampleType must have an entry per each value type added
+	// to the resolver (see AddSamplesWithValueIndex), if set.
+	SampleType        []*profile.ValueType
+	DefaultSampleType string
+	PeriodType        *profile.ValueType
+	Period            int64
+	TimeNanos         int64
+	DurationNanos     int64
+}
+
+// ProfileProto resolves the samples and returns the profile in
+// the protobuf representation, with the metadata populated.
+func (r *Resolver) ProfileProto(meta ProfileMeta) (*profilev1.Profile, error) {
+	span, _ := opentracing.StartSpanFromContext(r.ctx, "Resolver.ProfileProto")
+	defer span.Finish()
+	p, err := r.profileWithMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+	x, err := pprof.FromProfile(p)
+	if err != nil {
+		return nil, err
+	}
+	r.setStringTable(newStringTable(x))
+	return x, nil
+}
+
+// profileWithMeta resolves the samples and returns the profile with
+// the metadata populated, as ProfileProto does.
+func (r *Resolver) profileWithMeta(meta ProfileMeta) (*profile.Profile, error) {
+	p, err := r.Profile()
+	if err != nil {
+		return nil, err
+	}
+	meta = r.rateMeta(r.contentionMeta(meta))
+	if err = meta.apply(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (m *ProfileMeta) apply(p *profile.Profile) error {
+	if len(m.SampleType) > 0 {
+		for _, s := range p.Sample {
+			if len(s.Value) != len(m.SampleType) {
+				return fmt.Errorf("profile has %d sample values, but %d sample types specified",
+					len(s.Value), len(m.SampleType))
+			}
+		}
+	}
+	p.SampleType = m.SampleType
+	p.DefaultSampleType = m.DefaultSampleType
+	if m.PeriodType != nil {
+		p.PeriodType = m.PeriodType
+	}
+	p.Period = m.Period
+	p.TimeNanos = m.TimeNanos
+	p.DurationNanos = m.DurationNanos
+	return nil
+}
@@ -0,0 +1,73 @@
+package symdb
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// WithLocationDedup specifies that locations of the profile returned by
+// Profile that refer to the same functions and lines are collapsed into
+// a single location, regardless of their addresses. Samples are remapped
+// accordingly, and samples that end up with identical stack traces and
+// labels are merged. The address and mapping of the first location are
+// retained. This reduces the output size of profiles that have many
+// locations per source line, at the cost of the address information.
+func WithLocationDedup() ResolverOption {
+	return func(r *Resolver) {
+		r.locationDedup = true
+	}
+}
+
+// dedupLocations collapses locations with identical lines and
+// returns the compacted profile. The profile is modified in place.
+func dedupLocations(p *profile.Profile) *profile.Profile {
+	if len(p.Location) == 0 {
+		return p
+	}
+	var b strings.Builder
+	locations := make(map[string]*profile.Location, len(p.Location))
+	remap := make(map[*profile.Location]*profile.Location, len(p.Location))
+	deduped := p.Location[:0]
+	for _, loc := range p.Location {
+		if len(loc.Line) == 0 {
+			// Locations without lines are
+			// distinguished by the address only.
+			deduped = append(deduped, loc)
+			continue
+		}
+		b.Reset()
+		for _, line := range loc.Line {
+			b.WriteString(strconv.FormatUint(line.Function.ID, 16))
+			b.WriteByte(':')
+			b.WriteString(strconv.FormatInt(line.Line, 16))
+			b.WriteByte(';')
+		}
+		k := b.String()
+		if x, ok := locations[k]; ok {
+			remap[loc] = x
+			continue
+		}
+		locations[k] = loc
+		deduped = append(deduped, loc)
+	}
+	if len(remap) == 0 {
+		return p
+	}
+	for i := len(deduped); i < len(p.Location); i++ {
+		p.Location[i] = nil
+	}
+	p.Location = deduped
+	for i, loc := range p.Location {
+		loc.ID = uint64(i + 1)
+	}
+	for _, s := range p.Sample {
+		for i, loc := range s.Location {
+			if x, ok := remap[loc]; ok {
+				s.Location[i] = x
+			}
+		}
+	}
+	return p.Compact()
+}
@@ -0,0 +1,554 @@
+package symdb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/google/pprof/profile"
+	"github.com/klauspost/compress/gzip"
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	profilev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
+)
+
+// WriteProfile resolves the samples and writes the gzip-compressed
+// profile in the pprof format to w, with the metadata populated, as
+// ProfileProto does: the sample types must be specified for the output
+// to be parsed by the pprof tools. Unlike Profile, WriteProfile does
+// not build the profile in memory: partitions are resolved concurrently,
+// and once a partition is resolved, its samples are written, followed
+// by locations, functions and mappings they reference. Partitions are
+// written one by one; only the string table is written last.
+//
+// Note that locations, functions, and mappings are not deduplicated
+// across partitions; therefore, the output might be larger than the
+// one of Profile. The options that only apply to Profile, such as
+// WithSampleLabels, WithSampleTimestamps, and WithLocationDedup, are
+// not supported: ErrProfileOnlyOption is returned, if any is set.
+func (r *Resolver) WriteProfile(ctx context.Context, w io.Writer, meta ProfileMeta) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Resolver.WriteProfile")
+	defer span.Finish()
+	gw := gzip.NewWriter(w)
+	if err := r.writeProfile(ctx, gw, meta); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// writeProfile resolves the samples and writes
+// the uncompressed profile to w, see WriteProfile.
+func (r *Resolver) writeProfile(ctx context.Context, w io.Writer, meta ProfileMeta) error {
+	if err := r.checkWriterOptions(); err != nil {
+		return err
+	}
+	ctx, cancel := r.withContext(ctx)
+	defer cancel()
+	if r.contention {
+		r.withContentionValues()
+	}
+	meta = r.rateMeta(r.contentionMeta(meta))
+	pw := &pprofWriter{
+		w:          w,
+		strings:    map[string]int64{"": 0},
+		table:      []string{""},
+		valueTypes: len(meta.SampleType),
+		rate:       r.rateFunc(),
+	}
+	if err := pw.writeMeta(meta); err != nil {
+		return err
+	}
+	err := r.withPartitionSymbols(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		return pw.writePartition(ctx, symbols, p.multiValueSamples())
+	})
+	if err != nil {
+		return err
+	}
+	if err = pw.writeComments(r.comments); err != nil {
+		return err
+	}
+	return pw.writeStrings()
+}
+
+// ProfileInto resolves the samples and writes the profile into p,
+// which is reset first. Unlike ProfileProto, ProfileInto reuses the
+// memory allocated for p: samples, locations, functions, mappings, and
+// the string table retained by the profile are overwritten, so that a
+// profile can be reused across resolvers to avoid allocations in hot
+// paths. Similarly to WriteProfile, the entities are not deduplicated
+// across partitions, and the profile metadata, such as sample types,
+// is not populated, unless the resolver is created with the option
+// WithContentionProfile. Options that only apply to Profile are not
+// supported, as with WriteProfile.
+//
+// The profile must not be accessed concurrently with the call, nor be
+// shared after it returns, if it is going to be reused: the contents
+// are overwritten by the next call. On error, the profile contents
+// are undefined.
+func (r *Resolver) ProfileInto(p *profilev1.Profile) error {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.ProfileInto")
+	defer span.Finish()
+	if err := r.checkWriterOptions(); err != nil {
+		return err
+	}
+	resetProfile(p)
+	pw := &pprofWriter{
+		dst:     p,
+		strings: map[string]int64{"": 0},
+		table:   append(p.StringTable, ""),
+		rate:    r.rateFunc(),
+	}
+	if r.contention {
+		r.withContentionValues()
+		meta := ContentionProfileMeta()
+		pw.valueTypes = len(meta.SampleType)
+		// Metadata is written into the profile and never fails.
+		_ = pw.writeMeta(meta)
+	}
+	err := r.withPartitionSymbols(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		return pw.writePartition(ctx, symbols, p.multiValueSamples())
+	})
+	if err == nil {
+		err = pw.writeComments(r.comments)
+	}
+	p.StringTable = pw.table
+	if err == nil {
+		t := newStringTable(p)
+		// The writer index is not shared.
+		t.index = pw.strings
+		r.setStringTable(t)
+	}
+	return err
+}
+
+// ErrProfileOnlyOption is returned by WriteProfile, Bytes, and
+// ProfileInto, if the resolver has an option that only Profile and
+// ProfileProto support.
+var ErrProfileOnlyOption = fmt.Errorf("option is only supported by Profile")
+
+// checkWriterOptions returns ErrProfileOnlyOption,
+// if the resolver has any option pprofWriter ignores.
+func (r *Resolver) checkWriterOptions() error {
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"WithSampleLabels", r.sampleLabels},
+		{"WithSampleTimestamps", r.sampleTimestamps},
+		{"WithLocationDedup", r.locationDedup},
+	} {
+		if o.set {
+			return fmt.Errorf("%w: %s", ErrProfileOnlyOption, o.name)
+		}
+	}
+	return nil
+}
+
+// resetProfile resets the profile, retaining the allocated slices.
+func resetProfile(p *profilev1.Profile) {
+	samples := p.Sample[:0]
+	locations := p.Location[:0]
+	functions := p.Function[:0]
+	mappings := p.Mapping[:0]
+	strings := p.StringTable[:0]
+	p.Reset()
+	p.Sample = samples
+	p.Location = locations
+	p.Function = functions
+	p.Mapping = mappings
+	p.StringTable = strings
+}
+
+// withContext returns a context that is canceled either when ctx
+// is done, or when the resolver is released.
+func (r *Resolver) withContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	c, cancel := context.WithCancel(r.ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-c.Done():
+		}
+	}()
+	return c, cancel
+}
+
+type pprofWriter struct {
+	m   sync.Mutex
+	w   io.Writer
+	buf []byte
+	// If set, the entities are written into
+	// the profile instead of the writer.
+	dst *profilev1.Profile
+
+	// Offsets of entity IDs of the current partition.
+	// IDs must be unique within the whole profile.
+	locationID uint64
+	functionID uint64
+	mappingID  uint64
+
+	strings map[string]int64
+	table   []string
+
+	// Number of the sample types written, if any:
+	// samples must have a value per each of them.
+	valueTypes int
+	// If set, the sample values are converted
+	// to the rate per second, see WithRate.
+	rate func(int64) int64
+}
+
+func (w *pprofWriter) writePartition(ctx context.Context, symbols *Symbols, samples multiValueSamples) error {
+	if w.valueTypes > 0 && len(samples.Values) != w.valueTypes {
+		return fmt.Errorf("profile has %d sample values, but %d sample types specified",
+			len(samples.Values), w.valueTypes)
+	}
+	x := &pprofWriterSymbols{
+		w:         w,
+		symbols:   symbols,
+		samples:   &samples,
+		locations: make([]uint64, len(symbols.Locations)),
+		values:    make([]int64, 0, len(samples.StacktraceIDs)*len(samples.Values)),
+	}
+	// The partition is resolved into the buffer
+	// without blocking the other partitions.
+	if err := symbols.Stacktraces.ResolveStacktraceLocations(ctx, x, samples.StacktraceIDs); err != nil {
+		return err
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	if err := x.writeSamples(); err != nil {
+		return err
+	}
+	return x.writeSymbols()
+}
+
+func (w *pprofWriter) string(s string) int64 {
+	x, ok := w.strings[s]
+	if !ok {
+		x = int64(len(w.table))
+		w.strings[s] = x
+		w.table = append(w.table, s)
+	}
+	return x
+}
+
+func (w *pprofWriter) writeSample(s *profilev1.Sample) error {
+	if w.dst == nil {
+		return w.writeMessage(2, s)
+	}
+	var x *profilev1.Sample
+	w.dst.Sample, x = appendReused(w.dst.Sample)
+	locations, values := x.LocationId[:0], x.Value[:0]
+	x.Reset()
+	x.LocationId = append(locations, s.LocationId...)
+	x.Value = append(values, s.Value...)
+	return nil
+}
+
+func (w *pprofWriter) writeLocation(l *profilev1.Location) error {
+	if w.dst == nil {
+		return w.writeMessage(4, l)
+	}
+	var x *profilev1.Location
+	w.dst.Location, x = appendReused(w.dst.Location)
+	lines := x.Line[:0]
+	x.Reset()
+	x.Id = l.Id
+	x.MappingId = l.MappingId
+	x.Address = l.Address
+	x.IsFolded = l.IsFolded
+	x.Line = lines
+	for _, line := range l.Line {
+		var y *profilev1.Line
+		x.Line, y = appendReused(x.Line)
+		y.Reset()
+		y.FunctionId = line.FunctionId
+		y.Line = line.Line
+	}
+	return nil
+}
+
+func (w *pprofWriter) writeFunction(f *profilev1.Function) error {
+	if w.dst == nil {
+		return w.writeMessage(5, f)
+	}
+	var x *profilev1.Function
+	w.dst.Function, x = appendReused(w.dst.Function)
+	x.Reset()
+	x.Id = f.Id
+	x.Name = f.Name
+	x.SystemName = f.SystemName
+	x.Filename = f.Filename
+	x.StartLine = f.StartLine
+	return nil
+}
+
+func (w *pprofWriter) writeMapping(m *profilev1.Mapping) error {
+	if w.dst == nil {
+		return w.writeMessage(3, m)
+	}
+	var x *profilev1.Mapping
+	w.dst.Mapping, x = appendReused(w.dst.Mapping)
+	x.Reset()
+	x.Id = m.Id
+	x.MemoryStart = m.MemoryStart
+	x.MemoryLimit = m.MemoryLimit
+	x.FileOffset = m.FileOffset
+	x.Filename = m.Filename
+	x.BuildId = m.BuildId
+	x.HasFunctions = m.HasFunctions
+	x.HasFilenames = m.HasFilenames
+	x.HasLineNumbers = m.HasLineNumbers
+	x.HasInlineFrames = m.HasInlineFrames
+	return nil
+}
+
+// appendReused extends the slice by one element and returns it. The
+// element previously allocated beyond the slice length is reused, if
+// any: the caller must overwrite all its fields.
+func appendReused[T any](s []*T) ([]*T, *T) {
+	n := len(s)
+	if n < cap(s) {
+		s = s[:n+1]
+		if x := s[n]; x != nil {
+			return s, x
+		}
+	} else {
+		s = append(s, nil)
+	}
+	x := new(T)
+	s[n] = x
+	return s, x
+}
+
+type vtMessage interface {
+	SizeVT() int
+	MarshalToSizedBufferVT([]byte) (int, error)
+}
+
+func (w *pprofWriter) writeMessage(field protowire.Number, m vtMessage) error {
+	size := m.SizeVT()
+	w.buf = protowire.AppendTag(w.buf[:0], field, protowire.BytesType)
+	w.buf = protowire.AppendVarint(w.buf, uint64(size))
+	n := len(w.buf)
+	if cap(w.buf) < n+size {
+		b := make([]byte, n, 2*(n+size))
+		copy(b, w.buf)
+		w.buf = b
+	}
+	w.buf = w.buf[:n+size]
+	if _, err := m.MarshalToSizedBufferVT(w.buf[n:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// writeMeta writes the profile metadata,
+// the way ProfileMeta.apply populates it.
+func (w *pprofWriter) writeMeta(m ProfileMeta) error {
+	valueType := func(t *profile.ValueType) *profilev1.ValueType {
+		return &profilev1.ValueType{Type: w.string(t.Type), Unit: w.string(t.Unit)}
+	}
+	if w.dst != nil {
+		for _, t := range m.SampleType {
+			w.dst.SampleType = append(w.dst.SampleType, valueType(t))
+		}
+		if m.PeriodType != nil {
+			w.dst.PeriodType = valueType(m.PeriodType)
+		}
+		w.dst.TimeNanos = m.TimeNanos
+		w.dst.DurationNanos = m.DurationNanos
+		w.dst.Period = m.Period
+		w.dst.DefaultSampleType = w.string(m.DefaultSampleType)
+		return nil
+	}
+	for _, t := range m.SampleType {
+		if err := w.writeMessage(1, valueType(t)); err != nil {
+			return err
+		}
+	}
+	if m.PeriodType != nil {
+		if err := w.writeMessage(11, valueType(m.PeriodType)); err != nil {
+			return err
+		}
+	}
+	w.buf = w.buf[:0]
+	for _, f := range []struct {
+		field protowire.Number
+		value int64
+	}{
+		{field: 9, value: m.TimeNanos},
+		{field: 10, value: m.DurationNanos},
+		{field: 12, value: m.Period},
+		{field: 14, value: w.string(m.DefaultSampleType)},
+	} {
+		if f.value != 0 {
+			w.buf = protowire.AppendTag(w.buf, f.field, protowire.VarintType)
+			w.buf = protowire.AppendVarint(w.buf, uint64(f.value))
+		}
+	}
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+func (w *pprofWriter) writeStrings() error {
+	for _, s := range w.table {
+		w.buf = protowire.AppendTag(w.buf[:0], 6, protowire.BytesType)
+		w.buf = protowire.AppendString(w.buf, s)
+		if _, err := w.w.Write(w.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type pprofWriterSymbols struct {
+	w       *pprofWriter
+	symbols *Symbols
+	samples *multiValueSamples
+	cur     int
+
+	// Location index -> ID of the location within the partition;
+	// the IDs are offset once the partition is written.
+	locations []uint64
+	// Locations in the order they have been referenced.
+	order []int32
+	// Resolved samples: values of the i-th sample are at
+	// values[i*len(samples.Values):], and its locations
+	// are at stacks[ends[i-1]:ends[i]].
+	values []int64
+	stacks []uint64
+	ends   []int
+	// Offset of the partition location IDs.
+	base uint64
+}
+
+func (r *pprofWriterSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	i := r.cur
+	r.cur++
+	if len(locations) == 0 {
+		return
+	}
+	var zero = true
+	for _, values := range r.samples.Values {
+		zero = zero && values[i] == 0
+	}
+	if zero {
+		return
+	}
+	for _, values := range r.samples.Values {
+		v := int64(values[i])
+		if r.w.rate != nil {
+			v = r.w.rate(v)
+		}
+		r.values = append(r.values, v)
+	}
+	for _, loc := range locations {
+		id := r.locations[loc]
+		if id == 0 {
+			r.order = append(r.order, loc)
+			id = uint64(len(r.order))
+			r.locations[loc] = id
+		}
+		r.stacks = append(r.stacks, id)
+	}
+	r.ends = append(r.ends, len(r.stacks))
+}
+
+// writeSamples writes the resolved samples of the partition,
+// and reserves the IDs of the locations they reference.
+func (r *pprofWriterSymbols) writeSamples() error {
+	r.base = r.w.locationID
+	r.w.locationID += uint64(len(r.order))
+	n := len(r.samples.Values)
+	sample := &profilev1.Sample{Value: make([]int64, n)}
+	var start int
+	for i, end := range r.ends {
+		copy(sample.Value, r.values[i*n:(i+1)*n])
+		sample.LocationId = sample.LocationId[:0]
+		for _, id := range r.stacks[start:end] {
+			sample.LocationId = append(sample.LocationId, r.base+id)
+		}
+		start = end
+		if err := r.w.writeSample(sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *pprofWriterSymbols) writeSymbols() error {
+	functions := make(map[uint32]uint64)
+	mappings := make(map[uint32]uint64)
+	loc := new(profilev1.Location)
+	var lines []*profilev1.Line
+	for _, i := range r.order {
+		l := r.symbols.Locations[i]
+		m, ok := mappings[l.MappingId]
+		if !ok {
+			r.w.mappingID++
+			m = r.w.mappingID
+			mappings[l.MappingId] = m
+			if err := r.writeMapping(l.MappingId, m); err != nil {
+				return err
+			}
+		}
+		loc.Reset()
+		loc.Id = r.base + r.locations[i]
+		loc.MappingId = m
+		loc.Address = l.Address
+		loc.IsFolded = l.IsFolded
+		lines = lines[:0]
+		for _, line := range l.Line {
+			f, ok := functions[line.FunctionId]
+			if !ok {
+				r.w.functionID++
+				f = r.w.functionID
+				functions[line.FunctionId] = f
+				if err := r.writeFunction(line.FunctionId, f); err != nil {
+					return err
+				}
+			}
+			var x *profilev1.Line
+			lines, x = appendReused(lines)
+			x.FunctionId = f
+			x.Line = int64(line.Line)
+		}
+		loc.Line = lines
+		if err := r.w.writeLocation(loc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *pprofWriterSymbols) writeFunction(i uint32, id uint64) error {
+	f := r.symbols.Functions[i]
+	return r.w.writeFunction(&profilev1.Function{
+		Id:         id,
+		Name:       r.w.string(r.symbols.Strings[f.Name]),
+		SystemName: r.w.string(r.symbols.Strings[f.SystemName]),
+		Filename:   r.w.string(r.symbols.Strings[f.Filename]),
+		StartLine:  int64(f.StartLine),
+	})
+}
+
+func (r *pprofWriterSymbols) writeMapping(i uint32, id uint64) error {
+	m := r.symbols.Mappings[i]
+	return r.w.writeMapping(&profilev1.Mapping{
+		Id:              id,
+		MemoryStart:     m.MemoryStart,
+		MemoryLimit:     m.MemoryLimit,
+		FileOffset:      m.FileOffset,
+		Filename:        r.w.string(r.symbols.Strings[m.Filename]),
+		BuildId:         r.w.string(r.symbols.Strings[m.BuildId]),
+		HasFunctions:    m.HasFunctions,
+		HasFilenames:    m.HasFilenames,
+		HasLineNumbers:  m.HasLineNumbers,
+		HasInlineFrames: m.HasInlineFrames,
+	})
+}
@@ -0,0 +1,45 @@
+package symdb
+
+import (
+	"context"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// Prefetch waits for the partitions of the samples added so far to be
+// loaded. Partition loading starts in the background as soon as the
+// first samples of the partition are added, and the partitions are
+// fetched concurrently; Prefetch allows the caller to overlap loading
+// with other work and make sure the data is available before Tree,
+// Profile, or any other resolution call is made.
+//
+// Prefetch returns the first error encountered while loading, unless
+// the resolver is created with WithBestEffort. In-memory readers do
+// not fetch data, and Prefetch returns immediately. The call is safe
+// for concurrent use, and is optional: resolution waits for the
+// partitions to be loaded regardless.
+func (r *Resolver) Prefetch(ctx context.Context) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Resolver.Prefetch")
+	defer span.Finish()
+	r.m.Lock()
+	partitions := make([]*lazyPartition, 0, len(r.p))
+	for _, p := range r.p {
+		if p.acquired.Load() {
+			partitions = append(partitions, p)
+		}
+	}
+	r.m.Unlock()
+	for _, p := range partitions {
+		select {
+		case <-p.loaded:
+			if p.loadErr != nil && !r.bestEffort {
+				return p.loadErr
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package symdb
+
+import (
+	"context"
+	"sync"
+)
+
+// WithProgress specifies the function to be called as stack traces
+// are resolved: resolved is the number of stack traces processed so
+// far, and total is the number of distinct stack traces of all the
+// partitions to be resolved. The function is called periodically,
+// and at least once per partition; calls are serialized.
+//
+// The function is never called once Release returns.
+func WithProgress(fn func(resolved, total uint64)) ResolverOption {
+	return func(r *Resolver) {
+		r.progress = &progressReporter{fn: fn}
+	}
+}
+
+// progressReportInterval defines how often, in stack traces,
+// the progress is reported.
+const progressReportInterval = 1 << 10
+
+type progressReporter struct {
+	fn func(resolved, total uint64)
+
+	m        sync.Mutex
+	total    uint64
+	resolved uint64
+	released bool
+}
+
+func (p *progressReporter) reset(total uint64) {
+	p.m.Lock()
+	p.total = total
+	p.resolved = 0
+	p.m.Unlock()
+}
+
+func (p *progressReporter) add(n uint64) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	// Stack traces might be resolved more than once
+	// (e.g., when the tree is truncated).
+	if p.resolved += n; p.resolved > p.total {
+		p.resolved = p.total
+	}
+	if !p.released {
+		p.fn(p.resolved, p.total)
+	}
+}
+
+func (p *progressReporter) init() {
+	p.m.Lock()
+	p.released = false
+	p.m.Unlock()
+}
+
+func (p *progressReporter) release() {
+	p.m.Lock()
+	p.released = true
+	p.m.Unlock()
+}
+
+// withProgress returns symbols that report the resolution progress.
+func (p *progressReporter) withProgress(s *Symbols) *Symbols {
+	c := *s
+	c.Stacktraces = &progressStacktraceResolver{
+		StacktraceResolver: s.Stacktraces,
+		progress:           p,
+	}
+	return &c
+}
+
+type progressStacktraceResolver struct {
+	StacktraceResolver
+	progress *progressReporter
+}
+
+func (r *progressStacktraceResolver) ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) error {
+	c := &progressInserter{StacktraceInserter: dst, progress: r.progress}
+	err := r.StacktraceResolver.ResolveStacktraceLocations(ctx, c, stacktraces)
+	r.progress.add(c.n)
+	return err
+}
+
+type progressInserter struct {
+	StacktraceInserter
+	progress *progressReporter
+	n        uint64
+}
+
+func (i *progressInserter) InsertStacktrace(stacktraceID uint32, locations []int32) {
+	i.StacktraceInserter.InsertStacktrace(stacktraceID, locations)
+	if i.n++; i.n == progressReportInterval {
+		i.progress.add(i.n)
+		i.n = 0
+	}
+}
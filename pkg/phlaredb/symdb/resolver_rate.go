@@ -0,0 +1,68 @@
+package symdb
+
+import (
+	"math"
+
+	"github.com/google/pprof/profile"
+)
+
+// rateUnitSuffix is appended to the units of the sample
+// types of the profiles resolved with WithRate.
+const rateUnitSuffix = "/s"
+
+// WithRate specifies that the resolved values are expressed as a rate
+// per second, given the duration of the profile in nanoseconds: values
+// of the tree nodes and the profile samples are divided by the duration
+// in seconds, once the samples are aggregated, and rounded to the nearest
+// integer: values of less than a half per second are therefore zeroed.
+// Totals of the tree nodes are recomputed from the self values, so that
+// the rounding does not break the tree structure.
+//
+// The option applies to:
+//   - Tree, TreeSampled, and the tree of WithRootLabel, including the
+//     trees given to MergeTreeProfiles, and the methods built on Tree:
+//     Flamegraph, WriteTreeNDJSON, and WriteChromeTrace.
+//   - TreeSeries.
+//   - Profile, and the methods built on it: ProfileProto, ProfileGeneric,
+//     and ProfileOTLP.
+//   - PartitionSamples, and therefore symdbarrow.Records.
+//   - The pprof writer: WriteProfile, Bytes, and ProfileInto.
+//
+// Other methods, e.g., TreeByLabel, TreeInverted, and Top, return the
+// values added. ProfileProto, ProfileGeneric, WriteProfile, and Bytes
+// append "/s" to the units of the sample types. WithMinValue still
+// refers to the values added. The option is ignored, if the duration
+// is not positive.
+func WithRate(durationNanos int64) ResolverOption {
+	return func(r *Resolver) {
+		r.rate = durationNanos
+	}
+}
+
+func (r *Resolver) perSecond(v int64) int64 {
+	return int64(math.Round(float64(v) * 1e9 / float64(r.rate)))
+}
+
+// rateFunc returns the function converting the values
+// to the rate per second, or nil, if the rate is not set.
+func (r *Resolver) rateFunc() func(int64) int64 {
+	if r.rate > 0 {
+		return r.perSecond
+	}
+	return nil
+}
+
+// rateMeta returns the metadata with the rate unit suffix appended
+// to the units of the sample types, if the rate is specified. The
+// sample types of the given metadata are not modified.
+func (r *Resolver) rateMeta(meta ProfileMeta) ProfileMeta {
+	if r.rate <= 0 || len(meta.SampleType) == 0 {
+		return meta
+	}
+	types := make([]*profile.ValueType, len(meta.SampleType))
+	for i, t := range meta.SampleType {
+		types[i] = &profile.ValueType{Type: t.Type, Unit: t.Unit + rateUnitSuffix}
+	}
+	meta.SampleType = types
+	return meta
+}
@@ -0,0 +1,81 @@
+package symdb
+
+import (
+	"context"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// WithRecursionFolding specifies that consecutive frames of the same
+// function are collapsed into a single frame, so that a recursive call
+// chain is represented by one node. Frames are identical if they refer
+// to the same functions, including the inlined ones, regardless of the
+// call site. Unsymbolized frames are only folded, if they refer to the
+// same location. The value of the stack trace is preserved and
+// attributed to the leaf, therefore the total value does not change.
+func WithRecursionFolding() ResolverOption {
+	return func(r *Resolver) {
+		r.recursionFolding = true
+	}
+}
+
+// withRecursionFolding returns symbols that resolve stack
+// traces with consecutive identical frames collapsed.
+func withRecursionFolding(s *Symbols) *Symbols {
+	if len(s.Locations) == 0 {
+		return s
+	}
+	x := *s
+	x.Stacktraces = &recursionFoldingStacktraceResolver{
+		StacktraceResolver: s.Stacktraces,
+		locations:          s.Locations,
+	}
+	return &x
+}
+
+type recursionFoldingStacktraceResolver struct {
+	StacktraceResolver
+	locations []*schemav1.InMemoryLocation
+}
+
+func (r *recursionFoldingStacktraceResolver) ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) error {
+	return r.StacktraceResolver.ResolveStacktraceLocations(ctx, &recursionFoldingInserter{
+		StacktraceInserter: dst,
+		resolver:           r,
+	}, stacktraces)
+}
+
+type recursionFoldingInserter struct {
+	StacktraceInserter
+	resolver  *recursionFoldingStacktraceResolver
+	locations []int32
+}
+
+func (i *recursionFoldingInserter) InsertStacktrace(stacktraceID uint32, locations []int32) {
+	i.locations = i.locations[:0]
+	for _, loc := range locations {
+		if n := len(i.locations); n > 0 && i.resolver.sameFunctions(i.locations[n-1], loc) {
+			continue
+		}
+		i.locations = append(i.locations, loc)
+	}
+	i.StacktraceInserter.InsertStacktrace(stacktraceID, i.locations)
+}
+
+func (r *recursionFoldingStacktraceResolver) sameFunctions(a, b int32) bool {
+	if a == b {
+		return true
+	}
+	x, y := r.locations[a].Line, r.locations[b].Line
+	// Distinct unsymbolized locations refer to different
+	// addresses, which are not known to be of one function.
+	if len(x) != len(y) || len(x) == 0 {
+		return false
+	}
+	for i := range x {
+		if x[i].FunctionId != y[i].FunctionId {
+			return false
+		}
+	}
+	return true
+}
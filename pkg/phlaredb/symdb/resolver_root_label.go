@@ -0,0 +1,84 @@
+package symdb
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/grafana/pyroscope/pkg/model"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// UnknownRootLabelValue is the name of the root frame
+// of the samples that lack the label, see WithRootLabel.
+const UnknownRootLabelValue = "[unknown]"
+
+// WithRootLabel splits the tree returned by Tree by the value of the
+// label key: a synthetic root frame named after the label value is
+// prepended to the stack traces, for example, to group samples of a
+// goroutine profile by the goroutine state. The labels of the samples
+// are those given to AddSamplesWithLabels, and the sample labels of
+// the profiles given to MergeTreeProfiles; samples that lack the label
+// are grouped under UnknownRootLabelValue, and so are the samples of
+// value types other than 0, see WithTreeValueIndex. The total value of
+// the tree is not affected. WithMinValue option is not applied.
+func WithRootLabel(key string) ResolverOption {
+	return func(r *Resolver) {
+		r.rootLabel = key
+	}
+}
+
+// rootLabelTree builds the tree of WithRootLabel. The stack traces
+// are sampled with the rate given, if it is less than 1, see
+// TreeSampled.
+func (r *Resolver) rootLabelTree(ctx context.Context, rate float64) (*model.Tree, error) {
+	seed := rand.Int63()
+	return r.buildTree(ctx, func(symbols *Symbols, p *lazyPartition, _ schemav1.Samples) (*model.Tree, error) {
+		values, samples := p.samplesByLabel(r.rootLabel, r.treeValueIdx)
+		if rate < 1 {
+			rnd := rand.New(rand.NewSource(seed + int64(p.id)))
+			samples = sampleMultiValueStacktraces(samples, rate, rnd)
+		}
+		t := &rootLabelTreeSymbols{
+			symbols: symbols,
+			samples: &samples,
+			roots:   values,
+		}
+		for i, v := range t.roots {
+			if v == "" {
+				t.roots[i] = UnknownRootLabelValue
+			}
+		}
+		if err := symbols.Stacktraces.ResolveStacktraceLocations(ctx, t, samples.StacktraceIDs); err != nil {
+			return nil, err
+		}
+		return t.tree.Build(), nil
+	})
+}
+
+// rootLabelTreeSymbols inserts the stack traces of each of the sample
+// value columns with the root frame of the column prepended.
+type rootLabelTreeSymbols struct {
+	symbols *Symbols
+	samples *multiValueSamples
+	roots   []string
+	tree    TreeBuilder
+	lines   []string
+	cur     int
+}
+
+func (r *rootLabelTreeSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	i := r.cur
+	r.cur++
+	r.lines = r.lines[:0]
+	for j, values := range r.samples.Values {
+		v := int64(values[i])
+		if v == 0 {
+			continue
+		}
+		if len(r.lines) == 0 {
+			r.lines = r.symbols.appendFunctionNames(append(r.lines, ""), locations)
+		}
+		r.lines[0] = r.roots[j]
+		r.tree.Insert(r.lines, v)
+	}
+}
@@ -0,0 +1,68 @@
+package symdb
+
+import (
+	"context"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/grafana/pyroscope/pkg/model"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// TreeRootedAt builds a tree of the stack traces that include the
+// function, rooted at the first (outermost) occurrence of it: frames
+// of the callers are omitted, and stack traces that do not include
+// the function are excluded. Therefore, the total value of the tree
+// is the sum of the totals of the outermost nodes of the function in
+// the tree returned by Tree. WithMinValue option is not applied.
+func (r *Resolver) TreeRootedAt(functionName string) (*model.Tree, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.TreeRootedAt")
+	defer span.Finish()
+	var lock sync.Mutex
+	tree := new(model.Tree)
+	err := r.withSymbols(ctx, func(symbols *Symbols, samples schemav1.Samples) error {
+		resolved, err := symbols.treeRootedAt(ctx, samples, functionName)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		tree.Merge(resolved)
+		lock.Unlock()
+		return nil
+	})
+	return tree, err
+}
+
+func (r *Symbols) treeRootedAt(ctx context.Context, samples schemav1.Samples, functionName string) (*model.Tree, error) {
+	t := &rootedTreeSymbols{
+		symbols: r,
+		samples: &samples,
+		root:    functionName,
+	}
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, t, samples.StacktraceIDs); err != nil {
+		return nil, err
+	}
+	return t.tree.Build(), nil
+}
+
+type rootedTreeSymbols struct {
+	symbols *Symbols
+	samples *schemav1.Samples
+	tree    TreeBuilder
+	root    string
+	lines   []string
+	cur     int
+}
+
+func (r *rootedTreeSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	v := int64(r.samples.Values[r.cur])
+	r.cur++
+	r.lines = r.symbols.appendFunctionNames(r.lines[:0], locations)
+	for i, name := range r.lines {
+		if name == r.root {
+			r.tree.Insert(r.lines[i:], v)
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package symdb
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/grafana/pyroscope/pkg/model"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// TreeSampled builds an approximate tree from a random sample of the
+// stack traces: each distinct stack trace is included independently
+// with the probability rate, and its value is scaled by 1/rate. Only
+// the sampled stack traces are resolved, therefore the call is roughly
+// 1/rate times cheaper than Tree.
+//
+// The estimated total of the tree is unbiased. Given the values v[i]
+// of the distinct stack traces, its standard deviation is
+//
+//	σ = sqrt((1-rate)/rate * Σ v[i]²)
+//
+// By Chebyshev's inequality, the estimated total deviates from the
+// exact one by more than k*σ with the probability of at most 1/k²,
+// regardless of the value distribution. Scaled values are rounded,
+// which adds at most 0.5 per sampled stack trace. The bound is tight
+// when the values are evenly distributed; a few dominating stack
+// traces make the estimate less accurate.
+//
+// The options of Tree are honoured, e.g., WithTreeValueIndex and
+// WithRootLabel; the values merged with MergeTreeProfiles are not
+// sampled. Rate 1 or greater is equivalent to Tree. Rate must be
+// positive.
+func (r *Resolver) TreeSampled(rate float64) (*model.Tree, error) {
+	if rate >= 1 {
+		return r.Tree()
+	}
+	if !(rate > 0) {
+		return nil, fmt.Errorf("invalid sampling rate: %v", rate)
+	}
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.TreeSampled")
+	defer span.Finish()
+	span.SetTag("rate", rate)
+	if r.rootLabel != "" {
+		return r.rootLabelTree(ctx, rate)
+	}
+	seed := rand.Int63()
+	return r.buildTree(ctx, func(symbols *Symbols, p *lazyPartition, samples schemav1.Samples) (*model.Tree, error) {
+		rnd := rand.New(rand.NewSource(seed + int64(p.id)))
+		return symbols.tree(ctx, sampleStacktraces(samples, rate, rnd), r.minValue, nil)
+	})
+}
+
+// sampleStacktraces retains each of the samples with the probability
+// rate, scaling the values by 1/rate. Values are signed, e.g., of diff
+// profiles. Samples are modified in place.
+func sampleStacktraces(s schemav1.Samples, rate float64, rnd *rand.Rand) schemav1.Samples {
+	var j int
+	for i, v := range s.Values {
+		if rnd.Float64() >= rate {
+			continue
+		}
+		s.StacktraceIDs[j] = s.StacktraceIDs[i]
+		s.Values[j] = scaleSampled(v, rate)
+		j++
+	}
+	s.StacktraceIDs = s.StacktraceIDs[:j]
+	s.Values = s.Values[:j]
+	return s
+}
+
+// sampleMultiValueStacktraces is sampleStacktraces for samples
+// of multiple value types: all the values of a stack trace are
+// either retained or dropped together.
+func sampleMultiValueStacktraces(s multiValueSamples, rate float64, rnd *rand.Rand) multiValueSamples {
+	var j int
+	for i, sid := range s.StacktraceIDs {
+		if rnd.Float64() >= rate {
+			continue
+		}
+		s.StacktraceIDs[j] = sid
+		for _, values := range s.Values {
+			values[j] = scaleSampled(values[i], rate)
+		}
+		j++
+	}
+	s.StacktraceIDs = s.StacktraceIDs[:j]
+	for t := range s.Values {
+		s.Values[t] = s.Values[t][:j]
+	}
+	return s
+}
+
+func scaleSampled(v uint64, rate float64) uint64 {
+	return uint64(int64(math.Round(float64(int64(v)) / rate)))
+}
@@ -0,0 +1,140 @@
+package symdb
+
+import (
+	"context"
+	"sort"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/grafana/pyroscope/pkg/iter"
+	"github.com/grafana/pyroscope/pkg/model"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// ResolvedSample is a sample of a resolved stack trace,
+// see Resolver.PartitionSamples.
+type ResolvedSample struct {
+	// Stack holds the function names of the stack trace, from the
+	// root to the leaf. Inlined functions are included.
+	Stack []string
+	Value int64
+	// Labels of the sample, see AddSamplesWithLabels.
+	Labels model.Labels
+}
+
+// PartitionSamples resolves the samples and calls fn with the iterator
+// of the samples of each of the partitions: a sample is yielded for
+// each of the label sets of the stack trace, and the values that are
+// not attributed to any of the label sets make up an unlabeled sample.
+// Samples with zero value are omitted, and the values are converted to
+// the rate, if specified with WithRate. Stack traces are ordered by the
+// stack trace identifier, and label sets are ordered by hash, therefore
+// the order of the samples is deterministic.
+//
+// fn may be called concurrently for different partitions. The iterator
+// must not be used after fn returns, and the stack of the sample is only
+// valid until the next call of Next. If fn returns an error, the
+// resolution stops, and the error is returned.
+func (r *Resolver) PartitionSamples(ctx context.Context, fn func(partition uint64, samples iter.Iterator[ResolvedSample]) error) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Resolver.PartitionSamples")
+	defer span.Finish()
+	return r.withPartitionSymbols(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		stacktraces, err := symbols.locations(ctx, schemav1.NewSamplesFromMap(p.samples))
+		if err != nil {
+			return err
+		}
+		it := &partitionSamplesIterator{
+			ctx:         ctx,
+			resolver:    r,
+			symbols:     symbols,
+			stacktraces: stacktraces,
+			labeled:     p.sortedLabeledSamples(),
+			resolved:    -1,
+		}
+		return fn(p.id, it)
+	})
+}
+
+// sortedLabeledSamples returns the samples
+// of the label sets, ordered by hash.
+func (p *lazyPartition) sortedLabeledSamples() []*labeledSamples {
+	hashes := make([]uint64, 0, len(p.labeled))
+	for h := range p.labeled {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	labeled := make([]*labeledSamples, len(hashes))
+	for i, h := range hashes {
+		labeled[i] = p.labeled[h]
+	}
+	return labeled
+}
+
+type partitionSamplesIterator struct {
+	ctx         context.Context
+	resolver    *Resolver
+	symbols     *Symbols
+	stacktraces []StacktraceLocations
+	labeled     []*labeledSamples
+
+	// Current stack trace, and the label set to be visited next:
+	// len(labeled) refers to the unlabeled remainder of the value.
+	cur int
+	set int
+	rem int64
+	// Stack trace the names of the stack have been resolved for.
+	resolved int
+	sample   ResolvedSample
+	err      error
+}
+
+func (it *partitionSamplesIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for ; it.cur < len(it.stacktraces); it.cur, it.set = it.cur+1, 0 {
+		st := &it.stacktraces[it.cur]
+		if it.set == 0 {
+			if it.err = it.ctx.Err(); it.err != nil {
+				return false
+			}
+			it.rem = st.Value
+		}
+		for it.set < len(it.labeled) {
+			ls := it.labeled[it.set]
+			it.set++
+			if v := ls.samples[st.StacktraceID]; v != 0 {
+				it.rem -= v
+				it.setSample(v, ls.labels)
+				return true
+			}
+		}
+		if it.set == len(it.labeled) {
+			it.set++
+			if it.rem != 0 {
+				it.setSample(it.rem, nil)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (it *partitionSamplesIterator) setSample(v int64, labels model.Labels) {
+	if it.resolved != it.cur {
+		it.resolved = it.cur
+		locations := it.stacktraces[it.cur].Locations
+		it.sample.Stack = it.symbols.appendFunctionNames(it.sample.Stack[:0], locations)
+	}
+	if it.resolver.rate > 0 {
+		v = it.resolver.perSecond(v)
+	}
+	it.sample.Value = v
+	it.sample.Labels = labels
+}
+
+func (it *partitionSamplesIterator) At() ResolvedSample { return it.sample }
+
+func (it *partitionSamplesIterator) Err() error { return it.err }
+
+func (it *partitionSamplesIterator) Close() error { return nil }
@@ -0,0 +1,187 @@
+package symdb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/grafana/pyroscope/pkg/model"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+// AddSamplesWithTimestamp adds a collection of stack trace samples
+// collected at the time given, e.g., the samples of a profile. The
+// samples are resolved as if they were added with AddSamples; in
+// addition, TreeSeries can split them by time.
+func (r *Resolver) AddSamplesWithTimestamp(partition uint64, s schemav1.Samples, t time.Time) {
+	p := r.partition(partition)
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.timed == nil {
+		p.timed = make(map[int64]map[uint32]int64)
+	}
+	ts := t.UnixNano()
+	samples, ok := p.timed[ts]
+	if !ok {
+		samples = make(map[uint32]int64)
+		p.timed[ts] = samples
+	}
+	for i, sid := range s.StacktraceIDs {
+		if sid > 0 {
+			v := r.value(s.Values[i])
+			p.samples[sid] += v
+			samples[sid] += v
+		}
+	}
+	if len(p.samples) > 0 {
+		r.acquire(p)
+	}
+}
+
+// TimestampLabel is the numeric label Profile attaches to the samples
+// added with AddSamplesWithTimestamp, if WithSampleTimestamps is used.
+const TimestampLabel = "timestamp"
+
+// WithSampleTimestamps specifies that Profile carries the timestamps
+// of the samples added with AddSamplesWithTimestamp to the resolved
+// profile: a distinct sample is created for each of the timestamps of
+// the stack trace, with the TimestampLabel numeric label holding the
+// Unix time in nanoseconds. Samples without timestamps are left unset.
+// Similarly to WithSampleLabels, the timestamps only apply to the
+// values added with AddSamplesWithTimestamp.
+func WithSampleTimestamps() ResolverOption {
+	return func(r *Resolver) {
+		r.sampleTimestamps = true
+	}
+}
+
+// timestampGroups returns the samples of the timestamps of the
+// partition, ordered by time, see splitSamples.
+func (p *lazyPartition) timestampGroups() []sampleGroup {
+	timestamps := make([]int64, 0, len(p.timed))
+	for ts := range p.timed {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	groups := make([]sampleGroup, len(timestamps))
+	for i, ts := range timestamps {
+		ts := ts
+		groups[i] = sampleGroup{
+			samples: p.timed[ts],
+			set: func(s *profile.Sample) {
+				s.NumLabel = map[string][]int64{TimestampLabel: {ts}}
+				s.NumUnit = map[string][]string{TimestampLabel: {"nanoseconds"}}
+			},
+		}
+	}
+	return groups
+}
+
+// TreeSeriesPoint is a tree of the samples of a time bucket.
+type TreeSeriesPoint struct {
+	// Start of the bucket, inclusive.
+	Start time.Time
+	Tree  *model.Tree
+}
+
+// TreeSeries resolves the samples added with AddSamplesWithTimestamp
+// and builds a tree for each of the time buckets of the duration given:
+// the buckets are aligned to the Unix epoch, and a sample belongs to
+// the bucket its timestamp falls into. Points are ordered by time, and
+// buckets without samples are omitted. Stack traces are resolved once
+// for all the buckets, and the trees sum up to the tree returned by
+// Tree, if all the samples have been added with timestamps; samples
+// without timestamps are not included. WithMinValue is not applied.
+func (r *Resolver) TreeSeries(bucket time.Duration) ([]TreeSeriesPoint, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.TreeSeries")
+	defer span.Finish()
+	if bucket <= 0 {
+		return nil, fmt.Errorf("invalid bucket duration: %v", bucket)
+	}
+	var lock sync.Mutex
+	trees := make(map[int64]*model.Tree)
+	err := r.withPartitionSymbols(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		starts, samples := p.samplesByTime(int64(bucket))
+		if len(starts) == 0 {
+			return nil
+		}
+		resolved, err := symbols.trees(ctx, samples)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for i, tree := range resolved {
+			if t, ok := trees[starts[i]]; ok {
+				t.Merge(tree)
+				continue
+			}
+			trees[starts[i]] = tree
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	series := make([]TreeSeriesPoint, 0, len(trees))
+	for start, tree := range trees {
+		if r.rate > 0 {
+			tree.TransformSelfValues(r.perSecond)
+		}
+		series = append(series, TreeSeriesPoint{Start: time.Unix(0, start), Tree: tree})
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].Start.Before(series[j].Start)
+	})
+	return series, nil
+}
+
+// samplesByTime returns the timestamped samples of the partition grouped
+// by the time bucket: values of the i-th bucket are at the i-th column.
+func (p *lazyPartition) samplesByTime(bucket int64) ([]int64, multiValueSamples) {
+	buckets := make(map[int64]map[uint32]int64)
+	stacktraces := make(map[uint32]int64)
+	for ts, samples := range p.timed {
+		start := ts - ts%bucket
+		if ts%bucket < 0 {
+			start -= bucket
+		}
+		b, ok := buckets[start]
+		if !ok {
+			b = make(map[uint32]int64, len(samples))
+			buckets[start] = b
+		}
+		for sid, v := range samples {
+			b[sid] += v
+			stacktraces[sid] = 0
+		}
+	}
+	for start, b := range buckets {
+		if isEmpty(b) {
+			delete(buckets, start)
+		}
+	}
+	starts := make([]int64, 0, len(buckets))
+	for start := range buckets {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	s := schemav1.NewSamplesFromMap(stacktraces)
+	samples := multiValueSamples{
+		StacktraceIDs: s.StacktraceIDs,
+		Values:        make([][]uint64, len(starts)),
+	}
+	for i, start := range starts {
+		b := buckets[start]
+		column := make([]uint64, len(s.StacktraceIDs))
+		for j, sid := range s.StacktraceIDs {
+			column[j] = uint64(b[sid])
+		}
+		samples.Values[i] = column
+	}
+	return starts, samples
+}
@@ -0,0 +1,70 @@
+package symdb
+
+import (
+	"sort"
+	"time"
+)
+
+// ResolverPartitionStats describes resolution of a partition.
+type ResolverPartitionStats struct {
+	Partition uint64
+	// Number of distinct stack traces resolved.
+	Stacktraces int
+	// Number of symbols of the partition loaded.
+	Locations int
+	Mappings  int
+	Functions int
+	Strings   int
+	// BytesRead is the estimated amount of data fetched from the
+	// storage to load the partition. Zero, if the partition data
+	// resides in memory, or the amount is not known.
+	BytesRead int64
+	// LoadDuration is the wall time spent on loading the partition.
+	LoadDuration time.Duration
+	// ResolveDuration is the wall time spent on resolving
+	// stack traces of the partition, once it has been loaded.
+	ResolveDuration time.Duration
+}
+
+// Stats returns statistics of the partitions resolved, ordered by
+// the partition identifier. Partitions that have not been resolved
+// are not included. Stats should be called after the resolution
+// completes, e.g. after Tree or Profile returns.
+func (r *Resolver) Stats() []ResolverPartitionStats {
+	r.m.Lock()
+	defer r.m.Unlock()
+	stats := make([]ResolverPartitionStats, 0, len(r.p))
+	for _, p := range r.p {
+		if p.stats != nil {
+			stats = append(stats, *p.stats)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Partition < stats[j].Partition
+	})
+	return stats
+}
+
+type bytesReader interface{ bytesRead() int64 }
+
+func (r *Resolver) observePartition(p *lazyPartition, pr PartitionReader, symbols *Symbols, start time.Time) {
+	s := ResolverPartitionStats{
+		Partition:       p.id,
+		Stacktraces:     p.stacktraces(),
+		Locations:       len(symbols.Locations),
+		Mappings:        len(symbols.Mappings),
+		Functions:       len(symbols.Functions),
+		Strings:         len(symbols.Strings),
+		LoadDuration:    p.loadDuration,
+		ResolveDuration: time.Since(start),
+	}
+	if b, ok := pr.(bytesReader); ok {
+		s.BytesRead = b.bytesRead()
+	}
+	r.m.Lock()
+	p.stats = &s
+	r.m.Unlock()
+	if r.metrics != nil {
+		r.metrics.observe(&s)
+	}
+}
@@ -0,0 +1,70 @@
+package symdb
+
+import (
+	"sync"
+
+	profilev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
+)
+
+// StringTable is a read-only view of the string table of a resolved
+// profile: it maps the string indices of the profile to the strings,
+// and the strings back to the indices. StringTable is safe for
+// concurrent use.
+type StringTable struct {
+	strings []string
+	once    sync.Once
+	index   map[string]int64
+}
+
+func newStringTable(p *profilev1.Profile) *StringTable {
+	t := &StringTable{strings: make([]string, len(p.StringTable))}
+	copy(t.strings, p.StringTable)
+	return t
+}
+
+// Len returns the number of strings in the table.
+func (t *StringTable) Len() int { return len(t.strings) }
+
+// At returns the string at the index i, or an empty
+// string, if the index is out of the table bounds.
+func (t *StringTable) At(i int64) string {
+	if i < 0 || i >= int64(len(t.strings)) {
+		return ""
+	}
+	return t.strings[i]
+}
+
+// Index returns the index of the string in the table, and false,
+// if the table does not contain the string.
+func (t *StringTable) Index(s string) (int64, bool) {
+	t.once.Do(func() {
+		if t.index != nil {
+			return
+		}
+		t.index = make(map[string]int64, len(t.strings))
+		for i, x := range t.strings {
+			if _, ok := t.index[x]; !ok {
+				t.index[x] = int64(i)
+			}
+		}
+	})
+	i, ok := t.index[s]
+	return i, ok
+}
+
+// StringTable returns the string table of the profile produced by
+// the last ProfileProto or ProfileInto call, or nil, if the profile
+// has not been produced. In contrast to the StringTable field of the
+// profile, the table is not affected by the subsequent calls, nor by
+// modifications of the profile.
+func (r *Resolver) StringTable() *StringTable {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.stringTable
+}
+
+func (r *Resolver) setStringTable(t *StringTable) {
+	r.m.Lock()
+	r.stringTable = t
+	r.m.Unlock()
+}
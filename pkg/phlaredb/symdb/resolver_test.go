@@ -1,16 +1,43 @@
 package symdb
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/rand"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/cespare/xxhash/v2"
+	"github.com/google/pprof/profile"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 
+	googlev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
+	"github.com/grafana/pyroscope/pkg/iter"
+	"github.com/grafana/pyroscope/pkg/model"
+	"github.com/grafana/pyroscope/pkg/objstore/providers/filesystem"
 	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/pyroscope/pkg/pprof"
+	"github.com/grafana/pyroscope/pkg/slices"
 )
 
 func Test_memory_Resolver_ResolveProfile(t *testing.T) {
@@ -42,94 +69,4453 @@ func Test_memory_Resolver_ResolveProfile_multiple_partitions(t *testing.T) {
 	require.Equal(t, expectedFingerprint, profileFingerprint(resolved, 0))
 }
 
+func Test_memory_Resolver_MergeProfiles(t *testing.T) {
+	s := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	for i := range expectedFingerprint {
+		expectedFingerprint[i][1] *= 2
+	}
+	resolve := func() *Resolver {
+		r := NewResolver(context.Background(), s.db)
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		return r
+	}
+
+	t.Run("Profile", func(t *testing.T) {
+		profiles := make([]*profile.Profile, 2)
+		for i := range profiles {
+			r := resolve()
+			p, err := r.Profile()
+			require.NoError(t, err)
+			r.Release()
+			profiles[i] = p
+		}
+		merged, err := MergeProfiles(profiles...)
+		require.NoError(t, err)
+		require.Equal(t, expectedFingerprint, profileFingerprint(merged, 0))
+	})
+
+	t.Run("ProfileProto", func(t *testing.T) {
+		profiles := make([]*googlev1.Profile, 2)
+		for i := range profiles {
+			r := resolve()
+			p, err := r.ProfileProto(ProfileMeta{})
+			require.NoError(t, err)
+			r.Release()
+			profiles[i] = p
+		}
+		// Make sure the string tables differ.
+		reverseStrings(profiles[1])
+
+		merged, err := MergeProfilesProto(profiles...)
+		require.NoError(t, err)
+		merged.SampleType = []*googlev1.ValueType{{}}
+		b, err := merged.MarshalVT()
+		require.NoError(t, err)
+		p, err := profile.ParseData(b)
+		require.NoError(t, err)
+		require.Equal(t, expectedFingerprint, profileFingerprint(p, 0))
+	})
+
+	t.Run("Tree", func(t *testing.T) {
+		trees := make([]*model.Tree, 2)
+		for i := range trees {
+			r := resolve()
+			tree, err := r.Tree()
+			require.NoError(t, err)
+			r.Release()
+			trees[i] = tree
+		}
+		require.Equal(t, expectedFingerprint, treeFingerprint(MergeTrees(trees...)))
+	})
+}
+
+// reverseStrings reverses the string table of the
+// profile, except for the empty string at index 0.
+func reverseStrings(p *googlev1.Profile) {
+	n := len(p.StringTable)
+	idx := make([]uint32, n)
+	for i := 1; i < n; i++ {
+		idx[i] = uint32(n - i)
+	}
+	slices.Reverse(p.StringTable[1:])
+	pprof.RewriteStrings(p, idx)
+}
+
+func Test_block_Resolver_ResolveProfile_multiple_value_types(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	for i, p := range s.indexed[0] {
+		r.AddSamplesWithValueIndex(0, p.Samples, i)
+	}
+	resolved, err := r.Profile()
+	require.NoError(t, err)
+	for i := range s.indexed[0] {
+		expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, i)
+		require.Equal(t, expectedFingerprint, profileFingerprint(resolved, i))
+	}
+}
+
+func Test_memory_Resolver_ResolveTree_multiple_partitions_concurrently(t *testing.T) {
+	s := newMemSuite(t, [][]string{
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+	})
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	for i := range expectedFingerprint {
+		expectedFingerprint[i][1] *= uint64(len(s.files))
+	}
+	for _, n := range []int{1, 2, len(s.files)} {
+		r := NewResolver(context.Background(), s.db, WithMaxConcurrent(n))
+		for p := range s.files {
+			r.AddSamples(uint64(p), s.indexed[uint64(p)][0].Samples)
+		}
+		resolved, err := r.Tree()
+		require.NoError(t, err)
+		require.Equal(t, expectedFingerprint, treeFingerprint(resolved))
+		r.Release()
+	}
+}
+
+func Test_block_Resolver_Tree_MarshalBinary(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	b, err := tree.MarshalBinary()
+	require.NoError(t, err)
+	decoded := new(model.Tree)
+	require.NoError(t, decoded.UnmarshalBinary(b))
+	require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 0), treeFingerprint(decoded))
+	require.Equal(t, tree.String(), decoded.String())
+}
+
+func Test_memory_Resolver_Tree_stable_order(t *testing.T) {
+	s := newMemSuite(t, [][]string{
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+	})
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		for _, n := range []int{1, 2, len(s.files)} {
+			r := NewResolver(context.Background(), s.db, WithMaxConcurrent(n))
+			for p := range s.files {
+				r.AddSamples(uint64(p), s.indexed[uint64(p)][0].Samples)
+			}
+			resolved, err := r.Tree()
+			require.NoError(t, err)
+			r.Release()
+			b, err := json.Marshal(resolved)
+			require.NoError(t, err)
+			if expected == nil {
+				expected = b
+				continue
+			}
+			require.Equal(t, expected, b)
+		}
+	}
+}
+
+func Test_block_Resolver_WriteTreeNDJSON(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteTreeNDJSON(context.Background(), &buf))
+
+	// Parents precede their children, and the totals of
+	// the nodes sum up from the self values of the subtree.
+	nodes := make(map[int64]TreeNode)
+	children := make(map[int64]int64)
+	var total int64
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var n TreeNode
+		require.NoError(t, dec.Decode(&n))
+		require.Equal(t, int64(len(nodes)+1), n.ID)
+		if n.Parent != 0 {
+			_, ok := nodes[n.Parent]
+			require.True(t, ok, "parent of node %d not found", n.ID)
+			children[n.Parent] += n.Total
+		} else {
+			total += n.Total
+		}
+		nodes[n.ID] = n
+	}
+	for id, n := range nodes {
+		require.Equal(t, n.Total, n.Self+children[id])
+	}
+
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, tree.Total(), total)
+	var n int
+	tree.IterateNodes(func(int64, int64, string, int64, int64) bool {
+		n++
+		return true
+	})
+	require.Len(t, nodes, n)
+}
+
+func Test_block_Resolver_WriteProfile(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	meta := ProfileMeta{
+		SampleType:    []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:        10000000,
+		TimeNanos:     1700000000000000000,
+		DurationNanos: 10000000000,
+	}
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteProfile(context.Background(), &buf, meta))
+
+	resolved, err := profile.Parse(&buf)
+	require.NoError(t, err)
+	require.Equal(t, expectedFingerprint, profileFingerprint(resolved, 0))
+	require.Equal(t, meta.SampleType, resolved.SampleType)
+	require.Equal(t, meta.PeriodType, resolved.PeriodType)
+	require.Equal(t, meta.Period, resolved.Period)
+	require.Equal(t, meta.TimeNanos, resolved.TimeNanos)
+	require.Equal(t, meta.DurationNanos, resolved.DurationNanos)
+
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	meta.SampleType = append(meta.SampleType, meta.PeriodType)
+	require.Error(t, r.WriteProfile(context.Background(), io.Discard, meta))
+}
+
+func Test_memory_Resolver_WriteProfile_Partitions(t *testing.T) {
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	r := NewResolver(context.Background(), db)
+	defer r.Release()
+	for i := uint64(0); i < 4; i++ {
+		samples := db.WriteProfileSymbols(i, newRateTestProfile(3, 1))[0].Samples
+		r.AddSamples(i, samples)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteProfile(context.Background(), &buf, ProfileMeta{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+	}))
+	resolved, err := profile.Parse(&buf)
+	require.NoError(t, err)
+	require.Len(t, resolved.Sample, 8)
+	require.Len(t, resolved.Location, 12)
+	ids := make(map[uint64]struct{})
+	for _, loc := range resolved.Location {
+		ids[loc.ID] = struct{}{}
+	}
+	require.Len(t, ids, len(resolved.Location))
+	values := make(map[string]int64)
+	for _, x := range resolved.Sample {
+		values[x.Location[0].Line[0].Function.Name] += x.Value[0]
+	}
+	require.Equal(t, map[string]int64{"foo": 12, "bar": 4}, values)
+}
+
+func Test_memory_Resolver_WriteProfile_ProfileOnlyOptions(t *testing.T) {
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, newRateTestProfile(3, 1))[0].Samples
+	meta := ProfileMeta{SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}}}
+	for _, opt := range []ResolverOption{
+		WithSampleLabels(),
+		WithSampleTimestamps(),
+		WithLocationDedup(),
+	} {
+		r := NewResolver(context.Background(), db, opt)
+		r.AddSamples(0, samples)
+		require.ErrorIs(t, r.WriteProfile(context.Background(), io.Discard, meta), ErrProfileOnlyOption)
+		_, err := r.Bytes(context.Background(), meta, CompressionNone)
+		require.ErrorIs(t, err, ErrProfileOnlyOption)
+		require.ErrorIs(t, r.ProfileInto(new(googlev1.Profile)), ErrProfileOnlyOption)
+		_, err = r.Profile()
+		require.NoError(t, err)
+		r.Release()
+	}
+}
+
+func Test_block_Resolver_Bytes(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	meta := ProfileMeta{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+	}
+	resolve := func(c Compression) []byte {
+		r := NewResolver(context.Background(), s.reader)
+		defer r.Release()
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		b, err := r.Bytes(context.Background(), meta, c)
+		require.NoError(t, err)
+		return b
+	}
+
+	expected := resolve(CompressionNone)
+	resolved, err := profile.ParseData(expected)
+	require.NoError(t, err)
+	require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 0), profileFingerprint(resolved, 0))
+	require.Equal(t, meta.SampleType, resolved.SampleType)
+	require.Equal(t, meta.Period, resolved.Period)
+
+	// Buffers and compressors are reused.
+	for i := 0; i < 2; i++ {
+		b := resolve(CompressionGzip)
+		_, err = profile.ParseData(b)
+		require.NoError(t, err)
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		require.NoError(t, err)
+		b, err = io.ReadAll(gr)
+		require.NoError(t, err)
+		require.Equal(t, expected, b)
+
+		zr, err := zstd.NewReader(nil)
+		require.NoError(t, err)
+		b, err = zr.DecodeAll(resolve(CompressionZstd), nil)
+		zr.Close()
+		require.NoError(t, err)
+		require.Equal(t, expected, b)
+		_, err = profile.ParseData(b)
+		require.NoError(t, err)
+	}
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	_, err = r.Bytes(context.Background(), meta, Compression(-1))
+	require.Error(t, err)
+}
+
+func Test_block_Resolver_ProfileInto(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	half := schemav1.Samples{
+		StacktraceIDs: samples.StacktraceIDs[:len(samples.StacktraceIDs)/2],
+		Values:        samples.Values[:len(samples.Values)/2],
+	}
+	fingerprint := func(p *googlev1.Profile) [][2]uint64 {
+		// Sample types are required to parse the profile.
+		p.SampleType = []*googlev1.ValueType{{}}
+		b, err := p.MarshalVT()
+		require.NoError(t, err)
+		resolved, err := profile.ParseData(b)
+		require.NoError(t, err)
+		return profileFingerprint(resolved, 0)
+	}
+
+	var p googlev1.Profile
+	// The profile is reused: the second resolution
+	// overwrites the contents of the first one.
+	for _, x := range []schemav1.Samples{samples, half, samples} {
+		r := NewResolver(context.Background(), s.reader)
+		r.AddSamples(0, x)
+		expected, err := r.Profile()
+		require.NoError(t, err)
+		r.Release()
+
+		r = NewResolver(context.Background(), s.reader)
+		r.AddSamples(0, x)
+		require.NoError(t, r.ProfileInto(&p))
+		r.Release()
+		require.Equal(t, profileFingerprint(expected, 0), fingerprint(&p))
+	}
+}
+
+func Test_block_Resolver_Top(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+
+	// Reference values computed from the source profile.
+	p := s.profiles[0].Profile
+	expected := make(map[string]TopFunction)
+	var total int64
+	for _, sample := range p.Sample {
+		v := sample.Value[0]
+		if v == 0 {
+			continue
+		}
+		total += v
+		seen := make(map[string]struct{})
+		for i, loc := range sample.LocationId {
+			lines := p.Location[loc].Line
+			for j, line := range lines {
+				name := p.StringTable[p.Function[line.FunctionId-1].Name]
+				f := expected[name]
+				f.Name = name
+				if i == 0 && j == 0 {
+					f.Self += v
+				}
+				if _, ok := seen[name]; !ok {
+					seen[name] = struct{}{}
+					f.Total += v
+				}
+				expected[name] = f
+			}
+		}
+	}
+
+	top := func(opts TopOptions) ([]TopFunction, error) {
+		r := NewResolver(context.Background(), s.reader)
+		defer r.Release()
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		return r.Top(opts)
+	}
+
+	for _, sortBy := range []TopSortBy{TopSortBySelf, TopSortByTotal} {
+		rows, err := top(TopOptions{SortBy: sortBy})
+		require.NoError(t, err)
+		require.Len(t, rows, len(expected))
+		var self int64
+		for i, row := range rows {
+			e := expected[row.Name]
+			require.Equal(t, e.Self, row.Self, row.Name)
+			require.Equal(t, e.Total, row.Total, row.Name)
+			require.InDelta(t, float64(row.Total)/float64(total)*100, row.Cum, 1e-9)
+			self += row.Self
+			if i == 0 {
+				continue
+			}
+			if sortBy == TopSortBySelf {
+				require.GreaterOrEqual(t, rows[i-1].Self, row.Self)
+			} else {
+				require.GreaterOrEqual(t, rows[i-1].Total, row.Total)
+			}
+		}
+		require.Equal(t, total, self)
+	}
+
+	rows, err := top(TopOptions{MaxRows: 10})
+	require.NoError(t, err)
+	require.Len(t, rows, 10)
+}
+
+func Test_block_Resolver_FlatSelf(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	flat, err := r.FlatSelf()
+	require.NoError(t, err)
+
+	var total, sum int64
+	for _, v := range samples.Values {
+		total += int64(v)
+	}
+	for _, v := range flat {
+		sum += v
+	}
+	require.Equal(t, total, sum)
+
+	// Self values match those of the top table.
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	top, err := r.Top(TopOptions{})
+	require.NoError(t, err)
+	expected := make(map[string]int64)
+	for _, f := range top {
+		if f.Self != 0 {
+			expected[f.Name] = f.Self
+		}
+	}
+	require.Equal(t, expected, flat)
+}
+
+func Test_block_Resolver_TopStacks(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	expected, err := r.Tree()
+	require.NoError(t, err)
+
+	for _, n := range []int{0, 1, 10, 1 << 20} {
+		r = NewResolver(context.Background(), s.reader)
+		defer r.Release()
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		top, err := r.TopStacks(n)
+		require.NoError(t, err)
+		if n < len(s.indexed[0][0].Samples.StacktraceIDs) {
+			require.Len(t, top.Stacks, n)
+		}
+		total := top.Other
+		for i, stack := range top.Stacks {
+			require.NotEmpty(t, stack.Functions)
+			if i > 0 {
+				require.GreaterOrEqual(t, top.Stacks[i-1].Value, stack.Value)
+			}
+			total += stack.Value
+		}
+		require.Equal(t, expected.Total(), total)
+	}
+}
+
+func Test_block_Resolver_CallGraph(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+
+	// Reference values computed from the source profile.
+	type edge struct{ caller, callee string }
+	p := s.profiles[0].Profile
+	nodes := make(map[string][2]int64)
+	edges := make(map[edge]int64)
+	for _, sample := range p.Sample {
+		v := sample.Value[0]
+		if v == 0 {
+			continue
+		}
+		var names []string
+		for _, loc := range sample.LocationId {
+			for _, line := range p.Location[loc].Line {
+				names = append(names, p.StringTable[p.Function[line.FunctionId-1].Name])
+			}
+		}
+		slices.Reverse(names)
+		seenNodes := make(map[string]struct{})
+		seenEdges := make(map[edge]struct{})
+		for i, name := range names {
+			n := nodes[name]
+			if i == len(names)-1 {
+				n[0] += v
+			}
+			if _, ok := seenNodes[name]; !ok {
+				seenNodes[name] = struct{}{}
+				n[1] += v
+			}
+			nodes[name] = n
+			if i == 0 {
+				continue
+			}
+			e := edge{names[i-1], name}
+			if _, ok := seenEdges[e]; !ok {
+				seenEdges[e] = struct{}{}
+				edges[e] += v
+			}
+		}
+	}
+
+	callGraph := func(opts CallGraphOptions) string {
+		r := NewResolver(context.Background(), s.reader)
+		defer r.Release()
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		var buf bytes.Buffer
+		require.NoError(t, r.CallGraph(&buf, opts))
+		return buf.String()
+	}
+
+	nodeRe := regexp.MustCompile(`^N(\d+) \[label="(.*)\\n(\d+) \(.*\)\\nof (\d+) \(.*\)"\]$`)
+	edgeRe := regexp.MustCompile(`^N(\d+) -> N(\d+) \[label=" (\d+)" weight=\d+\]$`)
+	unescape := strings.NewReplacer(`\\`, `\`, `\"`, `"`)
+	parse := func(dot string) (map[string][2]int64, map[edge]int64) {
+		lines := strings.Split(strings.TrimSpace(dot), "\n")
+		require.Equal(t, `digraph "callgraph" {`, lines[0])
+		require.Equal(t, "}", lines[len(lines)-1])
+		names := make(map[string]string)
+		n := make(map[string][2]int64)
+		e := make(map[edge]int64)
+		for _, line := range lines[2 : len(lines)-1] {
+			if m := nodeRe.FindStringSubmatch(line); m != nil {
+				name := unescape.Replace(m[2])
+				names[m[1]] = name
+				self, _ := strconv.ParseInt(m[3], 10, 64)
+				total, _ := strconv.ParseInt(m[4], 10, 64)
+				n[name] = [2]int64{self, total}
+				continue
+			}
+			m := edgeRe.FindStringSubmatch(line)
+			require.NotNil(t, m, line)
+			v, _ := strconv.ParseInt(m[3], 10, 64)
+			e[edge{names[m[1]], names[m[2]]}] = v
+		}
+		return n, e
+	}
+
+	actualNodes, actualEdges := parse(callGraph(CallGraphOptions{}))
+	require.Equal(t, nodes, actualNodes)
+	require.Equal(t, edges, actualEdges)
+
+	const threshold = 1000
+	actualNodes, actualEdges = parse(callGraph(CallGraphOptions{
+		NodeThreshold: threshold,
+		EdgeThreshold: threshold,
+	}))
+	require.NotEmpty(t, actualNodes)
+	require.Less(t, len(actualNodes), len(nodes))
+	for name, n := range actualNodes {
+		require.Equal(t, nodes[name], n)
+		require.GreaterOrEqual(t, n[1], int64(threshold))
+	}
+	for e, v := range actualEdges {
+		require.Equal(t, edges[e], v)
+		require.GreaterOrEqual(t, v, int64(threshold))
+		require.Contains(t, actualNodes, e.caller)
+		require.Contains(t, actualNodes, e.callee)
+	}
+}
+
+func Test_block_Resolver_Locations(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+
+	r := NewResolver(context.Background(), s.reader, WithLocationsOnly())
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	partitions, err := r.Locations()
+	require.NoError(t, err)
+	require.Len(t, partitions, 1)
+	stats := r.Stats()
+	require.Len(t, stats, 1)
+	require.Zero(t, stats[0].Functions)
+	require.Zero(t, stats[0].Strings)
+
+	pr, err := s.reader.Partition(context.Background(), 0)
+	require.NoError(t, err)
+	defer pr.Release()
+	symbols := pr.Symbols()
+	require.Equal(t, symbols.Locations, partitions[0].Locations)
+
+	// Other methods fail instead of resolving incomplete symbols.
+	_, err = r.Tree()
+	require.ErrorIs(t, err, ErrLocationsOnly)
+	_, err = r.Profile()
+	require.ErrorIs(t, err, ErrLocationsOnly)
+	_, err = r.Flamegraph(-1)
+	require.ErrorIs(t, err, ErrLocationsOnly)
+
+	m := make(map[uint64]uint64)
+	h := xxhash.New()
+	for _, st := range partitions[0].Stacktraces {
+		if st.Value == 0 {
+			continue
+		}
+		h.Reset()
+		for _, loc := range st.Locations {
+			for _, line := range partitions[0].Locations[loc].Line {
+				_, _ = h.WriteString(symbols.Strings[symbols.Functions[line.FunctionId].Name])
+			}
+		}
+		m[h.Sum64()] += uint64(st.Value)
+	}
+	fingerprint := make([][2]uint64, 0, len(m))
+	for k, v := range m {
+		fingerprint = append(fingerprint, [2]uint64{k, v})
+	}
+	sort.Slice(fingerprint, func(i, j int) bool { return fingerprint[i][0] < fingerprint[j][0] })
+	require.Equal(t, expectedFingerprint, fingerprint)
+}
+
+func Test_block_Resolver_Functions(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	p := s.profiles[0].Profile
+	seen := make(map[FunctionName]struct{})
+	for _, sample := range p.Sample {
+		if sample.Value[0] == 0 {
+			continue
+		}
+		for _, loc := range sample.LocationId {
+			for _, line := range p.Location[loc].Line {
+				f := p.Function[line.FunctionId-1]
+				seen[FunctionName{
+					Name:     p.StringTable[f.Name],
+					Filename: p.StringTable[f.Filename],
+				}] = struct{}{}
+			}
+		}
+	}
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	functions, err := r.Functions()
+	require.NoError(t, err)
+	require.Len(t, functions, len(seen))
+	for i, f := range functions {
+		require.Contains(t, seen, f)
+		if i > 0 {
+			require.Less(t, functions[i-1].Name+"\x00"+functions[i-1].Filename, f.Name+"\x00"+f.Filename)
+		}
+	}
+}
+
+func Test_block_Resolver_TreeRootedAt(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	full, err := r.Tree()
+	require.NoError(t, err)
+
+	const root = "github.com/pyroscope-io/pyroscope/pkg/scrape.(*scrapeLoop).scrape"
+	expected := new(model.Tree)
+	full.IterateStacks(func(_ string, self int64, stack []string) {
+		// The stack is ordered from the leaf to the root.
+		for i := len(stack) - 1; i >= 0; i-- {
+			if stack[i] == root {
+				x := append([]string{}, stack[:i+1]...)
+				slices.Reverse(x)
+				expected.InsertStack(self, x...)
+				return
+			}
+		}
+	})
+	require.NotZero(t, expected.Total())
+
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	rooted, err := r.TreeRootedAt(root)
+	require.NoError(t, err)
+	require.Equal(t, treeFingerprint(expected), treeFingerprint(rooted))
+	require.Equal(t, expected.Total(), rooted.Total())
+	rooted.IterateStacks(func(_ string, _ int64, stack []string) {
+		require.Equal(t, root, stack[len(stack)-1])
+	})
+
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	rooted, err = r.TreeRootedAt("missing")
+	require.NoError(t, err)
+	require.Zero(t, rooted.Total())
+}
+
+func Test_block_Resolver_TreeInverted(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	full, err := r.Tree()
+	require.NoError(t, err)
+
+	expected := new(model.Tree)
+	self := make(map[string]int64)
+	full.IterateStacks(func(name string, v int64, stack []string) {
+		// The stack is ordered from the leaf to the root.
+		expected.InsertStack(v, stack...)
+		self[name] += v
+	})
+
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	inverted, err := r.TreeInverted()
+	require.NoError(t, err)
+	require.Equal(t, treeFingerprint(expected), treeFingerprint(inverted))
+	require.Equal(t, full.Total(), inverted.Total())
+
+	roots := make(map[string]int64)
+	inverted.IterateStacks(func(_ string, v int64, stack []string) {
+		roots[stack[len(stack)-1]] += v
+	})
+	for name, v := range self {
+		if v > 0 {
+			require.Equal(t, v, roots[name], name)
+		}
+	}
+}
+
+func Test_block_Resolver_WriteChromeTrace(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteChromeTrace(context.Background(), &buf, ChromeTraceOptions{}))
+
+	var events []ChromeTraceEvent
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &events))
+	require.Greater(t, len(events), 1)
+	require.Equal(t, ChromeTraceEvent{
+		Name:  "thread_name",
+		Phase: "M",
+		PID:   1,
+		TID:   1,
+		Args:  map[string]string{"name": DefaultChromeTraceTrackName},
+	}, events[0])
+
+	// Events are nested: each one starts within the enclosing
+	// event, and ends before it does. Roots follow each other.
+	var stack []ChromeTraceEvent
+	var end int64
+	for _, e := range events[1:] {
+		require.Equal(t, "X", e.Phase)
+		require.Positive(t, e.Duration)
+		for len(stack) > 0 && e.Timestamp >= stack[len(stack)-1].Timestamp+stack[len(stack)-1].Duration {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			require.Equal(t, end, e.Timestamp)
+			end += e.Duration
+		} else {
+			p := stack[len(stack)-1]
+			require.GreaterOrEqual(t, e.Timestamp, p.Timestamp)
+			require.LessOrEqual(t, e.Timestamp+e.Duration, p.Timestamp+p.Duration)
+		}
+		stack = append(stack, e)
+	}
+
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, tree.Total(), end)
+}
+
+func Test_memory_Resolver_MergeProfilesIgnoringLabels(t *testing.T) {
+	s := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	for i := range expectedFingerprint {
+		expectedFingerprint[i][1] *= 2
+	}
+	// Each of the series has the same stack traces.
+	series := func() []*profile.Profile {
+		profiles := make([]*profile.Profile, 2)
+		for i := range profiles {
+			r := NewResolver(context.Background(), s.db, WithSampleLabels())
+			r.AddSamplesWithLabels(0, s.indexed[0][0].Samples, model.LabelsFromStrings("series", strconv.Itoa(i)))
+			p, err := r.Profile()
+			require.NoError(t, err)
+			r.Release()
+			profiles[i] = p
+		}
+		return profiles
+	}
+	total := func(p *profile.Profile) (v int64) {
+		for _, s := range p.Sample {
+			v += s.Value[0]
+		}
+		return v
+	}
+
+	t.Run("Profile", func(t *testing.T) {
+		labeled, err := MergeProfiles(series()...)
+		require.NoError(t, err)
+		merged, err := MergeProfilesIgnoringLabels(series()...)
+		require.NoError(t, err)
+		require.Less(t, len(merged.Sample), len(labeled.Sample))
+		require.Equal(t, total(labeled), total(merged))
+		require.Equal(t, expectedFingerprint, profileFingerprint(merged, 0))
+		for _, x := range merged.Sample {
+			require.Empty(t, x.Label)
+		}
+	})
+
+	t.Run("ProfileProto", func(t *testing.T) {
+		profiles := make([]*googlev1.Profile, 2)
+		for i := range profiles {
+			r := NewResolver(context.Background(), s.db)
+			r.AddSamples(0, s.indexed[0][0].Samples)
+			p, err := r.ProfileProto(ProfileMeta{})
+			require.NoError(t, err)
+			r.Release()
+			p.StringTable = append(p.StringTable, "series", strconv.Itoa(i))
+			n := int64(len(p.StringTable))
+			for _, x := range p.Sample {
+				x.Label = []*googlev1.Label{{Key: n - 2, Str: n - 1}}
+			}
+			profiles[i] = p
+		}
+		samples := len(profiles[0].Sample)
+		merged, err := MergeProfilesProtoIgnoringLabels(profiles...)
+		require.NoError(t, err)
+		require.Len(t, merged.Sample, samples)
+		merged.SampleType = []*googlev1.ValueType{{}}
+		b, err := merged.MarshalVT()
+		require.NoError(t, err)
+		p, err := profile.ParseData(b)
+		require.NoError(t, err)
+		require.Equal(t, expectedFingerprint, profileFingerprint(p, 0))
+	})
+}
+
+func Test_block_Resolver_MergeTreeProfiles(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	// The suite profiles are modified at write.
+	x, err := pprof.OpenFile("testdata/profile.pb.gz")
+	require.NoError(t, err)
+	external := x.Profile
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	for i := range expectedFingerprint {
+		expectedFingerprint[i][1] *= 2
+	}
+	resolved := resolveSamplesTree(t, s, s.indexed[0][0].Samples)
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	require.NoError(t, r.MergeTreeProfiles(external, nil))
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	var total int64
+	for _, smp := range external.Sample {
+		total += smp.Value[0]
+	}
+	require.Equal(t, resolved.Total()+total, tree.Total())
+	require.Equal(t, expectedFingerprint, treeFingerprint(tree))
+
+	// Merged profiles are discarded at Reset.
+	r.Reset(context.Background(), s.reader)
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	tree, err = r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, resolved.String(), tree.String())
+
+	invalid := external.CloneVT()
+	invalid.Function[0].Name = int64(len(invalid.StringTable))
+	require.Error(t, NewResolver(context.Background(), s.reader).MergeTreeProfiles(invalid))
+}
+
+func Test_block_Resolver_TreeSeries(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	// Six profiles, 20s apart: the last one is two
+	// minutes later, leaving the bucket before empty.
+	n := len(samples.StacktraceIDs) / 6
+	groups := make([]schemav1.Samples, 6)
+	timestamps := make([]time.Time, 6)
+	start := time.Unix(1700000040, 0)
+	for i := range groups {
+		hi := (i + 1) * n
+		if i == len(groups)-1 {
+			hi = len(samples.StacktraceIDs)
+		}
+		groups[i] = schemav1.Samples{
+			StacktraceIDs: samples.StacktraceIDs[i*n : hi],
+			Values:        samples.Values[i*n : hi],
+		}
+		timestamps[i] = start.Add(time.Duration(i) * 20 * time.Second)
+	}
+	timestamps[5] = timestamps[5].Add(2 * time.Minute)
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	for i, g := range groups {
+		r.AddSamplesWithTimestamp(0, g, timestamps[i])
+	}
+	series, err := r.TreeSeries(time.Minute)
+	require.NoError(t, err)
+	require.Len(t, series, 3)
+
+	expected := []struct {
+		start time.Time
+		tree  *model.Tree
+	}{
+		{start, resolveSamplesTree(t, s, groups[0:3]...)},
+		{start.Add(time.Minute), resolveSamplesTree(t, s, groups[3:5]...)},
+		{start.Add(3 * time.Minute), resolveSamplesTree(t, s, groups[5])},
+	}
+	merged := new(model.Tree)
+	for i, e := range expected {
+		require.True(t, e.start.Equal(series[i].Start), i)
+		require.Equal(t, e.tree.String(), series[i].Tree.String(), i)
+		merged.Merge(series[i].Tree)
+	}
+	require.Equal(t, resolveSamplesTree(t, s, samples).String(), merged.String())
+
+	_, err = NewResolver(context.Background(), s.reader).TreeSeries(0)
+	require.Error(t, err)
+}
+
+func Test_block_Resolver_RootLabel(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	n := len(samples.StacktraceIDs) / 4
+	groups := make([]schemav1.Samples, 4)
+	for i := range groups {
+		hi := (i + 1) * n
+		if i == len(groups)-1 {
+			hi = len(samples.StacktraceIDs)
+		}
+		groups[i] = schemav1.Samples{
+			StacktraceIDs: samples.StacktraceIDs[i*n : hi],
+			Values:        samples.Values[i*n : hi],
+		}
+	}
+	labels := []model.Labels{
+		model.LabelsFromStrings("state", "running"),
+		model.LabelsFromStrings("state", "waiting"),
+		model.LabelsFromStrings("service", "c"),
+	}
+
+	r := NewResolver(context.Background(), s.reader, WithRootLabel("state"))
+	defer r.Release()
+	for i, l := range labels {
+		r.AddSamplesWithLabels(0, groups[i], l)
+	}
+	r.AddSamples(0, groups[3])
+	tree, err := r.Tree()
+	require.NoError(t, err)
+
+	expected := map[string]int64{
+		"running":             resolveSamplesTree(t, s, groups[0]).Total(),
+		"waiting":             resolveSamplesTree(t, s, groups[1]).Total(),
+		UnknownRootLabelValue: resolveSamplesTree(t, s, groups[2], groups[3]).Total(),
+	}
+	roots := make(map[string]int64)
+	tree.Walk(func(n model.TreeWalkNode) bool {
+		if n.Depth == 0 {
+			require.Zero(t, n.Self)
+			roots[n.Name] = n.Total
+		}
+		return true
+	})
+	require.Equal(t, expected, roots)
+	require.Equal(t, resolveSamplesTree(t, s, samples).Total(), tree.Total())
+}
+
+func Test_memory_Resolver_RootLabel_Options(t *testing.T) {
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, newRateTestProfile(3, 1))[0].Samples
+	delays := db.WriteProfileSymbols(0, newRateTestProfile(5, 7))[0].Samples
+	running := model.LabelsFromStrings("state", "running")
+
+	// Samples of the merged profiles are grouped by their labels.
+	external := newRateTestProfile(1, 2)
+	external.StringTable = append(external.StringTable, "state", "waiting")
+	external.Sample[0].Label = []*googlev1.Label{{Key: 6, Str: 7}}
+	r := NewResolver(context.Background(), db, WithRootLabel("state"))
+	r.AddSamplesWithLabels(0, samples, running)
+	require.NoError(t, r.MergeTreeProfiles(external))
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	r.Release()
+	expected := `.
+├── [unknown]: self 0 total 2
+│   └── main: self 0 total 2
+│       └── bar: self 2 total 2
+├── running: self 0 total 4
+│   └── main: self 0 total 4
+│       ├── bar: self 1 total 1
+│       └── foo: self 3 total 3
+└── waiting: self 0 total 1
+    └── main: self 0 total 1
+        └── foo: self 1 total 1
+`
+	require.Equal(t, expected, tree.String())
+
+	// Labels are only attached to the value index 0.
+	r = NewResolver(context.Background(), db,
+		WithRootLabel("state"),
+		WithContentionProfile(),
+		WithTreeValueIndex(DelayValueIndex))
+	r.AddSamplesWithLabels(0, samples, running)
+	r.AddSamplesWithValueIndex(0, delays, DelayValueIndex)
+	tree, err = r.Tree()
+	require.NoError(t, err)
+	r.Release()
+	expected = `.
+└── [unknown]: self 0 total 12
+    └── main: self 0 total 12
+        ├── bar: self 7 total 7
+        └── foo: self 5 total 5
+`
+	require.Equal(t, expected, tree.String())
+}
+
+func Test_block_Resolver_TreeByLabel(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	// The samples are split into four groups: two of them
+	// have the label, one has another label, and the last
+	// one has no labels.
+	n := len(samples.StacktraceIDs) / 4
+	groups := make([]schemav1.Samples, 4)
+	for i := range groups {
+		hi := (i + 1) * n
+		if i == len(groups)-1 {
+			hi = len(samples.StacktraceIDs)
+		}
+		groups[i] = schemav1.Samples{
+			StacktraceIDs: samples.StacktraceIDs[i*n : hi],
+			Values:        samples.Values[i*n : hi],
+		}
+	}
+	labels := []model.Labels{
+		model.LabelsFromStrings("endpoint", "a"),
+		model.LabelsFromStrings("endpoint", "b"),
+		model.LabelsFromStrings("service", "c"),
+	}
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	for i, l := range labels {
+		r.AddSamplesWithLabels(0, groups[i], l)
+	}
+	r.AddSamples(0, groups[3])
+	trees, err := r.TreeByLabel("endpoint")
+	require.NoError(t, err)
+	require.Len(t, trees, 3)
+
+	expected := map[string]*model.Tree{
+		"a": resolveSamplesTree(t, s, groups[0]),
+		"b": resolveSamplesTree(t, s, groups[1]),
+		"":  resolveSamplesTree(t, s, groups[2], groups[3]),
+	}
+	merged := new(model.Tree)
+	for value, e := range expected {
+		require.Equal(t, e.String(), trees[value].String(), value)
+		merged.Merge(trees[value])
+	}
+	require.Equal(t, resolveSamplesTree(t, s, samples).String(), merged.String())
+}
+
+func Test_block_Resolver_AggregateBy(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	var total int64
+	for _, v := range samples.Values {
+		total += int64(v)
+	}
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	var calls int
+	// The outermost frame of the main package.
+	keys, err := r.AggregateBy(func(frames []Frame) string {
+		calls++
+		for i := len(frames) - 1; i >= 0; i-- {
+			if strings.HasPrefix(frames[i].Function, "main.") {
+				return frames[i].Function
+			}
+		}
+		return ""
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(r.DumpSamples(0)), calls)
+	require.Greater(t, len(keys), 1)
+	var sum int64
+	for _, v := range keys {
+		sum += v
+	}
+	require.Equal(t, total, sum)
+}
+
+func Test_block_Resolver_PartitionSamples(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	n := len(samples.StacktraceIDs) / 2
+	labeled := schemav1.Samples{
+		StacktraceIDs: samples.StacktraceIDs[:n],
+		Values:        samples.Values[:n],
+	}
+	unlabeled := schemav1.Samples{
+		StacktraceIDs: samples.StacktraceIDs[n:],
+		Values:        samples.Values[n:],
+	}
+	// A sample is expected for each of the distinct
+	// stack traces of both groups.
+	expected := make(map[string]struct{})
+	for _, g := range []struct {
+		key     string
+		samples schemav1.Samples
+	}{{"a", labeled}, {"", unlabeled}} {
+		for i, sid := range g.samples.StacktraceIDs {
+			if g.samples.Values[i] > 0 {
+				expected[fmt.Sprintf("%s/%d", g.key, sid)] = struct{}{}
+			}
+		}
+	}
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamplesWithLabels(0, labeled, model.LabelsFromStrings("endpoint", "a"))
+	r.AddSamples(0, unlabeled)
+	var total int
+	trees := map[string]*model.Tree{"a": new(model.Tree), "": new(model.Tree)}
+	err := r.PartitionSamples(context.Background(), func(partition uint64, it iter.Iterator[ResolvedSample]) error {
+		require.Zero(t, partition)
+		for it.Next() {
+			x := it.At()
+			var value string
+			for _, l := range x.Labels {
+				require.Equal(t, "endpoint", l.Name)
+				value = l.Value
+			}
+			require.NotZero(t, x.Value)
+			trees[value].InsertStack(x.Value, x.Stack...)
+			total++
+		}
+		return it.Err()
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(expected), total)
+	require.Equal(t, resolveSamplesTree(t, s, labeled).String(), trees["a"].String())
+	require.Equal(t, resolveSamplesTree(t, s, unlabeled).String(), trees[""].String())
+
+	stop := errors.New("stop")
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	err = r.PartitionSamples(context.Background(), func(uint64, iter.Iterator[ResolvedSample]) error {
+		return stop
+	})
+	require.ErrorIs(t, err, stop)
+}
+
+func Test_memory_Resolver_MaxNameLength(t *testing.T) {
+	// 10KB of multi-byte runes.
+	name := "std::vector<" + strings.Repeat("é", 5<<10) + ">"
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", name, "a.cpp", "b.cpp", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 5, Unit: 6}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true}},
+		Function: []*googlev1.Function{
+			{Id: 1, Name: 1},
+			// Distinct functions with the same name.
+			{Id: 2, Name: 2, Filename: 3},
+			{Id: 3, Name: 2, Filename: 4},
+		},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{1}},
+			{LocationId: []uint64{3, 1}, Value: []int64{2}},
+		},
+	}
+	for i := 1; i <= 3; i++ {
+		id := uint64(i)
+		p.Location = append(p.Location, &googlev1.Location{
+			Id:        id,
+			MappingId: 1,
+			Address:   id,
+			Line:      []*googlev1.Line{{FunctionId: id}},
+		})
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	r := NewResolver(context.Background(), db, WithMaxNameLength(16))
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	expected := `.
+└── main: self 0 total 3
+    └── std::vector<éééé…: self 3 total 3
+`
+	require.Equal(t, expected, tree.String())
+}
+
+func Test_memory_Resolver_NameNormalizer(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "main.run.func1", "main.run.func2.1", "main.work", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 5, Unit: 6}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true}},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{1}},
+			{LocationId: []uint64{4, 3, 1}, Value: []int64{2}},
+		},
+	}
+	for i := 1; i <= 4; i++ {
+		id := uint64(i)
+		p.Function = append(p.Function, &googlev1.Function{Id: id, Name: int64(i)})
+		p.Location = append(p.Location, &googlev1.Location{
+			Id:        id,
+			MappingId: 1,
+			Address:   id,
+			Line:      []*googlev1.Line{{FunctionId: id}},
+		})
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	r := NewResolver(context.Background(), db, WithNameNormalizer(NormalizeGoClosureName))
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	expected := `.
+└── main: self 0 total 3
+    └── main.run: self 1 total 3
+        └── main.work: self 2 total 2
+`
+	require.Equal(t, expected, tree.String())
+}
+
+func Test_NormalizeGoClosureName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"main.run":                      "main.run",
+		"main.run.func1":                "main.run",
+		"main.run.func12.3.4":           "main.run",
+		"main.(*T).run.gowrap1":         "main.(*T).run",
+		"main.run.deferwrap2":           "main.run",
+		"net/http.(*conn).serve.func1":  "net/http.(*conn).serve",
+		"main.func1":                    "main",
+		"main.function":                 "main.function",
+		"main.run.func":                 "main.run.func",
+		"gopkg.in/yaml%2ev3.(*parser).": "gopkg.in/yaml%2ev3.(*parser).",
+		"func1":                         "func1",
+		".func1":                        ".func1",
+	} {
+		require.Equal(t, expected, NormalizeGoClosureName(name), name)
+	}
+}
+
+func newRateTestProfile(foo, bar int64) *googlev1.Profile {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "foo", "bar", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 4, Unit: 5}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true}},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{foo}},
+			{LocationId: []uint64{3, 1}, Value: []int64{bar}},
+		},
+	}
+	for i := 1; i <= 3; i++ {
+		id := uint64(i)
+		p.Function = append(p.Function, &googlev1.Function{Id: id, Name: int64(i)})
+		p.Location = append(p.Location, &googlev1.Location{
+			Id:        id,
+			MappingId: 1,
+			Address:   id,
+			Line:      []*googlev1.Line{{FunctionId: id}},
+		})
+	}
+	return p
+}
+
+func Test_memory_Resolver_Rate(t *testing.T) {
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, newRateTestProfile(3e9, 1e9))[0].Samples
+	const duration = 4e9 // 4s.
+
+	r := NewResolver(context.Background(), db, WithRate(duration))
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	r.Release()
+	expected := `.
+└── main: self 0 total 1000000000
+    ├── bar: self 250000000 total 250000000
+    └── foo: self 750000000 total 750000000
+`
+	require.Equal(t, expected, tree.String())
+	require.Equal(t, int64(4e9/4), tree.Total())
+
+	r = NewResolver(context.Background(), db, WithRate(duration))
+	r.AddSamples(0, samples)
+	resolved, err := r.ProfileProto(ProfileMeta{
+		SampleType:    []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		DurationNanos: duration,
+	})
+	require.NoError(t, err)
+	r.Release()
+	require.Equal(t, "nanoseconds/s", resolved.StringTable[resolved.SampleType[0].Unit])
+	var total int64
+	for _, x := range resolved.Sample {
+		total += x.Value[0]
+	}
+	require.Equal(t, int64(1e9), total)
+
+	r = NewResolver(context.Background(), db, WithRate(duration))
+	r.AddSamples(0, samples)
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteProfile(context.Background(), &buf, ProfileMeta{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+	}))
+	r.Release()
+	written, err := profile.Parse(&buf)
+	require.NoError(t, err)
+	require.Equal(t, "nanoseconds/s", written.SampleType[0].Unit)
+	total = 0
+	for _, x := range written.Sample {
+		total += x.Value[0]
+	}
+	require.Equal(t, int64(1e9), total)
+
+	r = NewResolver(context.Background(), db, WithRate(duration))
+	r.AddSamples(0, samples)
+	var into googlev1.Profile
+	require.NoError(t, r.ProfileInto(&into))
+	r.Release()
+	total = 0
+	for _, x := range into.Sample {
+		total += x.Value[0]
+	}
+	require.Equal(t, int64(1e9), total)
+}
+
+func Test_memory_Resolver_Rate_Rounding(t *testing.T) {
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, newRateTestProfile(2, 2))[0].Samples
+	const duration = 4e9 // 4s.
+
+	// Values are rounded to the nearest integer: 0.5/s
+	// of each of the leaves is rounded up, and the total
+	// of the root is the sum of the rounded values.
+	r := NewResolver(context.Background(), db, WithRate(duration))
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	r.Release()
+	expected := `.
+└── main: self 0 total 2
+    ├── bar: self 1 total 1
+    └── foo: self 1 total 1
+`
+	require.Equal(t, expected, tree.String())
+	var children int64
+	tree.Walk(func(n model.TreeWalkNode) bool {
+		if n.Depth > 0 {
+			children += n.Total
+		}
+		return true
+	})
+	require.Equal(t, tree.Total(), children)
+}
+
+func Test_memory_Resolver_Profile_LocationDedup(t *testing.T) {
+	// Each of the leaf function lines is represented
+	// by many locations with distinct addresses.
+	const addresses = 64
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "foo", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 3, Unit: 4}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true, HasLineNumbers: true}},
+		Function:    []*googlev1.Function{{Id: 1, Name: 1}, {Id: 2, Name: 2}},
+		Location:    []*googlev1.Location{{Id: 1, MappingId: 1, Address: 1, Line: []*googlev1.Line{{FunctionId: 1, Line: 1}}}},
+	}
+	for i := 0; i < addresses; i++ {
+		id := uint64(len(p.Location) + 1)
+		p.Location = append(p.Location, &googlev1.Location{
+			Id:        id,
+			MappingId: 1,
+			Address:   0x1000 + id,
+			Line:      []*googlev1.Line{{FunctionId: 2, Line: int64(10 + i%2)}},
+		})
+		p.Sample = append(p.Sample, &googlev1.Sample{LocationId: []uint64{id, 1}, Value: []int64{int64(i + 1)}})
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	resolve := func(options ...ResolverOption) (*profile.Profile, int) {
+		r := NewResolver(context.Background(), db, options...)
+		defer r.Release()
+		r.AddSamples(0, samples)
+		resolved, err := r.Profile()
+		require.NoError(t, err)
+		resolved.SampleType = []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}}
+		var buf bytes.Buffer
+		require.NoError(t, resolved.WriteUncompressed(&buf))
+		return resolved, buf.Len()
+	}
+
+	expected, size := resolve()
+	actual, dedupSize := resolve(WithLocationDedup())
+	require.NoError(t, actual.CheckValid())
+	require.Equal(t, profileFingerprint(expected, 0), profileFingerprint(actual, 0))
+	require.Len(t, expected.Location, addresses+1)
+	require.Len(t, actual.Location, 3)
+	require.Len(t, actual.Sample, 2)
+	require.Less(t, dedupSize*4, size)
+}
+
+// newFooBarSymDB writes a profile with the main;foo and main;bar
+// stack traces, and returns their stack trace IDs.
+func newFooBarSymDB(t *testing.T) (db *SymDB, foo, bar uint32) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "foo", "bar", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 4, Unit: 5}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true}},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{1}},
+			{LocationId: []uint64{3, 1}, Value: []int64{1}},
+		},
+	}
+	for i := 1; i <= 3; i++ {
+		id := uint64(i)
+		p.Function = append(p.Function, &googlev1.Function{Id: id, Name: int64(i)})
+		p.Location = append(p.Location, &googlev1.Location{
+			Id:        id,
+			MappingId: 1,
+			Address:   id,
+			Line:      []*googlev1.Line{{FunctionId: id}},
+		})
+	}
+	db = NewSymDB(&Config{Dir: t.TempDir()})
+	ids := db.WriteProfileSymbols(0, p)[0].Samples.StacktraceIDs
+	return db, ids[0], ids[1]
+}
+
+func Test_memory_Resolver_Profile_SampleLabels(t *testing.T) {
+	db, foo, bar := newFooBarSymDB(t)
+	samples := func(sid uint32, v uint64) schemav1.Samples {
+		return schemav1.Samples{StacktraceIDs: []uint32{sid}, Values: []uint64{v}}
+	}
+
+	r := NewResolver(context.Background(), db, WithSampleLabels())
+	defer r.Release()
+	r.AddSamplesWithLabels(0, samples(foo, 3), model.LabelsFromStrings("endpoint", "a"))
+	r.AddSamplesWithLabels(0, samples(foo, 4), model.LabelsFromStrings("endpoint", "b"))
+	r.AddSamplesWithLabels(0, samples(bar, 2), model.LabelsFromStrings("endpoint", "a", "service", "c"))
+	r.AddSamples(0, samples(foo, 5))
+	resolved, err := r.Profile()
+	require.NoError(t, err)
+
+	// Sample types are not set by the resolver.
+	resolved.SampleType = []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}}
+	var buf bytes.Buffer
+	require.NoError(t, resolved.Write(&buf))
+	decoded, err := profile.Parse(&buf)
+	require.NoError(t, err)
+
+	actual := make(map[string]int64)
+	for _, x := range decoded.Sample {
+		k := x.Location[0].Line[0].Function.Name
+		for _, key := range []string{"endpoint", "service"} {
+			if v, ok := x.Label[key]; ok {
+				k += fmt.Sprintf(" %s=%s", key, v)
+			}
+		}
+		actual[k] += x.Value[0]
+	}
+	expected := map[string]int64{
+		"foo endpoint=[a]":             3,
+		"foo endpoint=[b]":             4,
+		"foo":                          5,
+		"bar endpoint=[a] service=[c]": 2,
+	}
+	require.Equal(t, expected, actual)
+	require.Len(t, decoded.Sample, len(expected))
+}
+
+func Test_memory_Resolver_Profile_SampleTimestamps(t *testing.T) {
+	db, foo, bar := newFooBarSymDB(t)
+	samples := func(sid uint32, v uint64) schemav1.Samples {
+		return schemav1.Samples{StacktraceIDs: []uint32{sid}, Values: []uint64{v}}
+	}
+
+	t1 := time.Unix(1700000000, 1)
+	t2 := t1.Add(15 * time.Second)
+	r := NewResolver(context.Background(), db, WithSampleTimestamps())
+	defer r.Release()
+	r.AddSamplesWithTimestamp(0, samples(foo, 3), t1)
+	r.AddSamplesWithTimestamp(0, samples(foo, 4), t2)
+	r.AddSamplesWithTimestamp(0, samples(bar, 2), t2)
+	r.AddSamples(0, samples(foo, 5))
+	resolved, err := r.Profile()
+	require.NoError(t, err)
+
+	resolved.SampleType = []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}}
+	var buf bytes.Buffer
+	require.NoError(t, resolved.Write(&buf))
+	decoded, err := profile.Parse(&buf)
+	require.NoError(t, err)
+
+	actual := make(map[string]int64)
+	for _, x := range decoded.Sample {
+		k := x.Location[0].Line[0].Function.Name
+		if ts, ok := x.NumLabel[TimestampLabel]; ok {
+			require.Equal(t, []string{"nanoseconds"}, x.NumUnit[TimestampLabel])
+			k += fmt.Sprintf(" %v", ts)
+		}
+		actual[k] += x.Value[0]
+	}
+	expected := map[string]int64{
+		fmt.Sprintf("foo [%d]", t1.UnixNano()): 3,
+		fmt.Sprintf("foo [%d]", t2.UnixNano()): 4,
+		fmt.Sprintf("bar [%d]", t2.UnixNano()): 2,
+		"foo":                                  5,
+	}
+	require.Equal(t, expected, actual)
+	require.Len(t, decoded.Sample, len(expected))
+}
+
+func resolveSamplesTree(t *testing.T, s *blockSuite, samples ...schemav1.Samples) *model.Tree {
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	for _, x := range samples {
+		r.AddSamples(0, x)
+	}
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	return tree
+}
+
+func Test_block_BatchResolver_Trees(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	n := len(samples.StacktraceIDs) / 3
+	head := schemav1.Samples{StacktraceIDs: samples.StacktraceIDs[:n], Values: samples.Values[:n]}
+	tail := schemav1.Samples{StacktraceIDs: samples.StacktraceIDs[n:], Values: samples.Values[n:]}
+
+	b := NewBatchResolver(context.Background(), s.reader)
+	defer b.Release()
+	trees, err := b.Trees([]LabeledSamples{
+		{Label: "head", Samples: head},
+		{Label: "all", Samples: samples},
+		{Label: "empty"},
+		{Label: "split", Samples: tail},
+		{Label: "split", Samples: head},
+	})
+	require.NoError(t, err)
+	require.Len(t, trees, 4)
+	require.Equal(t, resolveSamplesTree(t, s, head).String(), trees["head"].String())
+	require.Equal(t, resolveSamplesTree(t, s, samples).String(), trees["all"].String())
+	require.Equal(t, trees["all"].String(), trees["split"].String())
+	require.Zero(t, trees["empty"].Total())
+}
+
+func Test_TreeBuilder(t *testing.T) {
+	var b TreeBuilder
+	require.Equal(t, int64(0), b.Build().Total())
+
+	path := []string{"a", "b", "c"}
+	b.Insert(path, 1)
+	// The path is not retained.
+	path[2] = "d"
+	b.Insert(path, 2)
+	b.Insert([]string{"a", "b", "c"}, 3)
+	b.Insert([]string{"a", "e"}, 4)
+	b.Insert([]string{"a"}, 5)
+	b.Insert([]string{"f"}, 0)
+	expected := `.
+└── a: self 5 total 15
+    ├── b: self 0 total 6
+    │   ├── c: self 4 total 4
+    │   └── d: self 2 total 2
+    └── e: self 4 total 4
+`
+	tree := b.Build()
+	require.Equal(t, expected, tree.String())
+	data, err := tree.MarshalBinary()
+	require.NoError(t, err)
+	decoded := new(model.Tree)
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	require.Equal(t, expected, decoded.String())
+
+	// The builder is reset.
+	b.Insert([]string{"x"}, -1)
+	require.Equal(t, ".\n└── x: self -1 total -1\n", b.Build().String())
+}
+
+func Test_block_TreeBuilder_Resolver(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	expected := resolveSamplesTree(t, s, s.indexed[0][0].Samples)
+	// The tree is rebuilt of the paths of the resolved tree.
+	var b TreeBuilder
+	var path []string
+	expected.Walk(func(n model.TreeWalkNode) bool {
+		path = append(path[:n.Depth], n.Name)
+		b.Insert(path, n.Self)
+		return true
+	})
+	tree := b.Build()
+	require.Equal(t, expected.String(), tree.String())
+	require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 0), treeFingerprint(tree))
+}
+
+func Test_ProfileFingerprint(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	meta := ProfileMeta{SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}}}
+	resolve := func(r *Resolver) *googlev1.Profile {
+		defer r.Release()
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		p, err := r.ProfileProto(meta)
+		require.NoError(t, err)
+		return p
+	}
+	p := resolve(NewResolver(context.Background(), s.reader))
+	fp := ProfileFingerprint(p)
+	require.Equal(t, fp, ProfileFingerprint(resolve(NewResolver(context.Background(), s.db))))
+
+	// Reorder the string table, functions, locations, and samples.
+	x := p.CloneVT()
+	n := int64(len(x.StringTable))
+	for i := int64(1); i < n; i++ {
+		x.StringTable[i] = p.StringTable[n-i]
+	}
+	remap := func(i int64) int64 {
+		if i == 0 {
+			return 0
+		}
+		return n - i
+	}
+	for _, st := range x.SampleType {
+		st.Type, st.Unit = remap(st.Type), remap(st.Unit)
+	}
+	ids := uint64(len(x.Function) + 1)
+	for _, fn := range x.Function {
+		fn.Id = ids - fn.Id
+		fn.Name = remap(fn.Name)
+	}
+	ids = uint64(len(x.Location) + 1)
+	for _, loc := range x.Location {
+		loc.Id = ids - loc.Id
+		for _, line := range loc.Line {
+			line.FunctionId = uint64(len(x.Function)+1) - line.FunctionId
+		}
+	}
+	for _, smp := range x.Sample {
+		for i, id := range smp.LocationId {
+			smp.LocationId[i] = ids - id
+		}
+	}
+	slices.Reverse(x.Function)
+	slices.Reverse(x.Location)
+	slices.Reverse(x.Sample)
+	// Split a sample and add a zero one.
+	smp := x.Sample[0].CloneVT()
+	smp.Value[0] = 1
+	x.Sample[0].Value[0]--
+	x.Sample = append(x.Sample, smp, &googlev1.Sample{LocationId: smp.LocationId, Value: []int64{0}})
+	require.Equal(t, fp, ProfileFingerprint(x))
+
+	x.Sample[0].Value[0]++
+	require.NotEqual(t, fp, ProfileFingerprint(x))
+}
+
+func Test_block_Resolver_StringTable(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	requireTable := func(t *testing.T, table *StringTable, strings []string) {
+		require.NotNil(t, table)
+		require.Equal(t, len(strings), table.Len())
+		for i, x := range strings {
+			require.Equal(t, x, table.At(int64(i)))
+			j, ok := table.Index(x)
+			require.True(t, ok)
+			require.Equal(t, int64(i), j)
+		}
+		require.Empty(t, table.At(-1))
+		require.Empty(t, table.At(int64(len(strings))))
+		_, ok := table.Index("not-a-function-name")
+		require.False(t, ok)
+	}
+
+	t.Run("ProfileProto", func(t *testing.T) {
+		r := NewResolver(context.Background(), s.reader)
+		defer r.Release()
+		require.Nil(t, r.StringTable())
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		p, err := r.ProfileProto(ProfileMeta{
+			SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		})
+		require.NoError(t, err)
+		strings := append([]string(nil), p.StringTable...)
+		table := r.StringTable()
+		requireTable(t, table, strings)
+		// The table is not affected by the profile modifications.
+		p.StringTable[1] = "modified"
+		require.Equal(t, strings[1], table.At(1))
+	})
+
+	t.Run("ProfileInto", func(t *testing.T) {
+		r := NewResolver(context.Background(), s.reader)
+		defer r.Release()
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		var p googlev1.Profile
+		require.NoError(t, r.ProfileInto(&p))
+		requireTable(t, r.StringTable(), p.StringTable)
+	})
+}
+
+func Test_block_Resolver_Comments(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	comments := []string{"tenant=anonymous", "", "block=01HA2V3CPSNS8SYGRQ3NBAP5HX"}
+	expected := []string{"tenant=anonymous", "block=01HA2V3CPSNS8SYGRQ3NBAP5HX"}
+	resolver := func() *Resolver {
+		r := NewResolver(context.Background(), s.reader, WithComments(comments))
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		return r
+	}
+	commentsOf := func(p *googlev1.Profile) []string {
+		c := make([]string, len(p.Comment))
+		for i, x := range p.Comment {
+			c[i] = p.StringTable[x]
+		}
+		return c
+	}
+
+	r := resolver()
+	defer r.Release()
+	p, err := r.ProfileProto(ProfileMeta{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, expected, commentsOf(p))
+	// The comments round-trip through the pprof encoding.
+	b, err := p.MarshalVT()
+	require.NoError(t, err)
+	decoded, err := profile.ParseData(b)
+	require.NoError(t, err)
+	require.Equal(t, expected, decoded.Comments)
+
+	r = resolver()
+	defer r.Release()
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteProfile(context.Background(), &buf, ProfileMeta{}))
+	gr, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	b, err = io.ReadAll(gr)
+	require.NoError(t, err)
+	var written googlev1.Profile
+	require.NoError(t, written.UnmarshalVT(b))
+	require.Equal(t, expected, commentsOf(&written))
+
+	r = resolver()
+	defer r.Release()
+	var into googlev1.Profile
+	require.NoError(t, r.ProfileInto(&into))
+	require.Equal(t, expected, commentsOf(&into))
+}
+
+func Test_block_Resolver_ProfileProto(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	src := s.profiles[0].Profile
+	meta := ProfileMeta{
+		PeriodType: &profile.ValueType{
+			Type: src.StringTable[src.PeriodType.Type],
+			Unit: src.StringTable[src.PeriodType.Unit],
+		},
+		Period:        src.Period,
+		TimeNanos:     src.TimeNanos,
+		DurationNanos: src.DurationNanos,
+	}
+	for _, st := range src.SampleType {
+		meta.SampleType = append(meta.SampleType, &profile.ValueType{
+			Type: src.StringTable[st.Type],
+			Unit: src.StringTable[st.Unit],
+		})
+	}
+	meta.DefaultSampleType = meta.SampleType[0].Type
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	for i, p := range s.indexed[0] {
+		r.AddSamplesWithValueIndex(0, p.Samples, i)
+	}
+	resolved, err := r.ProfileProto(meta)
+	require.NoError(t, err)
+
+	require.Equal(t, src.Period, resolved.Period)
+	require.Equal(t, src.TimeNanos, resolved.TimeNanos)
+	require.Equal(t, src.DurationNanos, resolved.DurationNanos)
+	require.Equal(t, meta.PeriodType.Type, resolved.StringTable[resolved.PeriodType.Type])
+	require.Equal(t, meta.PeriodType.Unit, resolved.StringTable[resolved.PeriodType.Unit])
+	require.Equal(t, meta.DefaultSampleType, resolved.StringTable[resolved.DefaultSampleType])
+	require.Len(t, resolved.SampleType, len(meta.SampleType))
+	for i, st := range resolved.SampleType {
+		require.Equal(t, meta.SampleType[i].Type, resolved.StringTable[st.Type])
+		require.Equal(t, meta.SampleType[i].Unit, resolved.StringTable[st.Unit])
+	}
+	for _, sample := range resolved.Sample {
+		require.Len(t, sample.Value, len(meta.SampleType))
+	}
+
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	_, err = r.ProfileProto(meta)
+	require.Error(t, err)
+}
+
+func Test_block_Resolver_ProfileGeneric(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	meta := ProfileMeta{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+	}
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	g, err := r.ProfileGeneric(meta)
+	require.NoError(t, err)
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	resolved, err := r.Profile()
+	require.NoError(t, err)
+
+	require.Equal(t, []GenericValueType{{Type: "cpu", Unit: "nanoseconds"}}, g.SampleTypes)
+	require.Len(t, g.Samples, len(resolved.Sample))
+	require.Len(t, g.Mappings, len(resolved.Mapping))
+	var b TreeBuilder
+	for _, x := range g.Samples {
+		stack := make([]string, len(x.Stack))
+		for i, name := range x.Stack {
+			stack[len(stack)-1-i] = name
+		}
+		b.Insert(stack, x.Values[0])
+	}
+	expected := resolveSamplesTree(t, s, s.indexed[0][0].Samples)
+	require.Equal(t, treeFingerprint(expected), treeFingerprint(b.Build()))
+
+	x := g.Proto()
+	data, err := x.MarshalVT()
+	require.NoError(t, err)
+	decoded, err := profile.ParseData(data)
+	require.NoError(t, err)
+	require.Equal(t, "cpu", decoded.SampleType[0].Type)
+	require.Equal(t, profileFingerprint(resolved, 0), profileFingerprint(decoded, 0))
+	require.Len(t, decoded.Mapping, len(g.Mappings))
+}
+
 func Test_memory_Resolver_ResolveTree(t *testing.T) {
 	s := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}})
 	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
-	r := NewResolver(context.Background(), s.db)
-	defer r.Release()
+	r := NewResolver(context.Background(), s.db)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	resolved, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, expectedFingerprint, treeFingerprint(resolved))
+}
+
+func Test_memory_Resolver_ResolveFlamegraph(t *testing.T) {
+	s := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	r := NewResolver(context.Background(), s.db)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+
+	r = NewResolver(context.Background(), s.db)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	fg, err := r.Flamegraph(16)
+	require.NoError(t, err)
+	require.Equal(t, model.NewFlameGraph(tree, 16), fg)
+	require.Equal(t, tree.Total(), fg.Total)
+	require.Contains(t, fg.Names, "other")
+}
+
+func Test_block_Resolver_Collapsed(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	var buf bytes.Buffer
+	require.NoError(t, r.Collapsed(&buf))
+
+	tree := new(model.Tree)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseInt(line[i+1:], 10, 64)
+		require.NoError(t, err)
+		tree.InsertStack(v, strings.Split(line[:i], ";")...)
+	}
+	require.Equal(t, expectedFingerprint, treeFingerprint(tree))
+}
+
+func Test_block_Resolver_ResolveTree_MinValue(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	expected, err := r.Tree()
+	require.NoError(t, err)
+
+	const minValue = 1e9
+	r = NewResolver(context.Background(), s.reader, WithMinValue(minValue))
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	truncated, err := r.Tree()
+	require.NoError(t, err)
+
+	require.Equal(t, expected.Total(), truncated.Total())
+	var stacks, other int
+	truncated.IterateStacks(func(name string, self int64, stack []string) {
+		stacks++
+		if name == truncatedNodeName {
+			other++
+		}
+	})
+	require.Greater(t, other, 0)
+	require.Less(t, stacks, len(treeFingerprint(expected)))
+}
+
+func Test_block_Resolver_TreeSampled(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][1].Samples
+	values := make(map[uint32]float64, len(samples.StacktraceIDs))
+	for i, id := range samples.StacktraceIDs {
+		values[id] += float64(samples.Values[i])
+	}
+	var exact, squares float64
+	for _, v := range values {
+		exact += v
+		squares += v * v
+	}
+
+	const rate = 0.2
+	sigma := math.Sqrt((1 - rate) / rate * squares)
+	// Rounding of the scaled values.
+	bound := 3*sigma + 0.5*float64(len(values))
+	const runs = 90
+	var exceeded int
+	for i := 0; i < runs; i++ {
+		r := NewResolver(context.Background(), s.reader)
+		r.AddSamples(0, samples)
+		sampled, err := r.TreeSampled(rate)
+		r.Release()
+		require.NoError(t, err)
+		if math.Abs(float64(sampled.Total())-exact) > bound {
+			exceeded++
+		}
+	}
+	// Chebyshev's inequality: P(|X-μ| > 3σ) ≤ 1/9.
+	require.LessOrEqual(t, exceeded, runs/9)
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	full, err := r.TreeSampled(1)
+	require.NoError(t, err)
+	require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 1), treeFingerprint(full))
+
+	// Negative values are scaled the same way.
+	negative := samples.Clone()
+	for i, v := range negative.Values {
+		negative.Values[i] = uint64(-int64(v))
+	}
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, negative)
+	sampled, err := r.TreeSampled(rate)
+	require.NoError(t, err)
+	require.Less(t, sampled.Total(), int64(0))
+	require.LessOrEqual(t, math.Abs(float64(sampled.Total())+exact), 9*bound)
+
+	neg := func(v int64) uint64 { return uint64(-v) }
+	x := schemav1.Samples{
+		StacktraceIDs: []uint32{1, 2, 3, 4},
+		Values:        []uint64{neg(100), 100, neg(3), 0},
+	}
+	x = sampleStacktraces(x, 0.5, rand.New(rand.NewSource(1)))
+	expected := map[uint32]int64{1: -200, 2: 200, 3: -6, 4: 0}
+	require.NotEmpty(t, x.StacktraceIDs)
+	for i, id := range x.StacktraceIDs {
+		require.Equal(t, expected[id], int64(x.Values[i]))
+	}
+
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	_, err = r.TreeSampled(0)
+	require.Error(t, err)
+}
+
+func Test_memory_Resolver_TreeSampled_Options(t *testing.T) {
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, newRateTestProfile(3e9, 1e9))[0].Samples
+	external := newRateTestProfile(1e9, 2e9)
+	// Stack traces are dropped with the negligible
+	// probability, and the values are not scaled.
+	const rate = 1 - 1e-12
+	for _, tc := range []struct {
+		name string
+		opts []ResolverOption
+	}{
+		{"rate", []ResolverOption{WithRate(4e9)}},
+		{"max children", []ResolverOption{WithMaxChildren(1)}},
+		{"cumulative", []ResolverOption{WithCumulativeValues()}},
+		{"tree value index", []ResolverOption{WithTreeValueIndex(1)}},
+		{"root label", []ResolverOption{WithRootLabel("state")}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			resolve := func(fn func(*Resolver) (*model.Tree, error)) string {
+				r := NewResolver(context.Background(), db, tc.opts...)
+				defer r.Release()
+				r.AddSamplesWithLabels(0, samples, model.LabelsFromStrings("state", "running"))
+				r.AddSamplesWithValueIndex(0, samples, 1)
+				require.NoError(t, r.MergeTreeProfiles(external))
+				tree, err := fn(r)
+				require.NoError(t, err)
+				return tree.String()
+			}
+			expected := resolve((*Resolver).Tree)
+			sampled := resolve(func(r *Resolver) (*model.Tree, error) { return r.TreeSampled(rate) })
+			require.Equal(t, expected, sampled)
+		})
+	}
+}
+
+func Test_memory_Resolver_MappingFilter(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "/app", "/lib/libc.so", "main", "handler", "malloc", "callback", "qsort", "start", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 9, Unit: 10}},
+		Mapping: []*googlev1.Mapping{
+			{Id: 1, Filename: 1, HasFunctions: true},
+			{Id: 2, Filename: 2, HasFunctions: true},
+		},
+	}
+	// Functions malloc, qsort, and start belong to libc.
+	for i, mapping := range []uint64{1, 1, 2, 1, 2, 2} {
+		id := uint64(i + 1)
+		p.Function = append(p.Function, &googlev1.Function{Id: id, Name: int64(i + 3)})
+		p.Location = append(p.Location, &googlev1.Location{
+			Id:        id,
+			MappingId: mapping,
+			Address:   id,
+			Line:      []*googlev1.Line{{FunctionId: id}},
+		})
+	}
+	p.Sample = []*googlev1.Sample{
+		{LocationId: []uint64{3, 2, 1}, Value: []int64{10}},
+		{LocationId: []uint64{4, 5, 1}, Value: []int64{20}},
+		{LocationId: []uint64{3, 6}, Value: []int64{5}},
+		{LocationId: []uint64{2, 1}, Value: []int64{7}},
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	expected := `.
+├── main: self 0 total 37
+│   ├── callback: self 20 total 20
+│   └── handler: self 17 total 17
+└── other: self 5 total 5
+`
+	for _, opt := range []ResolverOption{
+		WithMappingFilter(nil, regexp.MustCompile(`libc`)),
+		WithMappingFilter(regexp.MustCompile(`^/app$`), nil),
+	} {
+		r := NewResolver(context.Background(), db, opt)
+		defer r.Release()
+		r.AddSamples(0, samples)
+		tree, err := r.Tree()
+		require.NoError(t, err)
+		require.Equal(t, expected, tree.String())
+	}
+
+	// The tree is not affected by the stack traces
+	// cached by the resolver without the filter.
+	c, err := NewStacktraceCache(1<<10, nil)
+	require.NoError(t, err)
+	r := NewResolver(context.Background(), db, WithStacktraceCache(c))
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, int64(42), tree.Total())
+	require.NotEqual(t, expected, tree.String())
+
+	r = NewResolver(context.Background(), db, WithStacktraceCache(c), WithMappingFilter(nil, regexp.MustCompile(`libc`)))
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err = r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, expected, tree.String())
+}
+
+func Test_memory_Resolver_FunctionAllowList(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "handler", "helper", "malloc", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 5, Unit: 6}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true}},
+		Function: []*googlev1.Function{
+			{Id: 1, Name: 1},
+			{Id: 2, Name: 2},
+			{Id: 3, Name: 3},
+			{Id: 4, Name: 4},
+		},
+		Location: []*googlev1.Location{
+			{Id: 1, MappingId: 1, Address: 1, Line: []*googlev1.Line{{FunctionId: 1}}},
+			// helper is inlined into handler.
+			{Id: 2, MappingId: 1, Address: 2, Line: []*googlev1.Line{{FunctionId: 3}, {FunctionId: 2}}},
+			{Id: 3, MappingId: 1, Address: 3, Line: []*googlev1.Line{{FunctionId: 4}}},
+		},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{3, 2, 1}, Value: []int64{10}},
+			{LocationId: []uint64{3, 1}, Value: []int64{5}},
+			{LocationId: []uint64{3}, Value: []int64{2}},
+		},
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	names := map[string]struct{}{"main": {}, "handler": {}}
+	r := NewResolver(context.Background(), db, WithFunctionAllowList(names))
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	expected := `.
+├── main: self 5 total 15
+│   └── handler: self 10 total 10
+└── other: self 2 total 2
+`
+	require.Equal(t, expected, tree.String())
+
+	r = NewResolver(context.Background(), db, WithFunctionAllowList(names))
+	defer r.Release()
+	r.AddSamples(0, samples)
+	resolved, err := r.Profile()
+	require.NoError(t, err)
+	var total int64
+	for _, s := range resolved.Sample {
+		total += s.Value[0]
+		for _, loc := range s.Location {
+			for _, line := range loc.Line {
+				require.NotEqual(t, "helper", line.Function.Name)
+				require.NotEqual(t, "malloc", line.Function.Name)
+			}
+		}
+	}
+	require.Equal(t, int64(17), total)
+}
+
+func Test_memory_Resolver_LineGranularity(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "loop", "add", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 4, Unit: 5}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true, HasLineNumbers: true}},
+		Function: []*googlev1.Function{
+			{Id: 1, Name: 1},
+			{Id: 2, Name: 2},
+			{Id: 3, Name: 3},
+		},
+		Location: []*googlev1.Location{
+			{Id: 1, MappingId: 1, Address: 1, Line: []*googlev1.Line{{FunctionId: 1, Line: 5}}},
+			// Function add is inlined into loop.
+			{Id: 2, MappingId: 1, Address: 2, Line: []*googlev1.Line{{FunctionId: 3, Line: 30}, {FunctionId: 2, Line: 12}}},
+			{Id: 3, MappingId: 1, Address: 3, Line: []*googlev1.Line{{FunctionId: 2, Line: 14}}},
+			{Id: 4, MappingId: 1, Address: 4, Line: []*googlev1.Line{{FunctionId: 1, Line: 6}}},
+			{Id: 5, MappingId: 1, Address: 5, Line: []*googlev1.Line{{FunctionId: 2, Line: 12}}},
+		},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{10}},
+			{LocationId: []uint64{3, 1}, Value: []int64{5}},
+			{LocationId: []uint64{3, 4}, Value: []int64{3}},
+			{LocationId: []uint64{5, 1}, Value: []int64{1}},
+		},
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	r := NewResolver(context.Background(), db)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	functions, err := r.Tree()
+	require.NoError(t, err)
+
+	r = NewResolver(context.Background(), db, WithLineGranularity())
+	defer r.Release()
+	r.AddSamples(0, samples)
+	lines, err := r.Tree()
+	require.NoError(t, err)
+	expected := `.
+├── main:5: self 0 total 16
+│   ├── loop:12: self 1 total 11
+│   │   └── add:30: self 10 total 10
+│   └── loop:14: self 5 total 5
+└── main:6: self 0 total 3
+    └── loop:14: self 3 total 3
+`
+	require.Equal(t, expected, lines.String())
+
+	// Totals of the functions are the sums of their lines.
+	merged := new(model.Tree)
+	lines.IterateStacks(func(_ string, v int64, stack []string) {
+		// The stack is ordered from the leaf to the root.
+		names := make([]string, len(stack))
+		for i, name := range stack {
+			names[len(names)-1-i] = name[:strings.LastIndexByte(name, ':')]
+		}
+		merged.InsertStack(v, names...)
+	})
+	require.Equal(t, functions.String(), merged.String())
+}
+
+func Test_memory_Resolver_NegativeValues(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "foo", "bar", "baz", "qux", "inuse_space", "bytes"},
+		SampleType:  []*googlev1.ValueType{{Type: 6, Unit: 7}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true}},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{10}},
+			{LocationId: []uint64{3, 1}, Value: []int64{-7}},
+			{LocationId: []uint64{4, 1}, Value: []int64{-1}},
+			{LocationId: []uint64{5, 1}, Value: []int64{2}},
+		},
+	}
+	for i := 1; i <= 5; i++ {
+		id := uint64(i)
+		p.Function = append(p.Function, &googlev1.Function{Id: id, Name: int64(i)})
+		p.Location = append(p.Location, &googlev1.Location{
+			Id:        id,
+			MappingId: 1,
+			Address:   id,
+			Line:      []*googlev1.Line{{FunctionId: id}},
+		})
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+	resolve := func(opts ...ResolverOption) *Resolver {
+		r := NewResolver(context.Background(), db, opts...)
+		r.AddSamples(0, samples)
+		return r
+	}
+
+	r := resolve()
+	defer r.Release()
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), tree.Total())
+	require.Equal(t, `.
+└── main: self 0 total 4
+    ├── bar: self -7 total -7
+    ├── baz: self -1 total -1
+    ├── foo: self 10 total 10
+    └── qux: self 2 total 2
+`, tree.String())
+
+	// Subtrees are compared by the absolute value.
+	r = resolve(WithMinValue(3))
+	defer r.Release()
+	tree, err = r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, `.
+└── main: self 0 total 4
+    ├── bar: self -7 total -7
+    ├── foo: self 10 total 10
+    └── other: self 1 total 1
+`, tree.String())
+
+	r = resolve()
+	defer r.Release()
+	top, err := r.Top(TopOptions{})
+	require.NoError(t, err)
+	names := make([]string, len(top))
+	for i, f := range top {
+		names[i] = f.Name
+	}
+	require.Equal(t, []string{"foo", "bar", "qux", "baz", "main"}, names)
+	require.Equal(t, int64(-7), top[1].Self)
+	require.Equal(t, int64(4), top[4].Total)
+
+	r = resolve()
+	defer r.Release()
+	stacks, err := r.TopStacks(2)
+	require.NoError(t, err)
+	require.Len(t, stacks.Stacks, 2)
+	require.Equal(t, int64(10), stacks.Stacks[0].Value)
+	require.Equal(t, int64(-7), stacks.Stacks[1].Value)
+	require.Equal(t, int64(1), stacks.Other)
+}
+
+func Test_memory_Resolver_CanonicalLocations(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "foo", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 3, Unit: 4}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true, HasLineNumbers: true}},
+		Function: []*googlev1.Function{
+			{Id: 1, Name: 1},
+			{Id: 2, Name: 2},
+		},
+		// Locations 2 and 3 share the function and line.
+		Location: []*googlev1.Location{
+			{Id: 1, MappingId: 1, Address: 0x10, Line: []*googlev1.Line{{FunctionId: 1, Line: 5}}},
+			{Id: 2, MappingId: 1, Address: 0x20, Line: []*googlev1.Line{{FunctionId: 2, Line: 10}}},
+			{Id: 3, MappingId: 1, Address: 0x24, Line: []*googlev1.Line{{FunctionId: 2, Line: 10}}},
+		},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{3}},
+			{LocationId: []uint64{3, 1}, Value: []int64{4}},
+		},
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	for _, tc := range []struct {
+		opts      []ResolverOption
+		locations int
+	}{
+		{locations: 3},
+		{opts: []ResolverOption{WithCanonicalLocations()}, locations: 2},
+	} {
+		r := NewResolver(context.Background(), db, append(tc.opts, WithLineGranularity())...)
+		r.AddSamples(0, samples)
+		tree, err := r.Tree()
+		require.NoError(t, err)
+		require.Equal(t, `.
+└── main:5: self 0 total 7
+    └── foo:10: self 7 total 7
+`, tree.String())
+		r.Release()
+
+		r = NewResolver(context.Background(), db, tc.opts...)
+		r.AddSamples(0, samples)
+		resolved, err := r.Profile()
+		require.NoError(t, err)
+		require.Len(t, resolved.Location, tc.locations)
+		var total int64
+		for _, s := range resolved.Sample {
+			total += s.Value[0]
+			require.Len(t, s.Location, 2)
+		}
+		require.Equal(t, int64(7), total)
+		r.Release()
+	}
+}
+
+func Test_memory_Resolver_MaxChildren(t *testing.T) {
+	// main calls 100 functions, f1 to f100, the value
+	// of the function equals its number.
+	const width = 100
+	p := &googlev1.Profile{
+		StringTable: []string{"", "cpu", "nanoseconds", "main"},
+		SampleType:  []*googlev1.ValueType{{Type: 1, Unit: 2}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true}},
+		Function:    []*googlev1.Function{{Id: 1, Name: 3}},
+		Location:    []*googlev1.Location{{Id: 1, MappingId: 1, Address: 1, Line: []*googlev1.Line{{FunctionId: 1}}}},
+	}
+	for i := 1; i <= width; i++ {
+		id := uint64(i + 1)
+		p.StringTable = append(p.StringTable, "f"+strconv.Itoa(i))
+		p.Function = append(p.Function, &googlev1.Function{Id: id, Name: int64(len(p.StringTable) - 1)})
+		p.Location = append(p.Location, &googlev1.Location{
+			Id:        id,
+			MappingId: 1,
+			Address:   id,
+			Line:      []*googlev1.Line{{FunctionId: id}},
+		})
+		p.Sample = append(p.Sample, &googlev1.Sample{LocationId: []uint64{id, 1}, Value: []int64{int64(i)}})
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	r := NewResolver(context.Background(), db, WithMaxChildren(10))
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, int64(width*(width+1)/2), tree.Total())
+	children := make(map[string]int64)
+	tree.Walk(func(n model.TreeWalkNode) bool {
+		if n.Depth == 1 {
+			children[n.Name] = n.Total
+		}
+		return true
+	})
+	require.Len(t, children, 11)
+	for i := width - 9; i <= width; i++ {
+		require.Equal(t, int64(i), children["f"+strconv.Itoa(i)])
+	}
+	// The sum of 1 to 90.
+	require.Equal(t, int64(4095), children["other (90)"])
+}
+
+func Test_block_Resolver_CumulativeValues(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	expected := resolveSamplesTree(t, s, samples)
+	var totals []int64
+	expected.Walk(func(n model.TreeWalkNode) bool {
+		totals = append(totals, n.Total)
+		return true
+	})
+
+	r := NewResolver(context.Background(), s.reader, WithCumulativeValues())
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, expected.Total(), tree.Total())
+	var roots int64
+	var values []int64
+	tree.Walk(func(n model.TreeWalkNode) bool {
+		require.Equal(t, n.Total, n.Self)
+		if n.Depth == 0 {
+			roots += n.Self
+		}
+		values = append(values, n.Self)
+		return true
+	})
+	// The cumulative values of the roots sum up to the total.
+	require.Equal(t, expected.Total(), roots)
+	require.Equal(t, totals, values)
+}
+
+func Test_memory_Resolver_ContentionProfile(t *testing.T) {
+	s := newMemSuite(t, [][]string{{"testdata/block.pb.gz"}})
+	// The block profile written by runtime/pprof.
+	f, err := os.Open("testdata/block.pb.gz")
+	require.NoError(t, err)
+	defer f.Close()
+	expected, err := profile.Parse(f)
+	require.NoError(t, err)
+	newResolver := func(opts ...ResolverOption) *Resolver {
+		r := NewResolver(context.Background(), s.db, append([]ResolverOption{WithContentionProfile()}, opts...)...)
+		r.AddSamplesWithValueIndex(0, s.indexed[0][ContentionsValueIndex].Samples, ContentionsValueIndex)
+		r.AddSamplesWithValueIndex(0, s.indexed[0][DelayValueIndex].Samples, DelayValueIndex)
+		return r
+	}
+
+	t.Run("Profile", func(t *testing.T) {
+		r := newResolver()
+		defer r.Release()
+		p, err := r.Profile()
+		require.NoError(t, err)
+		require.Equal(t, expected.SampleType, p.SampleType)
+		require.Equal(t, expected.PeriodType, p.PeriodType)
+		require.Equal(t, expected.Period, p.Period)
+		require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 0), profileFingerprint(p, 0))
+		require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 1), profileFingerprint(p, 1))
+	})
+
+	t.Run("ProfileProto", func(t *testing.T) {
+		r := newResolver()
+		defer r.Release()
+		x, err := r.ProfileProto(ProfileMeta{DurationNanos: 1e9})
+		require.NoError(t, err)
+		b, err := x.MarshalVT()
+		require.NoError(t, err)
+		p, err := profile.ParseData(b)
+		require.NoError(t, err)
+		require.Equal(t, expected.SampleType, p.SampleType)
+		require.Equal(t, expected.PeriodType, p.PeriodType)
+		require.Equal(t, expected.Period, p.Period)
+		require.Equal(t, int64(1e9), p.DurationNanos)
+		require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 1), profileFingerprint(p, 1))
+	})
+
+	t.Run("WriteProfile", func(t *testing.T) {
+		r := newResolver()
+		defer r.Release()
+		var buf bytes.Buffer
+		require.NoError(t, r.WriteProfile(context.Background(), &buf, ProfileMeta{DurationNanos: 1e9}))
+		p, err := profile.Parse(&buf)
+		require.NoError(t, err)
+		require.Equal(t, expected.SampleType, p.SampleType)
+		require.Equal(t, expected.PeriodType, p.PeriodType)
+		require.Equal(t, expected.Period, p.Period)
+		require.Equal(t, int64(1e9), p.DurationNanos)
+		require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 0), profileFingerprint(p, 0))
+		require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 1), profileFingerprint(p, 1))
+	})
+
+	t.Run("Bytes", func(t *testing.T) {
+		r := newResolver()
+		defer r.Release()
+		b, err := r.Bytes(context.Background(), ProfileMeta{}, CompressionNone)
+		require.NoError(t, err)
+		p, err := profile.ParseData(b)
+		require.NoError(t, err)
+		require.Equal(t, expected.SampleType, p.SampleType)
+		require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 1), profileFingerprint(p, 1))
+	})
+
+	t.Run("ProfileInto", func(t *testing.T) {
+		r := newResolver()
+		defer r.Release()
+		var x googlev1.Profile
+		require.NoError(t, r.ProfileInto(&x))
+		b, err := x.MarshalVT()
+		require.NoError(t, err)
+		p, err := profile.ParseData(b)
+		require.NoError(t, err)
+		require.Equal(t, expected.SampleType, p.SampleType)
+		require.Equal(t, expected.PeriodType, p.PeriodType)
+		require.Equal(t, expected.Period, p.Period)
+		require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 1), profileFingerprint(p, 1))
+	})
+
+	t.Run("Tree", func(t *testing.T) {
+		r := newResolver()
+		defer r.Release()
+		tree, err := r.Tree()
+		require.NoError(t, err)
+		require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 0), treeFingerprint(tree))
+
+		r = newResolver(WithTreeValueIndex(DelayValueIndex))
+		defer r.Release()
+		tree, err = r.Tree()
+		require.NoError(t, err)
+		require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 1), treeFingerprint(tree))
+	})
+
+	t.Run("delay only", func(t *testing.T) {
+		r := NewResolver(context.Background(), s.db, WithContentionProfile())
+		defer r.Release()
+		r.AddSamplesWithValueIndex(0, s.indexed[0][DelayValueIndex].Samples, DelayValueIndex)
+		p, err := r.Profile()
+		require.NoError(t, err)
+		require.Len(t, p.SampleType, 2)
+		require.Empty(t, profileFingerprint(p, 0))
+		require.Equal(t, pprofFingerprint(s.profiles[0].Profile, 1), profileFingerprint(p, 1))
+	})
+}
+
+func Test_memory_Resolver_Inlining(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "handler", "parse", "next", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 5, Unit: 6}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true, HasInlineFrames: true}},
+		Location: []*googlev1.Location{
+			{Id: 1, MappingId: 1, Address: 1, Line: []*googlev1.Line{{FunctionId: 1}}},
+			// Function next is inlined into parse,
+			// which is inlined into handler.
+			{Id: 2, MappingId: 1, Address: 2, Line: []*googlev1.Line{{FunctionId: 4}, {FunctionId: 3}, {FunctionId: 2}}},
+			{Id: 3, MappingId: 1, Address: 3, Line: []*googlev1.Line{{FunctionId: 2}}},
+		},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{10}},
+			{LocationId: []uint64{3, 1}, Value: []int64{5}},
+		},
+	}
+	for i := 1; i <= 4; i++ {
+		p.Function = append(p.Function, &googlev1.Function{Id: uint64(i), Name: int64(i)})
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	for _, tc := range []struct {
+		mode     InliningMode
+		expected string
+	}{
+		{
+			mode: InliningExpand,
+			expected: `.
+└── main: self 0 total 15
+    └── handler: self 5 total 15
+        └── parse: self 0 total 10
+            └── next: self 10 total 10
+`,
+		},
+		{
+			mode: InliningCollapse,
+			expected: `.
+└── main: self 0 total 15
+    └── handler: self 15 total 15
+`,
+		},
+	} {
+		r := NewResolver(context.Background(), db, WithInlining(tc.mode))
+		r.AddSamples(0, samples)
+		tree, err := r.Tree()
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, tree.String())
+		r.Release()
+	}
+
+	r := NewResolver(context.Background(), db, WithInlining(InliningCollapse))
+	defer r.Release()
+	r.AddSamples(0, samples)
+	resolved, err := r.Profile()
+	require.NoError(t, err)
+	for _, loc := range resolved.Location {
+		require.Len(t, loc.Line, 1)
+	}
+}
+
+func Test_block_Resolver_SymbolDetail(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	resolve := func(opts ...ResolverOption) (*model.Tree, ResolverPartitionStats) {
+		r := NewResolver(context.Background(), s.reader, opts...)
+		defer r.Release()
+		r.AddSamples(0, samples)
+		tree, err := r.Tree()
+		require.NoError(t, err)
+		stats := r.Stats()
+		require.Len(t, stats, 1)
+		return tree, stats[0]
+	}
+
+	full, fullStats := resolve(WithInlining(InliningCollapse))
+	functions, functionsStats := resolve(WithSymbolDetail(SymbolDetailFunctions))
+	require.Equal(t, full.String(), functions.String())
+	// Mappings are not fetched.
+	require.Zero(t, functionsStats.Mappings)
+	require.NotZero(t, fullStats.Mappings)
+	require.Less(t, functionsStats.BytesRead, fullStats.BytesRead)
+
+	r := NewResolver(context.Background(), s.reader, WithSymbolDetail(SymbolDetailFunctions))
+	defer r.Release()
+	r.AddSamples(0, samples)
+	resolved, err := r.Profile()
+	require.NoError(t, err)
+	for _, loc := range resolved.Location {
+		for _, line := range loc.Line {
+			require.Zero(t, line.Line)
+		}
+	}
+}
+
+func Test_memory_Resolver_SymbolDetail_Fallback(t *testing.T) {
+	s := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	samples := s.indexed[0][0].Samples
+	expected := NewResolver(context.Background(), s.db, WithInlining(InliningCollapse))
+	defer expected.Release()
+	expected.AddSamples(0, samples)
+	expectedTree, err := expected.Tree()
+	require.NoError(t, err)
+
+	// The partition is loaded in full.
+	r := NewResolver(context.Background(), s.db, WithSymbolDetail(SymbolDetailFunctions))
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, expectedTree.String(), tree.String())
+}
+
+func Test_memory_Resolver_DepthHistogram(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "handler", "parse", "next", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 5, Unit: 6}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true, HasInlineFrames: true}},
+		Location: []*googlev1.Location{
+			{Id: 1, MappingId: 1, Address: 1, Line: []*googlev1.Line{{FunctionId: 1}}},
+			// Inlined functions are counted as frames.
+			{Id: 2, MappingId: 1, Address: 2, Line: []*googlev1.Line{{FunctionId: 4}, {FunctionId: 3}, {FunctionId: 2}}},
+			{Id: 3, MappingId: 1, Address: 3, Line: []*googlev1.Line{{FunctionId: 2}}},
+		},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{10}},
+			{LocationId: []uint64{3, 1}, Value: []int64{5}},
+			{LocationId: []uint64{1}, Value: []int64{2}},
+			{LocationId: []uint64{3}, Value: []int64{1}},
+		},
+	}
+	for i := 1; i <= 4; i++ {
+		p.Function = append(p.Function, &googlev1.Function{Id: uint64(i), Name: int64(i)})
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	expected := &DepthHistogram{
+		Stacktraces:   []int64{0, 2, 1, 0, 1},
+		Values:        []int64{0, 3, 5, 0, 10},
+		MaxDepth:      4,
+		MaxDepthStack: []string{"main", "handler", "parse", "next"},
+	}
+	// Depths are not affected by the tree truncation.
+	for _, minValue := range []int64{0, 6} {
+		r := NewResolver(context.Background(), db, WithMinValue(minValue))
+		require.Nil(t, r.DepthHistogram())
+		r.AddSamples(0, samples)
+		_, err := r.Tree()
+		require.NoError(t, err)
+		require.Equal(t, expected, r.DepthHistogram())
+		r.Release()
+	}
+}
+
+func Test_memory_Resolver_RecursionFolding(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "fib", "add", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 4, Unit: 5}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, HasFunctions: true}},
+		Function: []*googlev1.Function{
+			{Id: 1, Name: 1},
+			{Id: 2, Name: 2},
+			{Id: 3, Name: 3},
+		},
+		Location: []*googlev1.Location{
+			{Id: 1, MappingId: 1, Address: 1, Line: []*googlev1.Line{{FunctionId: 1}}},
+			// Two call sites of the recursive function.
+			{Id: 2, MappingId: 1, Address: 2, Line: []*googlev1.Line{{FunctionId: 2}}},
+			{Id: 3, MappingId: 1, Address: 3, Line: []*googlev1.Line{{FunctionId: 2}}},
+			{Id: 4, MappingId: 1, Address: 4, Line: []*googlev1.Line{{FunctionId: 3}}},
+		},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{4, 2, 3, 2, 2, 3, 1}, Value: []int64{10}},
+			{LocationId: []uint64{2, 2, 2, 1}, Value: []int64{5}},
+			// Frames that are not consecutive are not folded.
+			{LocationId: []uint64{3, 4, 3, 1}, Value: []int64{1}},
+		},
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	r := NewResolver(context.Background(), db, WithRecursionFolding())
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	expected := `.
+└── main: self 0 total 16
+    └── fib: self 5 total 16
+        └── add: self 10 total 11
+            └── fib: self 1 total 1
+`
+	require.Equal(t, expected, tree.String())
+
+	r = NewResolver(context.Background(), db, WithRecursionFolding())
+	defer r.Release()
+	r.AddSamples(0, samples)
+	resolved, err := r.Profile()
+	require.NoError(t, err)
+	var total int64
+	for _, x := range resolved.Sample {
+		total += x.Value[0]
+		for i := 1; i < len(x.Location); i++ {
+			require.NotEqual(t,
+				x.Location[i-1].Line[0].Function.Name,
+				x.Location[i].Line[0].Function.Name)
+		}
+	}
+	require.Equal(t, int64(16), total)
+}
+
+func Test_memory_Resolver_RecursionFolding_Unsymbolized(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "main", "/bin/app", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 3, Unit: 4}},
+		Mapping:     []*googlev1.Mapping{{Id: 1, Filename: 2, MemoryStart: 0x1000, MemoryLimit: 0x9000}},
+		Function:    []*googlev1.Function{{Id: 1, Name: 1}},
+		Location: []*googlev1.Location{
+			{Id: 1, MappingId: 1, Address: 0x1100, Line: []*googlev1.Line{{FunctionId: 1}}},
+			// Locations without lines of distinct addresses.
+			{Id: 2, MappingId: 1, Address: 0x1234},
+			{Id: 3, MappingId: 1, Address: 0x5678},
+		},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{3, 2, 2, 1}, Value: []int64{10}},
+		},
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	r := NewResolver(context.Background(), db, WithRecursionFolding())
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	// Only the repeated frame of the same location is folded.
+	expected := `.
+└── main: self 0 total 10
+    └── app+0x234: self 0 total 10
+        └── app+0x4678: self 10 total 10
+`
+	require.Equal(t, expected, tree.String())
+}
+
+func Test_memory_Resolver_ByMapping(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "/app", "/lib/libc.so", "main", "handler", "malloc", "callback", "qsort", "start", "jit", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 10, Unit: 11}},
+		Mapping: []*googlev1.Mapping{
+			{Id: 1, Filename: 1, HasFunctions: true},
+			{Id: 2, Filename: 2, HasFunctions: true},
+			// The mapping of the JIT-compiled code has no file name.
+			{Id: 3, HasFunctions: true},
+		},
+	}
+	for i, mapping := range []uint64{1, 1, 2, 1, 2, 2, 3} {
+		id := uint64(i + 1)
+		p.Function = append(p.Function, &googlev1.Function{Id: id, Name: int64(i + 3)})
+		p.Location = append(p.Location, &googlev1.Location{
+			Id:        id,
+			MappingId: mapping,
+			Address:   id,
+			Line:      []*googlev1.Line{{FunctionId: id}},
+		})
+	}
+	p.Sample = []*googlev1.Sample{
+		{LocationId: []uint64{3, 2, 1}, Value: []int64{10}},
+		{LocationId: []uint64{4, 5, 1}, Value: []int64{20}},
+		{LocationId: []uint64{3, 6}, Value: []int64{5}},
+		{LocationId: []uint64{2, 1}, Value: []int64{7}},
+		{LocationId: []uint64{7, 1}, Value: []int64{3}},
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	r := NewResolver(context.Background(), db)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	mappings, err := r.ByMapping()
+	require.NoError(t, err)
+	expected := []MappingValue{
+		{Name: "/app", Self: 27, Total: 40},
+		{Name: "/lib/libc.so", Self: 15, Total: 35},
+		{Name: "[unknown]", Self: 3, Total: 3},
+	}
+	require.Equal(t, expected, mappings)
+
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r = NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	mappings, err = r.ByMapping()
+	require.NoError(t, err)
+	var self int64
+	for _, m := range mappings {
+		self += m.Self
+	}
+	var total int64
+	for _, v := range pprofFingerprint(s.profiles[0].Profile, 0) {
+		total += int64(v[1])
+	}
+	require.Equal(t, total, self)
+}
+
+func Test_memory_Resolver_UnsymbolizedLocations(t *testing.T) {
+	p := &googlev1.Profile{
+		StringTable: []string{"", "/app", "/usr/lib/libfoo.so", "main", "cpu", "nanoseconds"},
+		SampleType:  []*googlev1.ValueType{{Type: 4, Unit: 5}},
+		Mapping: []*googlev1.Mapping{
+			{Id: 1, Filename: 1, HasFunctions: true, MemoryStart: 0x1000, MemoryLimit: 0x2000},
+			{Id: 2, Filename: 2, MemoryStart: 0x400000, MemoryLimit: 0x500000, FileOffset: 0x1000},
+		},
+		Function: []*googlev1.Function{{Id: 1, Name: 3}},
+		Location: []*googlev1.Location{
+			{Id: 1, MappingId: 1, Address: 0x1100, Line: []*googlev1.Line{{FunctionId: 1}}},
+			// Locations without function info.
+			{Id: 2, MappingId: 2, Address: 0x401234},
+			{Id: 3, MappingId: 2, Address: 0x402000},
+		},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{10}},
+			{LocationId: []uint64{3, 1}, Value: []int64{5}},
+		},
+	}
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	samples := db.WriteProfileSymbols(0, p)[0].Samples
+
+	r := NewResolver(context.Background(), db)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	expected := `.
+└── main: self 0 total 15
+    ├── libfoo.so+0x2234: self 10 total 10
+    └── libfoo.so+0x3000: self 5 total 5
+`
+	require.Equal(t, expected, tree.String())
+}
+
+func Test_Resolver_Close(t *testing.T) {
+	var c io.Closer = NewResolver(context.Background(), NewSymDB(&Config{Dir: t.TempDir()}))
+	require.NoError(t, c.Close())
+	// Close is idempotent, as Release is.
+	require.NoError(t, c.Close())
+	c.(*Resolver).Release()
+}
+
+func Test_Resolver_DumpSamples(t *testing.T) {
+	// The partition is never resolved.
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	r := NewResolver(context.Background(), db)
+	defer r.Release()
+	r.AddSamples(1, schemav1.Samples{StacktraceIDs: []uint32{1, 2, 3}, Values: []uint64{1, 2, 3}})
+	r.AddSamples(1, schemav1.Samples{StacktraceIDs: []uint32{2, 5}, Values: []uint64{10, 5}})
+	require.Equal(t, map[uint32]int64{1: 1, 2: 12, 3: 3, 5: 5}, r.DumpSamples(1))
+	require.Nil(t, r.DumpSamples(2))
+
+	// The copy is not affected by further calls.
+	dump := r.DumpSamples(1)
+	r.AddSamples(1, schemav1.Samples{StacktraceIDs: []uint32{1}, Values: []uint64{1}})
+	require.Equal(t, int64(1), dump[1])
+	require.Equal(t, int64(2), r.DumpSamples(1)[1])
+}
+
+func Test_block_Resolver_AddStacktraceIDs(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	expected := NewResolver(context.Background(), s.reader)
+	defer expected.Release()
+	expected.AddSamples(0, samples)
+	expectedTree, err := expected.Tree()
+	require.NoError(t, err)
+
+	// IDs are added in small batches.
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	const batchSize = 16
+	values := make([]int64, 0, batchSize)
+	for lo := 0; lo < len(samples.StacktraceIDs); lo += batchSize {
+		hi := lo + batchSize
+		if hi > len(samples.StacktraceIDs) {
+			hi = len(samples.StacktraceIDs)
+		}
+		values = values[:0]
+		for _, v := range samples.Values[lo:hi] {
+			values = append(values, int64(v))
+		}
+		r.AddStacktraceIDs(0, samples.StacktraceIDs[lo:hi], values)
+	}
+	require.Equal(t, expected.DumpSamples(0), r.DumpSamples(0))
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, expectedTree.String(), tree.String())
+}
+
+func Test_block_Resolver_Paths(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	// Each of the paths ends at a node with the self value.
+	var expected [][]string
+	var path []string
+	resolveSamplesTree(t, s, samples).Walk(func(n model.TreeWalkNode) bool {
+		path = append(path[:n.Depth], n.Name)
+		if n.Self != 0 {
+			expected = append(expected, append([]string(nil), path...))
+		}
+		return true
+	})
+	sort.Slice(expected, func(i, j int) bool {
+		return strings.Join(expected[i], "\x00") < strings.Join(expected[j], "\x00")
+	})
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	paths, err := r.Paths()
+	require.NoError(t, err)
+	require.Len(t, paths, 370)
+	require.Equal(t, expected, paths)
+}
+
+func Test_block_Resolver_AddSamplesEncoded(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	expected := NewResolver(context.Background(), s.reader)
+	defer expected.Release()
+	expected.AddSamples(0, samples)
+	expectedTree, err := expected.Tree()
+	require.NoError(t, err)
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	ids := EncodeStacktraceIDs(nil, samples.StacktraceIDs)
+	require.NoError(t, r.AddSamplesEncoded(0, ids, samples.Values))
+	require.Equal(t, expected.DumpSamples(0), r.DumpSamples(0))
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, expectedTree.String(), tree.String())
+}
+
+func Test_Resolver_AddSamplesEncoded_Invalid(t *testing.T) {
+	// The partition is never resolved.
+	db := NewSymDB(&Config{Dir: t.TempDir()})
+	r := NewResolver(context.Background(), db)
+	defer r.Release()
+	// Unsorted IDs.
+	ids := EncodeStacktraceIDs(nil, []uint32{5, 1, 300, 2})
+	require.NoError(t, r.AddSamplesEncoded(0, ids, []uint64{1, 2, 3, 4}))
+	require.Equal(t, map[uint32]int64{1: 2, 2: 4, 5: 1, 300: 3}, r.DumpSamples(0))
+
+	err := r.AddSamplesEncoded(1, ids, []uint64{1, 2, 3})
+	require.ErrorIs(t, err, ErrInvalidEncodedStacktraceIDs)
+	err = r.AddSamplesEncoded(1, ids, []uint64{1, 2, 3, 4, 5})
+	require.ErrorIs(t, err, ErrInvalidEncodedStacktraceIDs)
+	err = r.AddSamplesEncoded(1, []byte{0x80}, []uint64{1})
+	require.ErrorIs(t, err, ErrInvalidEncodedStacktraceIDs)
+	err = r.AddSamplesEncoded(1, EncodeStacktraceIDs(nil, []uint32{1})[:0], nil)
+	require.NoError(t, err)
+}
+
+func Test_block_Resolver_AddSamplesRange(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	expected := NewResolver(context.Background(), s.reader)
+	defer expected.Release()
+	expected.AddSamples(0, samples)
+	expectedTree, err := expected.Tree()
+	require.NoError(t, err)
+
+	const pageSize = 100
+	n := len(samples.StacktraceIDs)
+	require.Greater(t, n, 2*pageSize)
+
+	// Ranges added to the same resolver, the last
+	// one exceeds the bounds of the collection.
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	for lo := 0; lo < n; lo += pageSize {
+		r.AddSamplesRange(0, samples, lo, lo+pageSize)
+	}
+	r.AddSamplesRange(0, samples, n, n+pageSize)
+	r.AddSamplesRange(0, samples, -1, 0)
+	require.Equal(t, expected.DumpSamples(0), r.DumpSamples(0))
+
+	// Pages resolved independently.
+	merged := new(model.Tree)
+	for lo := 0; lo < n; lo += pageSize {
+		p := NewResolver(context.Background(), s.reader)
+		p.AddSamplesRange(0, samples, lo, lo+pageSize)
+		tree, err := p.Tree()
+		p.Release()
+		require.NoError(t, err)
+		merged.Merge(tree)
+	}
+	require.Equal(t, expectedTree.String(), merged.String())
+}
+
+func Test_block_Resolver_CountMode(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	var total int64
+	for _, v := range samples.Values {
+		total += int64(v)
+	}
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	values, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, total, values.Total())
+
+	r = NewResolver(context.Background(), s.reader, WithCountMode())
+	defer r.Release()
+	r.AddSamples(0, samples)
+	r.AddSamples(0, samples)
+	counts, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, int64(2*len(samples.StacktraceIDs)), counts.Total())
+	require.NotEqual(t, values.Total(), counts.Total())
+
+	// Each of the stacks is weighted by the number of occurrences.
+	occurrences := make(map[uint32]int64)
+	for _, sid := range samples.StacktraceIDs {
+		occurrences[sid] += 2
+	}
+	require.Equal(t, occurrences, r.DumpSamples(0))
+}
+
+func Test_block_Resolver_Upscale(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	const period = int64(10 * time.Millisecond)
+
+	r := NewResolver(context.Background(), s.reader, WithCountMode(), WithUpscale(period))
+	defer r.Release()
+	r.AddSamples(0, samples)
+	upscaled, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, int64(len(samples.StacktraceIDs))*period, upscaled.Total())
+
+	r = NewResolver(context.Background(), s.reader, WithCountMode())
+	defer r.Release()
+	r.AddSamples(0, samples)
+	counts, err := r.Tree()
+	require.NoError(t, err)
+	counts.TransformValues(func(v int64) int64 { return v * period })
+	require.Equal(t, treeFingerprint(counts), treeFingerprint(upscaled))
+}
+
+func Test_memory_Resolver_SkipZeroValues(t *testing.T) {
+	s := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}, {"testdata/profile.pb.gz"}})
+	samples := s.indexed[0][0].Samples
+	// Every other stack trace has the zero value.
+	withZeros := samples.Clone()
+	values := make(map[uint32]uint64)
+	for i, sid := range withZeros.StacktraceIDs {
+		if i%2 == 0 {
+			withZeros.Values[i] = 0
+		}
+		values[sid] += withZeros.Values[i]
+	}
+	zeros := make(map[uint32]struct{})
+	for sid, v := range values {
+		if v == 0 {
+			zeros[sid] = struct{}{}
+		}
+	}
+	require.NotEmpty(t, zeros)
+	// Partition 1 only has zero values.
+	zeroOnly := s.indexed[1][0].Samples.Clone()
+	for i := range zeroOnly.Values {
+		zeroOnly.Values[i] = 0
+	}
+
+	resolve := func(opts ...ResolverOption) (*model.Tree, map[uint32]struct{}) {
+		m := &recordingSymbolsReader{SymbolsReader: s.db}
+		r := NewResolver(context.Background(), m, opts...)
+		defer r.Release()
+		r.AddSamples(0, withZeros)
+		r.AddSamples(1, zeroOnly)
+		tree, err := r.Tree()
+		require.NoError(t, err)
+		return tree, m.stacktraces()
+	}
+
+	expected, resolved := resolve()
+	for sid := range zeros {
+		require.Contains(t, resolved, sid)
+	}
+	actual, resolved := resolve(WithSkipZeroValues())
+	require.Equal(t, expected.String(), actual.String())
+	require.NotEmpty(t, resolved)
+	for sid := range zeros {
+		require.NotContains(t, resolved, sid)
+	}
+}
+
+func Test_memory_Resolver_ResolveTree_Filter(t *testing.T) {
+	s := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	samples := s.indexed[0][0].Samples
+	selected := make(map[uint32]struct{})
+	expected := schemav1.NewSamples(len(samples.StacktraceIDs) / 2)
+	for i, sid := range samples.StacktraceIDs {
+		if i%2 == 0 {
+			selected[sid] = struct{}{}
+		}
+	}
+	for i, sid := range samples.StacktraceIDs {
+		if _, ok := selected[sid]; ok {
+			expected.StacktraceIDs = append(expected.StacktraceIDs, sid)
+			expected.Values = append(expected.Values, samples.Values[i])
+		}
+	}
+
+	r := NewResolver(context.Background(), s.db)
+	defer r.Release()
+	r.AddSamples(0, expected)
+	expectedTree, err := r.Tree()
+	require.NoError(t, err)
+
+	r = NewResolver(context.Background(), s.db)
+	defer r.Release()
+	r.AddSamplesWithFilter(0, samples, func(sid uint32) bool {
+		_, ok := selected[sid]
+		return ok
+	})
+	resolved, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, treeFingerprint(expectedTree), treeFingerprint(resolved))
+	require.Equal(t, int64(expected.Sum()), resolved.Total())
+}
+
+func Test_block_Resolver_ResolveTree_Diff(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	resolved, err := r.Tree()
+	require.NoError(t, err)
+
+	nodes := resolved.Diff(resolved).Root
+	var total int64
+	for _, n := range nodes {
+		total += n.Right.Total
+	}
+	require.Equal(t, resolved.Total(), total)
+	for len(nodes) > 0 {
+		n := nodes[len(nodes)-1]
+		nodes = append(nodes[:len(nodes)-1], n.Children...)
+		require.Zero(t, n.Delta())
+		require.Equal(t, n.Left, n.Right)
+	}
+}
+
+func Test_block_DiffTrees_Normalized(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	scaled := samples.Clone()
+	for i := range scaled.Values {
+		scaled.Values[i] *= 3
+	}
+
+	left := NewResolver(context.Background(), s.reader)
+	defer left.Release()
+	left.AddSamples(0, samples)
+	right := NewResolver(context.Background(), s.reader)
+	defer right.Release()
+	right.AddSamples(0, scaled)
+	d, err := DiffTrees(left, right, model.TreeDiffNormalized)
+	require.NoError(t, err)
+	require.Equal(t, 3*d.LeftTotal, d.RightTotal)
+
+	nodes := d.Root
+	for len(nodes) > 0 {
+		n := nodes[len(nodes)-1]
+		nodes = append(nodes[:len(nodes)-1], n.Children...)
+		require.Equal(t, 3*n.Left.Total, n.Right.Total)
+		require.InDelta(t, 0, n.NormalizedDelta, 1e-9)
+	}
+}
+
+func Test_block_Resolver_ResolveProfile(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	resolved, err := r.Profile()
+	require.NoError(t, err)
+	require.Equal(t, expectedFingerprint, profileFingerprint(resolved, 0))
+}
+
+func Test_block_Resolver_ResolveTree(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 1)
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][1].Samples)
+	resolved, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, expectedFingerprint, treeFingerprint(resolved))
+}
+
+func Test_block_Resolver_Reset(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	for i := range s.indexed[0] {
+		r.Reset(context.Background(), s.reader)
+		r.AddSamples(0, s.indexed[0][i].Samples)
+		resolved, err := r.Tree()
+		require.NoError(t, err)
+		require.Equal(t, pprofFingerprint(s.profiles[0].Profile, i), treeFingerprint(resolved))
+	}
+}
+
+func Benchmark_block_Resolver_ResolveProfile(t *testing.B) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	t.ResetTimer()
+	t.ReportAllocs()
+	for i := 0; i < t.N; i++ {
+		r := NewResolver(context.Background(), s.reader)
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		_, _ = r.Profile()
+	}
+}
+
+const benchmarkBatchSize = 8
+
+func Benchmark_block_Resolver_Tree_Independent(t *testing.B) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	t.ResetTimer()
+	t.ReportAllocs()
+	for i := 0; i < t.N; i++ {
+		for j := 0; j < benchmarkBatchSize; j++ {
+			r := NewResolver(context.Background(), s.reader)
+			r.AddSamples(0, s.indexed[0][0].Samples)
+			_, _ = r.Tree()
+			r.Release()
+		}
+	}
+}
+
+// benchmarkStacktraceIDs returns a large set of sorted stack trace
+// IDs with duplicates, as they are stored in the profiles table.
+func benchmarkStacktraceIDs() ([]uint32, []uint64) {
+	const n = 1 << 20
+	ids := make([]uint32, n)
+	values := make([]uint64, n)
+	for i := range ids {
+		ids[i] = uint32(i/4 + 1)
+		values[i] = 1
+	}
+	return ids, values
+}
+
+func Benchmark_Resolver_AddSamples_Decoded(b *testing.B) {
+	ids, values := benchmarkStacktraceIDs()
+	encoded := EncodeStacktraceIDs(nil, ids)
+	db := NewSymDB(&Config{Dir: b.TempDir()})
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := NewResolver(context.Background(), db)
+		decoded := make([]uint32, 0, len(values))
+		var prev int64
+		for off := 0; off < len(encoded); {
+			d, n := binary.Varint(encoded[off:])
+			off += n
+			prev += d
+			decoded = append(decoded, uint32(prev))
+		}
+		r.AddSamples(0, schemav1.Samples{StacktraceIDs: decoded, Values: values})
+		r.Release()
+	}
+}
+
+func Benchmark_Resolver_AddSamples_Encoded(b *testing.B) {
+	ids, values := benchmarkStacktraceIDs()
+	encoded := EncodeStacktraceIDs(nil, ids)
+	db := NewSymDB(&Config{Dir: b.TempDir()})
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := NewResolver(context.Background(), db)
+		_ = r.AddSamplesEncoded(0, encoded, values)
+		r.Release()
+	}
+}
+
+func Benchmark_block_BatchResolver_Trees(t *testing.B) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	sets := make([]LabeledSamples, benchmarkBatchSize)
+	for j := range sets {
+		sets[j] = LabeledSamples{Label: strconv.Itoa(j), Samples: s.indexed[0][0].Samples}
+	}
+	t.ResetTimer()
+	t.ReportAllocs()
+	for i := 0; i < t.N; i++ {
+		b := NewBatchResolver(context.Background(), s.reader)
+		_, _ = b.Trees(sets)
+		b.Release()
+	}
+}
+
+func Benchmark_block_Resolver_ProfileInto(t *testing.B) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	var p googlev1.Profile
+	t.ResetTimer()
+	t.ReportAllocs()
+	for i := 0; i < t.N; i++ {
+		r := NewResolver(context.Background(), s.reader)
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		_ = r.ProfileInto(&p)
+	}
+}
+
+func Benchmark_block_Resolver_WriteProfile(t *testing.B) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	t.ResetTimer()
+	t.ReportAllocs()
+	for i := 0; i < t.N; i++ {
+		r := NewResolver(context.Background(), s.reader)
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		_ = r.WriteProfile(context.Background(), io.Discard, ProfileMeta{})
+	}
+}
+
+func Benchmark_block_Resolver_Bytes(b *testing.B) {
+	s := newBlockSuite(b, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	meta := ProfileMeta{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+	}
+	for _, bc := range []struct {
+		name        string
+		compression Compression
+	}{
+		{name: "none", compression: CompressionNone},
+		{name: "gzip", compression: CompressionGzip},
+		{name: "zstd", compression: CompressionZstd},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var size int
+			for i := 0; i < b.N; i++ {
+				r := NewResolver(context.Background(), s.reader)
+				r.AddSamples(0, s.indexed[0][0].Samples)
+				data, _ := r.Bytes(context.Background(), meta, bc.compression)
+				size = len(data)
+				r.Release()
+			}
+			b.ReportMetric(float64(size), "bytes")
+		})
+	}
+}
+
+func Benchmark_block_Resolver_Locations(t *testing.B) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	t.ResetTimer()
+	t.ReportAllocs()
+	for i := 0; i < t.N; i++ {
+		r := NewResolver(context.Background(), s.reader, WithLocationsOnly())
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		_, _ = r.Locations()
+	}
+}
+
+func Benchmark_block_Resolver_Functions(t *testing.B) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	t.ResetTimer()
+	t.ReportAllocs()
+	for i := 0; i < t.N; i++ {
+		r := NewResolver(context.Background(), s.reader)
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		_, _ = r.Functions()
+	}
+}
+
+func Benchmark_block_Resolver_StacktraceMemo(b *testing.B) {
+	const profile = "testdata/profile.pb.gz"
+	s := newBlockSuite(b, [][]string{{profile}, {profile}})
+	defer s.teardown()
+	for _, size := range []int{0, 1 << 20} {
+		size := size
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r := NewResolver(context.Background(), s.reader, WithMinValue(1e7), WithStacktraceMemo(size))
+				r.AddSamples(0, s.indexed[0][0].Samples)
+				r.AddSamples(1, s.indexed[1][0].Samples)
+				_, _ = r.Tree()
+				r.Release()
+			}
+		})
+	}
+}
+
+func Benchmark_block_Resolver_ResolveTree(t *testing.B) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	t.ResetTimer()
+	t.ReportAllocs()
+	for i := 0; i < t.N; i++ {
+		r := NewResolver(context.Background(), s.reader)
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		_, _ = r.Tree()
+	}
+}
+
+func Benchmark_block_Resolver_ResolveTree_Reset(t *testing.B) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	t.ResetTimer()
+	t.ReportAllocs()
+	for i := 0; i < t.N; i++ {
+		r.Reset(context.Background(), s.reader)
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		_, _ = r.Tree()
+	}
+}
+
+func Test_Resolver_Release(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+
+	t.Run("before AddSamples", func(t *testing.T) {
+		r := NewResolver(context.Background(), s.reader)
+		r.Release()
+		r.Release()
+	})
+
+	t.Run("without resolution", func(t *testing.T) {
+		r := NewResolver(context.Background(), s.reader)
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r.Release()
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Release blocked")
+		}
+	})
+
+	t.Run("twice", func(t *testing.T) {
+		r := NewResolver(context.Background(), s.reader)
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		_, err := r.Tree()
+		require.NoError(t, err)
+		r.Release()
+		r.Release()
+	})
+
+	t.Run("concurrently", func(t *testing.T) {
+		r := NewResolver(context.Background(), s.reader)
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		_, err := r.Tree()
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				defer wg.Done()
+				r.Release()
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func Test_Resolver_Unreleased_Failed_Partition(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	// Pass canceled context to make partition initialization to fail.
+	cancel()
+
+	r := NewResolver(ctx, s.reader)
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	_, err := r.Tree()
+	require.ErrorIs(t, err, context.Canceled)
+	r.Release()
+
+	// This time we pass normal context.
+	r = NewResolver(context.Background(), s.reader)
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	_, err = r.Tree()
+	require.NoError(t, err)
+	r.Release()
+}
+
+func Test_Resolver_Error_Propagation(t *testing.T) {
+	m := new(mockSymbolsReader)
+	m.On("Partition", mock.Anything, mock.Anything).Return(nil, io.EOF).Once()
+	r := NewResolver(context.Background(), m)
+	r.AddSamples(0, schemav1.Samples{StacktraceIDs: []uint32{1}, Values: []uint64{1}})
+	_, err := r.Tree()
+	require.ErrorIs(t, err, io.EOF)
+	r.Release()
+}
+
+func Test_Resolver_Error_categories(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+
+	t.Run("partition not found", func(t *testing.T) {
+		r := NewResolver(context.Background(), s.reader)
+		defer r.Release()
+		r.AddSamples(1, samples)
+		_, err := r.Tree()
+		require.ErrorIs(t, err, ErrPartitionNotFound)
+		var partitionErr *PartitionError
+		require.ErrorAs(t, err, &partitionErr)
+		require.Equal(t, uint64(1), partitionErr.Partition)
+		require.False(t, errors.Is(err, ErrSectionCorrupt))
+	})
+
+	t.Run("section corrupt", func(t *testing.T) {
+		x := openBlockReaders(t, s, 1)[0]
+		x.partitions[0].stacktraceChunks[0].header.CRC++
+		r := NewResolver(context.Background(), x)
+		defer r.Release()
+		r.AddSamples(0, samples)
+		_, err := r.Tree()
+		require.ErrorIs(t, err, ErrSectionCorrupt)
+		require.ErrorIs(t, err, ErrInvalidCRC)
+		var sectionErr *SectionError
+		require.ErrorAs(t, err, &sectionErr)
+		require.Equal(t, sectionStacktraces, sectionErr.Section)
+		require.False(t, errors.Is(err, context.Canceled))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		m := new(mockSymbolsReader)
+		m.On("Partition", mock.Anything, mock.Anything).
+			Run(func(mock.Arguments) { cancel() }).
+			Return(nil, io.ErrUnexpectedEOF)
+		r := NewResolver(ctx, m)
+		defer r.Release()
+		r.AddSamples(0, samples)
+		_, err := r.Tree()
+		require.ErrorIs(t, err, context.Canceled)
+		var canceledErr *CanceledError
+		require.ErrorAs(t, err, &canceledErr)
+
+		// The underlying error is wrapped.
+		err = r.canceled(ctx, fmt.Errorf("fetching chunk: %w", io.ErrUnexpectedEOF))
+		require.ErrorIs(t, err, context.Canceled)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.NoError(t, r.canceled(ctx, nil))
+	})
+}
+
+func Test_Resolver_no_samples(t *testing.T) {
+	m := new(mockSymbolsReader)
+	m.On("Partition", mock.Anything, mock.Anything).Return(nil, io.EOF)
+	newResolver := func() *Resolver {
+		r := NewResolver(context.Background(), m)
+		r.AddSamples(0, schemav1.Samples{})
+		r.AddSamplesWithLabels(1, schemav1.Samples{}, model.LabelsFromStrings("foo", "bar"))
+		r.AddSamplesWithFilter(2, schemav1.Samples{StacktraceIDs: []uint32{1}, Values: []uint64{1}},
+			func(uint32) bool { return false })
+		return r
+	}
+
+	r := newResolver()
+	require.NoError(t, r.Prefetch(context.Background()))
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), tree.Total())
+	r.Release()
+
+	r = newResolver()
+	p, err := r.Profile()
+	require.NoError(t, err)
+	require.Empty(t, p.Sample)
+	var buf bytes.Buffer
+	require.NoError(t, p.Write(&buf))
+	r.Release()
+
+	r = newResolver()
+	var out bytes.Buffer
+	require.NoError(t, r.WriteProfile(context.Background(), &out, ProfileMeta{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+	}))
+	_, err = profile.Parse(&out)
+	require.NoError(t, err)
+	r.Release()
+
+	m.AssertNotCalled(t, "Partition", mock.Anything, mock.Anything)
+}
+
+func Test_Resolver_Error_Propagation_multiple_partitions(t *testing.T) {
+	s := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	m := new(mockSymbolsReader)
+	m.On("Partition", mock.Anything, uint64(0)).Return(s.db.Partition(context.Background(), 0))
+	m.On("Partition", mock.Anything, uint64(1)).Return(nil, io.EOF)
+	r := NewResolver(context.Background(), m, WithMaxConcurrent(1))
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	r.AddSamples(1, schemav1.Samples{StacktraceIDs: []uint32{1}, Values: []uint64{1}})
+	_, err := r.Tree()
+	require.ErrorIs(t, err, io.EOF)
+	r.Release()
+}
+
+func Test_Resolver_SoftDeadline(t *testing.T) {
+	s := newMemSuite(t, [][]string{
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+	})
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	// Loading of partition 1 takes longer than allowed.
+	loaded := make(chan time.Time)
+	m := new(mockSymbolsReader)
+	m.On("Partition", mock.Anything, uint64(0)).Return(s.db.Partition(context.Background(), 0))
+	m.On("Partition", mock.Anything, uint64(1)).WaitUntil(loaded).Return(s.db.Partition(context.Background(), 1))
+
+	// Partitions are resolved concurrently regardless of GOMAXPROCS:
+	// otherwise, partition 1 may hold the only slot until the deadline.
+	r := NewResolver(context.Background(), m, WithSoftDeadline(100*time.Millisecond), WithMaxConcurrent(2))
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	r.AddSamples(1, s.indexed[1][0].Samples)
+	tree, err := r.Tree()
+	require.True(t, IsPartialResult(err))
+	require.True(t, IsTruncated(err))
+	var partial *PartialResultError
+	require.ErrorAs(t, err, &partial)
+	require.Len(t, partial.Errors, 1)
+	require.Equal(t, uint64(1), partial.Errors[0].Partition)
+	require.ErrorIs(t, partial.Errors[0], ErrSoftDeadlineExceeded)
+	require.Equal(t, expectedFingerprint, treeFingerprint(tree))
+	close(loaded)
+	r.Release()
+
+	// Partitions resolved within the deadline are not affected.
+	r = NewResolver(context.Background(), s.db, WithSoftDeadline(time.Minute))
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	tree, err = r.Tree()
+	require.NoError(t, err)
+	require.False(t, IsTruncated(err))
+	require.Equal(t, expectedFingerprint, treeFingerprint(tree))
+	r.Release()
+}
+
+func Test_Resolver_TimeBudget(t *testing.T) {
+	s := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	samples := s.indexed[0][0].Samples
+	expected := pprofFingerprint(s.profiles[0].Profile, 0)
+	exact := make(map[uint64]struct{}, len(expected))
+	for _, v := range expected {
+		exact[v[0]] = struct{}{}
+	}
+
+	// Resolution of more than a half of the stack traces
+	// does not complete until the context is canceled.
+	m := &slowSymbolsReader{SymbolsReader: s.db, limit: len(samples.StacktraceIDs) / 2}
+	r := NewResolver(context.Background(), m, WithTimeBudget(50*time.Millisecond, 0.1))
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.True(t, r.Approximate())
+	sampled := treeFingerprint(tree)
+	require.NotEmpty(t, sampled)
+	require.Less(t, len(sampled), len(expected))
+	for _, v := range sampled {
+		require.Contains(t, exact, v[0])
+	}
+	r.Release()
+
+	// Negative values of the fallback tree are scaled
+	// the same way, e.g., of diff profiles.
+	values := make(map[uint64]int64, len(expected))
+	for _, v := range expected {
+		values[v[0]] = int64(v[1])
+	}
+	negative := samples.Clone()
+	for i, v := range negative.Values {
+		negative.Values[i] = uint64(-int64(v))
+	}
+	r = NewResolver(context.Background(), m, WithTimeBudget(50*time.Millisecond, 0.1))
+	r.AddSamples(0, negative)
+	tree, err = r.Tree()
+	require.NoError(t, err)
+	require.True(t, r.Approximate())
+	require.Less(t, tree.Total(), int64(0))
+	sampled = treeFingerprint(tree)
+	require.NotEmpty(t, sampled)
+	for _, v := range sampled {
+		require.Contains(t, values, v[0])
+		// Scaled by 1/rate, with rounding of each of the stack traces.
+		scaled := -int64(v[1])
+		require.Greater(t, scaled, int64(0))
+		require.LessOrEqual(t, scaled, 10*values[v[0]]+int64(len(samples.StacktraceIDs)))
+	}
+	r.Release()
+
+	// Trees resolved within the budget are exact.
+	r = NewResolver(context.Background(), s.db, WithTimeBudget(time.Minute, 0.1))
+	r.AddSamples(0, samples)
+	tree, err = r.Tree()
+	require.NoError(t, err)
+	require.False(t, r.Approximate())
+	require.Equal(t, expected, treeFingerprint(tree))
+	r.Release()
+}
+
+func Test_Resolver_CancelPartition(t *testing.T) {
+	s := newMemSuite(t, [][]string{
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+	})
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	for i := range expectedFingerprint {
+		expectedFingerprint[i][1] *= 2
+	}
+
+	t.Run("slow partition is canceled", func(t *testing.T) {
+		loading := make(chan struct{})
+		unblock := make(chan struct{})
+		m := new(mockSymbolsReader)
+		m.On("Partition", mock.Anything, uint64(0)).Return(s.db.Partition(context.Background(), 0))
+		m.On("Partition", mock.Anything, uint64(1)).Run(func(mock.Arguments) {
+			close(loading)
+			<-unblock
+		}).Return(s.db.Partition(context.Background(), 1))
+		m.On("Partition", mock.Anything, uint64(2)).Return(s.db.Partition(context.Background(), 2))
+		r := NewResolver(context.Background(), m, WithBestEffort())
+		for i := uint64(0); i < 3; i++ {
+			r.AddSamples(i, s.indexed[i][0].Samples)
+		}
+		go func() {
+			<-loading
+			r.CancelPartition(1)
+		}()
+		tree, err := r.Tree()
+		require.True(t, IsPartialResult(err))
+		var partial *PartialResultError
+		require.ErrorAs(t, err, &partial)
+		require.Len(t, partial.Errors, 1)
+		require.Equal(t, uint64(1), partial.Errors[0].Partition)
+		require.ErrorIs(t, partial.Errors[0], ErrPartitionCanceled)
+		require.Equal(t, expectedFingerprint, treeFingerprint(tree))
+		close(unblock)
+		r.Release()
+	})
+
+	t.Run("not best-effort", func(t *testing.T) {
+		r := NewResolver(context.Background(), s.db)
+		defer r.Release()
+		for i := uint64(0); i < 3; i++ {
+			r.AddSamples(i, s.indexed[i][0].Samples)
+		}
+		r.CancelPartition(1)
+		_, err := r.Tree()
+		require.ErrorIs(t, err, ErrPartitionCanceled)
+		require.False(t, IsPartialResult(err))
+		var partitionErr *PartitionError
+		require.ErrorAs(t, err, &partitionErr)
+		require.Equal(t, uint64(1), partitionErr.Partition)
+	})
+}
+
+func Test_Resolver_BestEffort(t *testing.T) {
+	s := newMemSuite(t, [][]string{
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+	})
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	for i := range expectedFingerprint {
+		expectedFingerprint[i][1] *= 2
+	}
+	newResolver := func() *Resolver {
+		m := new(mockSymbolsReader)
+		m.On("Partition", mock.Anything, uint64(0)).Return(s.db.Partition(context.Background(), 0))
+		m.On("Partition", mock.Anything, uint64(1)).Return(nil, io.EOF)
+		m.On("Partition", mock.Anything, uint64(2)).Return(s.db.Partition(context.Background(), 1))
+		r := NewResolver(context.Background(), m, WithBestEffort(), WithMaxConcurrent(1))
+		r.AddSamples(0, s.indexed[0][0].Samples)
+		r.AddSamples(1, s.indexed[0][0].Samples)
+		r.AddSamples(2, s.indexed[1][0].Samples)
+		return r
+	}
+	requirePartial := func(t *testing.T, err error) {
+		require.True(t, IsPartialResult(err))
+		var partial *PartialResultError
+		require.ErrorAs(t, err, &partial)
+		require.Len(t, partial.Errors, 1)
+		require.Equal(t, uint64(1), partial.Errors[0].Partition)
+		require.ErrorIs(t, partial.Errors[0], io.EOF)
+	}
+
+	t.Run("Tree", func(t *testing.T) {
+		r := newResolver()
+		defer r.Release()
+		tree, err := r.Tree()
+		requirePartial(t, err)
+		require.Equal(t, expectedFingerprint, treeFingerprint(tree))
+	})
+
+	t.Run("Profile", func(t *testing.T) {
+		r := newResolver()
+		defer r.Release()
+		p, err := r.Profile()
+		requirePartial(t, err)
+		require.Equal(t, expectedFingerprint, profileFingerprint(p, 0))
+	})
+}
+
+func Test_block_Resolver_ValueTransform(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	for i := range expectedFingerprint {
+		expectedFingerprint[i][1] *= 2
+	}
+	double := WithValueTransform(func(v int64) int64 { return 2 * v })
+
+	r := NewResolver(context.Background(), s.reader, double)
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, expectedFingerprint, treeFingerprint(tree))
+	r.Release()
+
+	r = NewResolver(context.Background(), s.reader, double)
+	r.AddSamples(0, samples)
+	p, err := r.Profile()
+	require.NoError(t, err)
+	require.Equal(t, expectedFingerprint, profileFingerprint(p, 0))
+	r.Release()
+
+	// The transform is applied to the individual
+	// samples, before they are aggregated.
+	var n int64
+	for _, sid := range samples.StacktraceIDs {
+		if sid > 0 {
+			n++
+		}
+	}
+	r = NewResolver(context.Background(), s.reader, WithValueTransform(func(int64) int64 { return 1 }))
+	r.AddSamples(0, samples)
+	tree, err = r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, n, tree.Total())
+	r.Release()
+}
+
+func Test_Resolver_AddSamples_merges_partition_samples(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	// Two overlapping sample sets: the first half of
+	// the samples, and all the samples.
+	half := schemav1.Samples{
+		StacktraceIDs: samples.StacktraceIDs[:len(samples.StacktraceIDs)/2],
+		Values:        samples.Values[:len(samples.Values)/2],
+	}
+	merged := make(map[uint32]uint64)
+	for _, x := range []schemav1.Samples{half, samples} {
+		for i, sid := range x.StacktraceIDs {
+			merged[sid] += x.Values[i]
+		}
+	}
+	m := schemav1.Samples{
+		StacktraceIDs: make([]uint32, 0, len(merged)),
+		Values:        make([]uint64, 0, len(merged)),
+	}
+	for sid, v := range merged {
+		m.StacktraceIDs = append(m.StacktraceIDs, sid)
+		m.Values = append(m.Values, v)
+	}
+
+	r := NewResolver(context.Background(), s.reader)
+	r.AddSamples(0, m)
+	expected, err := r.Tree()
+	require.NoError(t, err)
+	r.Release()
+
+	var resolved uint64
+	r = NewResolver(context.Background(), s.reader, WithProgress(func(_, total uint64) {
+		resolved = total
+	}))
+	r.AddSamples(0, half)
+	r.AddSamples(0, samples)
+	actual, err := r.Tree()
+	require.NoError(t, err)
+	r.Release()
+	require.Equal(t, treeFingerprint(expected), treeFingerprint(actual))
+	require.Equal(t, uint64(len(merged)), resolved)
+}
+
+func Test_Resolver_Prefetch(t *testing.T) {
+	s := newBlockSuite(t, [][]string{
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+	})
+	defer s.teardown()
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	for i := range expectedFingerprint {
+		expectedFingerprint[i][1] *= 2
+	}
+
+	r := NewResolver(context.Background(), s.reader)
 	r.AddSamples(0, s.indexed[0][0].Samples)
+	r.AddSamples(1, s.indexed[1][0].Samples)
+	require.NoError(t, r.Prefetch(context.Background()))
 	resolved, err := r.Tree()
 	require.NoError(t, err)
 	require.Equal(t, expectedFingerprint, treeFingerprint(resolved))
+	r.Release()
+
+	r = NewResolver(context.Background(), s.reader)
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	r.AddSamples(10, s.indexed[1][0].Samples)
+	require.ErrorIs(t, r.Prefetch(context.Background()), ErrPartitionNotFound)
+	r.Release()
+
+	r = NewResolver(context.Background(), s.reader, WithBestEffort())
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	r.AddSamples(10, s.indexed[1][0].Samples)
+	require.NoError(t, r.Prefetch(context.Background()))
+	r.Release()
+
+	m := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	r = NewResolver(context.Background(), m.db)
+	r.AddSamples(0, m.indexed[0][0].Samples)
+	require.NoError(t, r.Prefetch(context.Background()))
+	resolved, err = r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, pprofFingerprint(m.profiles[0].Profile, 0), treeFingerprint(resolved))
+	r.Release()
 }
 
-func Test_block_Resolver_ResolveProfile(t *testing.T) {
-	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+func Test_Resolver_MaxStacktraces(t *testing.T) {
+	s := newBlockSuite(t, [][]string{
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+	})
+	defer s.teardown()
+	samples := s.indexed[0][0].Samples
+	distinct := make(map[uint32]struct{})
+	for _, sid := range samples.StacktraceIDs {
+		distinct[sid] = struct{}{}
+	}
+	n := len(distinct)
+
+	r := NewResolver(context.Background(), s.reader, WithMaxStacktraces(n))
+	r.AddSamples(0, samples)
+	_, err := r.Tree()
+	require.NoError(t, err)
+	r.Release()
+
+	r = NewResolver(context.Background(), s.reader, WithMaxStacktraces(n), WithMaxConcurrent(1))
+	r.AddSamples(0, samples)
+	r.AddSamples(1, s.indexed[1][0].Samples)
+	_, err = r.Tree()
+	require.ErrorIs(t, err, ErrStacktracesLimitExceeded)
+	var limitErr *StacktracesLimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Equal(t, int64(2*n), limitErr.Stacktraces)
+	require.Equal(t, int64(n), limitErr.Limit)
+	r.Release()
+}
+
+func Test_Resolver_MemoryLimit(t *testing.T) {
+	s := newBlockSuite(t, [][]string{
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+	})
 	defer s.teardown()
 	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+
+	r := NewResolver(context.Background(), s.reader, WithMemoryLimit(1<<30))
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	resolved, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, expectedFingerprint, treeFingerprint(resolved))
+	used := r.memory.Load()
+	require.Greater(t, used, int64(0))
+	r.Release()
+
+	// The limit applies to all the partitions, and
+	// is enforced regardless of the best-effort mode.
+	r = NewResolver(context.Background(), s.reader, WithMemoryLimit(used), WithBestEffort())
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	r.AddSamples(1, s.indexed[1][0].Samples)
+	_, err = r.Tree()
+	require.ErrorIs(t, err, ErrMemoryLimitExceeded)
+	var limitErr *MemoryLimitError
+	require.ErrorAs(t, err, &limitErr)
+	require.Greater(t, limitErr.Bytes, used)
+	require.Equal(t, used, limitErr.Limit)
+	r.Release()
+
+	r = NewResolver(context.Background(), s.reader, WithMemoryLimit(1))
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	_, err = r.Profile()
+	require.ErrorIs(t, err, ErrMemoryLimitExceeded)
+	r.Release()
+}
+
+func Test_Resolver_Progress(t *testing.T) {
+	s := newBlockSuite(t, [][]string{
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+	})
+	defer s.teardown()
+	var calls int
+	var decreased bool
+	var resolved, total uint64
+	r := NewResolver(context.Background(), s.reader, WithProgress(func(n, m uint64) {
+		decreased = decreased || n < resolved
+		resolved, total = n, m
+		calls++
+	}))
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	r.AddSamples(1, s.indexed[1][0].Samples)
+	_, err := r.Tree()
+	require.NoError(t, err)
+	r.Release()
+
+	require.GreaterOrEqual(t, calls, 2)
+	require.False(t, decreased)
+	require.NotZero(t, total)
+	require.Equal(t, total, resolved)
+}
+
+func Test_Resolver_Stats(t *testing.T) {
+	s := newBlockSuite(t, [][]string{
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+	})
+	defer s.teardown()
 	r := NewResolver(context.Background(), s.reader)
 	defer r.Release()
 	r.AddSamples(0, s.indexed[0][0].Samples)
-	resolved, err := r.Profile()
+	r.AddSamples(1, s.indexed[1][0].Samples)
+	require.Empty(t, r.Stats())
+	_, err := r.Tree()
 	require.NoError(t, err)
-	require.Equal(t, expectedFingerprint, profileFingerprint(resolved, 0))
+
+	stats := r.Stats()
+	require.Len(t, stats, 2)
+	for i, st := range stats {
+		require.Equal(t, uint64(i), st.Partition)
+		require.Equal(t, r.p[st.Partition].stacktraces(), st.Stacktraces)
+		require.NotZero(t, st.Locations)
+		require.NotZero(t, st.Mappings)
+		require.NotZero(t, st.Functions)
+		require.NotZero(t, st.Strings)
+		require.NotZero(t, st.BytesRead)
+		require.NotZero(t, st.ResolveDuration)
+	}
 }
 
-func Test_block_Resolver_ResolveTree(t *testing.T) {
-	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+func Test_Resolver_Metrics(t *testing.T) {
+	const profile = "testdata/profile.pb.gz"
+	s := newBlockSuite(t, [][]string{{profile}, {profile}})
 	defer s.teardown()
-	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 1)
-	r := NewResolver(context.Background(), s.reader)
+	reg := prometheus.NewRegistry()
+	m := NewResolverMetrics(reg)
+	r := NewResolver(context.Background(), s.reader, WithMetrics(m))
 	defer r.Release()
-	r.AddSamples(0, s.indexed[0][1].Samples)
-	resolved, err := r.Tree()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	r.AddSamples(1, s.indexed[1][0].Samples)
+	_, err := r.Tree()
 	require.NoError(t, err)
-	require.Equal(t, expectedFingerprint, treeFingerprint(resolved))
+
+	var stacktraces, locations, bytesRead int
+	for _, st := range r.Stats() {
+		stacktraces += st.Stacktraces
+		locations += st.Locations
+		bytesRead += int(st.BytesRead)
+	}
+	require.Equal(t, float64(2), testutil.ToFloat64(m.partitions))
+	require.Equal(t, float64(stacktraces), testutil.ToFloat64(m.stacktraces))
+	require.Equal(t, float64(locations), testutil.ToFloat64(m.symbols.WithLabelValues("locations")))
+	require.Equal(t, float64(bytesRead), testutil.ToFloat64(m.bytesRead))
+	require.NotZero(t, bytesRead)
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	durations := make(map[string]uint64)
+	for _, f := range families {
+		if h := f.GetMetric()[0].GetHistogram(); h != nil {
+			durations[f.GetName()] = h.GetSampleCount()
+		}
+	}
+	require.Equal(t, map[string]uint64{
+		"pyroscope_symdb_resolver_partition_load_duration_seconds":    2,
+		"pyroscope_symdb_resolver_partition_resolve_duration_seconds": 2,
+	}, durations)
+
+	// Metrics are shared by the resolvers of the registry.
+	require.Same(t, m.partitions, NewResolverMetrics(reg).partitions)
 }
 
-func Benchmark_block_Resolver_ResolveProfile(t *testing.B) {
+func Test_Resolver_StacktraceCache(t *testing.T) {
 	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
 	defer s.teardown()
-	t.ResetTimer()
-	t.ReportAllocs()
-	for i := 0; i < t.N; i++ {
-		r := NewResolver(context.Background(), s.reader)
+	expected := treeFingerprint(resolveTree(t, s, nil))
+
+	c, err := NewStacktraceCache(1<<20, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected, treeFingerprint(resolveTree(t, s, c)))
+	misses := testutil.ToFloat64(c.metrics.misses)
+	require.NotZero(t, misses)
+	require.Zero(t, testutil.ToFloat64(c.metrics.hits))
+	require.Equal(t, int(misses), c.Len())
+
+	require.Equal(t, expected, treeFingerprint(resolveTree(t, s, c)))
+	require.Equal(t, misses, testutil.ToFloat64(c.metrics.misses))
+	require.Equal(t, misses, testutil.ToFloat64(c.metrics.hits))
+
+	// Stack traces are evicted from the cache, and are
+	// resolved again.
+	c, err = NewStacktraceCache(10, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected, treeFingerprint(resolveTree(t, s, c)))
+	require.Equal(t, expected, treeFingerprint(resolveTree(t, s, c)))
+	require.Equal(t, 10, c.Len())
+	require.NotZero(t, testutil.ToFloat64(c.metrics.evictions))
+}
+
+func Test_Resolver_StacktraceMemo(t *testing.T) {
+	const profile = "testdata/profile.pb.gz"
+	s := newBlockSuite(t, [][]string{{profile}, {profile}})
+	defer s.teardown()
+	resolve := func(opts ...ResolverOption) (*Resolver, *model.Tree) {
+		r := NewResolver(context.Background(), s.reader, append(opts, WithMinValue(1e7))...)
 		r.AddSamples(0, s.indexed[0][0].Samples)
-		_, _ = r.Profile()
+		r.AddSamples(1, s.indexed[1][0].Samples)
+		tree, err := r.Tree()
+		require.NoError(t, err)
+		return r, tree
+	}
+	r, tree := resolve()
+	r.Release()
+	expected := tree.String()
+
+	r, tree = resolve(WithStacktraceMemo(1 << 20))
+	require.Equal(t, expected, tree.String())
+	// The second pass of the truncated tree only hits the memo.
+	misses := testutil.ToFloat64(r.memo.metrics.misses)
+	require.NotZero(t, misses)
+	require.Equal(t, misses, testutil.ToFloat64(r.memo.metrics.hits))
+	require.Equal(t, int(misses), r.memo.Len())
+	r.Release()
+	require.Zero(t, r.memo.Len())
+}
+
+func resolveTree(t *testing.T, s *blockSuite, c *StacktraceCache) *model.Tree {
+	var opts []ResolverOption
+	if c != nil {
+		opts = append(opts, WithStacktraceCache(c))
 	}
+	r := NewResolver(context.Background(), s.reader, opts...)
+	defer r.Release()
+	r.AddSamples(0, s.indexed[0][0].Samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	return tree
 }
 
-func Benchmark_block_Resolver_ResolveTree(t *testing.B) {
+func Test_Resolver_StringInterner(t *testing.T) {
 	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
 	defer s.teardown()
-	t.ResetTimer()
-	t.ReportAllocs()
-	for i := 0; i < t.N; i++ {
-		r := NewResolver(context.Background(), s.reader)
+	// Each of the readers loads its own copy of the symbols.
+	readers := openBlockReaders(t, s, 2)
+	interner := NewStringInterner()
+	names := func(x *Reader, opts ...ResolverOption) map[string]uintptr {
+		r := NewResolver(context.Background(), x, opts...)
+		defer r.Release()
 		r.AddSamples(0, s.indexed[0][0].Samples)
-		_, _ = r.Tree()
+		tree, err := r.Tree()
+		require.NoError(t, err)
+		m := make(map[string]uintptr)
+		tree.IterateStacks(func(name string, _ int64, _ []string) {
+			m[name] = stringData(name)
+		})
+		return m
+	}
+
+	a, b := names(readers[0]), names(readers[1])
+	for name, p := range a {
+		require.NotEqual(t, p, b[name], name)
 	}
+
+	a = names(readers[0], WithStringInterner(interner))
+	b = names(readers[1], WithStringInterner(interner))
+	require.Equal(t, len(a), len(b))
+	for name, p := range a {
+		require.Equal(t, p, b[name], name)
+	}
+	require.NotZero(t, interner.Len())
+	interner.Reset()
+	require.Zero(t, interner.Len())
 }
 
-func Test_Resolver_Unreleased_Failed_Partition(t *testing.T) {
-	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+// Benchmark_Resolver_StringInterner reports the heap retained by trees
+// resolved concurrently by resolvers of distinct readers of the block.
+func Benchmark_Resolver_StringInterner(b *testing.B) {
+	s := newBlockSuite(b, [][]string{{"testdata/profile.pb.gz"}})
 	defer s.teardown()
-	ctx, cancel := context.WithCancel(context.Background())
-	// Pass canceled context to make partition initialization to fail.
-	cancel()
-
-	r := NewResolver(ctx, s.reader)
-	r.AddSamples(0, s.indexed[0][0].Samples)
-	_, err := r.Tree()
-	require.ErrorIs(t, err, context.Canceled)
-	r.Release()
+	const resolvers = 16
+	for _, interned := range []bool{false, true} {
+		interned := interned
+		b.Run(fmt.Sprintf("interned=%v", interned), func(b *testing.B) {
+			var retained int64
+			for i := 0; i < b.N; i++ {
+				var opts []ResolverOption
+				if interned {
+					opts = append(opts, WithStringInterner(NewStringInterner()))
+				}
+				before := heapAlloc()
+				readers := openBlockReaders(b, s, resolvers)
+				trees := make([]*model.Tree, resolvers)
+				var wg sync.WaitGroup
+				for j := range readers {
+					j := j
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						r := NewResolver(context.Background(), readers[j], opts...)
+						defer r.Release()
+						r.AddSamples(0, s.indexed[0][0].Samples)
+						trees[j], _ = r.Tree()
+					}()
+				}
+				wg.Wait()
+				for _, x := range readers {
+					require.NoError(b, x.Close())
+				}
+				// Only the trees are retained.
+				readers = nil
+				retained += int64(heapAlloc()) - int64(before)
+				runtime.KeepAlive(trees)
+			}
+			b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+		})
+	}
+}
 
-	// This time we pass normal context.
-	r = NewResolver(context.Background(), s.reader)
-	r.AddSamples(0, s.indexed[0][0].Samples)
-	_, err = r.Tree()
+func openBlockReaders(t testing.TB, s *blockSuite, n int) []*Reader {
+	bucket, err := filesystem.NewBucket(s.config.Dir)
 	require.NoError(t, err)
-	r.Release()
+	readers := make([]*Reader, n)
+	for i := range readers {
+		readers[i], err = Open(context.Background(), bucket, testBlockMeta)
+		require.NoError(t, err)
+	}
+	return readers
 }
 
-func Test_Resolver_Error_Propagation(t *testing.T) {
-	m := new(mockSymbolsReader)
-	m.On("Partition", mock.Anything, mock.Anything).Return(nil, io.EOF).Once()
-	r := NewResolver(context.Background(), m)
-	r.AddSamples(0, schemav1.Samples{})
-	_, err := r.Tree()
-	require.ErrorIs(t, err, io.EOF)
-	r.Release()
+func heapAlloc() uint64 {
+	// Objects cached in sync.Pool survive one GC cycle.
+	runtime.GC()
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// stringData returns the pointer to the string bytes.
+func stringData(s string) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&s))
+}
+
+func Test_Resolver_AddSamples_concurrently(t *testing.T) {
+	s := newBlockSuite(t, [][]string{
+		{"testdata/profile.pb.gz"},
+		{"testdata/profile.pb.gz"},
+	})
+	defer s.teardown()
+	const workers = 16
+	expectedFingerprint := pprofFingerprint(s.profiles[0].Profile, 0)
+	for i := range expectedFingerprint {
+		expectedFingerprint[i][1] *= workers
+	}
+
+	r := NewResolver(context.Background(), s.reader)
+	defer r.Release()
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			// Half of the workers add samples to the same partition.
+			partition := uint64(i % 2)
+			samples := s.indexed[partition][0].Samples
+			if i%4 < 2 {
+				r.AddSamples(partition, samples)
+				return
+			}
+			r.AddSamplesWithFilter(partition, samples, func(uint32) bool { return true })
+		}()
+	}
+	wg.Wait()
+
+	resolved, err := r.Tree()
+	require.NoError(t, err)
+	require.Equal(t, expectedFingerprint, treeFingerprint(resolved))
 }
 
 func Test_Resolver_Cancellation(t *testing.T) {
@@ -166,6 +4552,149 @@ func Test_Resolver_Cancellation(t *testing.T) {
 	wg.Wait()
 }
 
+func Test_ResolveStacktraceLocations_Cancellation(t *testing.T) {
+	s := memSuite{
+		t: t,
+		config: &Config{
+			Dir:         t.TempDir(),
+			Stacktraces: StacktracesConfig{MaxNodesPerChunk: 1 << 20},
+			Parquet:     ParquetConfig{MaxBufferRowCount: 512},
+		},
+	}
+	s.init()
+	// A single partition with many distinct stack traces.
+	const n = 3 * contextCheckInterval
+	stacktraces := make([]*schemav1.Stacktrace, n)
+	for i := range stacktraces {
+		stacktraces[i] = &schemav1.Stacktrace{LocationIDs: []uint64{uint64(i + 1), 1}}
+	}
+	ids := make([]uint32, n)
+	s.db.PartitionWriter(0).AppendStacktraces(ids, stacktraces)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	b := &blockSuite{memSuite: &s}
+	b.flush()
+	defer b.teardown()
+
+	block, err := b.reader.Partition(context.Background(), 0)
+	require.NoError(t, err)
+	defer block.Release()
+	memory, err := s.db.Partition(context.Background(), 0)
+	require.NoError(t, err)
+
+	for _, p := range []PartitionReader{memory, block} {
+		ctx, cancel := context.WithCancel(context.Background())
+		dst := &cancelingInserter{cancel: cancel, after: 10}
+		stacks := make([]uint32, len(ids))
+		copy(stacks, ids)
+		err = p.Symbols().Stacktraces.ResolveStacktraceLocations(ctx, dst, stacks)
+		require.ErrorIs(t, err, context.Canceled)
+		require.LessOrEqual(t, dst.n, contextCheckInterval)
+	}
+}
+
+// cancelingInserter cancels the context after the given
+// number of stack traces is inserted.
+type cancelingInserter struct {
+	cancel context.CancelFunc
+	after  int
+	n      int
+}
+
+func (c *cancelingInserter) InsertStacktrace(uint32, []int32) {
+	if c.n++; c.n == c.after {
+		c.cancel()
+	}
+}
+
+// recordingSymbolsReader records the stack traces resolved
+// in any of the partitions of the symbols reader.
+type recordingSymbolsReader struct {
+	SymbolsReader
+	m   sync.Mutex
+	ids map[uint32]struct{}
+}
+
+func (r *recordingSymbolsReader) Partition(ctx context.Context, partition uint64) (PartitionReader, error) {
+	p, err := r.SymbolsReader.Partition(ctx, partition)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingPartitionReader{PartitionReader: p, reader: r}, nil
+}
+
+func (r *recordingSymbolsReader) stacktraces() map[uint32]struct{} {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.ids
+}
+
+type recordingPartitionReader struct {
+	PartitionReader
+	reader *recordingSymbolsReader
+}
+
+func (p *recordingPartitionReader) Symbols() *Symbols {
+	s := *p.PartitionReader.Symbols()
+	s.Stacktraces = &recordingStacktraceResolver{StacktraceResolver: s.Stacktraces, reader: p.reader}
+	return &s
+}
+
+type recordingStacktraceResolver struct {
+	StacktraceResolver
+	reader *recordingSymbolsReader
+}
+
+func (r *recordingStacktraceResolver) ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) error {
+	r.reader.m.Lock()
+	if r.reader.ids == nil {
+		r.reader.ids = make(map[uint32]struct{})
+	}
+	for _, sid := range stacktraces {
+		r.reader.ids[sid] = struct{}{}
+	}
+	r.reader.m.Unlock()
+	return r.StacktraceResolver.ResolveStacktraceLocations(ctx, dst, stacktraces)
+}
+
+// slowSymbolsReader never completes resolution of more
+// than limit stack traces before the context is canceled.
+type slowSymbolsReader struct {
+	SymbolsReader
+	limit int
+}
+
+func (r *slowSymbolsReader) Partition(ctx context.Context, partition uint64) (PartitionReader, error) {
+	p, err := r.SymbolsReader.Partition(ctx, partition)
+	if err != nil {
+		return nil, err
+	}
+	return &slowPartitionReader{PartitionReader: p, limit: r.limit}, nil
+}
+
+type slowPartitionReader struct {
+	PartitionReader
+	limit int
+}
+
+func (p *slowPartitionReader) Symbols() *Symbols {
+	s := *p.PartitionReader.Symbols()
+	s.Stacktraces = &slowStacktraceResolver{StacktraceResolver: s.Stacktraces, limit: p.limit}
+	return &s
+}
+
+type slowStacktraceResolver struct {
+	StacktraceResolver
+	limit int
+}
+
+func (r *slowStacktraceResolver) ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) error {
+	if len(stacktraces) > r.limit {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return r.StacktraceResolver.ResolveStacktraceLocations(ctx, dst, stacktraces)
+}
+
 type mockSymbolsReader struct{ mock.Mock }
 
 func (m *mockSymbolsReader) Partition(ctx context.Context, partition uint64) (PartitionReader, error) {
@@ -174,6 +4703,12 @@ func (m *mockSymbolsReader) Partition(ctx context.Context, partition uint64) (Pa
 	return r, args.Error(1)
 }
 
+func (m *mockSymbolsReader) PartitionKeys(ctx context.Context) ([]uint64, error) {
+	args := m.Called(ctx)
+	r, _ := args.Get(0).([]uint64)
+	return r, args.Error(1)
+}
+
 func (m *mockSymbolsReader) Load(ctx context.Context) error {
 	args := m.Called(ctx)
 	return args.Error(0)
@@ -0,0 +1,169 @@
+package symdb
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+type TopSortBy int
+
+const (
+	// TopSortBySelf orders functions by the absolute self value,
+	// descending.
+	TopSortBySelf TopSortBy = iota
+	// TopSortByTotal orders functions by the absolute total value,
+	// descending.
+	TopSortByTotal
+)
+
+type TopOptions struct {
+	SortBy TopSortBy
+	// MaxRows limits the number of functions returned.
+	// Zero or negative value means no limit.
+	MaxRows int
+}
+
+// TopFunction contains aggregated values of the function: Self is
+// the value of the samples where the function is the leaf frame, and
+// Total is the value of the samples where the function is present.
+// Flat and Cum are the Self and Total values respectively, in percent
+// of the total value of all the samples.
+type TopFunction struct {
+	Name  string
+	Self  int64
+	Total int64
+	Flat  float64
+	Cum   float64
+}
+
+// Top returns a flat table of the functions of the resolved stack
+// traces, similarly to `pprof -top`. Functions are aggregated by name.
+// If a function is present in a stack trace more than once (e.g. due
+// to recursion), the sample value is only accounted once in the total.
+func (r *Resolver) Top(opts TopOptions) ([]TopFunction, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.Top")
+	defer span.Finish()
+	t := &topFunctions{functions: make(map[string]*TopFunction)}
+	err := r.withSymbols(ctx, func(symbols *Symbols, samples schemav1.Samples) error {
+		x, err := symbols.top(ctx, samples)
+		if err != nil {
+			return err
+		}
+		t.merge(x)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.rows(opts), nil
+}
+
+type topFunctions struct {
+	m         sync.Mutex
+	functions map[string]*TopFunction
+	total     int64
+}
+
+func (t *topFunctions) merge(x *topSymbols) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.total += x.total
+	for name, f := range x.functions {
+		if e, ok := t.functions[name]; ok {
+			e.Self += f.Self
+			e.Total += f.Total
+			continue
+		}
+		t.functions[name] = &TopFunction{Name: name, Self: f.Self, Total: f.Total}
+	}
+}
+
+func (t *topFunctions) rows(opts TopOptions) []TopFunction {
+	rows := make([]TopFunction, 0, len(t.functions))
+	for _, f := range t.functions {
+		if t.total != 0 {
+			f.Flat = float64(f.Self) / float64(t.total) * 100
+			f.Cum = float64(f.Total) / float64(t.total) * 100
+		}
+		rows = append(rows, *f)
+	}
+	key := func(f TopFunction) (int64, int64) {
+		if opts.SortBy == TopSortByTotal {
+			return abs(f.Total), abs(f.Self)
+		}
+		return abs(f.Self), abs(f.Total)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a1, a2 := key(rows[i])
+		b1, b2 := key(rows[j])
+		if a1 != b1 {
+			return a1 > b1
+		}
+		if a2 != b2 {
+			return a2 > b2
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	if opts.MaxRows > 0 && len(rows) > opts.MaxRows {
+		rows = rows[:opts.MaxRows]
+	}
+	return rows
+}
+
+func (r *Symbols) top(ctx context.Context, samples schemav1.Samples) (*topSymbols, error) {
+	t := &topSymbols{
+		symbols:   r,
+		samples:   &samples,
+		functions: make(map[string]*topSymbolsFunction),
+	}
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, t, samples.StacktraceIDs); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+type topSymbols struct {
+	symbols   *Symbols
+	samples   *schemav1.Samples
+	functions map[string]*topSymbolsFunction
+	names     []string
+	total     int64
+	cur       int
+}
+
+type topSymbolsFunction struct {
+	Self  int64
+	Total int64
+	// Index of the last sample the function
+	// was accounted in, plus one.
+	sample int
+}
+
+func (r *topSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	v := int64(r.samples.Values[r.cur])
+	r.cur++
+	if v == 0 {
+		return
+	}
+	r.total += v
+	r.names = r.symbols.appendFunctionNames(r.names[:0], locations)
+	for i, name := range r.names {
+		f, ok := r.functions[name]
+		if !ok {
+			f = new(topSymbolsFunction)
+			r.functions[name] = f
+		}
+		if i == len(r.names)-1 {
+			f.Self += v
+		}
+		if f.sample != r.cur {
+			f.sample = r.cur
+			f.Total += v
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package symdb
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// TopStacks contains the stack traces with the largest values, and
+// the total value of all the remaining stack traces.
+type TopStacks struct {
+	// Stacks are ordered by the absolute value, descending.
+	Stacks []ResolvedStack
+	Other  int64
+}
+
+// ResolvedStack is a stack trace with function names
+// ordered from the root to the leaf. Inlined functions
+// are included.
+type ResolvedStack struct {
+	Functions []string
+	Value     int64
+}
+
+// TopStacks returns n stack traces with the largest absolute values,
+// and the sum of values of the rest. Stack traces are selected before they
+// are resolved, therefore only n stack traces are symbolized. Stack
+// traces are identified by partition: the same stack present in
+// multiple partitions is not aggregated, and the resolved stacks
+// may contain duplicates. WithMinValue option is not applied.
+func (r *Resolver) TopStacks(n int) (*TopStacks, error) {
+	span, ctx := opentracing.StartSpanFromContext(r.ctx, "Resolver.TopStacks")
+	defer span.Finish()
+	top, other := r.selectTopStacks(n)
+	result := &TopStacks{
+		Stacks: make([]ResolvedStack, len(top)),
+		Other:  other,
+	}
+	// Index of the stack in the result, by partition.
+	selected := make(map[*lazyPartition][]int)
+	for i, s := range top {
+		selected[s.partition] = append(selected[s.partition], i)
+		result.Stacks[i].Value = s.value
+	}
+	err := r.withPartitionSymbols(ctx, func(symbols *Symbols, p *lazyPartition) error {
+		idx := selected[p]
+		if len(idx) == 0 {
+			return nil
+		}
+		// Stack trace IDs must be sorted.
+		sort.Slice(idx, func(i, j int) bool {
+			return top[idx[i]].stacktraceID < top[idx[j]].stacktraceID
+		})
+		stacktraces := make([]uint32, len(idx))
+		for i, j := range idx {
+			stacktraces[i] = top[j].stacktraceID
+		}
+		// Each of the partitions writes to its own elements.
+		return symbols.resolveStacks(ctx, stacktraces, func(i int, functions []string) {
+			result.Stacks[idx[i]].Functions = functions
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type topStack struct {
+	partition    *lazyPartition
+	stacktraceID uint32
+	value        int64
+}
+
+// selectTopStacks returns n stack traces with the largest values,
+// ordered by value, and the total value of the rest.
+func (r *Resolver) selectTopStacks(n int) ([]topStack, int64) {
+	h := make(topStackHeap, 0, n)
+	var total int64
+	for _, p := range r.p {
+		for sid, v := range p.samples {
+			if v == 0 {
+				continue
+			}
+			total += v
+			if n <= 0 {
+				continue
+			}
+			s := topStack{partition: p, stacktraceID: sid, value: v}
+			if len(h) < n {
+				heap.Push(&h, s)
+			} else if h.less(h[0], s) {
+				h[0] = s
+				heap.Fix(&h, 0)
+			}
+		}
+	}
+	sort.Slice(h, func(i, j int) bool { return h.less(h[j], h[i]) })
+	for _, s := range h {
+		total -= s.value
+	}
+	return h, total
+}
+
+// topStackHeap is a min-heap of stack traces ordered by the absolute value.
+// Ties are broken by partition and stack trace ID to make the
+// selection deterministic.
+type topStackHeap []topStack
+
+func (h topStackHeap) less(a, b topStack) bool {
+	if x, y := abs(a.value), abs(b.value); x != y {
+		return x < y
+	}
+	if a.partition.id != b.partition.id {
+		return a.partition.id > b.partition.id
+	}
+	return a.stacktraceID > b.stacktraceID
+}
+
+func (h topStackHeap) Len() int           { return len(h) }
+func (h topStackHeap) Less(i, j int) bool { return h.less(h[i], h[j]) }
+func (h topStackHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *topStackHeap) Push(x any)        { *h = append(*h, x.(topStack)) }
+func (h *topStackHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// resolveStacks calls fn with the function names of each of the
+// stack traces, in the order of the stacktraces slice.
+func (r *Symbols) resolveStacks(ctx context.Context, stacktraces []uint32, fn func(int, []string)) error {
+	s := &stackSymbols{symbols: r, fn: fn}
+	return r.Stacktraces.ResolveStacktraceLocations(ctx, s, stacktraces)
+}
+
+type stackSymbols struct {
+	symbols *Symbols
+	fn      func(int, []string)
+	cur     int
+}
+
+func (r *stackSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	r.fn(r.cur, r.symbols.appendFunctionNames(nil, locations))
+	r.cur++
+}
@@ -0,0 +1,134 @@
+package symdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/grafana/pyroscope/pkg/model"
+)
+
+// DefaultChromeTraceTrackName is the name of the track
+// the events are written to, unless specified otherwise.
+const DefaultChromeTraceTrackName = "samples"
+
+type ChromeTraceOptions struct {
+	// TrackName is the name of the thread
+	// all the events are grouped under.
+	TrackName string
+}
+
+// ChromeTraceEvent is an event of the Chrome trace event format, as
+// written by WriteChromeTrace.
+type ChromeTraceEvent struct {
+	Name  string `json:"name"`
+	Phase string `json:"ph"`
+	// Timestamp and Duration are given in microseconds.
+	Timestamp int64             `json:"ts"`
+	Duration  int64             `json:"dur,omitempty"`
+	PID       int64             `json:"pid"`
+	TID       int64             `json:"tid"`
+	Args      map[string]string `json:"args,omitempty"`
+}
+
+// WriteChromeTrace resolves the samples and writes the tree to w as a
+// JSON array of the Chrome trace events, which can be opened in Perfetto
+// UI and chrome://tracing. The timeline is synthetic: each tree node is
+// a complete ("X") event with the duration equal to the node total value,
+// and the callees start when the caller does, one after another, ordered
+// by name. Therefore, the trace is rendered as the flame graph of the
+// tree, where one microsecond stands for one unit of the value. Nodes
+// with non-positive total values are omitted along with their subtrees.
+//
+// The events are written as the tree is traversed, preceded by the
+// metadata event naming the track. If the resolver is created with
+// WithBestEffort, the nodes of the partitions resolved are written,
+// and the partial result error is returned.
+func (r *Resolver) WriteChromeTrace(ctx context.Context, w io.Writer, opts ChromeTraceOptions) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Resolver.WriteChromeTrace")
+	defer span.Finish()
+	if opts.TrackName == "" {
+		opts.TrackName = DefaultChromeTraceTrackName
+	}
+	tree, resolveErr := r.Tree()
+	if resolveErr != nil && !IsPartialResult(resolveErr) {
+		return resolveErr
+	}
+	bw := bufio.NewWriter(w)
+	tw := &chromeTraceWriter{w: bw, enc: json.NewEncoder(bw)}
+	err := tw.write(ChromeTraceEvent{
+		Name:  "thread_name",
+		Phase: "M",
+		PID:   1,
+		TID:   1,
+		Args:  map[string]string{"name": opts.TrackName},
+	})
+	// Start of the next node at the depth.
+	next := []int64{0}
+	skip := -1
+	var id int64
+	tree.Walk(func(n model.TreeWalkNode) bool {
+		if err != nil {
+			return false
+		}
+		if id++; id%contextCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
+		}
+		if skip >= 0 {
+			if n.Depth > skip {
+				return true
+			}
+			skip = -1
+		}
+		if n.Total <= 0 {
+			skip = n.Depth
+			return true
+		}
+		ts := next[n.Depth]
+		next[n.Depth] += n.Total
+		// Children start with the parent.
+		next = append(next[:n.Depth+1], ts)
+		err = tw.write(ChromeTraceEvent{
+			Name:      n.Name,
+			Phase:     "X",
+			Timestamp: ts,
+			Duration:  n.Total,
+			PID:       1,
+			TID:       1,
+		})
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = bw.WriteString("]\n"); err != nil {
+		return err
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	return resolveErr
+}
+
+type chromeTraceWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+	n   int
+}
+
+func (w *chromeTraceWriter) write(e ChromeTraceEvent) error {
+	sep := byte(',')
+	if w.n == 0 {
+		sep = '['
+	}
+	w.n++
+	if err := w.w.WriteByte(sep); err != nil {
+		return err
+	}
+	return w.enc.Encode(&e)
+}
@@ -0,0 +1,94 @@
+package symdb
+
+import (
+	"context"
+
+	"github.com/cespare/xxhash/v2"
+
+	"github.com/grafana/pyroscope/pkg/model"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+)
+
+const truncatedNodeName = "other"
+
+// truncatedTree builds a tree, where subtrees with the total
+// value less than minValue are folded into "other" nodes.
+//
+// Stack traces are resolved twice: in the first pass, we only
+// calculate total values of the stack prefixes (identified by
+// the hash of the function names), in the second one, we insert
+// stacks truncated at the first prefix below the threshold.
+// This way, nodes of the pruned subtrees are never allocated.
+func (r *Symbols) truncatedTree(ctx context.Context, samples schemav1.Samples, minValue int64, depths *DepthHistogram) (*model.Tree, error) {
+	// Stacktraces slice might be modified during the call.
+	stacktraces := make([]uint32, len(samples.StacktraceIDs))
+	copy(stacktraces, samples.StacktraceIDs)
+	t := &truncatedTreeSymbols{
+		symbols: r,
+		samples: &samples,
+		totals:  make(map[uint64]int64, len(samples.StacktraceIDs)),
+		depths:  depths,
+	}
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, t, stacktraces); err != nil {
+		return nil, err
+	}
+	t.truncate = true
+	t.minValue = minValue
+	t.cur = 0
+	if err := r.Stacktraces.ResolveStacktraceLocations(ctx, t, samples.StacktraceIDs); err != nil {
+		return nil, err
+	}
+	return t.tree.Build(), nil
+}
+
+type truncatedTreeSymbols struct {
+	symbols  *Symbols
+	samples  *schemav1.Samples
+	totals   map[uint64]int64
+	depths   *DepthHistogram
+	tree     TreeBuilder
+	truncate bool
+	minValue int64
+	lines    []string
+	hash     xxhash.Digest
+	cur      int
+}
+
+func (r *truncatedTreeSymbols) InsertStacktrace(_ uint32, locations []int32) {
+	v := int64(r.samples.Values[r.cur])
+	r.cur++
+	r.lines = r.symbols.appendFunctionNames(r.lines[:0], locations)
+	r.hash.Reset()
+	if !r.truncate {
+		// First pass: accumulate prefix totals.
+		for _, name := range r.lines {
+			r.totals[r.prefixHash(name)] += v
+		}
+		if r.depths != nil {
+			r.depths.observe(r.lines, v)
+		}
+		return
+	}
+	for i, name := range r.lines {
+		if abs(r.totals[r.prefixHash(name)]) < r.minValue {
+			r.lines = append(r.lines[:i], truncatedNodeName)
+			break
+		}
+	}
+	r.tree.Insert(r.lines, v)
+}
+
+func (r *truncatedTreeSymbols) prefixHash(name string) uint64 {
+	_, _ = r.hash.WriteString(name)
+	// The separator is required to distinguish
+	// ["ab", "c"] from ["a", "bc"].
+	_, _ = r.hash.WriteString("\x00")
+	return r.hash.Sum64()
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
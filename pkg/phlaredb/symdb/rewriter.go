@@ -52,14 +52,19 @@ func (r *Rewriter) getOrCreatePartition(partition uint64) (_ *partitionRewriter,
 		return p, nil
 	}
 
-	n := &partitionRewriter{name: partition}
-	n.dst = r.symdb.PartitionWriter(partition)
 	// Note that the partition is not released: we want to keep
 	// it during the whole lifetime of the rewriter.
 	pr, err := r.source.Partition(context.TODO(), partition)
 	if err != nil {
 		return nil, err
 	}
+	n := newPartitionRewriter(partition, r.symdb.PartitionWriter(partition), pr)
+	r.partitions[partition] = n
+	return n, nil
+}
+
+func newPartitionRewriter(partition uint64, dst *PartitionWriter, pr PartitionReader) *partitionRewriter {
+	n := &partitionRewriter{name: partition, dst: dst}
 	// We clone locations, functions, and mappings,
 	// because these object will be modified.
 	n.src = cloneSymbolsPartially(pr.Symbols())
@@ -71,9 +76,7 @@ func (r *Rewriter) getOrCreatePartition(partition uint64) (_ *partitionRewriter,
 	n.mappings = newLookupTable[*schemav1.InMemoryMapping](stats.MappingsTotal)
 	n.functions = newLookupTable[*schemav1.InMemoryFunction](stats.FunctionsTotal)
 	n.strings = newLookupTable[string](stats.StringsTotal)
-
-	r.partitions[partition] = n
-	return n, nil
+	return n
 }
 
 type partitionRewriter struct {
@@ -283,13 +286,21 @@ func newLookupTable[T any](size int) *lookupTable[T] {
 	return &t
 }
 
+// grow extends the table to the size given. Entries that
+// have been looked up already are preserved.
 func (t *lookupTable[T]) grow(size int) {
+	n := len(t.resolved)
+	if size <= n {
+		return
+	}
 	if cap(t.resolved) < size {
-		t.resolved = make([]uint32, size)
+		resolved := make([]uint32, size)
+		copy(resolved, t.resolved)
+		t.resolved = resolved
 		return
 	}
 	t.resolved = t.resolved[:size]
-	for i := range t.resolved {
+	for i := n; i < size; i++ {
 		t.resolved[i] = 0
 	}
 }
@@ -1,9 +1,14 @@
 package symdb
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pyroscope/pkg/objstore/providers/filesystem"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
 )
 
 func Test_lookupTable(t *testing.T) {
@@ -98,3 +103,54 @@ func Test_lookupTable(t *testing.T) {
 	assert.Len(t, dst, 7)
 	assert.NotContains(t, dst, "seven")
 }
+
+func Test_SymbolsMerger(t *testing.T) {
+	blocks := []*blockSuite{
+		newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}}),
+		newBlockSuite(t, [][]string{{"testdata/block.pb.gz"}}),
+	}
+	config := DefaultConfig().WithDirectory(t.TempDir())
+	dst := NewSymDB(config)
+	m := NewSymbolsMerger(dst)
+	expected := make([][][2]uint64, len(blocks))
+	merged := make([]schemav1.Samples, len(blocks))
+	for i, s := range blocks {
+		defer s.teardown()
+		samples := s.indexed[0][0].Samples
+		expected[i] = treeFingerprint(resolveSamplesTree(t, s, samples))
+		p, err := s.reader.Partition(context.Background(), 0)
+		require.NoError(t, err)
+		defer p.Release()
+		merged[i] = samples.Clone()
+		require.NoError(t, m.Merge(0, p, merged[i].StacktraceIDs))
+	}
+
+	// Symbols merged again are deduplicated.
+	var before, after PartitionStats
+	dst.PartitionWriter(0).WriteStats(&before)
+	p, err := blocks[0].reader.Partition(context.Background(), 0)
+	require.NoError(t, err)
+	defer p.Release()
+	again := blocks[0].indexed[0][0].Samples.Clone()
+	require.NoError(t, m.Merge(0, p, again.StacktraceIDs))
+	require.Equal(t, merged[0].StacktraceIDs, again.StacktraceIDs)
+	dst.PartitionWriter(0).WriteStats(&after)
+	require.Equal(t, before, after)
+
+	require.NoError(t, dst.Flush())
+	b, err := filesystem.NewBucket(config.Dir)
+	require.NoError(t, err)
+	reader, err := Open(context.Background(), b, testBlockMeta)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, reader.Close())
+	}()
+	for i := range blocks {
+		r := NewResolver(context.Background(), reader)
+		r.AddSamples(0, merged[i])
+		tree, err := r.Tree()
+		r.Release()
+		require.NoError(t, err)
+		require.Equal(t, expected[i], treeFingerprint(tree))
+	}
+}
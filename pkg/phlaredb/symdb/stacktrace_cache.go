@@ -0,0 +1,154 @@
+package symdb
+
+import (
+	"context"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/pyroscope/pkg/util"
+)
+
+// StacktraceCache is an LRU cache of resolved stack traces: it maps
+// stack trace IDs to the locations of the stack trace. The cache is
+// safe for concurrent use, and is meant to be shared by resolvers
+// that query the same SymbolsReader. As stack trace identifiers are
+// only unique within a partition of a block, the cache must not be
+// shared across symbols readers of different blocks.
+type StacktraceCache struct {
+	lru     *lru.Cache
+	metrics *stacktraceCacheMetrics
+}
+
+type stacktraceCacheKey struct {
+	partition  uint64
+	stacktrace uint32
+}
+
+type stacktraceCacheMetrics struct {
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	evictions prometheus.Counter
+}
+
+func newStacktraceCacheMetrics(reg prometheus.Registerer) *stacktraceCacheMetrics {
+	m := &stacktraceCacheMetrics{
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pyroscope_symdb_stacktrace_cache_hits_total",
+			Help: "Total number of stack traces found in the cache.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pyroscope_symdb_stacktrace_cache_misses_total",
+			Help: "Total number of stack traces not found in the cache.",
+		}),
+		evictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pyroscope_symdb_stacktrace_cache_evictions_total",
+			Help: "Total number of stack traces evicted from the cache.",
+		}),
+	}
+	if reg != nil {
+		m.hits = util.RegisterOrGet(reg, m.hits)
+		m.misses = util.RegisterOrGet(reg, m.misses)
+		m.evictions = util.RegisterOrGet(reg, m.evictions)
+	}
+	return m
+}
+
+// NewStacktraceCache creates a new cache that holds up to size
+// stack traces. The least recently used stack traces are evicted
+// once the cache is full.
+func NewStacktraceCache(size int, reg prometheus.Registerer) (*StacktraceCache, error) {
+	c := StacktraceCache{metrics: newStacktraceCacheMetrics(reg)}
+	var err error
+	c.lru, err = lru.NewWithEvict(size, func(interface{}, interface{}) {
+		c.metrics.evictions.Inc()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Len returns the number of stack traces in the cache.
+func (c *StacktraceCache) Len() int { return c.lru.Len() }
+
+// Purge removes all the stack traces from the cache.
+func (c *StacktraceCache) Purge() { c.lru.Purge() }
+
+func (c *StacktraceCache) get(partition uint64, stacktrace uint32) ([]int32, bool) {
+	v, ok := c.lru.Get(stacktraceCacheKey{partition: partition, stacktrace: stacktrace})
+	if !ok {
+		c.metrics.misses.Inc()
+		return nil, false
+	}
+	c.metrics.hits.Inc()
+	return v.([]int32), true
+}
+
+func (c *StacktraceCache) add(partition uint64, stacktrace uint32, locations []int32) {
+	c.lru.Add(stacktraceCacheKey{partition: partition, stacktrace: stacktrace}, locations)
+}
+
+// withCache returns symbols that resolve stack traces
+// of the partition using the cache.
+func (c *StacktraceCache) withCache(partition uint64, s *Symbols) *Symbols {
+	x := *s
+	x.Stacktraces = &cachedStacktraceResolver{
+		StacktraceResolver: s.Stacktraces,
+		cache:              c,
+		partition:          partition,
+	}
+	return &x
+}
+
+type cachedStacktraceResolver struct {
+	StacktraceResolver
+	cache     *StacktraceCache
+	partition uint64
+}
+
+func (r *cachedStacktraceResolver) ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) error {
+	resolved := make([][]int32, len(stacktraces))
+	var missing []uint32
+	var positions []int
+	for i, id := range stacktraces {
+		if locations, ok := r.cache.get(r.partition, id); ok {
+			resolved[i] = locations
+			continue
+		}
+		missing = append(missing, id)
+		positions = append(positions, i)
+	}
+	if len(missing) > 0 {
+		x := &cacheInserter{
+			cache:     r.cache,
+			partition: r.partition,
+			resolved:  resolved,
+			positions: positions,
+		}
+		if err := r.StacktraceResolver.ResolveStacktraceLocations(ctx, x, missing); err != nil {
+			return err
+		}
+	}
+	for i, id := range stacktraces {
+		dst.InsertStacktrace(id, resolved[i])
+	}
+	return nil
+}
+
+type cacheInserter struct {
+	cache     *StacktraceCache
+	partition uint64
+	resolved  [][]int32
+	positions []int
+	cur       int
+}
+
+func (c *cacheInserter) InsertStacktrace(id uint32, locations []int32) {
+	// Locations slice is reused by the resolver.
+	x := make([]int32, len(locations))
+	copy(x, locations)
+	c.cache.add(c.partition, id, x)
+	c.resolved[c.positions[c.cur]] = x
+	c.cur++
+}
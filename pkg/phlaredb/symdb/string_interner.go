@@ -0,0 +1,96 @@
+package symdb
+
+import (
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const stringInternerShards = 64
+
+// StringInterner is a table of deduplicated strings shared by
+// resolvers: symbol strings of the resolved partitions are replaced
+// with the interned ones, therefore repeated function names and file
+// names of the resolved profiles and trees point to the same memory,
+// regardless of the partition, block, or resolver they come from.
+//
+// StringInterner is safe for concurrent use. Interned strings are
+// never evicted: the interner should be discarded (or reset) once
+// the resolved data sharing the strings is no longer needed.
+type StringInterner struct {
+	shards [stringInternerShards]stringInternerShard
+}
+
+type stringInternerShard struct {
+	m sync.RWMutex
+	s map[string]string
+}
+
+func NewStringInterner() *StringInterner {
+	var t StringInterner
+	for i := range t.shards {
+		t.shards[i].s = make(map[string]string)
+	}
+	return &t
+}
+
+// Intern returns the interned string equal to s. The string
+// is copied, if it has not been interned before, so that the
+// interner does not retain the memory s belongs to.
+func (t *StringInterner) Intern(s string) string {
+	if s == "" {
+		return ""
+	}
+	shard := &t.shards[xxhash.Sum64String(s)%stringInternerShards]
+	shard.m.RLock()
+	x, ok := shard.s[s]
+	shard.m.RUnlock()
+	if ok {
+		return x
+	}
+	shard.m.Lock()
+	defer shard.m.Unlock()
+	if x, ok = shard.s[s]; ok {
+		return x
+	}
+	x = string([]byte(s))
+	shard.s[x] = x
+	return x
+}
+
+// Len returns the number of interned strings.
+func (t *StringInterner) Len() int {
+	var n int
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.m.RLock()
+		n += len(shard.s)
+		shard.m.RUnlock()
+	}
+	return n
+}
+
+// Reset removes all the strings from the table. Strings
+// interned before the call remain valid.
+func (t *StringInterner) Reset() {
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.m.Lock()
+		shard.s = make(map[string]string)
+		shard.m.Unlock()
+	}
+}
+
+// withInternedStrings returns symbols with the strings
+// replaced with the interned ones.
+func (t *StringInterner) withInternedStrings(s *Symbols) *Symbols {
+	if len(s.Strings) == 0 {
+		return s
+	}
+	x := *s
+	x.Strings = make([]string, len(s.Strings))
+	for i, str := range s.Strings {
+		x.Strings[i] = t.Intern(str)
+	}
+	return &x
+}
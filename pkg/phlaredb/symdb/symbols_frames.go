@@ -0,0 +1,60 @@
+package symdb
+
+import "context"
+
+// Frame is a resolved frame of a stack trace. Functions inlined
+// at the location have their own frames, sharing the address and
+// the mapping of the location.
+type Frame struct {
+	Function string
+	Filename string
+	Line     int64
+	// Mapping is the file name of the mapping (binary or library).
+	Mapping string
+	Address uint64
+}
+
+// ResolveFrames resolves the stack traces and calls fn with the
+// frames of each of them, ordered from the leaf to the root. The
+// frames slice is reused between the calls: fn must copy it, if
+// the frames are retained. See ResolveStacktraceLocations for the
+// requirements for the stacktraces slice.
+//
+// If the symbols do not include functions or mappings, the
+// corresponding fields of the frames are left empty.
+func (r *Symbols) ResolveFrames(ctx context.Context, stacktraces []uint32, fn func(stacktraceID uint32, frames []Frame)) error {
+	return r.Stacktraces.ResolveStacktraceLocations(ctx, &framesInserter{symbols: r, fn: fn}, stacktraces)
+}
+
+type framesInserter struct {
+	symbols *Symbols
+	fn      func(uint32, []Frame)
+	frames  []Frame
+}
+
+func (r *framesInserter) InsertStacktrace(stacktraceID uint32, locations []int32) {
+	r.frames = r.frames[:0]
+	s := r.symbols
+	for _, x := range locations {
+		loc := s.Locations[x]
+		var mapping string
+		if int(loc.MappingId) < len(s.Mappings) {
+			mapping = s.Strings[s.Mappings[loc.MappingId].Filename]
+		}
+		if len(loc.Line) == 0 || len(s.Functions) == 0 {
+			r.frames = append(r.frames, Frame{Mapping: mapping, Address: loc.Address})
+			continue
+		}
+		for _, line := range loc.Line {
+			f := s.Functions[line.FunctionId]
+			r.frames = append(r.frames, Frame{
+				Function: s.Strings[f.Name],
+				Filename: s.Strings[f.Filename],
+				Line:     int64(line.Line),
+				Mapping:  mapping,
+				Address:  loc.Address,
+			})
+		}
+	}
+	r.fn(stacktraceID, r.frames)
+}
@@ -0,0 +1,87 @@
+package symdb
+
+import (
+	"context"
+
+	"github.com/grafana/pyroscope/pkg/iter"
+)
+
+// SymbolRecord describes a single line of a location:
+// a location has a record per each of its lines, one
+// for each inlined function, plus the caller.
+type SymbolRecord struct {
+	LocationID uint32
+	Address    uint64
+	Line       int64
+
+	FunctionName string
+	SystemName   string
+	Filename     string
+	StartLine    int64
+
+	MappingFile    string
+	MappingBuildID string
+}
+
+// Iterator returns an iterator over the symbol records of the
+// partition: a record is yielded for each line of every location,
+// in the order they are stored. If a location has no lines, a
+// record without function info is yielded.
+//
+// The records are created as the iterator advances, and are
+// not retained. The iterator stops once ctx is done. See also
+// PartitionReader.SymbolRecords.
+func (r *Symbols) Iterator(ctx context.Context) iter.Iterator[SymbolRecord] {
+	return &symbolsIterator{ctx: ctx, symbols: r}
+}
+
+type symbolsIterator struct {
+	ctx     context.Context
+	symbols *Symbols
+	loc     int
+	line    int
+	cur     SymbolRecord
+	err     error
+}
+
+func (it *symbolsIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+	for ; it.loc < len(it.symbols.Locations); it.loc, it.line = it.loc+1, 0 {
+		loc := it.symbols.Locations[it.loc]
+		if it.line > 0 && it.line >= len(loc.Line) {
+			continue
+		}
+		it.cur = SymbolRecord{
+			LocationID: uint32(it.loc),
+			Address:    loc.Address,
+		}
+		if int(loc.MappingId) < len(it.symbols.Mappings) {
+			m := it.symbols.Mappings[loc.MappingId]
+			it.cur.MappingFile = it.symbols.Strings[m.Filename]
+			it.cur.MappingBuildID = it.symbols.Strings[m.BuildId]
+		}
+		if len(loc.Line) > 0 {
+			line := loc.Line[it.line]
+			f := it.symbols.Functions[line.FunctionId]
+			it.cur.Line = int64(line.Line)
+			it.cur.FunctionName = it.symbols.Strings[f.Name]
+			it.cur.SystemName = it.symbols.Strings[f.SystemName]
+			it.cur.Filename = it.symbols.Strings[f.Filename]
+			it.cur.StartLine = int64(f.StartLine)
+		}
+		it.line++
+		return true
+	}
+	return false
+}
+
+func (it *symbolsIterator) At() SymbolRecord { return it.cur }
+
+func (it *symbolsIterator) Err() error { return it.err }
+
+func (it *symbolsIterator) Close() error { return nil }
@@ -0,0 +1,69 @@
+package symdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Symbols_Iterator(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	p, err := s.reader.Partition(context.Background(), 0)
+	require.NoError(t, err)
+	defer p.Release()
+
+	symbols := p.Symbols()
+	var expected int
+	functions := make(map[string]struct{})
+	for _, loc := range symbols.Locations {
+		expected += len(loc.Line)
+		if len(loc.Line) == 0 {
+			expected++
+		}
+		for _, line := range loc.Line {
+			functions[symbols.Strings[symbols.Functions[line.FunctionId].Name]] = struct{}{}
+		}
+	}
+
+	it := symbols.Iterator(context.Background())
+	var actual int
+	for it.Next() {
+		actual++
+		delete(functions, it.At().FunctionName)
+	}
+	require.NoError(t, it.Err())
+	require.NoError(t, it.Close())
+	require.Equal(t, expected, actual)
+	require.Empty(t, functions)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	it = symbols.Iterator(ctx)
+	require.False(t, it.Next())
+	require.ErrorIs(t, it.Err(), context.Canceled)
+}
+
+func Test_PartitionReader_SymbolRecords(t *testing.T) {
+	s := newBlockSuite(t, [][]string{{"testdata/profile.pb.gz"}})
+	defer s.teardown()
+	records := func(r SymbolsReader) []SymbolRecord {
+		p, err := r.Partition(context.Background(), 0)
+		require.NoError(t, err)
+		defer p.Release()
+		var records []SymbolRecord
+		it := p.SymbolRecords(context.Background())
+		for it.Next() {
+			records = append(records, it.At())
+		}
+		require.NoError(t, it.Err())
+		require.NoError(t, it.Close())
+		return records
+	}
+	// Block partitions yield the records of the
+	// in-memory partition they are written from.
+	expected := records(s.db)
+	require.NotEmpty(t, expected)
+	require.Equal(t, expected, records(s.reader))
+}
@@ -0,0 +1,50 @@
+package symdb
+
+// SymbolsMerger merges the symbols of multiple partition readers, e.g.,
+// of the blocks being compacted, into the partitions of the destination
+// SymDB, without resolving the stack traces to profiles: the stack
+// traces, locations, mappings, functions, and strings referenced are
+// copied to the destination, where they are deduplicated across all the
+// sources, and the IDs are remapped accordingly.
+//
+// SymbolsMerger is not safe for concurrent use.
+type SymbolsMerger struct {
+	dst        *SymDB
+	partitions map[symbolsMergerKey]*partitionRewriter
+}
+
+type symbolsMergerKey struct {
+	src       PartitionReader
+	partition uint64
+}
+
+func NewSymbolsMerger(dst *SymDB) *SymbolsMerger {
+	return &SymbolsMerger{
+		dst:        dst,
+		partitions: make(map[symbolsMergerKey]*partitionRewriter),
+	}
+}
+
+// Merge copies the stack traces of the source partition reader to the
+// destination partition, and rewrites the stack trace IDs in place to
+// refer to the destination ones. Merge can be called multiple times for
+// the same source, e.g., per each of the source profiles: the symbols
+// copied once are not looked up again. The reader must not be released
+// while the merger is in use.
+func (m *SymbolsMerger) Merge(partition uint64, src PartitionReader, stacktraces []uint32) error {
+	k := symbolsMergerKey{src: src, partition: partition}
+	p, ok := m.partitions[k]
+	if ok {
+		p.reset()
+	} else {
+		p = newPartitionRewriter(partition, m.dst.PartitionWriter(partition), src)
+		m.partitions[k] = p
+	}
+	if err := p.populateUnresolved(stacktraces); err != nil {
+		return err
+	}
+	if p.hasUnresolved() {
+		return p.appendRewrite(stacktraces)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package symdb
+
+import "unsafe"
+
+// Size of a parent pointer tree node, in bytes.
+const pptNodeSize = int64(unsafe.Sizeof(pptNode{}))
+
+// EstimateSize returns the approximate in-memory size of the
+// locations, mappings, functions, and strings, in bytes. The
+// stack traces are not included: their size depends on the
+// stack trace resolver implementation.
+func (r *Symbols) EstimateSize() int64 {
+	var n int64
+	for _, l := range r.Locations {
+		n += int64(locationSize) + int64(len(l.Line))*int64(lineSize)
+	}
+	n += int64(len(r.Mappings)) * int64(mappingSize)
+	n += int64(len(r.Functions)) * int64(functionSize)
+	n += int64(len(r.Strings)) * estimatedStringSize
+	for _, s := range r.Strings {
+		n += int64(len(s))
+	}
+	return n
+}
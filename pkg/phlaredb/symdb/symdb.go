@@ -7,7 +7,10 @@ import (
 	"sync"
 	"time"
 
+	googleprofile "github.com/google/pprof/profile"
+
 	profilev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
+	"github.com/grafana/pyroscope/pkg/iter"
 	"github.com/grafana/pyroscope/pkg/phlaredb/block"
 	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
 )
@@ -15,12 +18,48 @@ import (
 // SymbolsReader provides access to a symdb partition.
 type SymbolsReader interface {
 	Partition(ctx context.Context, partition uint64) (PartitionReader, error)
+	// PartitionKeys returns identifiers of the partitions
+	// present in the reader, in the ascending order.
+	PartitionKeys(ctx context.Context) ([]uint64, error)
 	Load(context.Context) error
 }
 
+// PartitionLocationsReader is implemented by symbols readers capable
+// of loading stack traces and locations of a partition only, without
+// mappings, functions, and strings. Symbols of the partition reader
+// returned only include stack traces and locations.
+type PartitionLocationsReader interface {
+	PartitionLocations(ctx context.Context, partition uint64) (PartitionReader, error)
+}
+
+// PartitionFunctionsReader is implemented by symbols readers capable
+// of loading a partition without mappings. Symbols of the partition
+// reader returned include stack traces, locations, functions, and
+// strings.
+type PartitionFunctionsReader interface {
+	PartitionFunctions(ctx context.Context, partition uint64) (PartitionReader, error)
+}
+
 type PartitionReader interface {
 	WriteStats(s *PartitionStats)
 	Symbols() *Symbols
+	// ResolveFrames calls fn with the resolved frames of each of
+	// the stack traces, see Symbols.ResolveFrames.
+	ResolveFrames(ctx context.Context, stacktraces []uint32, fn func(stacktraceID uint32, frames []Frame)) error
+	// SymbolRecords returns the iterator of the symbol records of the
+	// partition, see Symbols.Iterator. The records are created from the
+	// tables loaded with the partition: the tables are not streamed from
+	// the storage, therefore the partition must not be released before
+	// the iteration is done.
+	SymbolRecords(ctx context.Context) iter.Iterator[SymbolRecord]
+	// EstimateSize returns the approximate in-memory size of the
+	// partition symbols, in bytes: stack traces, locations, mappings,
+	// functions, and strings. The estimate is available before the
+	// symbols are loaded, which allows to decide whether to load them.
+	EstimateSize() int64
+	// Preload loads the partition symbols eagerly, if they have not
+	// been loaded yet. Otherwise, the call has no effect.
+	Preload(ctx context.Context) error
 	Release()
 }
 
@@ -53,6 +92,12 @@ type StacktraceResolver interface {
 	ResolveStacktraceLocations(ctx context.Context, dst StacktraceInserter, stacktraces []uint32) error
 }
 
+// contextCheckInterval specifies how many stack traces are resolved
+// between checks of the context: a partition may contain millions of
+// stack traces, therefore the resolution should stop early once the
+// context is canceled.
+const contextCheckInterval = 4 << 10
+
 // StacktraceInserter accepts resolved locations for a given stack
 // trace. The leaf is at locations[0].
 //
@@ -179,11 +224,29 @@ func (s *SymDB) WriteProfileSymbols(partition uint64, profile *profilev1.Profile
 	return s.PartitionWriter(partition).WriteProfileSymbols(profile)
 }
 
+// ImportProfile writes symbols of the profile in the format of the
+// github.com/google/pprof/profile package to the partition, see
+// PartitionWriter.ImportProfile.
+func (s *SymDB) ImportProfile(partition uint64, profile *googleprofile.Profile) ([]schemav1.InMemoryProfile, error) {
+	return s.PartitionWriter(partition).ImportProfile(profile)
+}
+
 func (s *SymDB) Partition(_ context.Context, partition uint64) (PartitionReader, error) {
 	if p, ok := s.lookupPartition(partition); ok {
 		return p, nil
 	}
-	return nil, ErrPartitionNotFound
+	return nil, &PartitionError{Partition: partition, Err: ErrPartitionNotFound}
+}
+
+func (s *SymDB) PartitionKeys(_ context.Context) ([]uint64, error) {
+	s.m.RLock()
+	keys := make([]uint64, 0, len(s.partitions))
+	for k := range s.partitions {
+		keys = append(keys, k)
+	}
+	s.m.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys, nil
 }
 
 func (s *SymDB) lookupPartition(partition uint64) (*PartitionWriter, bool) {
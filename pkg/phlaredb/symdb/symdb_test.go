@@ -124,7 +124,11 @@ func profileFingerprint(p *profile.Profile, typ int) [][2]uint64 {
 				_, _ = h.WriteString(line.Function.Name)
 			}
 		}
-		m[h.Sum64()] += uint64(s.Value[typ])
+		v := uint64(s.Value[typ])
+		if v == 0 {
+			continue
+		}
+		m[h.Sum64()] += v
 	}
 	s := make([][2]uint64, 0, len(p.Sample))
 	for k, v := range m {
@@ -183,3 +187,49 @@ func Test_Stats(t *testing.T) {
 	}
 	require.Equal(t, expected, actual)
 }
+
+func Test_SymDB_ImportProfile(t *testing.T) {
+	// The expected fingerprints are obtained from the samples
+	// written with WriteProfileSymbols.
+	expected := newMemSuite(t, [][]string{{"testdata/profile.pb.gz"}}).profiles[0]
+	x, err := pprof.OpenFile("testdata/profile.pb.gz")
+	require.NoError(t, err)
+	data, err := x.MarshalVT()
+	require.NoError(t, err)
+	p, err := profile.ParseData(data)
+	require.NoError(t, err)
+
+	s := newMemSuite(t, nil)
+	imported, err := s.db.ImportProfile(0, p)
+	require.NoError(t, err)
+	require.Len(t, imported, len(p.SampleType))
+	b := &blockSuite{memSuite: s}
+	b.flush()
+	defer b.teardown()
+
+	for _, reader := range []SymbolsReader{s.db, b.reader} {
+		for typ := range imported {
+			r := NewResolver(context.Background(), reader)
+			r.AddSamples(0, imported[typ].Samples)
+			resolved, err := r.Profile()
+			require.NoError(t, err)
+			require.Equal(t, pprofFingerprint(expected.Profile, typ), profileFingerprint(resolved, 0))
+			r.Release()
+		}
+	}
+}
+
+func Test_PartitionKeys(t *testing.T) {
+	s := newMemSuite(t, nil)
+	s.writeProfileFromFile(3, "testdata/profile.pb.gz")
+	s.writeProfileFromFile(1, "testdata/profile.pb.gz")
+	b := &blockSuite{memSuite: s}
+	b.flush()
+	defer b.teardown()
+
+	for _, reader := range []SymbolsReader{s.db, b.reader} {
+		keys, err := reader.PartitionKeys(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []uint64{1, 3}, keys)
+	}
+}
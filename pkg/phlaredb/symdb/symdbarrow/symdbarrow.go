@@ -0,0 +1,143 @@
+// Package symdbarrow represents the samples resolved with symdb.Resolver
+// as Apache Arrow record batches. The package is separate from symdb, so
+// that symdb does not depend on Arrow.
+package symdbarrow
+
+import (
+	"context"
+	"sync"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/grafana/pyroscope/pkg/iter"
+	"github.com/grafana/pyroscope/pkg/phlaredb/symdb"
+)
+
+// DefaultBatchSize is the maximum number of rows
+// of a record batch, unless specified otherwise.
+const DefaultBatchSize = 64 << 10
+
+// Schema is the schema of the record batches produced by Records:
+//   - stack: names of the stack trace functions, from the root to
+//     the leaf, as indices of the dictionary of the batch.
+//   - value: the value of the stack trace.
+//   - labels: labels of the sample, see AddSamplesWithLabels.
+var Schema = arrow.NewSchema([]arrow.Field{
+	{Name: "stack", Type: arrow.ListOf(&arrow.DictionaryType{
+		IndexType: arrow.PrimitiveTypes.Int32,
+		ValueType: arrow.BinaryTypes.String,
+	})},
+	{Name: "value", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "labels", Type: arrow.MapOf(arrow.BinaryTypes.String, arrow.BinaryTypes.String)},
+}, nil)
+
+type Options struct {
+	// BatchSize specifies the maximum number of rows of a record
+	// batch. DefaultBatchSize is used, if not positive.
+	BatchSize int
+	// Allocator of the record batches. The Go allocator
+	// is used, if not specified.
+	Allocator memory.Allocator
+}
+
+// Records resolves the samples of the resolver and calls fn with the
+// record batches of the Schema: a row is created for each of the
+// samples returned by Resolver.PartitionSamples. The dictionary of the
+// function names is specific to the batch, and a batch only holds rows
+// of a single partition.
+//
+// Calls of fn are serialized; the record is released once fn returns,
+// therefore fn must retain it, if the record is used afterwards. If fn
+// returns an error, the resolution stops, and the error is returned.
+func Records(ctx context.Context, r *symdb.Resolver, opts Options, fn func(arrow.Record) error) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "symdbarrow.Records")
+	defer span.Finish()
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.Allocator == nil {
+		opts.Allocator = memory.DefaultAllocator
+	}
+	var lock sync.Mutex
+	emit := func(rec arrow.Record) error {
+		lock.Lock()
+		defer lock.Unlock()
+		return fn(rec)
+	}
+	return r.PartitionSamples(ctx, func(_ uint64, samples iter.Iterator[symdb.ResolvedSample]) error {
+		w := newWriter(opts, emit)
+		defer w.release()
+		for samples.Next() {
+			if err := w.append(samples.At()); err != nil {
+				return err
+			}
+		}
+		if err := samples.Err(); err != nil {
+			return err
+		}
+		return w.flush()
+	})
+}
+
+type writer struct {
+	size int
+	emit func(arrow.Record) error
+
+	b      *array.RecordBuilder
+	stack  *array.ListBuilder
+	names  *array.BinaryDictionaryBuilder
+	value  *array.Int64Builder
+	labels *array.MapBuilder
+	keys   *array.StringBuilder
+	items  *array.StringBuilder
+}
+
+func newWriter(opts Options, emit func(arrow.Record) error) *writer {
+	w := &writer{
+		size: opts.BatchSize,
+		emit: emit,
+		b:    array.NewRecordBuilder(opts.Allocator, Schema),
+	}
+	w.stack = w.b.Field(0).(*array.ListBuilder)
+	w.names = w.stack.ValueBuilder().(*array.BinaryDictionaryBuilder)
+	w.value = w.b.Field(1).(*array.Int64Builder)
+	w.labels = w.b.Field(2).(*array.MapBuilder)
+	w.keys = w.labels.KeyBuilder().(*array.StringBuilder)
+	w.items = w.labels.ItemBuilder().(*array.StringBuilder)
+	return w
+}
+
+func (w *writer) append(s symdb.ResolvedSample) error {
+	w.stack.Append(true)
+	for _, name := range s.Stack {
+		if err := w.names.AppendString(name); err != nil {
+			return err
+		}
+	}
+	w.value.Append(s.Value)
+	w.labels.Append(true)
+	for _, l := range s.Labels {
+		w.keys.Append(l.Name)
+		w.items.Append(l.Value)
+	}
+	if w.value.Len() >= w.size {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *writer) flush() error {
+	if w.value.Len() == 0 {
+		return nil
+	}
+	rec := w.b.NewRecord()
+	defer rec.Release()
+	// The dictionary is not carried over to the next batch.
+	w.names.ResetFull()
+	return w.emit(rec)
+}
+
+func (w *writer) release() { w.b.Release() }
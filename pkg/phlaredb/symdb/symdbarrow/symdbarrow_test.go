@@ -0,0 +1,115 @@
+package symdbarrow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/pyroscope/pkg/model"
+	schemav1 "github.com/grafana/pyroscope/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/pyroscope/pkg/phlaredb/symdb"
+	"github.com/grafana/pyroscope/pkg/pprof"
+)
+
+func newTestSymDB(t *testing.T) (*symdb.SymDB, schemav1.Samples) {
+	x, err := pprof.OpenFile("../testdata/profile.pb.gz")
+	require.NoError(t, err)
+	db := symdb.NewSymDB(symdb.DefaultConfig().WithDirectory(t.TempDir()))
+	return db, db.PartitionWriter(0).WriteProfileSymbols(x.Profile)[0].Samples
+}
+
+func resolveTree(t *testing.T, db *symdb.SymDB, samples schemav1.Samples) *model.Tree {
+	r := symdb.NewResolver(context.Background(), db)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	tree, err := r.Tree()
+	require.NoError(t, err)
+	return tree
+}
+
+func Test_Records(t *testing.T) {
+	db, samples := newTestSymDB(t)
+	n := len(samples.StacktraceIDs) / 2
+	labeled := schemav1.Samples{
+		StacktraceIDs: samples.StacktraceIDs[:n],
+		Values:        samples.Values[:n],
+	}
+	unlabeled := schemav1.Samples{
+		StacktraceIDs: samples.StacktraceIDs[n:],
+		Values:        samples.Values[n:],
+	}
+	// A row is expected for each of the distinct stack
+	// traces of both groups.
+	rows := make(map[string]struct{})
+	for _, g := range []struct {
+		key     string
+		samples schemav1.Samples
+	}{{"a", labeled}, {"", unlabeled}} {
+		for i, sid := range g.samples.StacktraceIDs {
+			if g.samples.Values[i] > 0 {
+				rows[fmt.Sprintf("%s/%d", g.key, sid)] = struct{}{}
+			}
+		}
+	}
+
+	r := symdb.NewResolver(context.Background(), db)
+	defer r.Release()
+	r.AddSamplesWithLabels(0, labeled, model.LabelsFromStrings("endpoint", "a"))
+	r.AddSamples(0, unlabeled)
+	const batchSize = 100
+	var total, batches int
+	trees := map[string]*model.Tree{"a": new(model.Tree), "": new(model.Tree)}
+	err := Records(context.Background(), r, Options{BatchSize: batchSize}, func(rec arrow.Record) error {
+		require.True(t, rec.Schema().Equal(Schema))
+		require.LessOrEqual(t, rec.NumRows(), int64(batchSize))
+		stacks := rec.Column(0).(*array.List)
+		dict := stacks.ListValues().(*array.Dictionary)
+		names := dict.Dictionary().(*array.String)
+		values := rec.Column(1).(*array.Int64)
+		labels := rec.Column(2).(*array.Map)
+		keys := labels.Keys().(*array.String)
+		items := labels.Items().(*array.String)
+		for i := 0; i < int(rec.NumRows()); i++ {
+			var value string
+			lo, hi := labels.ValueOffsets(i)
+			for j := lo; j < hi; j++ {
+				require.Equal(t, "endpoint", keys.Value(int(j)))
+				value = items.Value(int(j))
+			}
+			lo, hi = stacks.ValueOffsets(i)
+			stack := make([]string, 0, hi-lo)
+			for j := lo; j < hi; j++ {
+				stack = append(stack, names.Value(dict.GetValueIndex(int(j))))
+			}
+			trees[value].InsertStack(values.Value(i), stack...)
+		}
+		total += int(rec.NumRows())
+		batches++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(rows), total)
+	require.Equal(t, (total+batchSize-1)/batchSize, batches)
+	require.Equal(t, resolveTree(t, db, labeled).String(), trees["a"].String())
+	require.Equal(t, resolveTree(t, db, unlabeled).String(), trees[""].String())
+}
+
+func Test_Records_Error(t *testing.T) {
+	db, samples := newTestSymDB(t)
+	r := symdb.NewResolver(context.Background(), db)
+	defer r.Release()
+	r.AddSamples(0, samples)
+	stop := errors.New("stop")
+	var batches int
+	err := Records(context.Background(), r, Options{BatchSize: 10}, func(arrow.Record) error {
+		batches++
+		return stop
+	})
+	require.ErrorIs(t, err, stop)
+	require.Equal(t, 1, batches)
+}
@@ -0,0 +1,37 @@
+package symdb
+
+import "github.com/grafana/pyroscope/pkg/model"
+
+// TreeBuilder builds a tree incrementally, the same way Resolver builds
+// the trees of the resolved stack traces. It allows to construct trees
+// from arbitrary sources, e.g., to combine them with the trees of the
+// resolver, and to serialize them the same way.
+//
+// The zero value is an empty builder ready to use.
+// TreeBuilder is not safe for concurrent use.
+type TreeBuilder struct {
+	tree *model.Tree
+}
+
+// Insert adds the value to the path of the function names, given from
+// the root to the leaf: values of identical paths are summed. Values
+// may be negative, e.g., of diff profiles; zero values are ignored.
+// The path is not retained, and can be reused by the caller.
+func (b *TreeBuilder) Insert(path []string, value int64) {
+	if b.tree == nil {
+		b.tree = new(model.Tree)
+	}
+	b.tree.InsertStack(value, path...)
+}
+
+// Build returns the tree built, and resets the builder: subsequent
+// insertions start a new tree. Build returns an empty tree, if no
+// paths have been inserted.
+func (b *TreeBuilder) Build() *model.Tree {
+	t := b.tree
+	b.tree = nil
+	if t == nil {
+		t = new(model.Tree)
+	}
+	return t
+}